@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/linuxdeepin/go-lib/log"
+	"golang.org/x/xerrors"
+)
+
+var logger = log.NewLogger("ab-recovery/atomicfile")
+
+// 写入过程中的每一步，测试时替换它们来模拟失败
+var (
+	createTemp = ioutil.TempFile
+	writeTemp  = (*os.File).Write
+	syncTemp   = (*os.File).Sync
+	chmodTemp  = (*os.File).Chmod
+	chownTemp  = (*os.File).Chown
+	closeTemp  = (*os.File).Close
+	rename     = os.Rename
+	syncDir    = syncDirImpl
+)
+
+func syncDirImpl(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 返回符号链接最终指向的文件，filename 不是符号链接或者不存在时原样返回。
+func resolve(filename string) (string, error) {
+	info, err := os.Lstat(filename)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return filename, nil
+	}
+	target, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// 指向不存在的文件，写入后它仍然是符号链接
+			target, err = os.Readlink(filename)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(filename), target)
+			}
+			return target, nil
+		}
+		return "", err
+	}
+	return target, nil
+}
+
+// WriteFile 与 ioutil.WriteFile 相同，但是断电或出错时 filename 要么是原来的内容，要么是新的内容。
+// 先写入同一文件夹中的临时文件并 fsync，再改名为 filename，最后 fsync 文件夹让改名落盘，这一步失败时只记录日志。
+// filename 已存在时保持它的权限和所有者，否则使用 perm；filename 是符号链接时写入它指向的文件。
+func WriteFile(filename string, data []byte, perm os.FileMode) (err error) {
+	filename, err = resolve(filename)
+	if err != nil {
+		return err
+	}
+
+	uid, gid := -1, -1
+	info, err := os.Stat(filename)
+	if err == nil {
+		perm = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(filename)
+	f, err := createTemp(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return xerrors.Errorf("failed to create temp file for %q: %w", filename, err)
+	}
+	tmpName := f.Name()
+	closed := false
+	defer func() {
+		if err != nil {
+			if !closed {
+				_ = f.Close()
+			}
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	_, err = writeTemp(f, data)
+	if err != nil {
+		return xerrors.Errorf("failed to write %q: %w", tmpName, err)
+	}
+	err = syncTemp(f)
+	if err != nil {
+		return xerrors.Errorf("failed to sync %q: %w", tmpName, err)
+	}
+	// TempFile 创建的文件权限是 0600，不受 umask 影响地设置为 perm
+	err = chmodTemp(f, perm)
+	if err != nil {
+		return xerrors.Errorf("failed to chmod %q: %w", tmpName, err)
+	}
+	if uid != -1 && (uid != os.Geteuid() || gid != os.Getegid()) {
+		err = chownTemp(f, uid, gid)
+		if err != nil {
+			return xerrors.Errorf("failed to chown %q: %w", tmpName, err)
+		}
+	}
+	closed = true
+	err = closeTemp(f)
+	if err != nil {
+		return xerrors.Errorf("failed to close %q: %w", tmpName, err)
+	}
+	err = rename(tmpName, filename)
+	if err != nil {
+		return xerrors.Errorf("failed to rename %q to %q: %w", tmpName, filename, err)
+	}
+
+	// 改名已经完成，filename 已经是新的内容，只是可能还没有落盘。
+	// 这时返回错误会让调用者以为没有写入而回退或重试，所以只记录日志。
+	syncErr := syncDir(dir)
+	if syncErr != nil {
+		logger.Warningf("failed to sync dir %q: %v", dir, syncErr)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package atomicfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "grub.cfg")
+
+	// 新文件使用 perm
+	err := WriteFile(filename, []byte("a"), 0640)
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// 已存在的文件保持原来的权限
+	require.NoError(t, os.Chmod(filename, 0600))
+	err = WriteFile(filename, []byte("b"), 0644)
+	require.NoError(t, err)
+	content, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+	info, err = os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// 不留下临时文件
+	names, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	require.NoError(t, ioutil.WriteFile(target, []byte("a"), 0644))
+	require.NoError(t, os.Symlink("target", link))
+
+	err := WriteFile(link, []byte("b"), 0644)
+	require.NoError(t, err)
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	content, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+}
+
+// 在每一步模拟失败，原文件的内容不变，也不留下临时文件。
+func TestWriteFileFault(t *testing.T) {
+	errFault := errors.New("fault")
+	tests := []struct {
+		name   string
+		inject func()
+	}{
+		{"createTemp", func() {
+			createTemp = func(dir, pattern string) (*os.File, error) { return nil, errFault }
+		}},
+		{"writeTemp", func() {
+			writeTemp = func(f *os.File, b []byte) (int, error) {
+				// 只写入一半
+				n, _ := f.Write(b[:len(b)/2])
+				return n, errFault
+			}
+		}},
+		{"syncTemp", func() {
+			syncTemp = func(f *os.File) error { return errFault }
+		}},
+		{"chmodTemp", func() {
+			chmodTemp = func(f *os.File, mode os.FileMode) error { return errFault }
+		}},
+		{"closeTemp", func() {
+			closeTemp = func(f *os.File) error {
+				_ = f.Close()
+				return errFault
+			}
+		}},
+		{"rename", func() {
+			rename = func(oldpath, newpath string) error { return errFault }
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "ab-recovery.json")
+			require.NoError(t, ioutil.WriteFile(filename, []byte("old"), 0644))
+
+			test.inject()
+			defer restoreHooks()
+			err := WriteFile(filename, []byte("new content"), 0644)
+			assert.True(t, errors.Is(err, errFault))
+
+			content, err := ioutil.ReadFile(filename)
+			require.NoError(t, err)
+			assert.Equal(t, "old", string(content))
+			names, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, names, 1)
+		})
+	}
+
+	// 改名后 fsync 文件夹失败，文件已经是新的内容，不返回错误
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ab-recovery.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("old"), 0644))
+	syncDir = func(dir string) error { return errFault }
+	defer restoreHooks()
+	err := WriteFile(filename, []byte("new content"), 0644)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(content))
+	names, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+}
+
+func restoreHooks() {
+	createTemp = ioutil.TempFile
+	writeTemp = (*os.File).Write
+	syncTemp = (*os.File).Sync
+	chmodTemp = (*os.File).Chmod
+	chownTemp = (*os.File).Chown
+	closeTemp = (*os.File).Close
+	rename = os.Rename
+	syncDir = syncDirImpl
+}
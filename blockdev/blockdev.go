@@ -0,0 +1,331 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package blockdev 读取块设备和挂载的信息，不依赖 lsblk、blkid 和 grub-probe 等外部命令。
+package blockdev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Device 是一个块设备，路径都是 /dev 中的路径。
+type Device struct {
+	Name       string // 内核中的名字，比如 sda1、dm-0
+	Path       string // device mapper 设备为 /dev/mapper 中的路径，其他为 /dev/<Name>
+	Disk       string // 所在的硬盘，device mapper 设备为它使用的第一个设备所在的硬盘，硬盘本身为自己
+	Major      uint32
+	Minor      uint32
+	FsType     string
+	Uuid       string // 文件系统的 uuid，LUKS 设备为 LUKS 头中的 uuid
+	Label      string
+	PartUuid   string
+	PartLabel  string
+	MountPoint string // 第一个挂载点，没有挂载时为空
+}
+
+// Interface 提供块设备和挂载的信息。System 读取正在运行的系统，Fake 用于测试。
+type Interface interface {
+	// Devices 返回全部块设备
+	Devices() ([]*Device, error)
+	// MountInfos 返回当前线程所在的挂载命名空间中的挂载
+	MountInfos() ([]*MountInfo, error)
+}
+
+var ErrNotFound = xerrors.New("block device not found")
+
+// ErrAmbiguous 表示有多个设备匹配，比如 LVM 精简快照与原卷的文件系统 uuid 相同。
+var ErrAmbiguous = xerrors.New("more than one block device matches")
+
+// FindByUuid 返回文件系统 uuid 为 uuid 的设备。有多个设备的 uuid 相同时不能确定是哪一个，
+// 返回 ErrAmbiguous，这时应该使用设备路径，比如 LVM 模式下使用逻辑卷的路径。
+func FindByUuid(b Interface, uuid string) (*Device, error) {
+	if uuid == "" {
+		return nil, xerrors.New("uuid is empty")
+	}
+	devices, err := b.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var result *Device
+	for _, d := range devices {
+		if d.Uuid != uuid {
+			continue
+		}
+		if result != nil {
+			return nil, xerrors.Errorf("uuid %s: %s and %s: %w", uuid, result.Path, d.Path, ErrAmbiguous)
+		}
+		result = d
+	}
+	if result == nil {
+		return nil, xerrors.Errorf("uuid %s: %w", uuid, ErrNotFound)
+	}
+	return result, nil
+}
+
+// FindByLabel 返回标签为 label 的第一个设备，不区分大小写，忽略首尾的空白。
+func FindByLabel(b Interface, label string) (*Device, error) {
+	label = strings.TrimSpace(label)
+	return find(b, func(d *Device) bool {
+		return d.Label != "" && strings.EqualFold(strings.TrimSpace(d.Label), label)
+	}, "label "+label)
+}
+
+// FindByPath 返回设备路径为 path 的设备，path 也可以是 /dev 中指向设备的符号链接，比如 /dev/disk/by-uuid 中的路径。
+func FindByPath(b Interface, path string) (*Device, error) {
+	realPath := resolvePath(b, path)
+	return find(b, func(d *Device) bool {
+		return d.Path == path || "/dev/"+d.Name == path || "/dev/"+d.Name == realPath
+	}, "path "+path)
+}
+
+func find(b Interface, match func(d *Device) bool, what string) (*Device, error) {
+	devices, err := b.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if match(d) {
+			return d, nil
+		}
+	}
+	return nil, xerrors.Errorf("%s: %w", what, ErrNotFound)
+}
+
+// FindByPathMount 返回 path 所在的文件系统所在的设备，path 应该是不含符号链接的绝对路径。
+func FindByPathMount(b Interface, path string) (*Device, error) {
+	infos, err := b.MountInfos()
+	if err != nil {
+		return nil, err
+	}
+	info := FindPathMountInfo(infos, path)
+	if info == nil {
+		return nil, xerrors.Errorf("not found mount of %q", path)
+	}
+	devices, err := b.Devices()
+	if err != nil {
+		return nil, err
+	}
+	d := findMountDevice(devices, info, func(path string) string {
+		return resolvePath(b, path)
+	})
+	if d == nil {
+		return nil, xerrors.Errorf("mount %q of %q: %w", info.Source, path, ErrNotFound)
+	}
+	return d, nil
+}
+
+// 可以解析 /dev 中的符号链接的实现，Fake 不解析
+type pathResolver interface {
+	resolvePath(path string) string
+}
+
+// 返回 path 解析符号链接后的路径，不能解析时返回 path。
+func resolvePath(b Interface, path string) string {
+	if r, ok := b.(pathResolver); ok {
+		return r.resolvePath(path)
+	}
+	return path
+}
+
+// 返回挂载 info 所在的设备。btrfs 的设备号是匿名设备，这时按挂载的来源查找，resolve 用于解析来源中的符号链接。
+func findMountDevice(devices []*Device, info *MountInfo, resolve func(path string) string) *Device {
+	if info.Major != 0 {
+		for _, d := range devices {
+			if d.Major == info.Major && d.Minor == info.Minor {
+				return d
+			}
+		}
+		return nil
+	}
+	if !strings.HasPrefix(info.Source, "/dev/") {
+		return nil
+	}
+	realSource := resolve(info.Source)
+	for _, d := range devices {
+		if d.Path == info.Source || "/dev/"+d.Name == realSource {
+			return d
+		}
+	}
+	return nil
+}
+
+// System 读取 /sys/class/block、/dev/disk/by-* 中的符号链接、/proc 中的 mountinfo 和设备中的文件系统超级块。
+type System struct {
+	Root string // 测试时使用的根文件夹，为空时为 /
+}
+
+func (s *System) path(path string) string {
+	return filepath.Join(s.Root, path)
+}
+
+func (s *System) resolvePath(path string) string {
+	realPath, err := filepath.EvalSymlinks(s.path(path))
+	if err != nil {
+		return path
+	}
+	if s.Root != "" {
+		rel, err := filepath.Rel(s.Root, realPath)
+		if err != nil {
+			return path
+		}
+		realPath = filepath.Join("/", rel)
+	}
+	return realPath
+}
+
+func (s *System) MountInfos() ([]*MountInfo, error) {
+	return readMountInfo(s.path("/proc"))
+}
+
+// /dev/disk 中按标识指向设备的文件夹，以及对应的 Device 字段
+var diskLinkDirs = []struct {
+	dir string
+	set func(d *Device, value string)
+}{
+	{"by-uuid", func(d *Device, value string) { d.Uuid = value }},
+	{"by-label", func(d *Device, value string) { d.Label = value }},
+	{"by-partuuid", func(d *Device, value string) { d.PartUuid = value }},
+	{"by-partlabel", func(d *Device, value string) { d.PartLabel = value }},
+}
+
+func (s *System) Devices() ([]*Device, error) {
+	sysBlockDir := s.path("/sys/class/block")
+	fileInfos, err := ioutil.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*Device
+	nameMap := make(map[string]*Device)
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		d := &Device{Name: name, Path: "/dev/" + name}
+		content, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "dev"))
+		if err != nil {
+			return nil, err
+		}
+		d.Major, d.Minor, err = parseDevNumber(string(content))
+		if err != nil {
+			return nil, err
+		}
+		dmName, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "dm/name"))
+		if err == nil {
+			d.Path = "/dev/mapper/" + strings.TrimSpace(string(dmName))
+		}
+		devices = append(devices, d)
+		nameMap[name] = d
+	}
+
+	for _, d := range devices {
+		d.Disk = "/dev/" + s.diskName(d.Name, 0)
+	}
+
+	// udev 创建的符号链接，没有 udev 或者超级块不能读取时也可以得到标识
+	for _, linkDir := range diskLinkDirs {
+		dir := s.path(filepath.Join("/dev/disk", linkDir.dir))
+		fileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fileInfo := range fileInfos {
+			target, err := filepath.EvalSymlinks(filepath.Join(dir, fileInfo.Name()))
+			if err != nil {
+				continue
+			}
+			if d, ok := nameMap[filepath.Base(target)]; ok {
+				linkDir.set(d, unescapeUdev(fileInfo.Name()))
+			}
+		}
+	}
+
+	for _, d := range devices {
+		s.readSuperblock(d)
+	}
+
+	infos, err := s.MountInfos()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		d := findMountDevice(devices, info, s.resolvePath)
+		if d != nil && d.MountPoint == "" {
+			d.MountPoint = info.MountPoint
+		}
+	}
+	return devices, nil
+}
+
+// 返回设备 name 所在的硬盘的名字。分区为上级设备，device mapper 等设备递归查找使用的第一个设备。
+func (s *System) diskName(name string, depth int) string {
+	dir := s.path(filepath.Join("/sys/class/block", name))
+	if isExist(filepath.Join(dir, "partition")) {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Base(filepath.Dir(realDir))
+		}
+		return name
+	}
+	// 避免链接成环时无限递归
+	if depth > 8 {
+		return name
+	}
+	slaves, err := ioutil.ReadDir(filepath.Join(dir, "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return name
+	}
+	return s.diskName(slaves[0].Name(), depth+1)
+}
+
+// 读取设备的超级块，能读取时覆盖来自符号链接的类型、uuid 和标签。大小为 0 的设备，比如没有光盘的光驱，不读取。
+func (s *System) readSuperblock(d *Device) {
+	size, err := ioutil.ReadFile(s.path(filepath.Join("/sys/class/block", d.Name, "size")))
+	if err != nil || strings.TrimSpace(string(size)) == "0" {
+		return
+	}
+	f, err := os.Open(s.path("/dev/" + d.Name))
+	if err != nil {
+		// 没有权限时只使用符号链接中的信息
+		return
+	}
+	defer f.Close()
+	sb := probeSuperblock(f)
+	if sb == nil {
+		return
+	}
+	d.FsType = sb.fsType
+	d.Uuid = sb.uuid
+	d.Label = sb.label
+}
+
+// udev 把符号链接名字中的特殊字符转义为 \x 加两位十六进制数，比如空格为 \x20。
+func unescapeUdev(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func isExist(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
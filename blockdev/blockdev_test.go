@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+const testLinkUuid = "8bafe9c6-71f5-4b5c-8923-accb280cc12b"
+
+// 在 root 中生成 sys、dev 和 proc：硬盘 sda 有分区 sda1（ext4，挂载在 /boot）和 sda2（没有可识别的超级块，
+// 标识来自 /dev/disk 中的符号链接，btrfs 子卷挂载在 /home），逻辑卷 vg0-root（xfs，挂载在 /）使用 sda2。
+// sda1 和 vg0-root 的文件系统 uuid 相同，与 LVM 精简快照和原卷一样。
+func makeTestSystem(t *testing.T) string {
+	root := t.TempDir()
+	writeFile := func(name, content string) {
+		filename := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	}
+	symlink := func(target, name string) {
+		filename := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		require.NoError(t, os.Symlink(target, filename))
+	}
+
+	for dir, dev := range map[string]string{
+		"sys/devices/pci/sda":      "8:0",
+		"sys/devices/pci/sda/sda1": "8:1",
+		"sys/devices/pci/sda/sda2": "8:2",
+		"sys/devices/virtual/dm-0": "253:0",
+	} {
+		writeFile(dir+"/dev", dev+"\n")
+		writeFile(dir+"/size", "8\n")
+		symlink("../../"+dir[len("sys/"):], "sys/class/block/"+filepath.Base(dir))
+	}
+	writeFile("sys/devices/pci/sda/sda1/partition", "1\n")
+	writeFile("sys/devices/pci/sda/sda2/partition", "2\n")
+	writeFile("sys/devices/virtual/dm-0/dm/name", "vg0-root\n")
+	symlink("../../pci/sda/sda2", "sys/devices/virtual/dm-0/slaves/sda2")
+
+	ext4 := make([]byte, 4096)
+	binary.LittleEndian.PutUint16(ext4[1024+56:], 0xef53)
+	binary.LittleEndian.PutUint32(ext4[1024+96:], 0x40)
+	copy(ext4[1024+104:], testUuidBytes)
+	copy(ext4[1024+120:], "Boot")
+	xfs := make([]byte, 4096)
+	copy(xfs, "XFSB")
+	copy(xfs[32:], testUuidBytes)
+	writeFile("dev/sda", "")
+	writeFile("dev/sda1", string(ext4))
+	writeFile("dev/sda2", string(make([]byte, 4096)))
+	writeFile("dev/dm-0", string(xfs))
+	symlink("../dm-0", "dev/mapper/vg0-root")
+	symlink("../../sda2", "dev/disk/by-uuid/"+testLinkUuid)
+	symlink("../../sda2", `dev/disk/by-label/My\x20Data`)
+	symlink("../../sda2", "dev/disk/by-partuuid/abcd-02")
+	symlink("../../sda2", "dev/disk/by-partlabel/rootb")
+	// sda1 的 by-uuid 链接已经过期，以超级块为准
+	symlink("../../sda1", "dev/disk/by-uuid/old-uuid")
+
+	writeFile("proc/self/mountinfo", `28 1 253:0 / / rw,relatime - xfs /dev/mapper/vg0-root rw
+30 28 8:1 / /boot rw,relatime - ext4 /dev/sda1 rw
+40 28 0:50 /@home /home rw,relatime - btrfs /dev/sda2 rw,subvol=/@home
+`)
+	return root
+}
+
+func TestSystem(t *testing.T) {
+	s := &System{Root: makeTestSystem(t)}
+	devices, err := s.Devices()
+	require.NoError(t, err)
+	require.Len(t, devices, 4)
+
+	dm, err := FindByPath(s, "/dev/mapper/vg0-root")
+	require.NoError(t, err)
+	assert.Equal(t, &Device{
+		Name:       "dm-0",
+		Path:       "/dev/mapper/vg0-root",
+		Disk:       "/dev/sda",
+		Major:      253,
+		Minor:      0,
+		FsType:     "xfs",
+		Uuid:       testUuid,
+		MountPoint: "/",
+	}, dm)
+
+	boot, err := FindByLabel(s, " boot ")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda1", boot.Path)
+	assert.Equal(t, "/dev/sda", boot.Disk)
+	assert.Equal(t, "ext4", boot.FsType)
+	assert.Equal(t, testUuid, boot.Uuid)
+	assert.Equal(t, "/boot", boot.MountPoint)
+
+	d, err := FindByUuid(s, testLinkUuid)
+	require.NoError(t, err)
+	assert.Equal(t, &Device{
+		Name:       "sda2",
+		Path:       "/dev/sda2",
+		Disk:       "/dev/sda",
+		Major:      8,
+		Minor:      2,
+		Uuid:       testLinkUuid,
+		Label:      "My Data",
+		PartUuid:   "abcd-02",
+		PartLabel:  "rootb",
+		MountPoint: "/home",
+	}, d)
+
+	d, err = FindByPath(s, "/dev/disk/by-partuuid/abcd-02")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda2", d.Path)
+
+	d, err = FindByPath(s, "/dev/sda")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda", d.Disk)
+
+	for path, want := range map[string]string{
+		"/":          "/dev/mapper/vg0-root",
+		"/usr":       "/dev/mapper/vg0-root",
+		"/boot/grub": "/dev/sda1",
+		"/home/a":    "/dev/sda2",
+	} {
+		d, err = FindByPathMount(s, path)
+		require.NoError(t, err, path)
+		assert.Equal(t, want, d.Path, path)
+	}
+
+	_, err = FindByUuid(s, "old-uuid")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+	_, err = FindByUuid(s, testUuid)
+	assert.True(t, xerrors.Is(err, ErrAmbiguous))
+	_, err = FindByUuid(s, "")
+	assert.Error(t, err)
+	_, err = FindByPath(s, "/dev/sdb")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+
+	_, err = (&System{Root: t.TempDir()}).Devices()
+	assert.Error(t, err)
+}
+
+func TestFake(t *testing.T) {
+	f := &Fake{
+		Devs: []*Device{
+			{Name: "sda1", Path: "/dev/sda1", Major: 8, Minor: 1, Uuid: "aaa"},
+			{Name: "dm-0", Path: "/dev/mapper/vg0-root", Major: 253, Minor: 0, Uuid: "bbb"},
+		},
+		Mounts: []*MountInfo{
+			{MountPoint: "/", Major: 253, Minor: 0, Source: "/dev/mapper/vg0-root"},
+			{MountPoint: "/data", Source: "/dev/sda1"},
+			{MountPoint: "/tmp", Source: "tmpfs"},
+		},
+	}
+	d, err := FindByPathMount(f, "/usr")
+	require.NoError(t, err)
+	assert.Equal(t, "bbb", d.Uuid)
+	d, err = FindByPathMount(f, "/data")
+	require.NoError(t, err)
+	assert.Equal(t, "aaa", d.Uuid)
+	_, err = FindByPathMount(f, "/tmp")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+	_, err = FindByPathMount(&Fake{}, "/")
+	assert.Error(t, err)
+
+	d, err = FindByPath(f, "/dev/dm-0")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/mapper/vg0-root", d.Path)
+}
+
+func TestUnescapeUdev(t *testing.T) {
+	assert.Equal(t, "My Data", unescapeUdev(`My\x20Data`))
+	assert.Equal(t, `a\x2`, unescapeUdev(`a\x2`))
+	assert.Equal(t, "a/b", unescapeUdev(`a\x2fb`))
+}
@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+// Fake 是用于测试的 Interface 实现，返回预先设置的设备和挂载，不解析符号链接。
+type Fake struct {
+	Devs   []*Device
+	Mounts []*MountInfo
+}
+
+func (f *Fake) Devices() ([]*Device, error) {
+	return f.Devs, nil
+}
+
+func (f *Fake) MountInfos() ([]*MountInfo, error) {
+	return f.Mounts, nil
+}
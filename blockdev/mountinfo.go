@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"../fstab"
+	"github.com/linuxdeepin/go-lib/strv"
+	"golang.org/x/xerrors"
+)
+
+// MountInfo 是 /proc/self/mountinfo 中的一行，格式见 proc(5)。
+type MountInfo struct {
+	MountId      int
+	ParentId     int
+	Major        uint32 // 文件系统所在设备的设备号，btrfs 等文件系统为匿名设备，主设备号为 0
+	Minor        uint32
+	Root         string // 文件系统中被挂载的路径
+	MountPoint   string
+	Options      strv.Strv // 挂载点的选项，比如 ro、nosuid
+	FsType       string
+	Source       string
+	SuperOptions strv.Strv // 文件系统的选项
+}
+
+func parseMountInfoLine(line string) (*MountInfo, error) {
+	fields := strings.Fields(line)
+	// 第 7 个字段开始是数量不定的可选字段，以 - 结束
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fields) < sep+4 {
+		return nil, xerrors.Errorf("invalid mountinfo line %q", line)
+	}
+	mountId, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, xerrors.Errorf("invalid mountinfo line %q: %w", line, err)
+	}
+	parentId, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, xerrors.Errorf("invalid mountinfo line %q: %w", line, err)
+	}
+	major, minor, err := parseDevNumber(fields[2])
+	if err != nil {
+		return nil, xerrors.Errorf("invalid mountinfo line %q: %w", line, err)
+	}
+	return &MountInfo{
+		MountId:      mountId,
+		ParentId:     parentId,
+		Major:        major,
+		Minor:        minor,
+		Root:         fstab.Unescape(fields[3]),
+		MountPoint:   fstab.Unescape(fields[4]),
+		Options:      strings.Split(fields[5], ","),
+		FsType:       fields[sep+1],
+		Source:       fstab.Unescape(fields[sep+2]),
+		SuperOptions: strings.Split(fields[sep+3], ","),
+	}, nil
+}
+
+// 解析 major:minor 格式的设备号
+func parseDevNumber(s string) (major, minor uint32, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return 0, 0, xerrors.Errorf("invalid device number %q", s)
+	}
+	v, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("invalid device number %q: %w", s, err)
+	}
+	major = uint32(v)
+	v, err = strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("invalid device number %q: %w", s, err)
+	}
+	minor = uint32(v)
+	return major, minor, nil
+}
+
+func ParseMountInfo(data []byte) ([]*MountInfo, error) {
+	var result []*MountInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		info, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// 读取 procDir 中当前线程所在的挂载命名空间中的挂载点
+func readMountInfo(procDir string) ([]*MountInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, "thread-self/mountinfo"))
+	if err != nil {
+		// 3.17 之前的内核没有 /proc/thread-self
+		data, err = ioutil.ReadFile(filepath.Join(procDir, "self/mountinfo"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ParseMountInfo(data)
+}
+
+// FindMountInfo 返回挂载在 mountPoint 上的最上层的挂载，即访问 mountPoint 时看到的那个，没有时返回 nil。
+func FindMountInfo(infos []*MountInfo, mountPoint string) *MountInfo {
+	var result *MountInfo
+	for _, info := range infos {
+		if info.MountPoint == mountPoint {
+			result = info
+		}
+	}
+	return result
+}
+
+// FindPathMountInfo 返回 path 所在的挂载，即挂载点是 path 或者 path 的上级文件夹中最深的那个。
+// path 应该是不含符号链接的绝对路径。
+func FindPathMountInfo(infos []*MountInfo, path string) *MountInfo {
+	path = filepath.Clean(path)
+	var result *MountInfo
+	for _, info := range infos {
+		mp := info.MountPoint
+		if mp != "/" && mp != path && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if result == nil || len(mp) >= len(result.MountPoint) {
+			result = info
+		}
+	}
+	return result
+}
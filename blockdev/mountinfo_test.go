@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mountInfoData = `22 28 0:21 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+28 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+64 28 8:2 / /home rw,relatime shared:30 - ext4 /dev/sda2 rw,data=ordered
+66 64 8:3 / /home/tp1/ext rw,relatime shared:31 - ext4 /dev/sda3 rw,data=ordered
+70 28 7:0 / /snap/core/5145 ro,nodev,relatime shared:33 - squashfs /dev/loop0 ro
+72 28 8:5 / /media/tp1/My\040Disk rw,nosuid,nodev,relatime shared:35 - ext4 /dev/sda5 rw
+74 28 8:6 / /boot rw,relatime shared:36 - ext4 /dev/sda6 rw
+76 74 8:6 / /boot ro,relatime shared:36 - ext4 /dev/sda6 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	infos, err := ParseMountInfo([]byte(mountInfoData))
+	require.NoError(t, err)
+	require.Len(t, infos, 8)
+	assert.Equal(t, &MountInfo{
+		MountId:      64,
+		ParentId:     28,
+		Major:        8,
+		Minor:        2,
+		Root:         "/",
+		MountPoint:   "/home",
+		Options:      []string{"rw", "relatime"},
+		FsType:       "ext4",
+		Source:       "/dev/sda2",
+		SuperOptions: []string{"rw", "data=ordered"},
+	}, infos[2])
+
+	assert.NotNil(t, FindMountInfo(infos, "/home"))
+	assert.Nil(t, FindMountInfo(infos, "/home/tp1"))
+	assert.Nil(t, FindMountInfo(infos, "/dev/sda3"))
+	// 转义的空格
+	assert.NotNil(t, FindMountInfo(infos, "/media/tp1/My Disk"))
+	// 同一个挂载点上有多个挂载时使用最上层的
+	assert.True(t, FindMountInfo(infos, "/boot").Options.Contains("ro"))
+	assert.False(t, FindMountInfo(infos, "/home").Options.Contains("ro"))
+
+	for _, line := range []string{
+		"28 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw\n",
+		"28 1 8 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n",
+	} {
+		_, err = ParseMountInfo([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestFindPathMountInfo(t *testing.T) {
+	infos, err := ParseMountInfo([]byte(mountInfoData))
+	require.NoError(t, err)
+	for path, mountPoint := range map[string]string{
+		"/":                     "/",
+		"/usr/bin":              "/",
+		"/home":                 "/home",
+		"/home/tp1":             "/home",
+		"/home/tp1/ext/a":       "/home/tp1/ext",
+		"/homework":             "/",
+		"/boot/efi/":            "/boot",
+		"/media/tp1/My Disk/a":  "/media/tp1/My Disk",
+		"/media/tp1/My Disk2/a": "/",
+	} {
+		info := FindPathMountInfo(infos, path)
+		require.NotNil(t, info, path)
+		assert.Equal(t, mountPoint, info.MountPoint, path)
+	}
+	assert.True(t, FindPathMountInfo(infos, "/boot/grub").Options.Contains("ro"))
+	assert.Nil(t, FindPathMountInfo(nil, "/"))
+}
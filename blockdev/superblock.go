@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// superblock 是从文件系统超级块中读取的信息。
+type superblock struct {
+	fsType string
+	uuid   string
+	label  string
+}
+
+// 内存页的大小可能为 4K、16K 或 64K，交换分区的签名在第一页的末尾
+var swapPageSizes = []int64{4096, 16384, 65536}
+
+// 读取 r 中 off 处的 n 个字节，读不到这么多时返回 nil。
+func readAt(r io.ReaderAt, off int64, n int) []byte {
+	buf := make([]byte, n)
+	_, err := r.ReadAt(buf, off)
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+func formatUuid(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// 去掉标签末尾的 \0 和空格
+func trimLabel(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+// 识别 r 中的文件系统，支持 ext2/3/4、xfs、btrfs、vfat、swap 和 LUKS，不认识时返回 nil。
+func probeSuperblock(r io.ReaderAt) *superblock {
+	for _, probe := range []func(io.ReaderAt) *superblock{
+		probeLuks, probeExt, probeXfs, probeBtrfs, probeSwap, probeVfat,
+	} {
+		if sb := probe(r); sb != nil {
+			return sb
+		}
+	}
+	return nil
+}
+
+func probeExt(r io.ReaderAt) *superblock {
+	const (
+		offset               = 1024
+		featureCompatJournal = 0x4
+		// extents、64bit、flex_bg
+		featureIncompatExt4 = 0x40 | 0x80 | 0x200
+	)
+	buf := readAt(r, offset, 136)
+	if buf == nil || binary.LittleEndian.Uint16(buf[56:]) != 0xef53 {
+		return nil
+	}
+	fsType := "ext2"
+	if binary.LittleEndian.Uint32(buf[96:])&featureIncompatExt4 != 0 {
+		fsType = "ext4"
+	} else if binary.LittleEndian.Uint32(buf[92:])&featureCompatJournal != 0 {
+		fsType = "ext3"
+	}
+	return &superblock{fsType: fsType, uuid: formatUuid(buf[104:120]), label: trimLabel(buf[120:136])}
+}
+
+func probeXfs(r io.ReaderAt) *superblock {
+	buf := readAt(r, 0, 120)
+	if buf == nil || string(buf[:4]) != "XFSB" {
+		return nil
+	}
+	return &superblock{fsType: "xfs", uuid: formatUuid(buf[32:48]), label: trimLabel(buf[108:120])}
+}
+
+func probeBtrfs(r io.ReaderAt) *superblock {
+	const offset = 0x10000
+	buf := readAt(r, offset, 0x12b+256)
+	if buf == nil || string(buf[64:72]) != "_BHRfS_M" {
+		return nil
+	}
+	return &superblock{fsType: "btrfs", uuid: formatUuid(buf[32:48]), label: trimLabel(buf[0x12b:])}
+}
+
+func probeSwap(r io.ReaderAt) *superblock {
+	for _, pageSize := range swapPageSizes {
+		magic := readAt(r, pageSize-10, 10)
+		if magic == nil || string(magic) != "SWAPSPACE2" {
+			continue
+		}
+		buf := readAt(r, 1024, 44)
+		if buf == nil {
+			return nil
+		}
+		return &superblock{fsType: "swap", uuid: formatUuid(buf[12:28]), label: trimLabel(buf[28:44])}
+	}
+	return nil
+}
+
+func probeLuks(r io.ReaderAt) *superblock {
+	buf := readAt(r, 0, 208)
+	if buf == nil || string(buf[:6]) != "LUKS\xba\xbe" {
+		return nil
+	}
+	sb := &superblock{fsType: "crypto_LUKS", uuid: trimLabel(buf[168:208])}
+	if binary.BigEndian.Uint16(buf[6:]) == 2 {
+		sb.label = trimLabel(buf[24:72])
+	}
+	return sb
+}
+
+func probeVfat(r io.ReaderAt) *superblock {
+	buf := readAt(r, 0, 512)
+	if buf == nil || buf[510] != 0x55 || buf[511] != 0xaa {
+		return nil
+	}
+	// FAT32 的卷序列号和卷标在引导扇区中的位置与 FAT12/16 不同
+	var id, label []byte
+	switch {
+	case string(buf[82:90]) == "FAT32   ":
+		id, label = buf[67:71], buf[71:82]
+	case string(buf[54:57]) == "FAT":
+		id, label = buf[39:43], buf[43:54]
+	default:
+		return nil
+	}
+	serial := binary.LittleEndian.Uint32(id)
+	sb := &superblock{fsType: "vfat", uuid: fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)}
+	if l := trimLabel(label); l != "NO NAME" {
+		sb.label = l
+	}
+	return sb
+}
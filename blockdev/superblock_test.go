@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blockdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testUuidBytes = []byte{0x01, 0x74, 0x15, 0xe7, 0x15, 0xb1, 0x48, 0x12,
+	0xbe, 0xaf, 0x8f, 0xb7, 0x5e, 0x68, 0x5f, 0x01}
+
+const testUuid = "017415e7-15b1-4812-beaf-8fb75e685f01"
+
+// 生成大小为 size 的设备内容，由 fn 写入超级块
+func makeImage(size int, fn func(b []byte)) *bytes.Reader {
+	b := make([]byte, size)
+	fn(b)
+	return bytes.NewReader(b)
+}
+
+func TestProbeSuperblock(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		image *bytes.Reader
+		want  *superblock
+	}{
+		{"ext4", makeImage(4096, func(b []byte) {
+			binary.LittleEndian.PutUint16(b[1024+56:], 0xef53)
+			binary.LittleEndian.PutUint32(b[1024+92:], 0x4)
+			binary.LittleEndian.PutUint32(b[1024+96:], 0x40)
+			copy(b[1024+104:], testUuidBytes)
+			copy(b[1024+120:], "Roota")
+		}), &superblock{"ext4", testUuid, "Roota"}},
+		{"ext3", makeImage(4096, func(b []byte) {
+			binary.LittleEndian.PutUint16(b[1024+56:], 0xef53)
+			binary.LittleEndian.PutUint32(b[1024+92:], 0x4)
+			copy(b[1024+104:], testUuidBytes)
+		}), &superblock{"ext3", testUuid, ""}},
+		{"xfs", makeImage(4096, func(b []byte) {
+			copy(b, "XFSB")
+			copy(b[32:], testUuidBytes)
+			copy(b[108:], "Rootb")
+		}), &superblock{"xfs", testUuid, "Rootb"}},
+		{"btrfs", makeImage(0x11000, func(b []byte) {
+			copy(b[0x10000+32:], testUuidBytes)
+			copy(b[0x10000+64:], "_BHRfS_M")
+			copy(b[0x10000+0x12b:], "Root")
+		}), &superblock{"btrfs", testUuid, "Root"}},
+		{"swap 64K", makeImage(65536, func(b []byte) {
+			copy(b[1024+12:], testUuidBytes)
+			copy(b[1024+28:], "SWAP")
+			copy(b[65536-10:], "SWAPSPACE2")
+		}), &superblock{"swap", testUuid, "SWAP"}},
+		{"luks2", makeImage(4096, func(b []byte) {
+			copy(b, "LUKS\xba\xbe\x00\x02")
+			copy(b[24:], "Crypt")
+			copy(b[168:], testUuid)
+		}), &superblock{"crypto_LUKS", testUuid, "Crypt"}},
+		{"vfat", makeImage(4096, func(b []byte) {
+			copy(b[67:], []byte{0xcc, 0x33, 0xef, 0x95})
+			copy(b[71:], "EFI        FAT32   ")
+			b[510], b[511] = 0x55, 0xaa
+		}), &superblock{"vfat", "95EF-33CC", "EFI"}},
+		{"fat16 no name", makeImage(4096, func(b []byte) {
+			copy(b[39:], []byte{0xcc, 0x33, 0xef, 0x95})
+			copy(b[43:], "NO NAME    FAT16   ")
+			b[510], b[511] = 0x55, 0xaa
+		}), &superblock{"vfat", "95EF-33CC", ""}},
+	} {
+		assert.Equal(t, c.want, probeSuperblock(c.image), c.name)
+	}
+
+	assert.Nil(t, probeSuperblock(makeImage(4096, func(b []byte) {})))
+	assert.Nil(t, probeSuperblock(bytes.NewReader(nil)))
+}
+
+func TestFormatUuid(t *testing.T) {
+	require.Len(t, testUuidBytes, 16)
+	assert.Equal(t, testUuid, formatUuid(testUuidBytes))
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"./bootloader"
+	"./bootloader/grubenv"
+	"./bootloader/grubmkconfig"
+	"golang.org/x/xerrors"
+)
+
+// grubenv 中记录连续未成功启动次数的变量，由 misc/11_deepin_ab_recovery 生成的 grub 脚本在每次启动时递增，
+// 由 ab-recovery -mark-boot-successful 在进入图形界面后清除。
+const grubEnvBootCountVar = "deepin_ab_recovery_boot_count"
+
+// Config.BootFailureLimit 的最大值，grub 脚本没有算术运算，递增计数的分支数量与它相同
+const maxBootFailureLimit = 10
+
+func getGrubEnvFile() string {
+	return filepath.Join(globalBootDir, "grub/grubenv")
+}
+
+// 清除 grubenv 文件 filename 中的启动计数，返回是否有计数，没有计数时不修改文件。
+func clearBootCount(filename string) (bool, error) {
+	env, err := grubenv.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !env.Unset(grubEnvBootCountVar) {
+		return false, nil
+	}
+	err = env.Save(filename)
+	if err != nil {
+		return false, xerrors.Errorf("failed to save grub env %q: %w", filename, err)
+	}
+	return true, nil
+}
+
+// 清除 grubenv 中的启动计数，表示本次启动成功，没有计数时不修改 grubenv。
+// 还会取消只启动一次备份分区中的系统的设置。
+func markBootSuccessful() error {
+	b, err := probeBootloader(nil)
+	if err != nil {
+		return err
+	}
+	// 启动过一次备份分区中的系统后恢复原来的默认启动项，grub 和 systemd-boot 在启动时已经自动清除了设置
+	if ob, ok := b.(bootloader.OneShotBackend); ok {
+		err = ob.CancelBootRecoveryOnce()
+		if err != nil {
+			logger.Warning("failed to cancel boot backup once:", err)
+		}
+	}
+
+	if _, ok := b.(*grubmkconfig.Backend); !ok {
+		// 不使用 grub-mkconfig 生成的配置，没有启动计数
+		return nil
+	}
+
+	cleared, err := clearBootCount(getGrubEnvFile())
+	if err != nil {
+		return err
+	}
+	if cleared {
+		logger.Debug("boot count cleared")
+	}
+	return nil
+}
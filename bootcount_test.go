@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"./bootloader/grubenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clearBootCount(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "grubenv")
+	cleared, err := clearBootCount(filename)
+	require.NoError(t, err)
+	assert.False(t, cleared)
+
+	env := grubenv.New()
+	env.Set("saved_entry", "gnulinux-simple-abc")
+	env.Set(grubEnvBootCountVar, "2")
+	require.NoError(t, env.Save(filename))
+
+	cleared, err = clearBootCount(filename)
+	require.NoError(t, err)
+	assert.True(t, cleared)
+	env, err = grubenv.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"saved_entry"}, env.Names())
+
+	cleared, err = clearBootCount(filename)
+	require.NoError(t, err)
+	assert.False(t, cleared)
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootloader
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Partition 是安装了系统的分区
+type Partition struct {
+	Uuid   string
+	Device string
+	Subvol string // 系统所在的 btrfs 子卷，相对于顶层子卷，为空时不是子卷模式
+	// Device 是 LVM 逻辑卷，比如 /dev/mapper/vg-root。精简快照与原卷的文件系统 uuid 相同，
+	// 所以内核参数 root 使用设备路径而不是 UUID=。
+	Lv   bool
+	Luks string // 分区所在的 LUKS 加密容器的 uuid，Uuid 为解锁后其中的文件系统的 uuid，为空时没有加密
+}
+
+// MenuEntryId 返回菜单项 id 中标识 p 的部分。btrfs 子卷和 LVM 快照与当前系统的文件系统 uuid 相同，
+// 加上子卷或设备名，以免与默认菜单项的 id 重复。
+func (p Partition) MenuEntryId() string {
+	id := p.Uuid
+	if p.Subvol != "" {
+		id += "-" + strings.Replace(p.Subvol, "/", "-", -1)
+	}
+	if p.Lv {
+		id += "-" + filepath.Base(p.Device)
+	}
+	return id
+}
+
+// LuksArgs 返回启动时解锁 p 所在的 LUKS 容器的内核参数，p 没有加密时返回 nil。
+// dracut 和 systemd 使用 rd.luks.uuid，mkinitcpio 使用 cryptdevice，initramfs-tools 使用 cryptopts。
+func (p Partition) LuksArgs() []string {
+	if p.Luks == "" {
+		return nil
+	}
+	name := "luks-" + p.Luks
+	return []string{
+		"rd.luks.uuid=" + p.Luks,
+		"cryptdevice=UUID=" + p.Luks + ":" + name,
+		"cryptopts=target=" + name + ",source=UUID=" + p.Luks + ",luks",
+	}
+}
+
+// RecoveryEntry 描述回滚到备份分区的启动项
+type RecoveryEntry struct {
+	Root             Partition // 备份分区
+	Linux            string    // 备份的内核文件的绝对路径，在 Options.BootDir 中
+	Initrd           string    // 备份的 initrd 文件的绝对路径，可以为空
+	OsDesc           string
+	BackupTime       time.Time
+	Title            string // 按用户的语言翻译的菜单标题
+	TitleEn          string // 英文的菜单标题，用于不能显示中文的引导程序
+	BootFailureLimit int    // 连续启动失败多少次后自动回滚，为 0 时不自动回滚
+}
+
+// Options 是检测和修改引导程序配置时需要的系统信息
+type Options struct {
+	BootDir        string
+	GrubCfgFile    string
+	PmonCfgFile    string
+	BiosVersion    string   // /proc/boardinfo 中的 BIOS 版本，没有时为空
+	NoGrubMkconfig bool     // 不使用 grub-mkconfig 生成 grub 配置
+	EnvVars        []string // 生成配置时使用的环境变量，比如 LANG
+}
+
+// Backend 修改一种引导程序的配置。修改先保存在内存中，调用 Commit 后才写入。
+type Backend interface {
+	// Describe 返回引导程序的名称，用于日志
+	Describe() string
+	// Detect 检查当前系统是否使用这种引导程序
+	Detect() bool
+	// AddRecoveryEntry 添加回滚到备份分区的启动项，并移除原有的回滚启动项
+	AddRecoveryEntry(entry *RecoveryEntry) error
+	// RemoveRecoveryEntries 移除回滚到 backup 的启动项，backup 中的系统仍然不出现在启动菜单中
+	RemoveRecoveryEntries(backup Partition) error
+	// SwitchRoot 在还原后让默认启动项使用 root 分区，隐藏原来的系统 previous，并移除回滚启动项
+	SwitchRoot(root, previous Partition) error
+	// Commit 写入全部修改
+	Commit() error
+}
+
+// OneShotBackend 是支持只在下次启动时启动回滚启动项的引导程序，不支持的引导程序不实现这个接口。
+// 这些方法直接修改引导程序的配置，不需要调用 Commit。
+type OneShotBackend interface {
+	// BootRecoveryOnce 让下次启动时启动回滚到 backup 的启动项，之后的启动仍然使用原来的默认启动项
+	BootRecoveryOnce(backup Partition) error
+	// CancelBootRecoveryOnce 取消 BootRecoveryOnce 的设置，没有设置时什么也不做
+	CancelBootRecoveryOnce() error
+	// IsBootRecoveryOnce 检查下次启动时是否会启动回滚启动项
+	IsBootRecoveryOnce() (bool, error)
+}
+
+type backendFactory struct {
+	priority int
+	newFn    func(opts *Options) Backend
+}
+
+var _factories []backendFactory
+
+// Register 注册一种引导程序，Probe 按 priority 从小到大检测，一般在实现包的 init 函数中调用。
+func Register(priority int, newFn func(opts *Options) Backend) {
+	_factories = append(_factories, backendFactory{priority: priority, newFn: newFn})
+	sort.SliceStable(_factories, func(i, j int) bool {
+		return _factories[i].priority < _factories[j].priority
+	})
+}
+
+// Probe 返回第一个检测到的引导程序，都没有检测到时返回 nil。
+func Probe(opts *Options) Backend {
+	for _, f := range _factories {
+		b := f.newFn(opts)
+		if b.Detect() {
+			return b
+		}
+	}
+	return nil
+}
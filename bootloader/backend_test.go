@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bootloader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	name   string
+	detect bool
+}
+
+func (b *fakeBackend) Describe() string                             { return b.name }
+func (b *fakeBackend) Detect() bool                                 { return b.detect }
+func (b *fakeBackend) AddRecoveryEntry(entry *RecoveryEntry) error  { return nil }
+func (b *fakeBackend) RemoveRecoveryEntries(backup Partition) error { return nil }
+func (b *fakeBackend) SwitchRoot(root, previous Partition) error    { return nil }
+func (b *fakeBackend) Commit() error                                { return nil }
+
+func TestProbe(t *testing.T) {
+	defer func() {
+		_factories = nil
+	}()
+
+	assert.Nil(t, Probe(&Options{}))
+
+	// 按优先级检测，与注册的顺序无关
+	Register(30, func(opts *Options) Backend {
+		return &fakeBackend{name: "c", detect: true}
+	})
+	Register(10, func(opts *Options) Backend {
+		return &fakeBackend{name: "a", detect: opts.BiosVersion == "a"}
+	})
+	Register(20, func(opts *Options) Backend {
+		return &fakeBackend{name: "b", detect: opts.NoGrubMkconfig}
+	})
+
+	assert.Equal(t, "c", Probe(&Options{}).Describe())
+	assert.Equal(t, "b", Probe(&Options{NoGrubMkconfig: true}).Describe())
+	assert.Equal(t, "a", Probe(&Options{BiosVersion: "a", NoGrubMkconfig: true}).Describe())
+}
+
+func TestPartitionMenuEntryId(t *testing.T) {
+	assert.Equal(t, "abc", Partition{Uuid: "abc", Device: "/dev/sda3"}.MenuEntryId())
+	assert.Equal(t, "abc-snapshots-@ab-backup",
+		Partition{Uuid: "abc", Subvol: "snapshots/@ab-backup"}.MenuEntryId())
+	p := Partition{Uuid: "abc", Device: "/dev/mapper/vg-ab--backup", Lv: true}
+	assert.Equal(t, "abc-vg-ab--backup", p.MenuEntryId())
+
+	assert.Equal(t, ErrLvUnsupported, CheckPlainPartition(p))
+	assert.Equal(t, ErrSubvolUnsupported, CheckPlainPartition(Partition{Uuid: "abc", Subvol: "@"}))
+	assert.NoError(t, CheckPlainPartition(Partition{Uuid: "abc"}))
+	assert.Equal(t, ErrLuksUnsupported, CheckPlainPartition(Partition{Uuid: "abc", Luks: "def"}))
+	assert.NoError(t, CheckUuidRoot(Partition{Uuid: "abc", Luks: "def"}))
+}
+
+func TestReplaceLuksArgs(t *testing.T) {
+	assert.Empty(t, Partition{Uuid: "abc"}.LuksArgs())
+	assert.Equal(t, "root=UUID=abc ro rd.luks.uuid=1234", ReplaceLuksArgs("root=UUID=abc ro rd.luks.uuid=1234",
+		Partition{Uuid: "abc"}))
+	assert.Equal(t, "root=UUID=abc ro quiet rd.luks.uuid=5678 cryptdevice=UUID=5678:luks-5678 "+
+		"cryptopts=target=luks-5678,source=UUID=5678,luks",
+		ReplaceLuksArgs("root=UUID=abc ro rd.luks.uuid=1234 cryptdevice=UUID=1234:root quiet",
+			Partition{Uuid: "abc", Luks: "5678"}))
+}
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blscfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bootloader ".."
+	"../efiboot"
+	"golang.org/x/xerrors"
+)
+
+// 回滚启动项的文件名，在 loader/entries 文件夹中
+const RecoveryEntryFile = "deepin-ab-recovery.conf"
+
+// 没有找到默认启动项时回滚启动项使用的内核参数
+const defaultOptions = "ro quiet splash"
+
+// systemd-boot 需要先于 grub-mkconfig 检测，因为系统中可能同时安装了 grub
+const backendPriority = 15
+
+// systemd-boot 在下次启动时启动这个 EFI 变量指定的启动项，然后删除它
+const loaderEntryOneShotVar = "LoaderEntryOneShot"
+
+func init() {
+	bootloader.Register(backendPriority, NewBackend)
+}
+
+// Backend 修改 systemd-boot 等支持 Boot Loader Specification 的引导程序的启动项，
+// Options.BootDir 需要是 ESP 或 XBOOTLDR 分区的挂载点。
+type Backend struct {
+	opts           *bootloader.Options
+	entries        map[string]*Entry // 修改过的启动项，键为文件名
+	recovery       *Entry
+	removeRecovery bool
+	vars           *efiboot.Vars // systemd-boot 的 EFI 变量
+}
+
+func NewBackend(opts *bootloader.Options) bootloader.Backend {
+	return &Backend{
+		opts:    opts,
+		entries: make(map[string]*Entry),
+		vars:    &efiboot.Vars{Dir: efiboot.EfivarsDir, Guid: efiboot.LoaderGuid},
+	}
+}
+
+func (b *Backend) Describe() string {
+	return "boot loader specification " + b.getEntriesDir()
+}
+
+func (b *Backend) getLoaderConfFile() string {
+	return filepath.Join(b.opts.BootDir, "loader/loader.conf")
+}
+
+func (b *Backend) getEntriesDir() string {
+	return filepath.Join(b.opts.BootDir, "loader/entries")
+}
+
+func (b *Backend) Detect() bool {
+	fi, err := os.Stat(b.getLoaderConfFile())
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	fi, err = os.Stat(b.getEntriesDir())
+	return err == nil && fi.IsDir()
+}
+
+// 按文件名的顺序返回回滚启动项以外的启动项的文件名
+func (b *Backend) listEntries() ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(b.getEntriesDir())
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if fi.Mode().IsRegular() && strings.HasSuffix(name, ".conf") && name != RecoveryEntryFile {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// 查找 loader.conf 中 default 指定的 linux 启动项，没有指定时使用第一个 linux 启动项，没有 linux 启动项时返回 nil。
+func (b *Backend) findDefaultEntry() (*Entry, error) {
+	names, err := b.listEntries()
+	if err != nil {
+		return nil, err
+	}
+	var pattern string
+	loaderConf, err := ParseEntryFile(b.getLoaderConfFile())
+	if err == nil {
+		pattern = loaderConf.Get("default")
+	}
+
+	var first *Entry
+	for _, name := range names {
+		e, err := ParseEntryFile(filepath.Join(b.getEntriesDir(), name))
+		if err != nil {
+			return nil, err
+		}
+		if e.Get("linux") == "" {
+			continue
+		}
+		if pattern != "" {
+			id := strings.TrimSuffix(name, ".conf")
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return e, nil
+			}
+			if ok, _ := filepath.Match(pattern, id); ok {
+				return e, nil
+			}
+		}
+		if first == nil {
+			first = e
+		}
+	}
+	return first, nil
+}
+
+// 启动项中的路径是相对于 BootDir 的
+func (b *Backend) getEntryPath(filename string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(filename, b.opts.BootDir), "/")
+}
+
+func (b *Backend) AddRecoveryEntry(entry *bootloader.RecoveryEntry) error {
+	err := bootloader.CheckUuidRoot(entry.Root)
+	if err != nil {
+		return err
+	}
+	// 使用默认启动项的内核参数
+	options := defaultOptions
+	def, err := b.findDefaultEntry()
+	if err != nil {
+		return xerrors.Errorf("failed to find default entry: %w", err)
+	}
+	if def != nil && def.Options() != "" {
+		options = def.Options()
+	}
+	rootOption := "root=UUID=" + entry.Root.Uuid
+	if bootloader.RegRootUUID.MatchString(options) {
+		options = bootloader.RegRootUUID.ReplaceAllString(options, rootOption)
+	} else {
+		options = rootOption + " " + options
+	}
+	options = bootloader.ReplaceLuksArgs(options, entry.Root)
+
+	e := &Entry{}
+	e.Set("title", entry.TitleEn)
+	e.Set("linux", b.getEntryPath(entry.Linux))
+	if entry.Initrd != "" {
+		e.Set("initrd", b.getEntryPath(entry.Initrd))
+	}
+	e.Set("options", options)
+	b.recovery = e
+	b.removeRecovery = false
+	return nil
+}
+
+func (b *Backend) RemoveRecoveryEntries(backup bootloader.Partition) error {
+	b.recovery = nil
+	b.removeRecovery = true
+	return nil
+}
+
+// SwitchRoot 把根分区为 previous 的启动项改为使用 root，不修改其他系统的启动项。
+func (b *Backend) SwitchRoot(root, previous bootloader.Partition) error {
+	b.recovery = nil
+	b.removeRecovery = true
+
+	names, err := b.listEntries()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		e, err := ParseEntryFile(filepath.Join(b.getEntriesDir(), name))
+		if err != nil {
+			return err
+		}
+		if e.ReplaceRootUuid(previous.Uuid, root.Uuid) {
+			if root.Luks != "" {
+				e.Set("options", bootloader.ReplaceLuksArgs(e.Options(), root))
+			}
+			b.entries[name] = e
+		}
+	}
+	if len(b.entries) == 0 {
+		return xerrors.New("not found replace target")
+	}
+	return nil
+}
+
+func (b *Backend) Commit() error {
+	for name, e := range b.entries {
+		err := e.Save(filepath.Join(b.getEntriesDir(), name))
+		if err != nil {
+			return xerrors.Errorf("failed to save entry %q: %w", name, err)
+		}
+	}
+	b.entries = make(map[string]*Entry)
+
+	filename := filepath.Join(b.getEntriesDir(), RecoveryEntryFile)
+	if b.recovery != nil {
+		err := b.recovery.Save(filename)
+		if err != nil {
+			return xerrors.Errorf("failed to save entry %q: %w", RecoveryEntryFile, err)
+		}
+	} else if b.removeRecovery {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// BootRecoveryOnce 与 bootctl set-oneshot 相同，设置 LoaderEntryOneShot 变量，只适用于 systemd-boot。
+func (b *Backend) BootRecoveryOnce(backup bootloader.Partition) error {
+	_, err := os.Stat(filepath.Join(b.getEntriesDir(), RecoveryEntryFile))
+	if err != nil {
+		return xerrors.Errorf("not found recovery entry: %w", err)
+	}
+	if !b.vars.Available() {
+		return xerrors.New("efivarfs is not available")
+	}
+	const attrs = efiboot.AttrNonVolatile | efiboot.AttrBootServiceAccess | efiboot.AttrRuntimeAccess
+	return b.vars.Set(loaderEntryOneShotVar, attrs, efiboot.EncodeArgs(RecoveryEntryFile))
+}
+
+func (b *Backend) CancelBootRecoveryOnce() error {
+	ok, err := b.IsBootRecoveryOnce()
+	if err != nil || !ok {
+		return err
+	}
+	return b.vars.Delete(loaderEntryOneShotVar)
+}
+
+func (b *Backend) IsBootRecoveryOnce() (bool, error) {
+	if !b.vars.Available() {
+		return false, nil
+	}
+	_, data, err := b.vars.Get(loaderEntryOneShotVar)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	id, err := efiboot.DecodeArgs(data)
+	if err != nil {
+		return false, err
+	}
+	// 启动项的 id 可以不带 .conf 后缀
+	return id == RecoveryEntryFile || id == strings.TrimSuffix(RecoveryEntryFile, ".conf"), nil
+}
@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blscfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bootloader ".."
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testCurrentUuid = "5d0f1c1e-54a7-4a3e-9f0e-0f3b6f0f9d2e"
+	testBackupUuid  = "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75"
+)
+
+// 把 testdata/boot 复制到临时文件夹，作为 ESP 分区的挂载点
+func newTestBackend(t *testing.T) *Backend {
+	bootDir := filepath.Join(t.TempDir(), "boot")
+	err := filepath.Walk("testdata/boot", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("testdata/boot", path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(bootDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dest, 0755)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, content, 0644)
+	})
+	require.NoError(t, err)
+	return NewBackend(&bootloader.Options{BootDir: bootDir}).(*Backend)
+}
+
+func readEntry(t *testing.T, b *Backend, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join(b.getEntriesDir(), name))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func readTestEntry(t *testing.T, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join("testdata/boot/loader/entries", name))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestBackendDetect(t *testing.T) {
+	b := newTestBackend(t)
+	assert.True(t, b.Detect())
+
+	err := os.Remove(b.getLoaderConfFile())
+	require.NoError(t, err)
+	assert.False(t, b.Detect())
+
+	b = NewBackend(&bootloader.Options{BootDir: "testdata/not-exist"}).(*Backend)
+	assert.False(t, b.Detect())
+}
+
+func TestBackendAddRecoveryEntry(t *testing.T) {
+	b := newTestBackend(t)
+	err := os.Remove(filepath.Join(b.getEntriesDir(), RecoveryEntryFile))
+	require.NoError(t, err)
+
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: testBackupUuid, Device: "/dev/nvme0n1p4"},
+		Linux:   filepath.Join(b.opts.BootDir, "deepin-ab-recovery/vmlinuz-5.15.77-amd64-desktop"),
+		Initrd:  filepath.Join(b.opts.BootDir, "deepin-ab-recovery/initrd.img-5.15.77-amd64-desktop"),
+		Title:   "回滚到 UnionTech OS Desktop 20 Pro",
+		TitleEn: "Roll back to UnionTech OS Desktop 20 Pro (Wed 01 Jun 2022 10:20:30 AM CST)",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	// 使用 loader.conf 中 default 指定的启动项的内核参数
+	assert.Equal(t, readTestEntry(t, RecoveryEntryFile), readEntry(t, b, RecoveryEntryFile))
+
+	// 其他启动项没有被修改
+	for _, name := range []string{"uos-5.10.101-amd64-desktop.conf", "uos-5.15.77-amd64-desktop.conf",
+		"debian.conf", "windows.conf"} {
+		assert.Equal(t, readTestEntry(t, name), readEntry(t, b, name), name)
+	}
+}
+
+func TestBackendAddRecoveryEntryNoDefault(t *testing.T) {
+	b := newTestBackend(t)
+	err := ioutil.WriteFile(b.getLoaderConfFile(), []byte("timeout 3\n"), 0644)
+	require.NoError(t, err)
+
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: testBackupUuid},
+		Linux:   filepath.Join(b.opts.BootDir, "deepin-ab-recovery/vmlinuz"),
+		TitleEn: "Roll back",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	// 第一个 linux 启动项是 debian.conf
+	assert.Equal(t, "title Roll back\nlinux /deepin-ab-recovery/vmlinuz\n"+
+		"options root=UUID="+testBackupUuid+" ro quiet\n", readEntry(t, b, RecoveryEntryFile))
+}
+
+func TestBackendAddRecoveryEntryLuks(t *testing.T) {
+	b := newTestBackend(t)
+	err := ioutil.WriteFile(b.getLoaderConfFile(), []byte("timeout 3\n"), 0644)
+	require.NoError(t, err)
+
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: testBackupUuid, Luks: "def"},
+		Linux:   filepath.Join(b.opts.BootDir, "deepin-ab-recovery/vmlinuz"),
+		TitleEn: "Roll back",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	assert.Equal(t, "title Roll back\nlinux /deepin-ab-recovery/vmlinuz\n"+
+		"options root=UUID="+testBackupUuid+" ro quiet rd.luks.uuid=def cryptdevice=UUID=def:luks-def "+
+		"cryptopts=target=luks-def,source=UUID=def,luks\n", readEntry(t, b, RecoveryEntryFile))
+
+	b = newTestBackend(t)
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{Root: bootloader.Partition{Uuid: testBackupUuid, Lv: true}})
+	assert.Equal(t, bootloader.ErrLvUnsupported, err)
+}
+
+func TestBackendRemoveRecoveryEntries(t *testing.T) {
+	b := newTestBackend(t)
+	err := b.RemoveRecoveryEntries(bootloader.Partition{Uuid: testBackupUuid})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(b.getEntriesDir(), RecoveryEntryFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// 回滚启动项已经不存在
+	err = b.RemoveRecoveryEntries(bootloader.Partition{Uuid: testBackupUuid})
+	require.NoError(t, err)
+	assert.NoError(t, b.Commit())
+}
+
+func TestBackendSwitchRoot(t *testing.T) {
+	b := newTestBackend(t)
+	err := b.SwitchRoot(bootloader.Partition{Uuid: testBackupUuid},
+		bootloader.Partition{Uuid: testCurrentUuid, Device: "/dev/nvme0n1p3"})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(b.getEntriesDir(), RecoveryEntryFile))
+	assert.True(t, os.IsNotExist(err))
+	for _, name := range []string{"uos-5.10.101-amd64-desktop.conf", "uos-5.15.77-amd64-desktop.conf"} {
+		want := strings.Replace(readTestEntry(t, name), testCurrentUuid, testBackupUuid, 1)
+		assert.Equal(t, want, readEntry(t, b, name), name)
+	}
+	// 其他系统的启动项没有被修改
+	for _, name := range []string{"debian.conf", "windows.conf"} {
+		assert.Equal(t, readTestEntry(t, name), readEntry(t, b, name), name)
+	}
+
+	b = newTestBackend(t)
+	err = b.SwitchRoot(bootloader.Partition{Uuid: testBackupUuid}, bootloader.Partition{Uuid: "not-exist"})
+	assert.Error(t, err)
+}
+
+func TestBackendBootRecoveryOnce(t *testing.T) {
+	b := newTestBackend(t)
+	b.vars.Dir = filepath.Join(t.TempDir(), "efivars")
+	// 不是使用 UEFI 启动的
+	assert.Error(t, b.BootRecoveryOnce(bootloader.Partition{Uuid: testBackupUuid}))
+	ok, err := b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	err = os.Mkdir(b.vars.Dir, 0755)
+	require.NoError(t, err)
+	err = b.BootRecoveryOnce(bootloader.Partition{Uuid: testBackupUuid})
+	require.NoError(t, err)
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	content, err := ioutil.ReadFile(filepath.Join(b.vars.Dir, "LoaderEntryOneShot-4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{7, 0, 0, 0, 'd', 0, 'e', 0, 'e', 0}, content[:10])
+
+	err = b.CancelBootRecoveryOnce()
+	require.NoError(t, err)
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// 没有回滚启动项
+	require.NoError(t, b.RemoveRecoveryEntries(bootloader.Partition{Uuid: testBackupUuid}))
+	require.NoError(t, b.Commit())
+	assert.Error(t, b.BootRecoveryOnce(bootloader.Partition{Uuid: testBackupUuid}))
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blscfg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	bootloader ".."
+	"../../atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// Entry 是 Boot Loader Specification 的 Type #1 启动项，比如 loader/entries/xxx.conf。
+// 每行是用空白分隔的键和值，# 开始的行是注释。没有修改的行保持原样。
+type Entry struct {
+	lines []string
+}
+
+func splitLine(line string) (key, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	idx := strings.IndexAny(line, " \t")
+	if idx < 0 {
+		return line, ""
+	}
+	return line[:idx], strings.TrimSpace(line[idx:])
+}
+
+// Get 返回第一个 key 的值，没有时返回空字符串。
+func (e *Entry) Get(key string) string {
+	for _, line := range e.lines {
+		k, v := splitLine(line)
+		if k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// Options 返回全部 options 的值，多个 options 的值用空格连接。
+func (e *Entry) Options() string {
+	var result []string
+	for _, line := range e.lines {
+		k, v := splitLine(line)
+		if k == "options" && v != "" {
+			result = append(result, v)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// Set 修改第一个 key 的值，没有时在末尾添加。
+func (e *Entry) Set(key, value string) {
+	for i, line := range e.lines {
+		k, _ := splitLine(line)
+		if k == key {
+			e.lines[i] = key + " " + value
+			return
+		}
+	}
+	e.lines = append(e.lines, key+" "+value)
+}
+
+// ReplaceRootUuid 把 options 中的 root=UUID=oldUuid 替换为 newUuid，返回是否替换了。
+func (e *Entry) ReplaceRootUuid(oldUuid, newUuid string) bool {
+	done := false
+	for i, line := range e.lines {
+		k, _ := splitLine(line)
+		if k != "options" {
+			continue
+		}
+		newLine := bootloader.RegRootUUID.ReplaceAllStringFunc(line, func(s string) string {
+			if s != "root=UUID="+oldUuid {
+				return s
+			}
+			done = true
+			return "root=UUID=" + newUuid
+		})
+		e.lines[i] = newLine
+	}
+	return done
+}
+
+func (e *Entry) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range e.lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (e *Entry) Save(filename string) error {
+	return atomicfile.WriteFile(filename, e.Bytes(), 0644)
+}
+
+func Parse(content []byte) *Entry {
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return &Entry{}
+	}
+	return &Entry{lines: strings.Split(text, "\n")}
+}
+
+func ParseEntryFile(filename string) (*Entry, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read file: %w", err)
+	}
+	return Parse(content), nil
+}
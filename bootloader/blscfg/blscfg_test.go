@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package blscfg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry(t *testing.T) {
+	content := "# comment\ntitle  Deepin 20\nlinux\t/vmlinuz\noptions root=UUID=abc ro\noptions quiet\n"
+	e := Parse([]byte(content))
+	assert.Equal(t, content, string(e.Bytes()))
+	assert.Equal(t, "Deepin 20", e.Get("title"))
+	assert.Equal(t, "/vmlinuz", e.Get("linux"))
+	assert.Equal(t, "", e.Get("initrd"))
+	assert.Equal(t, "root=UUID=abc ro quiet", e.Options())
+
+	// 只替换指定的 uuid
+	assert.False(t, e.ReplaceRootUuid("def", "123"))
+	assert.True(t, e.ReplaceRootUuid("abc", "def"))
+	e.Set("initrd", "/initrd.img")
+	e.Set("title", "Deepin")
+	assert.Equal(t, "# comment\ntitle Deepin\nlinux\t/vmlinuz\noptions root=UUID=def ro\noptions quiet\n"+
+		"initrd /initrd.img\n", string(e.Bytes()))
+
+	e = Parse(nil)
+	assert.Equal(t, "", string(e.Bytes()))
+	assert.Equal(t, "", e.Options())
+}
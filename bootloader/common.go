@@ -4,6 +4,57 @@
 
 package bootloader
 
-import "regexp"
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
 
 var RegRootUUID = regexp.MustCompile(`root=UUID=[0-9a-fA-F\-]+`)
+
+var (
+	ErrSubvolUnsupported = errors.New("btrfs subvolume root is not supported")
+	ErrLvUnsupported     = errors.New("logical volume root is not supported")
+	ErrLuksUnsupported   = errors.New("LUKS encrypted root is not supported")
+)
+
+// CheckUuidRoot 检查 p 能否用 root=UUID= 指定，不支持 btrfs 子卷和 LVM 逻辑卷的后端在 AddRecoveryEntry 中调用。
+func CheckUuidRoot(p Partition) error {
+	if p.Subvol != "" {
+		return ErrSubvolUnsupported
+	}
+	if p.Lv {
+		return ErrLvUnsupported
+	}
+	return nil
+}
+
+// CheckPlainPartition 在 CheckUuidRoot 的基础上还要求 p 没有加密，用于不能修改其他内核参数的后端。
+func CheckPlainPartition(p Partition) error {
+	err := CheckUuidRoot(p)
+	if err != nil {
+		return err
+	}
+	if p.Luks != "" {
+		return ErrLuksUnsupported
+	}
+	return nil
+}
+
+// 解锁 LUKS 容器的内核参数，见 Partition.LuksArgs
+var regLuksArg = regexp.MustCompile(`^(rd\.luks\.uuid|rd\.luks\.name|cryptdevice|cryptopts)=`)
+
+// ReplaceLuksArgs 删除内核参数 args 中原有的解锁 LUKS 容器的参数，再加上解锁 p 的参数，p 没有加密时返回 args。
+func ReplaceLuksArgs(args string, p Partition) string {
+	if p.Luks == "" {
+		return args
+	}
+	var result []string
+	for _, field := range strings.Fields(args) {
+		if regLuksArg.MatchString(field) {
+			continue
+		}
+		result = append(result, field)
+	}
+	return strings.Join(append(result, p.LuksArgs()...), " ")
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package efiboot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEspGuid = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+
+var testHardDrive = &HardDrive{
+	PartitionNumber: 1,
+	PartitionStart:  2048,
+	PartitionSize:   1048576,
+	PartitionGuid:   testEspGuid,
+}
+
+func TestEncodeGuid(t *testing.T) {
+	guid, err := encodeGuid(testEspGuid)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11,
+		0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}, guid)
+
+	for _, s := range []string{"", "c12a7328-f81f-11d2-ba4b", "x12a7328-f81f-11d2-ba4b-00a0c93ec93b"} {
+		_, err = encodeGuid(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestLoadOption(t *testing.T) {
+	filePath, err := FileDevicePath(testHardDrive, "/EFI/deepin-ab-recovery/vmlinuz")
+	require.NoError(t, err)
+	assert.Len(t, filePath, 42+4+2*len(`\EFI\deepin-ab-recovery\vmlinuz`)+2+4)
+	assert.Equal(t, `\EFI\deepin-ab-recovery\vmlinuz`, FilePathOf(filePath))
+
+	opt := &LoadOption{
+		Attributes:   LoadOptionActive,
+		Description:  "Deepin Rollback",
+		FilePath:     filePath,
+		OptionalData: EncodeArgs("root=UUID=abc quiet"),
+	}
+	data := opt.Marshal()
+	assert.Equal(t, []byte{1, 0, 0, 0, byte(len(filePath)), 0, 'D', 0, 'e', 0}, data[:10])
+
+	opt2, err := ParseLoadOption(data)
+	require.NoError(t, err)
+	assert.Equal(t, opt, opt2)
+	args, err := DecodeArgs(opt2.OptionalData)
+	require.NoError(t, err)
+	assert.Equal(t, "root=UUID=abc quiet", args)
+
+	for _, data := range [][]byte{nil, {1, 0, 0, 0, 4, 0, 'a', 0}, {1, 0, 0, 0, 4, 0, 0, 0, 1}} {
+		_, err = ParseLoadOption(data)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, "", FilePathOf([]byte{0x7f, 0xff, 4, 0}))
+}
+
+// 创建假的 efivarfs 文件夹，其中有 Boot0000 和 Boot0001，启动顺序为 1, 0
+func newTestVars(t *testing.T) *Vars {
+	vars := &Vars{Dir: t.TempDir()}
+	for i, desc := range []string{"Windows Boot Manager", "UOS"} {
+		filePath, err := FileDevicePath(testHardDrive, "/EFI/boot.efi")
+		require.NoError(t, err)
+		opt := &LoadOption{Attributes: LoadOptionActive, Description: desc, FilePath: filePath}
+		err = vars.Set(bootVarName(uint16(i)), bootVarAttrs, opt.Marshal())
+		require.NoError(t, err)
+	}
+	err := vars.SetBootOrder([]uint16{1, 0})
+	require.NoError(t, err)
+	// 无法解析的变量和其他 GUID 的变量被忽略
+	err = ioutil.WriteFile(filepath.Join(vars.Dir, "Boot0003-"+GlobalGuid), []byte{7, 0, 0, 0, 1}, 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(vars.Dir, "Boot0002-605dab50-e046-4300-abb6-3dd810dd8b23"), nil, 0644)
+	require.NoError(t, err)
+	return vars
+}
+
+func TestVars(t *testing.T) {
+	vars := newTestVars(t)
+	assert.True(t, vars.Available())
+	assert.False(t, (&Vars{Dir: filepath.Join(vars.Dir, "not-exist")}).Available())
+
+	attrs, data, err := vars.Get("BootOrder")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(bootVarAttrs), attrs)
+	assert.Equal(t, []byte{1, 0, 0, 0}, data)
+
+	// 普通文件写入更短的值时被截断
+	err = vars.SetBootOrder([]uint16{1})
+	require.NoError(t, err)
+	order, err := vars.BootOrder()
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{1}, order)
+
+	err = vars.Delete("BootOrder")
+	require.NoError(t, err)
+	order, err = vars.BootOrder()
+	require.NoError(t, err)
+	assert.Empty(t, order)
+	assert.NoError(t, vars.Delete("BootOrder"))
+
+	nums, err := vars.BootEntries()
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{0, 1, 3}, nums)
+
+	// 其他 GUID 的变量
+	loaderVars := &Vars{Dir: vars.Dir, Guid: LoaderGuid}
+	err = loaderVars.Set("LoaderEntryOneShot", bootVarAttrs, EncodeArgs("a.conf"))
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(vars.Dir, "LoaderEntryOneShot-"+LoaderGuid))
+	_, _, err = vars.Get("LoaderEntryOneShot")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSetBootEntry(t *testing.T) {
+	vars := newTestVars(t)
+	filePath, err := FileDevicePath(testHardDrive, "/EFI/deepin-ab-recovery/vmlinuz")
+	require.NoError(t, err)
+	opt := &LoadOption{
+		Attributes:   LoadOptionActive,
+		Description:  "Deepin Rollback",
+		FilePath:     filePath,
+		OptionalData: EncodeArgs("root=UUID=abc"),
+	}
+
+	// 使用最小的空闲编号，加到启动顺序的末尾
+	num, err := vars.SetBootEntry(opt)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(2), num)
+	order, err := vars.BootOrder()
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{1, 0, 2}, order)
+	_, err = os.Stat(filepath.Join(vars.Dir, "Boot0002-"+GlobalGuid))
+	require.NoError(t, err)
+
+	// 再次设置时更新同一个启动项
+	opt.OptionalData = EncodeArgs("root=UUID=def")
+	num, err = vars.SetBootEntry(opt)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(2), num)
+	order, err = vars.BootOrder()
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{1, 0, 2}, order)
+	opt2, err := vars.GetBootEntry(2)
+	require.NoError(t, err)
+	assert.Equal(t, opt, opt2)
+
+	num, ok, err := vars.FindBootEntry("Deepin Rollback")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(2), num)
+
+	removed, err := vars.RemoveBootEntry("Deepin Rollback")
+	require.NoError(t, err)
+	assert.True(t, removed)
+	order, err = vars.BootOrder()
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{1, 0}, order)
+	_, err = os.Stat(filepath.Join(vars.Dir, "Boot0002-"+GlobalGuid))
+	assert.True(t, os.IsNotExist(err))
+
+	removed, err = vars.RemoveBootEntry("Deepin Rollback")
+	require.NoError(t, err)
+	assert.False(t, removed)
+}
+
+func TestReadHardDrive(t *testing.T) {
+	dir := t.TempDir()
+	// 模拟 sysfs：class/block/nvme0n1p1 链接到 nvme0n1/nvme0n1p1
+	files := map[string]string{
+		"nvme0n1/queue/logical_block_size": "4096\n",
+		"nvme0n1/nvme0n1p1/partition":      "1\n",
+		"nvme0n1/nvme0n1p1/start":          "2048\n",
+		"nvme0n1/nvme0n1p1/size":           "1048576\n",
+		"nvme0n1/nvme0n1p2/start":          "1050624\n",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	}
+	classDir := filepath.Join(dir, "class/block")
+	require.NoError(t, os.MkdirAll(classDir, 0755))
+	for _, name := range []string{"nvme0n1", "nvme0n1p1", "nvme0n1p2"} {
+		target := filepath.Join("../..", "nvme0n1")
+		if name != "nvme0n1" {
+			target = filepath.Join(target, name)
+		}
+		require.NoError(t, os.Symlink(target, filepath.Join(classDir, name)))
+	}
+
+	hd, err := ReadHardDrive(classDir, "/dev/nvme0n1p1", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	require.NoError(t, err)
+	assert.Equal(t, &HardDrive{
+		PartitionNumber: 1,
+		PartitionStart:  256,
+		PartitionSize:   131072,
+		PartitionGuid:   testEspGuid,
+	}, hd)
+
+	_, err = ReadHardDrive(classDir, "/dev/nvme0n1", testEspGuid)
+	assert.Error(t, err)
+	_, err = ReadHardDrive(classDir, "/dev/nvme0n1p2", testEspGuid)
+	assert.Error(t, err)
+	_, err = ReadHardDrive(classDir, "/dev/sda1", testEspGuid)
+	assert.Error(t, err)
+}
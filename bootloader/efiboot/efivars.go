@@ -0,0 +1,313 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package efiboot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// efivarfs 的默认挂载点
+const EfivarsDir = "/sys/firmware/efi/efivars"
+
+// EFI_GLOBAL_VARIABLE，BootOrder 和 Boot#### 变量使用这个 GUID
+const GlobalGuid = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// systemd-boot 的 LoaderEntryOneShot 等变量使用这个 GUID
+const LoaderGuid = "4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+
+// 变量的属性
+const (
+	AttrNonVolatile       = 0x00000001
+	AttrBootServiceAccess = 0x00000002
+	AttrRuntimeAccess     = 0x00000004
+
+	bootVarAttrs = AttrNonVolatile | AttrBootServiceAccess | AttrRuntimeAccess
+)
+
+const (
+	efivarfsMagic = 0xde5e81e4
+
+	fsIocGetFlags = 0x80086601
+	fsIocSetFlags = 0x40086602
+	fsImmutableFl = 0x00000010
+)
+
+var regBootVar = regexp.MustCompile(`^Boot([0-9A-F]{4})-` + GlobalGuid + `$`)
+
+// Vars 读写 efivarfs 中的变量，Dir 一般是 EfivarsDir，测试时可以是普通的文件夹。
+// Guid 是变量的 GUID，为空时使用 GlobalGuid，启动项相关的方法只用于 GlobalGuid。
+type Vars struct {
+	Dir  string
+	Guid string
+}
+
+func (v *Vars) varPath(name string) string {
+	guid := v.Guid
+	if guid == "" {
+		guid = GlobalGuid
+	}
+	return filepath.Join(v.Dir, name+"-"+guid)
+}
+
+// Available 检查 efivarfs 是否存在，不存在时说明不是使用 UEFI 启动的。
+func (v *Vars) Available() bool {
+	fi, err := os.Stat(v.Dir)
+	return err == nil && fi.IsDir()
+}
+
+// Get 返回变量的属性和值
+func (v *Vars) Get(name string) (attrs uint32, data []byte, err error) {
+	content, err := ioutil.ReadFile(v.varPath(name))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(content) < 4 {
+		return 0, nil, xerrors.Errorf("variable %s is too short", name)
+	}
+	return binary.LittleEndian.Uint32(content), content[4:], nil
+}
+
+// 清除 efivarfs 中的文件默认带有的不可修改标志，普通文件系统不支持时忽略。
+func clearImmutable(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		if errno == syscall.ENOTTY || errno == syscall.EOPNOTSUPP || errno == syscall.EINVAL {
+			return nil
+		}
+		return errno
+	}
+	if flags&fsImmutableFl == 0 {
+		return nil
+	}
+	flags &^= fsImmutableFl
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func isEfivarfs(dir string) bool {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	return err == nil && uint32(st.Type) == efivarfsMagic
+}
+
+// Set 写入变量。efivarfs 要求属性和值在一次 write 中写入。
+func (v *Vars) Set(name string, attrs uint32, data []byte) error {
+	filename := v.varPath(name)
+	err := clearImmutable(filename)
+	if err != nil {
+		return xerrors.Errorf("failed to clear immutable flag of %s: %w", name, err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if !isEfivarfs(v.Dir) {
+		// efivarfs 写入后文件的大小就是新的值的大小，普通文件需要截断
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, attrs)
+	copy(buf[4:], data)
+	_, err = f.Write(buf)
+	if err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("failed to write variable %s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// Delete 删除变量，变量不存在时不算错误。
+func (v *Vars) Delete(name string) error {
+	filename := v.varPath(name)
+	err := clearImmutable(filename)
+	if err != nil {
+		return xerrors.Errorf("failed to clear immutable flag of %s: %w", name, err)
+	}
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func bootVarName(num uint16) string {
+	return fmt.Sprintf("Boot%04X", num)
+}
+
+// BootOrder 返回启动顺序，变量不存在时返回空。
+func (v *Vars) BootOrder() ([]uint16, error) {
+	_, data, err := v.Get("BootOrder")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	order := make([]uint16, len(data)/2)
+	for i := range order {
+		order[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return order, nil
+}
+
+func (v *Vars) SetBootOrder(order []uint16) error {
+	data := make([]byte, 2*len(order))
+	for i, num := range order {
+		binary.LittleEndian.PutUint16(data[2*i:], num)
+	}
+	return v.Set("BootOrder", bootVarAttrs, data)
+}
+
+// BootEntries 按编号的顺序返回全部 Boot#### 变量的编号
+func (v *Vars) BootEntries() ([]uint16, error) {
+	fileInfos, err := ioutil.ReadDir(v.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []uint16
+	for _, fi := range fileInfos {
+		match := regBootVar.FindStringSubmatch(fi.Name())
+		if match == nil {
+			continue
+		}
+		num, err := strconv.ParseUint(match[1], 16, 16)
+		if err != nil {
+			continue
+		}
+		result = append(result, uint16(num))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result, nil
+}
+
+func (v *Vars) GetBootEntry(num uint16) (*LoadOption, error) {
+	_, data, err := v.Get(bootVarName(num))
+	if err != nil {
+		return nil, err
+	}
+	return ParseLoadOption(data)
+}
+
+// FindBootEntry 查找描述为 description 的启动项，返回它的编号，没有找到时 ok 为 false。
+func (v *Vars) FindBootEntry(description string) (num uint16, ok bool, err error) {
+	nums, err := v.BootEntries()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, num := range nums {
+		opt, err := v.GetBootEntry(num)
+		if err != nil {
+			// 无法解析的启动项不是我们添加的
+			continue
+		}
+		if opt.Description == description {
+			return num, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// SetBootEntry 添加或者更新描述为 opt.Description 的启动项，新的启动项使用最小的空闲编号，
+// 并被加到启动顺序的末尾，不会成为默认启动项。
+func (v *Vars) SetBootEntry(opt *LoadOption) (uint16, error) {
+	num, ok, err := v.FindBootEntry(opt.Description)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		nums, err := v.BootEntries()
+		if err != nil {
+			return 0, err
+		}
+		used := make(map[uint16]bool, len(nums))
+		for _, n := range nums {
+			used[n] = true
+		}
+		for used[num] {
+			if num == 0xffff {
+				return 0, xerrors.New("no free boot entry number")
+			}
+			num++
+		}
+	}
+
+	err = v.Set(bootVarName(num), bootVarAttrs, opt.Marshal())
+	if err != nil {
+		return 0, err
+	}
+
+	order, err := v.BootOrder()
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range order {
+		if n == num {
+			return num, nil
+		}
+	}
+	err = v.SetBootOrder(append(order, num))
+	if err != nil {
+		return 0, xerrors.Errorf("failed to set boot order: %w", err)
+	}
+	return num, nil
+}
+
+// RemoveBootEntry 删除描述为 description 的启动项，并把它从启动顺序中移除，没有找到时返回 false。
+func (v *Vars) RemoveBootEntry(description string) (bool, error) {
+	num, ok, err := v.FindBootEntry(description)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	order, err := v.BootOrder()
+	if err != nil {
+		return false, err
+	}
+	newOrder := make([]uint16, 0, len(order))
+	for _, n := range order {
+		if n != num {
+			newOrder = append(newOrder, n)
+		}
+	}
+	if len(newOrder) != len(order) {
+		err = v.SetBootOrder(newOrder)
+		if err != nil {
+			return false, xerrors.Errorf("failed to set boot order: %w", err)
+		}
+	}
+	err = v.Delete(bootVarName(num))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package efiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+)
+
+// EFI_LOAD_OPTION 的属性
+const LoadOptionActive = 0x00000001
+
+// 设备路径节点的类型
+const (
+	devicePathTypeMedia = 0x04
+	devicePathTypeEnd   = 0x7f
+
+	devicePathSubTypeHardDrive = 0x01
+	devicePathSubTypeFilePath  = 0x04
+	devicePathSubTypeEndEntire = 0xff
+)
+
+// LoadOption 是 Boot#### 变量的内容，即 UEFI 规范中的 EFI_LOAD_OPTION。
+type LoadOption struct {
+	Attributes   uint32
+	Description  string
+	FilePath     []byte // 设备路径，以 End Entire 节点结束
+	OptionalData []byte // 传给被启动程序的参数
+}
+
+// 编码为以 0 结束的 UCS-2 字符串
+func encodeUcs2(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(codes)+2)
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(buf[2*i:], c)
+	}
+	return buf
+}
+
+// 解码以 0 结束的 UCS-2 字符串，返回字符串和它占用的字节数，包括结尾的 0。
+func decodeUcs2(data []byte) (string, int, error) {
+	var codes []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			return string(utf16.Decode(codes)), i + 2, nil
+		}
+		codes = append(codes, c)
+	}
+	return "", 0, xerrors.New("unterminated UCS-2 string")
+}
+
+// EncodeArgs 把内核参数等字符串编码为 OptionalData，EFI stub 内核和 systemd-stub 按 UCS-2 读取它。
+func EncodeArgs(args string) []byte {
+	return encodeUcs2(args)
+}
+
+// DecodeArgs 是 EncodeArgs 的逆操作
+func DecodeArgs(data []byte) (string, error) {
+	s, _, err := decodeUcs2(data)
+	return s, err
+}
+
+func (o *LoadOption) Marshal() []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, o.Attributes)
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(len(o.FilePath)))
+	buf.Write(encodeUcs2(o.Description))
+	buf.Write(o.FilePath)
+	buf.Write(o.OptionalData)
+	return buf.Bytes()
+}
+
+func ParseLoadOption(data []byte) (*LoadOption, error) {
+	if len(data) < 6 {
+		return nil, xerrors.New("load option is too short")
+	}
+	o := &LoadOption{
+		Attributes: binary.LittleEndian.Uint32(data),
+	}
+	filePathLen := int(binary.LittleEndian.Uint16(data[4:]))
+	desc, n, err := decodeUcs2(data[6:])
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse description: %w", err)
+	}
+	o.Description = desc
+	data = data[6+n:]
+	if len(data) < filePathLen {
+		return nil, xerrors.New("file path list is too short")
+	}
+	o.FilePath = data[:filePathLen]
+	o.OptionalData = data[filePathLen:]
+	return o, nil
+}
+
+// HardDrive 描述 GPT 硬盘中的分区，位置和大小以硬盘的逻辑块为单位
+type HardDrive struct {
+	PartitionNumber uint32
+	PartitionStart  uint64
+	PartitionSize   uint64
+	PartitionGuid   string // 比如 c12a7328-f81f-11d2-ba4b-00a0c93ec93b
+}
+
+// 把 GUID 编码为 EFI_GUID，前三段是小端序
+func encodeGuid(guid string) ([]byte, error) {
+	parts := strings.Split(guid, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 ||
+		len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return nil, xerrors.Errorf("invalid guid %q", guid)
+	}
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return nil, xerrors.Errorf("invalid guid %q: %w", guid, err)
+	}
+	result := make([]byte, 16)
+	binary.LittleEndian.PutUint32(result[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(result[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(result[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(result[8:], raw[8:])
+	return result, nil
+}
+
+func writeNodeHeader(buf *bytes.Buffer, typ, subType byte, length int) {
+	buf.WriteByte(typ)
+	buf.WriteByte(subType)
+	_ = binary.Write(buf, binary.LittleEndian, uint16(length))
+}
+
+// FileDevicePath 返回 hd 分区中的文件 path 的设备路径，path 使用 / 或 \ 分隔，比如 /EFI/deepin/grubx64.efi。
+func FileDevicePath(hd *HardDrive, path string) ([]byte, error) {
+	guid, err := encodeGuid(hd.PartitionGuid)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	const hardDriveNodeLen = 42
+	writeNodeHeader(&buf, devicePathTypeMedia, devicePathSubTypeHardDrive, hardDriveNodeLen)
+	_ = binary.Write(&buf, binary.LittleEndian, hd.PartitionNumber)
+	_ = binary.Write(&buf, binary.LittleEndian, hd.PartitionStart)
+	_ = binary.Write(&buf, binary.LittleEndian, hd.PartitionSize)
+	buf.Write(guid)
+	const (
+		partitionFormatGpt = 0x02
+		signatureTypeGuid  = 0x02
+	)
+	buf.WriteByte(partitionFormatGpt)
+	buf.WriteByte(signatureTypeGuid)
+
+	path = strings.Replace(path, "/", `\`, -1)
+	if !strings.HasPrefix(path, `\`) {
+		path = `\` + path
+	}
+	name := encodeUcs2(path)
+	writeNodeHeader(&buf, devicePathTypeMedia, devicePathSubTypeFilePath, 4+len(name))
+	buf.Write(name)
+
+	writeNodeHeader(&buf, devicePathTypeEnd, devicePathSubTypeEndEntire, 4)
+	return buf.Bytes(), nil
+}
+
+// FilePathOf 返回设备路径中第一个文件路径节点的路径，没有时返回空字符串。
+func FilePathOf(devicePath []byte) string {
+	for len(devicePath) >= 4 {
+		typ, subType := devicePath[0], devicePath[1]
+		length := int(binary.LittleEndian.Uint16(devicePath[2:]))
+		if length < 4 || length > len(devicePath) || typ == devicePathTypeEnd {
+			return ""
+		}
+		if typ == devicePathTypeMedia && subType == devicePathSubTypeFilePath {
+			path, _, err := decodeUcs2(devicePath[4:length])
+			if err != nil {
+				return ""
+			}
+			return path
+		}
+		devicePath = devicePath[length:]
+	}
+	return ""
+}
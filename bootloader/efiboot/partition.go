@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package efiboot
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// sysfs 中全部块设备的链接所在的文件夹
+const SysClassBlockDir = "/sys/class/block"
+
+func readSysfsUint(filename string) (uint64, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// ReadHardDrive 从 sysfs 读取分区 device（比如 /dev/nvme0n1p1）的编号、位置和大小，partGuid 是分区的 PARTUUID。
+// sysfs 中的位置和大小以 512 字节为单位，需要转换为硬盘的逻辑块。
+func ReadHardDrive(sysClassBlockDir, device, partGuid string) (*HardDrive, error) {
+	partDir, err := filepath.EvalSymlinks(filepath.Join(sysClassBlockDir, filepath.Base(device)))
+	if err != nil {
+		return nil, err
+	}
+	number, err := readSysfsUint(filepath.Join(partDir, "partition"))
+	if err != nil {
+		return nil, xerrors.Errorf("%s is not a partition: %w", device, err)
+	}
+	start, err := readSysfsUint(filepath.Join(partDir, "start"))
+	if err != nil {
+		return nil, err
+	}
+	size, err := readSysfsUint(filepath.Join(partDir, "size"))
+	if err != nil {
+		return nil, err
+	}
+	blockSize, err := readSysfsUint(filepath.Join(partDir, "../queue/logical_block_size"))
+	if err != nil {
+		return nil, err
+	}
+	if blockSize < 512 || blockSize%512 != 0 {
+		return nil, xerrors.Errorf("invalid logical block size %d", blockSize)
+	}
+	sectors := blockSize / 512
+	return &HardDrive{
+		PartitionNumber: uint32(number),
+		PartitionStart:  start / sectors,
+		PartitionSize:   size / sectors,
+		PartitionGuid:   strings.ToLower(partGuid),
+	}, nil
+}
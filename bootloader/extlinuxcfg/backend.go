@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package extlinuxcfg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	bootloader ".."
+	"golang.org/x/xerrors"
+)
+
+// U-Boot 的 distro boot 先于 EFI 查找 extlinux.conf，所以先于 grub 检测
+const backendPriority = 16
+
+func init() {
+	bootloader.Register(backendPriority, NewBackend)
+}
+
+// Backend 修改 U-Boot 使用的 /boot/extlinux/extlinux.conf
+type Backend struct {
+	opts *bootloader.Options
+	cfg  *ExtlinuxCfg
+}
+
+func NewBackend(opts *bootloader.Options) bootloader.Backend {
+	return &Backend{opts: opts}
+}
+
+func (b *Backend) getCfgFile() string {
+	return filepath.Join(b.opts.BootDir, "extlinux/extlinux.conf")
+}
+
+func (b *Backend) Describe() string {
+	return "extlinux " + b.getCfgFile()
+}
+
+func (b *Backend) Detect() bool {
+	if _, err := os.Stat(b.getCfgFile()); err != nil {
+		return false
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return false
+	}
+	return len(cfg.Labels()) > 0
+}
+
+func (b *Backend) load() (*ExtlinuxCfg, error) {
+	if b.cfg != nil {
+		return b.cfg, nil
+	}
+	cfg, err := ParseExtlinuxCfgFile(b.getCfgFile())
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse extlinux cfg file: %w", err)
+	}
+	b.cfg = cfg
+	return cfg, nil
+}
+
+// 返回 extlinux.conf 中的路径在 BootDir 之前的部分。/boot 是单独的分区时为空，
+// 在根分区中时为 /boot，根据默认启动项的内核在 BootDir 中的位置判断。
+func (b *Backend) getPathPrefix(cfg *ExtlinuxCfg) string {
+	def := cfg.DefaultLabel()
+	if def == nil {
+		return ""
+	}
+	kernel := def.Kernel()
+	for i := 0; i < len(kernel); i++ {
+		if kernel[i] != '/' {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(b.opts.BootDir, kernel[i:])); err == nil {
+			return kernel[:i]
+		}
+	}
+	return ""
+}
+
+func (b *Backend) AddRecoveryEntry(entry *bootloader.RecoveryEntry) error {
+	err := bootloader.CheckPlainPartition(entry.Root)
+	if err != nil {
+		return err
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryLabels()
+
+	prefix := b.getPathPrefix(cfg)
+	getPath := func(filename string) string {
+		if filename == "" {
+			return ""
+		}
+		return prefix + "/" + strings.TrimPrefix(strings.TrimPrefix(filename, b.opts.BootDir), "/")
+	}
+	cfg.AddRecoveryLabel(entry.TitleEn, entry.Root.Uuid, getPath(entry.Linux), getPath(entry.Initrd))
+	return nil
+}
+
+func (b *Backend) RemoveRecoveryEntries(backup bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryLabels()
+	return nil
+}
+
+// SwitchRoot 把根分区为 previous 的启动项改为使用 root，不修改其他系统的启动项。
+func (b *Backend) SwitchRoot(root, previous bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryLabels()
+	done := false
+	for _, l := range cfg.Labels() {
+		if l.ReplaceRootUuid(previous.Uuid, root.Uuid) {
+			done = true
+		}
+	}
+	if !done {
+		return xerrors.New("not found replace target")
+	}
+	return nil
+}
+
+func (b *Backend) Commit() error {
+	if b.cfg == nil {
+		return nil
+	}
+	err := b.cfg.Save(b.getCfgFile())
+	if err != nil {
+		return xerrors.Errorf("failed to save extlinux cfg file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package extlinuxcfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bootloader ".."
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCurrentUuid = "6a3e1f2c-8b4d-4c7e-9a05-d1f2e3b4c5a6"
+
+// 创建 /boot 文件夹，其中有 testdata 中的 extlinux.conf 和 kernels 中的空文件
+func newTestBackend(t *testing.T, name string, kernels ...string) (*Backend, []byte) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	bootDir := filepath.Join(t.TempDir(), "boot")
+	err = os.MkdirAll(filepath.Join(bootDir, "extlinux"), 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(bootDir, "extlinux/extlinux.conf"), content, 0644)
+	require.NoError(t, err)
+	for _, kernel := range kernels {
+		err = ioutil.WriteFile(filepath.Join(bootDir, kernel), nil, 0644)
+		require.NoError(t, err)
+	}
+	return NewBackend(&bootloader.Options{BootDir: bootDir}).(*Backend), content
+}
+
+func readCfgFile(t *testing.T, b *Backend) string {
+	content, err := ioutil.ReadFile(b.getCfgFile())
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestBackendDetect(t *testing.T) {
+	b, _ := newTestBackend(t, "extlinux.conf")
+	assert.True(t, b.Detect())
+
+	err := ioutil.WriteFile(b.getCfgFile(), []byte("# no label\n"), 0644)
+	require.NoError(t, err)
+	b = NewBackend(b.opts).(*Backend)
+	assert.False(t, b.Detect())
+
+	b = NewBackend(&bootloader.Options{BootDir: "testdata/not-exist"}).(*Backend)
+	assert.False(t, b.Detect())
+}
+
+func TestBackendAddRecoveryEntry(t *testing.T) {
+	// /boot 在根分区中，extlinux.conf 中的路径以 /boot 开始
+	b, content := newTestBackend(t, "extlinux.conf", "vmlinuz-5.10.0-arm64-desktop")
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: "abc"},
+		Linux:   filepath.Join(b.opts.BootDir, "deepin-ab-recovery/vmlinuz-5.10.0-arm64-desktop"),
+		Initrd:  filepath.Join(b.opts.BootDir, "deepin-ab-recovery/initrd.img-5.10.0-arm64-desktop"),
+		Title:   "回滚",
+		TitleEn: "Roll back",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	assert.Equal(t, string(content)+`
+LABEL deepin-ab-recovery
+	MENU LABEL Roll back
+	LINUX /boot/deepin-ab-recovery/vmlinuz-5.10.0-arm64-desktop
+	INITRD /boot/deepin-ab-recovery/initrd.img-5.10.0-arm64-desktop
+	FDTDIR /usr/lib/linux-image-5.10.0-arm64-desktop/
+	APPEND root=UUID=abc rootwait console=ttyS2,1500000 quiet splash
+`, readCfgFile(t, b))
+
+	// /boot 是单独的分区
+	b, content = newTestBackend(t, "extlinux-recovery.conf", "Image")
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75"},
+		Linux:   filepath.Join(b.opts.BootDir, "deepin-ab-recovery/Image"),
+		TitleEn: "Roll back to Deepin",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	assert.Equal(t, strings.Replace(string(content), "LABEL deepin-ab-recovery", "\nLABEL deepin-ab-recovery", 1),
+		readCfgFile(t, b))
+}
+
+func TestBackendSwitchRoot(t *testing.T) {
+	b, content := newTestBackend(t, "extlinux.conf")
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:  bootloader.Partition{Uuid: "def"},
+		Linux: filepath.Join(b.opts.BootDir, "deepin-ab-recovery/vmlinuz"),
+	})
+	require.NoError(t, err)
+	err = b.SwitchRoot(bootloader.Partition{Uuid: "def"}, bootloader.Partition{Uuid: testCurrentUuid})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	// 回滚启动项被移除，其他系统的启动项没有被修改
+	assert.Equal(t, strings.Replace(string(content), testCurrentUuid, "def", -1), readCfgFile(t, b))
+
+	b, _ = newTestBackend(t, "extlinux.conf")
+	err = b.SwitchRoot(bootloader.Partition{Uuid: "def"}, bootloader.Partition{Uuid: "not-exist"})
+	assert.Error(t, err)
+}
+
+func TestBackendRemoveRecoveryEntries(t *testing.T) {
+	b, content := newTestBackend(t, "extlinux-recovery.conf")
+	err := b.RemoveRecoveryEntries(bootloader.Partition{Uuid: "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75"})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	idx := strings.Index(string(content), "LABEL deepin-ab-recovery")
+	assert.Equal(t, string(content[:idx]), readCfgFile(t, b))
+}
@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package extlinuxcfg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"../../atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// 回滚启动项的 LABEL
+const RecoveryLabel = "deepin-ab-recovery"
+
+// APPEND 中的 root 参数
+var regRoot = regexp.MustCompile(`(^|\s)root=\S+`)
+
+// Label 是以 LABEL 行开始的启动项，包括它后面的空行和注释，直到下一个 LABEL 之前。
+type Label struct {
+	lines []string // 每行都带有原来的换行符，最后一行可能没有
+}
+
+// ExtlinuxCfg 是 U-Boot 使用的 extlinux.conf，没有修改时 Bytes 返回与原文件完全相同的内容。
+type ExtlinuxCfg struct {
+	global []string // 第一个 LABEL 之前的全局指令
+	labels []*Label
+}
+
+// 解析一行指令，返回大写的关键字和值，MENU LABEL 等 MENU 开始的指令的关键字包含两个单词。
+// 空行和注释返回空的关键字。
+func splitDirective(line string) (keyword, value string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", ""
+	}
+	keyword = strings.ToUpper(fields[0])
+	rest := strings.TrimSpace(line)[len(fields[0]):]
+	if keyword == "MENU" && len(fields) > 1 {
+		keyword += " " + strings.ToUpper(fields[1])
+		rest = strings.TrimSpace(rest)[len(fields[1]):]
+	}
+	return keyword, strings.TrimSpace(rest)
+}
+
+func getDirective(lines []string, keywords ...string) string {
+	for _, line := range lines {
+		k, v := splitDirective(line)
+		for _, keyword := range keywords {
+			if k == keyword {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func (l *Label) Name() string {
+	_, name := splitDirective(l.lines[0])
+	return name
+}
+
+func (l *Label) MenuLabel() string {
+	return getDirective(l.lines[1:], "MENU LABEL")
+}
+
+// Kernel 返回 KERNEL 或 LINUX 指定的内核
+func (l *Label) Kernel() string {
+	return getDirective(l.lines[1:], "KERNEL", "LINUX")
+}
+
+func (l *Label) Initrd() string {
+	return getDirective(l.lines[1:], "INITRD")
+}
+
+func (l *Label) Fdt() string {
+	return getDirective(l.lines[1:], "FDT", "DEVICETREE")
+}
+
+func (l *Label) FdtDir() string {
+	return getDirective(l.lines[1:], "FDTDIR", "DEVICETREEDIR")
+}
+
+func (l *Label) Append() string {
+	return getDirective(l.lines[1:], "APPEND")
+}
+
+// 返回 LABEL 之后第一条指令的缩进
+func (l *Label) indent() string {
+	for _, line := range l.lines[1:] {
+		if k, _ := splitDirective(line); k != "" {
+			return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		}
+	}
+	return "\t"
+}
+
+// ReplaceRootUuid 把 APPEND 中的 root=UUID=oldUuid 替换为 newUuid，返回是否替换了。
+func (l *Label) ReplaceRootUuid(oldUuid, newUuid string) bool {
+	done := false
+	for i, line := range l.lines {
+		if k, _ := splitDirective(line); k != "APPEND" {
+			continue
+		}
+		old := "root=UUID=" + oldUuid
+		l.lines[i] = regRoot.ReplaceAllStringFunc(line, func(s string) string {
+			if strings.TrimSpace(s) != old {
+				return s
+			}
+			done = true
+			return strings.Replace(s, old, "root=UUID="+newUuid, 1)
+		})
+	}
+	return done
+}
+
+func (cfg *ExtlinuxCfg) Labels() []*Label {
+	return cfg.labels
+}
+
+func (cfg *ExtlinuxCfg) Default() string {
+	return getDirective(cfg.global, "DEFAULT")
+}
+
+// DefaultLabel 返回 DEFAULT 指定的启动项，没有指定时返回第一个启动项，没有启动项时返回 nil。
+func (cfg *ExtlinuxCfg) DefaultLabel() *Label {
+	name := cfg.Default()
+	for _, l := range cfg.labels {
+		if l.Name() == name {
+			return l
+		}
+	}
+	if len(cfg.labels) > 0 {
+		return cfg.labels[0]
+	}
+	return nil
+}
+
+func (cfg *ExtlinuxCfg) RemoveRecoveryLabels() {
+	labels := cfg.labels[:0:0]
+	removedLast := false
+	for _, l := range cfg.labels {
+		removedLast = l.Name() == RecoveryLabel
+		if !removedLast {
+			labels = append(labels, l)
+		}
+	}
+	cfg.labels = labels
+	if removedLast {
+		// 去掉 AddRecoveryLabel 添加的分隔空行
+		cfg.trimTrailingBlankLines()
+	}
+}
+
+func (cfg *ExtlinuxCfg) trimTrailingBlankLines() {
+	lines := &cfg.global
+	if len(cfg.labels) > 0 {
+		lines = &cfg.labels[len(cfg.labels)-1].lines
+	}
+	for len(*lines) > 1 && strings.TrimSpace((*lines)[len(*lines)-1]) == "" {
+		*lines = (*lines)[:len(*lines)-1]
+	}
+}
+
+// 返回最后一行，没有内容时返回空字符串
+func (cfg *ExtlinuxCfg) lastLine() string {
+	lines := cfg.global
+	if len(cfg.labels) > 0 {
+		lines = cfg.labels[len(cfg.labels)-1].lines
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[len(lines)-1]
+}
+
+// AddRecoveryLabel 在末尾添加回滚启动项，FDT 和 FDTDIR 复制自默认启动项，root 参数改为 rootUuid。
+func (cfg *ExtlinuxCfg) AddRecoveryLabel(menuLabel, rootUuid, kernel, initrd string) {
+	indent := "\t"
+	var fdt, fdtDir, appendArgs string
+	if def := cfg.DefaultLabel(); def != nil {
+		indent = def.indent()
+		fdt = def.Fdt()
+		fdtDir = def.FdtDir()
+		appendArgs = strings.TrimSpace(regRoot.ReplaceAllString(def.Append(), ""))
+	}
+	appendArgs = strings.TrimSpace("root=UUID=" + rootUuid + " " + appendArgs)
+
+	// 与前面的启动项之间用空行分隔
+	if last := cfg.lastLine(); last != "" {
+		if !strings.HasSuffix(last, "\n") {
+			cfg.appendToLastLine("\n")
+			last += "\n"
+		}
+		if strings.TrimSpace(last) != "" {
+			cfg.appendToLastLine("\n")
+		}
+	}
+
+	l := &Label{lines: []string{"LABEL " + RecoveryLabel + "\n"}}
+	add := func(keyword, value string) {
+		if value != "" {
+			l.lines = append(l.lines, indent+keyword+" "+value+"\n")
+		}
+	}
+	add("MENU LABEL", menuLabel)
+	add("LINUX", kernel)
+	add("INITRD", initrd)
+	add("FDT", fdt)
+	add("FDTDIR", fdtDir)
+	add("APPEND", appendArgs)
+	cfg.labels = append(cfg.labels, l)
+}
+
+// 在最后添加 s，用于补充换行符和空行
+func (cfg *ExtlinuxCfg) appendToLastLine(s string) {
+	if len(cfg.labels) > 0 {
+		l := cfg.labels[len(cfg.labels)-1]
+		l.lines = append(l.lines, s)
+	} else {
+		cfg.global = append(cfg.global, s)
+	}
+}
+
+func (cfg *ExtlinuxCfg) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range cfg.global {
+		buf.WriteString(line)
+	}
+	for _, l := range cfg.labels {
+		for _, line := range l.lines {
+			buf.WriteString(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (cfg *ExtlinuxCfg) Save(filename string) error {
+	return atomicfile.WriteFile(filename, cfg.Bytes(), 0644)
+}
+
+func Parse(content []byte) *ExtlinuxCfg {
+	cfg := &ExtlinuxCfg{}
+	var current *Label
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			// content 以换行符结束时 SplitAfter 返回的最后一个元素
+			continue
+		}
+		if k, _ := splitDirective(line); k == "LABEL" {
+			current = &Label{}
+			cfg.labels = append(cfg.labels, current)
+		}
+		if current != nil {
+			current.lines = append(current.lines, line)
+		} else {
+			cfg.global = append(cfg.global, line)
+		}
+	}
+	return cfg
+}
+
+func ParseExtlinuxCfgFile(filename string) (*ExtlinuxCfg, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read file: %w", err)
+	}
+	return Parse(content), nil
+}
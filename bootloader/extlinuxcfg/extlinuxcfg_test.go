@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package extlinuxcfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTestFile(t *testing.T, name string) (*ExtlinuxCfg, []byte) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return Parse(content), content
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, name := range []string{"extlinux.conf", "extlinux-recovery.conf"} {
+		cfg, content := parseTestFile(t, name)
+		assert.Equal(t, string(content), string(cfg.Bytes()), name)
+	}
+
+	for _, content := range []string{
+		"",
+		"\n\n",
+		"# comment only",
+		"LABEL a\n  KERNEL /a",
+		"timeout 1\r\nlabel a\r\n",
+	} {
+		assert.Equal(t, content, string(Parse([]byte(content)).Bytes()))
+	}
+}
+
+func TestLabels(t *testing.T) {
+	cfg, _ := parseTestFile(t, "extlinux.conf")
+	labels := cfg.Labels()
+	require.Len(t, labels, 3)
+	assert.Equal(t, "l0", cfg.Default())
+	assert.Equal(t, labels[0], cfg.DefaultLabel())
+
+	l := labels[0]
+	assert.Equal(t, "l0", l.Name())
+	assert.Equal(t, "UnionTech OS Desktop 20 Pro 5.10.0-arm64-desktop", l.MenuLabel())
+	assert.Equal(t, "/boot/vmlinuz-5.10.0-arm64-desktop", l.Kernel())
+	assert.Equal(t, "/boot/initrd.img-5.10.0-arm64-desktop", l.Initrd())
+	assert.Equal(t, "", l.Fdt())
+	assert.Equal(t, "/usr/lib/linux-image-5.10.0-arm64-desktop/", l.FdtDir())
+	assert.Equal(t, "root=UUID=6a3e1f2c-8b4d-4c7e-9a05-d1f2e3b4c5a6 rootwait console=ttyS2,1500000 quiet splash",
+		l.Append())
+	assert.Equal(t, "\t", l.indent())
+
+	cfg, _ = parseTestFile(t, "extlinux-recovery.conf")
+	l = cfg.DefaultLabel()
+	assert.Equal(t, "linux", l.Name())
+	assert.Equal(t, "/Image", l.Kernel())
+	assert.Equal(t, "/dtbs/rk3399-board.dtb", l.Fdt())
+	assert.Equal(t, "    ", l.indent())
+
+	// 没有 DEFAULT 时使用第一个启动项
+	cfg = Parse([]byte("LABEL a\nLABEL b\n"))
+	assert.Equal(t, "a", cfg.DefaultLabel().Name())
+	assert.Nil(t, Parse(nil).DefaultLabel())
+}
+
+func TestRemoveRecoveryLabels(t *testing.T) {
+	cfg, content := parseTestFile(t, "extlinux-recovery.conf")
+	cfg.RemoveRecoveryLabels()
+	idx := strings.Index(string(content), "LABEL deepin-ab-recovery")
+	require.True(t, idx > 0)
+	assert.Equal(t, string(content[:idx]), string(cfg.Bytes()))
+}
+
+func TestAddRecoveryLabel(t *testing.T) {
+	cfg, content := parseTestFile(t, "extlinux-recovery.conf")
+	cfg.RemoveRecoveryLabels()
+	cfg.AddRecoveryLabel("Roll back to Deepin", "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75",
+		"/deepin-ab-recovery/Image", "")
+	// 与前面的启动项之间多了空行，root=/dev/mmcblk0p2 被替换
+	want := strings.Replace(string(content), "LABEL deepin-ab-recovery", "\nLABEL deepin-ab-recovery", 1)
+	assert.Equal(t, want, string(cfg.Bytes()))
+
+	// 添加后再移除，与原文件相同
+	cfg, content = parseTestFile(t, "extlinux.conf")
+	cfg.AddRecoveryLabel("Roll back", "abc", "/boot/deepin-ab-recovery/vmlinuz", "/boot/deepin-ab-recovery/initrd.img")
+	l := cfg.Labels()[3]
+	assert.Equal(t, RecoveryLabel, l.Name())
+	assert.Equal(t, "Roll back", l.MenuLabel())
+	assert.Equal(t, "/boot/deepin-ab-recovery/initrd.img", l.Initrd())
+	assert.Equal(t, "/usr/lib/linux-image-5.10.0-arm64-desktop/", l.FdtDir())
+	assert.Equal(t, "root=UUID=abc rootwait console=ttyS2,1500000 quiet splash", l.Append())
+	cfg = Parse(cfg.Bytes())
+	cfg.RemoveRecoveryLabels()
+	assert.Equal(t, string(content), string(cfg.Bytes()))
+
+	// 文件末尾没有换行符
+	cfg = Parse([]byte("LABEL a\n  KERNEL /a"))
+	cfg.AddRecoveryLabel("r", "abc", "/r", "")
+	assert.Equal(t, "LABEL a\n  KERNEL /a\n\nLABEL deepin-ab-recovery\n  MENU LABEL r\n  LINUX /r\n"+
+		"  APPEND root=UUID=abc\n", string(cfg.Bytes()))
+}
+
+func TestReplaceRootUuid(t *testing.T) {
+	cfg, content := parseTestFile(t, "extlinux.conf")
+	for _, l := range cfg.Labels() {
+		l.ReplaceRootUuid("6a3e1f2c-8b4d-4c7e-9a05-d1f2e3b4c5a6", "def")
+	}
+	want := strings.Replace(string(content), "6a3e1f2c-8b4d-4c7e-9a05-d1f2e3b4c5a6", "def", -1)
+	assert.Equal(t, want, string(cfg.Bytes()))
+
+	l := Parse([]byte("LABEL a\nAPPEND root=UUID=abcd ro\n")).Labels()[0]
+	assert.False(t, l.ReplaceRootUuid("abc", "def"))
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	bootloader ".."
+	"golang.org/x/xerrors"
+)
+
+// 直接修改 grub.cfg 的优先级最低，只在不能使用 grub-mkconfig 时使用
+const backendPriority = 30
+
+func init() {
+	bootloader.Register(backendPriority, NewBackend)
+}
+
+// 回滚菜单项的格式，根据 grub.cfg 中已有的菜单项检测
+type entryStyle int
+
+const (
+	styleUnknown entryStyle = iota
+	styleSw                 // 使用 linux.boot、linux.vmlinux 等命令，比如申威
+	styleMips               // 使用 linux ${prefix}/vmlinuz，比如龙芯
+)
+
+// 遍历 nodes 中的简单命令，包括菜单项和复合语句中的命令。
+func walkCommands(nodes []node, fn func(n *commandNode)) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *commandNode:
+			fn(n)
+		case *blockNode:
+			walkCommands(n.body, fn)
+		case *compoundNode:
+			walkCommands(n.body, fn)
+		}
+	}
+}
+
+func (cfg *GrubCfg) detectStyle() entryStyle {
+	style := styleUnknown
+	walkCommands(cfg.nodes, func(n *commandNode) {
+		switch n.name() {
+		case "linux.vmlinux":
+			style = styleSw
+		case "linux":
+			if style == styleUnknown && len(n.words) > 1 &&
+				strings.HasPrefix(n.words[1].text, "${prefix}/") {
+				style = styleMips
+			}
+		}
+	})
+	return style
+}
+
+// Backend 直接修改不是由 grub-mkconfig 生成的 grub.cfg
+type Backend struct {
+	opts *bootloader.Options
+	cfg  *GrubCfg
+}
+
+func NewBackend(opts *bootloader.Options) bootloader.Backend {
+	return &Backend{opts: opts}
+}
+
+func (b *Backend) Describe() string {
+	return "grub.cfg " + b.opts.GrubCfgFile
+}
+
+func (b *Backend) Detect() bool {
+	if _, err := os.Stat(b.opts.GrubCfgFile); err != nil {
+		return false
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return false
+	}
+	return cfg.detectStyle() != styleUnknown
+}
+
+func (b *Backend) load() (*GrubCfg, error) {
+	if b.cfg != nil {
+		return b.cfg, nil
+	}
+	cfg, err := ParseGrubCfgFile(b.opts.GrubCfgFile)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse grub cfg file: %w", err)
+	}
+	b.cfg = cfg
+	return cfg, nil
+}
+
+func (b *Backend) AddRecoveryEntry(entry *bootloader.RecoveryEntry) error {
+	err := bootloader.CheckPlainPartition(entry.Root)
+	if err != nil {
+		return err
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+
+	// grub.cfg 中的内核路径是相对于 /boot 的
+	dir := strings.TrimPrefix(filepath.Dir(entry.Linux), b.opts.BootDir+"/")
+	linux := filepath.Join(dir, filepath.Base(entry.Linux))
+	initrd := filepath.Join(dir, filepath.Base(entry.Initrd))
+	switch cfg.detectStyle() {
+	case styleSw:
+		err = cfg.AddRecoveryMenuEntrySw(entry.Title, entry.Root.Uuid, linux, initrd)
+	case styleMips:
+		err = cfg.AddRecoveryMenuEntryMips(entry.TitleEn, entry.Root.Uuid, linux, initrd)
+	default:
+		err = xerrors.New("unknown menu entry style")
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to add recovery menu entry: %w", err)
+	}
+	return nil
+}
+
+func (b *Backend) RemoveRecoveryEntries(backup bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+	return nil
+}
+
+func (b *Backend) SwitchRoot(root, previous bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+	err = cfg.ReplaceRootUuid(root.Uuid)
+	if err != nil {
+		return xerrors.Errorf("failed to replace root uuid: %w", err)
+	}
+	return nil
+}
+
+func (b *Backend) Commit() error {
+	if b.cfg == nil {
+		return nil
+	}
+	err := b.cfg.Save(b.opts.GrubCfgFile)
+	if err != nil {
+		return xerrors.Errorf("failed to save grub cfg file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bootloader ".."
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 把 testdata 中的文件复制到临时文件夹，返回使用它的 Backend
+func newTestBackend(t *testing.T, name string) (*Backend, []byte) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "grub.cfg")
+	err = ioutil.WriteFile(filename, content, 0644)
+	require.NoError(t, err)
+	b := NewBackend(&bootloader.Options{
+		BootDir:     "/boot",
+		GrubCfgFile: filename,
+	})
+	return b.(*Backend), content
+}
+
+func TestBackendDetect(t *testing.T) {
+	for name, want := range map[string]bool{
+		"x86_64.cfg": false,
+		"mips64.cfg": true,
+		"sw_64.cfg":  true,
+	} {
+		b, _ := newTestBackend(t, name)
+		assert.Equal(t, want, b.Detect(), name)
+	}
+
+	b := NewBackend(&bootloader.Options{GrubCfgFile: "testdata/not-exist.cfg"})
+	assert.False(t, b.Detect())
+}
+
+func TestBackendAddRecoveryEntry(t *testing.T) {
+	b, content := newTestBackend(t, "mips64.cfg")
+	require.True(t, b.Detect())
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:       bootloader.Partition{Uuid: "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75", Device: "/dev/sda3"},
+		Linux:      "/boot/deepin-ab-recovery/vmlinuz-4.19.0-loongson-3-desktop",
+		Initrd:     "/boot/deepin-ab-recovery/initrd.img-4.19.0-loongson-3-desktop",
+		BackupTime: time.Unix(1654050030, 0),
+		Title:      "回滚到 UnionTech OS Desktop 20 Pro (2022/6/1 10:20:30)",
+		TitleEn:    "Roll back to UnionTech OS Desktop 20 Pro (2022/6/1 10:20:30)",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	result, err := ioutil.ReadFile(b.opts.GrubCfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(result))
+
+	// 申威使用翻译后的标题
+	b, _ = newTestBackend(t, "sw_64.cfg")
+	err = b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: "abc"},
+		Linux:   "/boot/deepin-ab-recovery/vmlinuz",
+		Initrd:  "/boot/deepin-ab-recovery/initrd.img",
+		Title:   "回滚",
+		TitleEn: "Roll back",
+	})
+	require.NoError(t, err)
+	entries := b.cfg.FindMenuEntriesByClass(RecoveryClass)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "回滚", entries[0].Title())
+	assert.Contains(t, string(b.cfg.Bytes()),
+		"linux.vmlinux ${boot}/deepin-ab-recovery/vmlinuz  root=UUID=abc ")
+}
+
+func TestBackendSwitchRoot(t *testing.T) {
+	const uuid = "0d7e4c2b-5a19-4f36-8e0b-9c2a1f6d3b48"
+	b, content := newTestBackend(t, "sw_64.cfg")
+	err := b.SwitchRoot(bootloader.Partition{Uuid: uuid},
+		bootloader.Partition{Uuid: "91f9e990-4958-4a32-a741-41da2ef4218c", Device: "/dev/sda2"})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	result, err := ioutil.ReadFile(b.opts.GrubCfgFile)
+	require.NoError(t, err)
+
+	idx := strings.Index(string(content), "menuentry 'Roll back")
+	require.True(t, idx > 0)
+	want := strings.Replace(string(content[:idx]), "91f9e990-4958-4a32-a741-41da2ef4218c", uuid, 1)
+	assert.Equal(t, want, string(result))
+}
+
+func TestBackendRemoveRecoveryEntries(t *testing.T) {
+	b, content := newTestBackend(t, "mips64.cfg")
+	err := b.RemoveRecoveryEntries(bootloader.Partition{Uuid: "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75"})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+	result, err := ioutil.ReadFile(b.opts.GrubCfgFile)
+	require.NoError(t, err)
+	idx := strings.Index(string(content), "menuentry 'Roll back")
+	assert.Equal(t, string(content[:idx]), string(result))
+}
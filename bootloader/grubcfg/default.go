@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultPrefix = "default="
+
+// 返回 nodes 这一层菜单中的菜单项，进入复合语句，不进入菜单项、子菜单和函数。
+// grub 的 default 中的序号是菜单项在这一层中的序号。
+func menuLevel(nodes []node) []*blockNode {
+	var result []*blockNode
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *blockNode:
+			if kind := n.kind(); kind == "menuentry" || kind == "submenu" {
+				result = append(result, n)
+			}
+		case *compoundNode:
+			result = append(result, menuLevel(n.body)...)
+		}
+	}
+	return result
+}
+
+// 返回菜单项和函数之外的 set default=xxx 命令中的 default=xxx 单词，值中有变量的除外，
+// 比如 grub-mkconfig 生成的 set default="${next_entry}"。
+func findDefaultWords(nodes []node) []*token {
+	var result []*token
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *commandNode:
+			if n.name() != "set" || len(n.words) != 2 || !strings.HasPrefix(n.words[1].text, defaultPrefix) {
+				continue
+			}
+			if strings.Contains(n.words[1].text, "$") {
+				continue
+			}
+			result = append(result, n.words[1])
+		case *compoundNode:
+			result = append(result, findDefaultWords(n.body)...)
+		}
+	}
+	return result
+}
+
+func getDefaultValue(word *token) string {
+	return unquoteWord(strings.TrimPrefix(word.text, defaultPrefix))
+}
+
+// 修改 default 的值，保留原来的引号
+func setDefaultValue(word *token, value string) {
+	raw := strings.TrimPrefix(word.text, defaultPrefix)
+	quote := ""
+	if len(raw) > 0 && (raw[0] == '"' || raw[0] == '\'') {
+		quote = raw[:1]
+	}
+	word.text = defaultPrefix + quote + value + quote
+}
+
+// 把 default 的值解析为菜单项，值是 > 分隔的路径，每一段是序号、菜单项的 id 或标题，找不到时返回 nil。
+func (cfg *GrubCfg) resolveDefault(value string) *blockNode {
+	nodes := cfg.nodes
+	var entry *blockNode
+	for _, part := range strings.Split(value, ">") {
+		level := menuLevel(nodes)
+		entry = nil
+		if i, err := strconv.Atoi(part); err == nil {
+			if i >= 0 && i < len(level) {
+				entry = level[i]
+			}
+		} else {
+			for _, b := range level {
+				me := &MenuEntry{block: b}
+				if me.Id() == part || me.Title() == part {
+					entry = b
+					break
+				}
+			}
+		}
+		if entry == nil {
+			return nil
+		}
+		nodes = entry.body
+	}
+	return entry
+}
+
+// 返回 target 在 nodes 中的序号路径，找不到时返回 nil。
+func indexPath(nodes []node, target *blockNode) []string {
+	for i, b := range menuLevel(nodes) {
+		if b == target {
+			return []string{strconv.Itoa(i)}
+		}
+		if b.kind() == "submenu" {
+			if sub := indexPath(b.body, target); sub != nil {
+				return append([]string{strconv.Itoa(i)}, sub...)
+			}
+		}
+	}
+	return nil
+}
+
+// 值中有序号时，删除菜单项会改变它指向的菜单项
+func hasIndex(value string) bool {
+	for _, part := range strings.Split(value, ">") {
+		if _, err := strconv.Atoi(part); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultState 记录修改前 set default 指向的菜单项
+type defaultState struct {
+	word  *token
+	entry *blockNode
+}
+
+func (cfg *GrubCfg) saveDefaults() []defaultState {
+	var result []defaultState
+	for _, word := range findDefaultWords(cfg.nodes) {
+		value := getDefaultValue(word)
+		if !hasIndex(value) {
+			// 使用 id 或标题时不受菜单项的位置影响
+			continue
+		}
+		entry := cfg.resolveDefault(value)
+		if entry == nil {
+			continue
+		}
+		result = append(result, defaultState{word: word, entry: entry})
+	}
+	return result
+}
+
+// 让 set default 仍然指向原来的菜单项，原来的菜单项被移除时指向主菜单项。
+func (cfg *GrubCfg) restoreDefaults(states []defaultState) {
+	for _, s := range states {
+		path := indexPath(cfg.nodes, s.entry)
+		if path == nil {
+			primary := cfg.PrimaryMenuEntry()
+			if primary == nil {
+				continue
+			}
+			path = indexPath(cfg.nodes, primary.block)
+		}
+		value := strings.Join(path, ">")
+		if value != getDefaultValue(s.word) {
+			setDefaultValue(s.word, value)
+		}
+	}
+}
+
+// PrimaryMenuEntry 返回第一个不是回滚菜单项的顶层菜单项，不包括子菜单，没有时返回 nil。
+func (cfg *GrubCfg) PrimaryMenuEntry() *MenuEntry {
+	for _, b := range menuLevel(cfg.nodes) {
+		me := &MenuEntry{block: b}
+		if !me.IsSubmenu() && !me.HasClass(RecoveryClass) {
+			return me
+		}
+	}
+	return nil
+}
+
+// DefaultMenuEntry 返回第一个 set default 命令指向的菜单项，没有 set default 时与 grub 相同使用第一个菜单项，
+// 找不到时返回 nil。
+func (cfg *GrubCfg) DefaultMenuEntry() *MenuEntry {
+	value := "0"
+	if words := findDefaultWords(cfg.nodes); len(words) > 0 {
+		value = getDefaultValue(words[0])
+	}
+	entry := cfg.resolveDefault(value)
+	if entry == nil {
+		return nil
+	}
+	return &MenuEntry{block: entry}
+}
+
+// SetDefaultMenuEntry 把全部 set default 命令改为 me 的序号路径，没有 set default 命令时在开头添加。
+func (cfg *GrubCfg) SetDefaultMenuEntry(me *MenuEntry) error {
+	path := indexPath(cfg.nodes, me.block)
+	if path == nil {
+		return xerrors.Errorf("menu entry %q not found", me.Title())
+	}
+	value := strings.Join(path, ">")
+	words := findDefaultWords(cfg.nodes)
+	for _, word := range words {
+		setDefaultValue(word, value)
+	}
+	if len(words) == 0 {
+		cmd := &commandNode{
+			words: []*token{
+				{kind: tokWord, text: "set"},
+				{kind: tokWord, prefix: " ", text: defaultPrefix + value},
+			},
+			end: &token{kind: tokNewline, text: "\n"},
+		}
+		cfg.nodes = append([]node{cmd}, cfg.nodes...)
+	}
+	return nil
+}
+
+// SetDefaultToRecovery 让默认启动回滚菜单项
+func (cfg *GrubCfg) SetDefaultToRecovery() error {
+	entries := cfg.FindMenuEntriesByClass(RecoveryClass)
+	if len(entries) == 0 {
+		return xerrors.New("not found recovery menu entry")
+	}
+	return cfg.SetDefaultMenuEntry(entries[0])
+}
+
+// SetDefaultToPrimary 让默认启动主菜单项，见 PrimaryMenuEntry
+func (cfg *GrubCfg) SetDefaultToPrimary() error {
+	primary := cfg.PrimaryMenuEntry()
+	if primary == nil {
+		return xerrors.New("not found primary menu entry")
+	}
+	return cfg.SetDefaultMenuEntry(primary)
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDefaultCfg = `set default="2"
+menuentry 'Roll back' --class ab-recovery {
+}
+menuentry 'a' {
+}
+menuentry 'b' {
+}
+`
+
+func TestDefaultMenuEntry(t *testing.T) {
+	cfg, err := Parse([]byte(testDefaultCfg))
+	require.NoError(t, err)
+	assert.Equal(t, "b", cfg.DefaultMenuEntry().Title())
+	assert.Equal(t, "a", cfg.PrimaryMenuEntry().Title())
+
+	// 序号路径、id 和标题
+	cfg, err = Parse([]byte("set default=1>0\nmenuentry a {\n}\nsubmenu s {\nmenuentry b --id b-id {\n}\n}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", cfg.DefaultMenuEntry().Title())
+	for _, value := range []string{"s>b-id", "'s>b'"} {
+		cfg, err = Parse([]byte("set default=" + value + "\nmenuentry a {\n}\nsubmenu s {\nmenuentry b --id b-id {\n}\n}\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "b", cfg.DefaultMenuEntry().Title(), value)
+	}
+
+	// 值中有变量的 set default 被忽略
+	cfg, _ = parseTestFile(t, "x86_64.cfg")
+	assert.Len(t, findDefaultWords(cfg.nodes), 1)
+}
+
+func TestRemoveMenuEntriesKeepDefault(t *testing.T) {
+	// 回滚菜单项在默认菜单项之前，移除后序号减一
+	cfg, err := Parse([]byte(testDefaultCfg))
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, "set default=\"1\"\nmenuentry 'a' {\n}\nmenuentry 'b' {\n}\n", string(cfg.Bytes()))
+	assert.Equal(t, "b", cfg.DefaultMenuEntry().Title())
+
+	// 默认菜单项被移除时指向主菜单项
+	cfg, err = Parse([]byte("set default=0\n" + testDefaultCfg[len("set default=\"2\"\n"):]))
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, "a", cfg.DefaultMenuEntry().Title())
+
+	// 使用 id 时不修改
+	cfg, err = Parse([]byte("set default=b\nmenuentry r --class ab-recovery {\n}\nmenuentry a --id b {\n}\n"))
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, "set default=b\nmenuentry a --id b {\n}\n", string(cfg.Bytes()))
+
+	// 没有修改时与原文件相同
+	for _, name := range testFiles {
+		cfg, content := parseTestFile(t, name)
+		cfg.RemoveMenuEntries(func(me *MenuEntry) bool {
+			return false
+		})
+		assert.Equal(t, string(content), string(cfg.Bytes()), name)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	cfg, err := Parse([]byte(testDefaultCfg))
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetDefaultToRecovery())
+	assert.Equal(t, "Roll back", cfg.DefaultMenuEntry().Title())
+	require.NoError(t, cfg.SetDefaultToPrimary())
+	assert.Equal(t, "a", cfg.DefaultMenuEntry().Title())
+	assert.Contains(t, string(cfg.Bytes()), "set default=\"1\"\n")
+
+	// 没有 set default 时在开头添加
+	cfg, err = Parse([]byte("menuentry a {\n}\nmenuentry r --class ab-recovery {\n}\n"))
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetDefaultToRecovery())
+	assert.Equal(t, "set default=1\nmenuentry a {\n}\nmenuentry r --class ab-recovery {\n}\n", string(cfg.Bytes()))
+
+	cfg, err = Parse([]byte("menuentry a {\n}\n"))
+	require.NoError(t, err)
+	assert.Error(t, cfg.SetDefaultToRecovery())
+}
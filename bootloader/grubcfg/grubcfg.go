@@ -5,99 +5,264 @@
 package grubcfg
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io/ioutil"
 	"strings"
 
 	bootloader ".."
+	"../../atomicfile"
 	"golang.org/x/xerrors"
 )
 
-type Line struct {
-	value string
+// 回滚菜单项的 class
+const RecoveryClass = "ab-recovery"
+
+// GrubCfg 是 grub.cfg 的语法树，没有修改时 Bytes 返回与原文件完全相同的内容。
+type GrubCfg struct {
+	nodes []node
+	eof   *token // 文件末尾的空白和注释在它的 prefix 中
 }
 
+// MenuEntry 是 menuentry 或 submenu 块
 type MenuEntry struct {
-	head  string
-	items []string
+	block *blockNode
 }
 
-type GrubCfg struct {
-	items []GrubCfgItem
+func (me *MenuEntry) IsSubmenu() bool {
+	return me.block.kind() == "submenu"
 }
 
-type GrubCfgItem interface {
-	String() string
-	Length() int
+// 解析 menuentry 的参数，返回标题和选项，选项的值已去掉引号。
+func (me *MenuEntry) parseArgs() (title string, opts map[string][]string) {
+	opts = make(map[string][]string)
+	args := me.block.head[1:]
+	hasTitle := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i].text
+		if arg == "$menuentry_id_option" || arg == "${menuentry_id_option}" {
+			// grub-mkconfig 生成的配置用这个变量表示 --id
+			arg = "--id"
+		}
+		if strings.HasPrefix(arg, "--") {
+			name := arg
+			value := ""
+			if idx := strings.Index(arg, "="); idx > 0 {
+				name = arg[:idx]
+				value = unquoteWord(arg[idx+1:])
+			} else if name != "--unrestricted" && i+1 < len(args) {
+				i++
+				value = unquoteWord(args[i].text)
+			}
+			opts[name] = append(opts[name], value)
+			continue
+		}
+		if !hasTitle {
+			title = unquoteWord(arg)
+			hasTitle = true
+		}
+	}
+	return
 }
 
-func (l Line) String() string {
-	return l.value + "\n"
+func (me *MenuEntry) Title() string {
+	title, _ := me.parseArgs()
+	return title
 }
 
-func (l Line) Length() int {
-	return len(l.value) + 1
+// Id 返回 --id 选项的值，没有时返回空字符串。
+func (me *MenuEntry) Id() string {
+	_, opts := me.parseArgs()
+	ids := opts["--id"]
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
 }
 
-func (me *MenuEntry) String() string {
-	length := me.Length()
-	buf := bytes.NewBuffer(make([]byte, 0, length))
-	buf.WriteString(me.head)
-	buf.WriteByte('\n')
-	for _, item := range me.items {
-		buf.WriteString(item)
-		buf.WriteByte('\n')
+func (me *MenuEntry) Classes() []string {
+	_, opts := me.parseArgs()
+	return opts["--class"]
+}
+
+func (me *MenuEntry) HasClass(class string) bool {
+	for _, c := range me.Classes() {
+		if c == class {
+			return true
+		}
 	}
-	buf.WriteString("}\n")
-	return buf.String()
+	return false
 }
 
-func (me *MenuEntry) Length() int {
-	length := len(me.head) + 3
-	for _, line := range me.items {
-		length += len(line) + 1
+// 遍历 nodes 中的菜单项，进入子菜单和复合语句，但不进入函数定义。
+// fn 返回 false 时停止遍历，walkMenuEntries 也返回 false。
+func walkMenuEntries(nodes []node, fn func(me *MenuEntry) bool) bool {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *blockNode:
+			kind := n.kind()
+			if kind != "menuentry" && kind != "submenu" {
+				continue
+			}
+			if !fn(&MenuEntry{block: n}) {
+				return false
+			}
+			if kind == "submenu" && !walkMenuEntries(n.body, fn) {
+				return false
+			}
+		case *compoundNode:
+			if !walkMenuEntries(n.body, fn) {
+				return false
+			}
+		}
 	}
-	return length
+	return true
 }
 
-func (cfg *GrubCfg) RemoveRecoveryMenuEntries() {
-	var items []GrubCfgItem
-	for _, item := range cfg.items {
-		me, ok := item.(*MenuEntry)
-		if ok {
-			if strings.Contains(me.head, " --class ab-recovery ") {
-				// remove it
-			} else {
-				items = append(items, item)
+// MenuEntries 按出现的顺序返回全部菜单项，包括子菜单和其中的菜单项。
+func (cfg *GrubCfg) MenuEntries() []*MenuEntry {
+	var result []*MenuEntry
+	walkMenuEntries(cfg.nodes, func(me *MenuEntry) bool {
+		result = append(result, me)
+		return true
+	})
+	return result
+}
+
+func (cfg *GrubCfg) FindMenuEntryById(id string) *MenuEntry {
+	var result *MenuEntry
+	walkMenuEntries(cfg.nodes, func(me *MenuEntry) bool {
+		if me.Id() == id {
+			result = me
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+func (cfg *GrubCfg) FindMenuEntriesByClass(class string) []*MenuEntry {
+	var result []*MenuEntry
+	walkMenuEntries(cfg.nodes, func(me *MenuEntry) bool {
+		if me.HasClass(class) {
+			result = append(result, me)
+		}
+		return true
+	})
+	return result
+}
+
+func removeMenuEntries(nodes []node, fn func(me *MenuEntry) bool) ([]node, int) {
+	result := nodes[:0:0]
+	count := 0
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *blockNode:
+			kind := n.kind()
+			if kind == "menuentry" || kind == "submenu" {
+				if fn(&MenuEntry{block: n}) {
+					count++
+					continue
+				}
+				if kind == "submenu" {
+					var c int
+					n.body, c = removeMenuEntries(n.body, fn)
+					count += c
+				}
 			}
-		} else {
-			items = append(items, item)
+		case *compoundNode:
+			var c int
+			n.body, c = removeMenuEntries(n.body, fn)
+			count += c
 		}
+		result = append(result, n)
 	}
-	cfg.items = items
+	return result, count
 }
 
-func (cfg *GrubCfg) ReplaceRootUuid(uuid string) error {
-	for _, item := range cfg.items {
-		me, ok := item.(*MenuEntry)
-		if ok {
-			if strings.Contains(me.head, "Recovery") {
+// RemoveMenuEntries 移除 fn 返回 true 的菜单项，返回移除的数量。菜单项前后的注释和空行被保留。
+// 使用序号的 set default 仍然指向原来的菜单项，它被移除时指向主菜单项。
+func (cfg *GrubCfg) RemoveMenuEntries(fn func(me *MenuEntry) bool) int {
+	states := cfg.saveDefaults()
+	var count int
+	cfg.nodes, count = removeMenuEntries(cfg.nodes, fn)
+	if count > 0 {
+		cfg.restoreDefaults(states)
+	}
+	return count
+}
+
+func (cfg *GrubCfg) RemoveRecoveryMenuEntries() {
+	cfg.RemoveMenuEntries(func(me *MenuEntry) bool {
+		return me.HasClass(RecoveryClass)
+	})
+}
+
+// 在 nodes 中查找第一个 linux 命令，把其中的 root=UUID=xxx 替换为新的 uuid。
+func replaceRootUuid(nodes []node, uuid string) bool {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *commandNode:
+			if !strings.HasPrefix(n.name(), "linux") {
 				continue
 			}
-
-			for idx, item := range me.items {
-				line := strings.TrimSpace(item)
-				if strings.HasPrefix(line, "linux") && bootloader.RegRootUUID.MatchString(line) {
-					me.items[idx] = bootloader.RegRootUUID.ReplaceAllString(item, "root=UUID="+uuid)
-					return nil
+			for _, word := range n.words[1:] {
+				if bootloader.RegRootUUID.MatchString(word.text) {
+					word.text = bootloader.RegRootUUID.ReplaceAllString(word.text, "root=UUID="+uuid)
+					return true
 				}
 			}
+		case *compoundNode:
+			if replaceRootUuid(n.body, uuid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReplaceRootUuid 替换第一个非回滚菜单项的根分区 uuid。
+func (cfg *GrubCfg) ReplaceRootUuid(uuid string) error {
+	done := false
+	walkMenuEntries(cfg.nodes, func(me *MenuEntry) bool {
+		if me.IsSubmenu() || me.HasClass(RecoveryClass) ||
+			strings.Contains(me.Title(), "Recovery") {
+			return true
 		}
+		done = replaceRootUuid(me.block.body, uuid)
+		return !done
+	})
+	if !done {
+		return xerrors.New("not found replace target")
+	}
+	return nil
+}
+
+// AppendText 在配置的末尾追加 grub 脚本。
+func (cfg *GrubCfg) AppendText(text string) error {
+	content := cfg.Bytes()
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(content, text...)
+	newCfg, err := Parse(content)
+	if err != nil {
+		return err
 	}
+	*cfg = *newCfg
+	return nil
+}
 
-	return xerrors.New("not found replace target")
+func formatMenuEntry(head string, items []string) string {
+	var buf bytes.Buffer
+	buf.WriteString(head)
+	buf.WriteByte('\n')
+	for _, item := range items {
+		buf.WriteString(item)
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("}\n")
+	return buf.String()
 }
 
 /*
@@ -113,12 +278,11 @@ echo "装载 vmlinux1 成功"
 echo "开始执行……"
 boot
 }
-
 */
-func (cfg *GrubCfg) AddRecoveryMenuEntrySw(menuText, rootUuid, linux, initrd string) {
-	cfg.items = append(cfg.items, &MenuEntry{
-		head: fmt.Sprintf("menuentry '%s' --class ab-recovery {", menuText),
-		items: []string{
+func (cfg *GrubCfg) AddRecoveryMenuEntrySw(menuText, rootUuid, linux, initrd string) error {
+	return cfg.AppendText(formatMenuEntry(
+		fmt.Sprintf("menuentry %s --class %s {", quoteWord(menuText), RecoveryClass),
+		[]string{
 			`echo "装载中，请耐心等待……"`,
 			`set boot=(${root})/boot/`,
 			fmt.Sprintf("linux.boot ${boot}/%s", initrd),
@@ -129,36 +293,37 @@ func (cfg *GrubCfg) AddRecoveryMenuEntrySw(menuText, rootUuid, linux, initrd str
 			`echo "装载 vmlinux 成功"`,
 			`echo "开始执行……"`,
 			"boot",
-		},
-	})
+		}))
 }
 
-func (cfg *GrubCfg) AddRecoveryMenuEntryMips(menuText, rootUuid, linux, initrd string) {
-	cfg.items = append(cfg.items, &MenuEntry{
-		head: fmt.Sprintf("menuentry '%s' --class ab-recovery {", menuText),
-		items: []string{
+func (cfg *GrubCfg) AddRecoveryMenuEntryMips(menuText, rootUuid, linux, initrd string) error {
+	return cfg.AppendText(formatMenuEntry(
+		fmt.Sprintf("menuentry %s --class %s {", quoteWord(menuText), RecoveryClass),
+		[]string{
 			fmt.Sprintf("linux ${prefix}/%s console=tty loglevel=0 quiet splash locales=zh_CN.UTF-8  root=UUID=%s", linux, rootUuid),
 			fmt.Sprintf("initrd ${prefix}/%s", initrd),
 			"boot",
-		},
-	})
+		}))
 }
 
-func (cfg *GrubCfg) toBytes() []byte {
-	length := 0
-	for _, item := range cfg.items {
-		length += item.Length()
-	}
-	buf := bytes.NewBuffer(make([]byte, 0, length))
-	for _, item := range cfg.items {
-		buf.WriteString(item.String())
-	}
+func (cfg *GrubCfg) Bytes() []byte {
+	var buf bytes.Buffer
+	writeNodes(&buf, cfg.nodes)
+	writeTokens(&buf, cfg.eof)
 	return buf.Bytes()
 }
 
 func (cfg *GrubCfg) Save(filename string) error {
-	content := cfg.toBytes()
-	return ioutil.WriteFile(filename, content, 0644)
+	content := cfg.Bytes()
+	return atomicfile.WriteFile(filename, content, 0644)
+}
+
+func Parse(content []byte) (*GrubCfg, error) {
+	nodes, eof, err := parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return &GrubCfg{nodes: nodes, eof: eof}, nil
 }
 
 func ParseGrubCfgFile(filename string) (*GrubCfg, error) {
@@ -167,36 +332,9 @@ func ParseGrubCfgFile(filename string) (*GrubCfg, error) {
 		return nil, xerrors.Errorf("failed to read file: %w", err)
 	}
 
-	var cfg GrubCfg
-	br := bytes.NewReader(content)
-	scanner := bufio.NewScanner(br)
-
-	var currentMenuEntry *MenuEntry
-	for scanner.Scan() {
-		line0 := scanner.Bytes()
-		line := bytes.TrimSpace(line0)
-		if bytes.HasPrefix(line, []byte("menuentry ")) &&
-			bytes.HasSuffix(line, []byte("{")) {
-			// 开始 menuentry 定义
-
-			currentMenuEntry = &MenuEntry{
-				head: string(line0),
-			}
-			cfg.items = append(cfg.items, currentMenuEntry)
-		} else if string(line) == "}" {
-			// 结束 menuentry 定义
-			currentMenuEntry = nil
-		} else {
-			if currentMenuEntry == nil {
-				cfg.items = append(cfg.items, Line{string(line0)})
-			} else {
-				currentMenuEntry.items = append(currentMenuEntry.items, string(line0))
-			}
-		}
-	}
-	err = scanner.Err()
+	cfg, err := Parse(content)
 	if err != nil {
-		return nil, xerrors.Errorf("scanner error: %w", err)
+		return nil, xerrors.Errorf("failed to parse file %q: %w", filename, err)
 	}
-	return &cfg, nil
+	return cfg, nil
 }
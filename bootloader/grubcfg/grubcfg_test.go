@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testFiles = []string{"x86_64.cfg", "mips64.cfg", "sw_64.cfg"}
+
+func parseTestFile(t *testing.T, name string) (*GrubCfg, []byte) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	cfg, err := Parse(content)
+	require.NoError(t, err)
+	return cfg, content
+}
+
+func getTitles(entries []*MenuEntry) []string {
+	var titles []string
+	for _, me := range entries {
+		titles = append(titles, me.Title())
+	}
+	return titles
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, name := range testFiles {
+		cfg, content := parseTestFile(t, name)
+		assert.Equal(t, string(content), string(cfg.Bytes()), name)
+	}
+
+	for _, content := range []string{
+		"",
+		"\n\n",
+		"# comment only",
+		"set a=1;;set b=2 ;\n",
+		"echo a \\\n  b\n",
+		"menuentry 'a' { echo }",
+		"if true; then echo '}'; fi # trailing",
+		"menuentry \"a \\\" b\" {\n\techo \"${a}\"\n}\n",
+	} {
+		cfg, err := Parse([]byte(content))
+		require.NoError(t, err, content)
+		assert.Equal(t, content, string(cfg.Bytes()))
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, content := range []string{
+		"menuentry 'a' {\n",
+		"menuentry 'a' {\n}\n}\n",
+		"if true; then\necho\n",
+		"fi\n",
+		"menuentry 'a {\n}\n",
+		"echo \"a\n",
+		"echo ${a\n",
+		"{\n}\n",
+		"menuentry 'a' {\nif true; then\n}\nfi\n",
+	} {
+		_, err := Parse([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestMenuEntries(t *testing.T) {
+	cfg, _ := parseTestFile(t, "x86_64.cfg")
+	entries := cfg.MenuEntries()
+	assert.Equal(t, []string{
+		"UnionTech OS Desktop 20 Pro GNU/Linux",
+		"UnionTech OS Desktop 20 Pro GNU/Linux 的高级选项",
+		"UnionTech OS Desktop 20 Pro GNU/Linux，Linux 5.10.101-amd64-desktop",
+		"UnionTech OS Desktop 20 Pro GNU/Linux，Linux 5.10.101-amd64-desktop (recovery mode)",
+		"回滚到 UnionTech OS Desktop 20 Pro (2022/6/1 10:20:30)",
+		"System setup",
+	}, getTitles(entries))
+
+	assert.False(t, entries[0].IsSubmenu())
+	assert.True(t, entries[1].IsSubmenu())
+	assert.Equal(t, "gnulinux-simple-5d0f1c1e-54a7-4a3e-9f0e-0f3b6f0f9d2e", entries[0].Id())
+	assert.Equal(t, []string{"deepin", "gnu-linux", "gnu", "os"}, entries[0].Classes())
+	assert.Empty(t, entries[5].Classes())
+
+	me := cfg.FindMenuEntryById("gnulinux-5.10.101-amd64-desktop-recovery-5d0f1c1e-54a7-4a3e-9f0e-0f3b6f0f9d2e")
+	require.NotNil(t, me)
+	assert.Equal(t, entries[3].Title(), me.Title())
+	assert.Nil(t, cfg.FindMenuEntryById("not-exist"))
+
+	assert.Len(t, cfg.FindMenuEntriesByClass("deepin"), 3)
+	assert.Len(t, cfg.FindMenuEntriesByClass("os"), 4)
+
+	// 函数定义中的 { } 不是菜单项
+	cfg, err := Parse([]byte("function f {\n  menuentry 'a' {\n  }\n}\n" +
+		"menuentry b --id=b-id --class=c1 --unrestricted --users root {\n}\n"))
+	require.NoError(t, err)
+	entries = cfg.MenuEntries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b", entries[0].Title())
+	assert.Equal(t, "b-id", entries[0].Id())
+	assert.Equal(t, []string{"c1"}, entries[0].Classes())
+}
+
+func TestBraceOnNextLine(t *testing.T) {
+	cfg, content := parseTestFile(t, "sw_64.cfg")
+	assert.Equal(t, []string{
+		"Deepin  15.5 sp2 sw421",
+		"Deepin  15.5 sp2 sw421 (安全模式)",
+		"Roll back to Deepin 15.5 (2022/6/1 10:20:30)",
+	}, getTitles(cfg.MenuEntries()))
+	assert.Equal(t, []string{"gnu-linux", "gnu", "os"}, cfg.MenuEntries()[0].Classes())
+	assert.Equal(t, string(content), string(cfg.Bytes()))
+}
+
+func TestRemoveRecoveryMenuEntries(t *testing.T) {
+	cfg, content := parseTestFile(t, "mips64.cfg")
+	cfg.RemoveRecoveryMenuEntries()
+	idx := strings.Index(string(content), "menuentry 'Roll back")
+	require.True(t, idx > 0)
+	assert.Equal(t, string(content[:idx]), string(cfg.Bytes()))
+
+	// 子菜单和复合语句中的菜单项也被移除，注释被保留
+	cfg, err := Parse([]byte("submenu s {\n\tmenuentry a --class ab-recovery {\n\t}\n\tmenuentry b {\n\t}\n}\n" +
+		"if true; then\n# comment\nmenuentry c --class ab-recovery {\n}\nfi\n"))
+	require.NoError(t, err)
+	n := cfg.RemoveMenuEntries(func(me *MenuEntry) bool {
+		return me.HasClass(RecoveryClass)
+	})
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "submenu s {\n\tmenuentry b {\n\t}\n}\nif true; then\n# comment\nfi\n", string(cfg.Bytes()))
+}
+
+func TestReplaceRootUuid(t *testing.T) {
+	const uuid = "0d7e4c2b-5a19-4f36-8e0b-9c2a1f6d3b48"
+	cfg, content := parseTestFile(t, "sw_64.cfg")
+	err := cfg.ReplaceRootUuid(uuid)
+	require.NoError(t, err)
+	want := strings.Replace(string(content), "91f9e990-4958-4a32-a741-41da2ef4218c", uuid, 1)
+	assert.Equal(t, want, string(cfg.Bytes()))
+
+	// 跳过子菜单，进入菜单项中的复合语句
+	cfg, err = Parse([]byte("submenu s {\n}\nmenuentry a {\nif true; then\nlinux /vmlinuz root=UUID=abc ro\nfi\n}\n"))
+	require.NoError(t, err)
+	err = cfg.ReplaceRootUuid("def")
+	require.NoError(t, err)
+	assert.Contains(t, string(cfg.Bytes()), "linux /vmlinuz root=UUID=def ro\n")
+
+	cfg, err = Parse([]byte("menuentry 'a' --class ab-recovery {\nlinux /vmlinuz root=UUID=abc\n}\n"))
+	require.NoError(t, err)
+	assert.Error(t, cfg.ReplaceRootUuid(uuid))
+}
+
+func TestAddRecoveryMenuEntry(t *testing.T) {
+	cfg, content := parseTestFile(t, "sw_64.cfg")
+	cfg.RemoveRecoveryMenuEntries()
+	err := cfg.AddRecoveryMenuEntrySw("Roll back to 'Deepin'", "abc", "linux", "initrd")
+	require.NoError(t, err)
+	entries := cfg.FindMenuEntriesByClass(RecoveryClass)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Roll back to 'Deepin'", entries[0].Title())
+	assert.True(t, strings.HasPrefix(string(cfg.Bytes()),
+		string(content[:strings.Index(string(content), "menuentry 'Roll back")])))
+
+	cfg, content = parseTestFile(t, "mips64.cfg")
+	cfg.RemoveRecoveryMenuEntries()
+	err = cfg.AddRecoveryMenuEntryMips("Roll back to UnionTech OS Desktop 20 Pro (2022/6/1 10:20:30)",
+		"9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75",
+		"deepin-ab-recovery/vmlinuz-4.19.0-loongson-3-desktop", "deepin-ab-recovery/initrd.img-4.19.0-loongson-3-desktop")
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(cfg.Bytes()))
+}
+
+func TestUnquoteWord(t *testing.T) {
+	assert.Equal(t, "a b", unquoteWord(`'a b'`))
+	assert.Equal(t, `a "b" $c`, unquoteWord(`"a \"b\" \$c"`))
+	assert.Equal(t, "it's", unquoteWord(`'it'\''s'`))
+	assert.Equal(t, "a b", unquoteWord(`a\ b`))
+	assert.Equal(t, "${a}", unquoteWord("${a}"))
+	assert.Equal(t, "it's", unquoteWord(quoteWord("it's")))
+}
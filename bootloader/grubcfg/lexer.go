@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"golang.org/x/xerrors"
+)
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokNewline
+	tokSemicolon
+	tokLBrace
+	tokRBrace
+	tokEOF
+)
+
+// token 保存原始文本，prefix 是它前面的空白、注释和续行，
+// 依次拼接全部 token 的 prefix 和 text 就能得到原始的文件内容。
+type token struct {
+	kind   tokenKind
+	prefix string
+	text   string
+	line   int // 从 1 开始的行号，用于错误消息
+}
+
+func (t *token) isSeparator() bool {
+	return t.kind == tokNewline || t.kind == tokSemicolon
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// 结束单词的字符
+func isWordEnd(c byte) bool {
+	return isBlank(c) || c == '\n' || c == ';' || c == '{' || c == '}'
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+// 跳过空白、注释和续行，返回跳过的原始文本。
+func (l *lexer) skipTrivia() string {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case isBlank(c):
+			l.pos++
+		case c == '\\' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '\n':
+			l.pos += 2
+			l.line++
+		case c == '#':
+			// 注释只能出现在单词的开头，一直到行尾，不包括换行符
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return l.src[start:l.pos]
+		}
+	}
+	return l.src[start:l.pos]
+}
+
+func (l *lexer) next() (*token, error) {
+	prefix := l.skipTrivia()
+	tok := &token{prefix: prefix, line: l.line}
+	if l.pos >= len(l.src) {
+		tok.kind = tokEOF
+		return tok, nil
+	}
+
+	start := l.pos
+	switch l.src[l.pos] {
+	case '\n':
+		tok.kind = tokNewline
+		l.pos++
+		l.line++
+	case ';':
+		tok.kind = tokSemicolon
+		l.pos++
+	case '{':
+		tok.kind = tokLBrace
+		l.pos++
+	case '}':
+		tok.kind = tokRBrace
+		l.pos++
+	default:
+		tok.kind = tokWord
+		err := l.scanWord()
+		if err != nil {
+			return nil, err
+		}
+	}
+	tok.text = l.src[start:l.pos]
+	return tok, nil
+}
+
+func (l *lexer) scanWord() error {
+	startLine := l.line
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if isWordEnd(c) {
+			return nil
+		}
+		switch c {
+		case '\'':
+			end := l.indexFrom(l.pos+1, '\'')
+			if end < 0 {
+				return xerrors.Errorf("line %d: unterminated single quote", startLine)
+			}
+			l.advanceTo(end + 1)
+		case '"':
+			end := l.pos + 1
+			for ; end < len(l.src); end++ {
+				if l.src[end] == '\\' {
+					end++
+				} else if l.src[end] == '"' {
+					break
+				}
+			}
+			if end >= len(l.src) {
+				return xerrors.Errorf("line %d: unterminated double quote", startLine)
+			}
+			l.advanceTo(end + 1)
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				l.advanceTo(l.pos + 2)
+			} else {
+				l.pos++
+			}
+		case '$':
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == '{' {
+				end := l.indexFrom(l.pos+2, '}')
+				if end < 0 {
+					return xerrors.Errorf("line %d: unterminated variable reference", startLine)
+				}
+				l.advanceTo(end + 1)
+			} else {
+				l.pos++
+			}
+		default:
+			l.pos++
+		}
+	}
+	return nil
+}
+
+func (l *lexer) indexFrom(from int, c byte) int {
+	for i := from; i < len(l.src); i++ {
+		if l.src[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// 前进到 end，统计经过的换行符
+func (l *lexer) advanceTo(end int) {
+	for ; l.pos < end; l.pos++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+		}
+	}
+}
+
+func tokenize(src string) ([]*token, error) {
+	l := &lexer{src: src, line: 1}
+	var tokens []*token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+// 去掉单词中的引号和转义，不展开变量。
+func unquoteWord(word string) string {
+	buf := make([]byte, 0, len(word))
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch c {
+		case '\'':
+			end := i + 1
+			for end < len(word) && word[end] != '\'' {
+				end++
+			}
+			buf = append(buf, word[i+1:end]...)
+			i = end
+		case '"':
+			i++
+			for ; i < len(word) && word[i] != '"'; i++ {
+				if word[i] == '\\' && i+1 < len(word) {
+					switch word[i+1] {
+					case '"', '\\', '$', '\n':
+						i++
+					}
+				}
+				buf = append(buf, word[i])
+			}
+		case '\\':
+			if i+1 < len(word) {
+				i++
+				buf = append(buf, word[i])
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+// 用单引号引用 s，与 grub-mkconfig_lib 中的 grub_quote 一致。
+func quoteWord(s string) string {
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '\'')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\'' {
+			buf = append(buf, `'\''`...)
+		} else {
+			buf = append(buf, s[i])
+		}
+	}
+	buf = append(buf, '\'')
+	return string(buf)
+}
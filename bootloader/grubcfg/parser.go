@@ -0,0 +1,286 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubcfg
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+// node 是 grub 脚本的语法树节点，writeTo 写出节点的原始文本。
+type node interface {
+	writeTo(buf *bytes.Buffer)
+}
+
+func writeTokens(buf *bytes.Buffer, tokens ...*token) {
+	for _, tok := range tokens {
+		if tok != nil {
+			buf.WriteString(tok.prefix)
+			buf.WriteString(tok.text)
+		}
+	}
+}
+
+func writeNodes(buf *bytes.Buffer, nodes []node) {
+	for _, n := range nodes {
+		n.writeTo(buf)
+	}
+}
+
+// 空语句，比如空行、注释行或多余的分号
+type blankNode struct {
+	sep *token
+}
+
+func (n *blankNode) writeTo(buf *bytes.Buffer) {
+	writeTokens(buf, n.sep)
+}
+
+// then、elif、else、do 等保留字，它们后面直接跟着命令，不需要分隔符
+type keywordNode struct {
+	tok *token
+}
+
+func (n *keywordNode) writeTo(buf *bytes.Buffer) {
+	writeTokens(buf, n.tok)
+}
+
+// 简单命令，end 为结束它的换行符或分号，在文件末尾或 } 之前时为 nil
+type commandNode struct {
+	words []*token
+	end   *token
+}
+
+func (n *commandNode) writeTo(buf *bytes.Buffer) {
+	writeTokens(buf, n.words...)
+	writeTokens(buf, n.end)
+}
+
+func (n *commandNode) name() string {
+	if len(n.words) == 0 {
+		return ""
+	}
+	return n.words[0].text
+}
+
+// 带有 { } 的块，比如 menuentry、submenu 和 function，
+// gap 为 head 和 { 之间的换行符。
+type blockNode struct {
+	head   []*token
+	gap    []*token
+	lbrace *token
+	body   []node
+	rbrace *token
+	end    *token
+}
+
+func (n *blockNode) writeTo(buf *bytes.Buffer) {
+	writeTokens(buf, n.head...)
+	writeTokens(buf, n.gap...)
+	writeTokens(buf, n.lbrace)
+	writeNodes(buf, n.body)
+	writeTokens(buf, n.rbrace, n.end)
+}
+
+func (n *blockNode) kind() string {
+	if len(n.head) == 0 {
+		return ""
+	}
+	return n.head[0].text
+}
+
+// 以保留字开始和结束的复合语句，比如 if ... fi、for ... done、while ... done
+type compoundNode struct {
+	open  *token
+	body  []node
+	close *token
+	end   *token
+}
+
+func (n *compoundNode) writeTo(buf *bytes.Buffer) {
+	writeTokens(buf, n.open)
+	writeNodes(buf, n.body)
+	writeTokens(buf, n.close, n.end)
+}
+
+// 复合语句的开始保留字和对应的结束保留字
+var compoundKeywords = map[string]string{
+	"if":    "fi",
+	"for":   "done",
+	"while": "done",
+	"until": "done",
+}
+
+// 在命令位置出现时不需要分隔符的保留字
+var innerKeywords = map[string]bool{
+	"then": true,
+	"elif": true,
+	"else": true,
+	"do":   true,
+}
+
+// 这些块的 { 可以在下一行
+var blockKinds = map[string]bool{
+	"menuentry": true,
+	"submenu":   true,
+	"function":  true,
+}
+
+type parser struct {
+	tokens []*token
+	pos    int
+}
+
+func (p *parser) peek() *token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(i int) *token {
+	if p.pos+i < len(p.tokens) {
+		return p.tokens[p.pos+i]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *parser) advance() *token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// 解析语句列表，直到遇到 EOF、} 或位于命令位置的 closeWord，遇到的结束 token 不被消耗。
+func (p *parser) parseList(closeWord string) ([]node, error) {
+	var nodes []node
+	for {
+		tok := p.peek()
+		switch tok.kind {
+		case tokEOF, tokRBrace:
+			return nodes, nil
+		case tokNewline, tokSemicolon:
+			nodes = append(nodes, &blankNode{sep: p.advance()})
+			continue
+		case tokLBrace:
+			return nil, xerrors.Errorf("line %d: unexpected {", tok.line)
+		}
+
+		if closeWord != "" && tok.text == closeWord {
+			return nodes, nil
+		}
+		if tok.text == "fi" || tok.text == "done" {
+			return nil, xerrors.Errorf("line %d: unexpected %s", tok.line, tok.text)
+		}
+
+		n, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+// 解析一个以单词开始的语句
+func (p *parser) parseStatement() (node, error) {
+	tok := p.peek()
+	if innerKeywords[tok.text] {
+		return &keywordNode{tok: p.advance()}, nil
+	}
+	if closeWord, ok := compoundKeywords[tok.text]; ok {
+		return p.parseCompound(closeWord)
+	}
+
+	var words []*token
+	for p.peek().kind == tokWord {
+		words = append(words, p.advance())
+	}
+
+	next := p.peek()
+	switch next.kind {
+	case tokLBrace:
+		return p.parseBlock(words, nil)
+	case tokNewline:
+		if blockKinds[words[0].text] {
+			// { 在下一行
+			i := 0
+			for p.peekAt(i).kind == tokNewline {
+				i++
+			}
+			if p.peekAt(i).kind == tokLBrace {
+				gap := make([]*token, i)
+				for j := range gap {
+					gap[j] = p.advance()
+				}
+				return p.parseBlock(words, gap)
+			}
+		}
+		return &commandNode{words: words, end: p.advance()}, nil
+	case tokSemicolon:
+		return &commandNode{words: words, end: p.advance()}, nil
+	default:
+		// EOF 或 }
+		return &commandNode{words: words}, nil
+	}
+}
+
+func (p *parser) parseBlock(head, gap []*token) (node, error) {
+	n := &blockNode{
+		head:   head,
+		gap:    gap,
+		lbrace: p.advance(),
+	}
+	body, err := p.parseList("")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if p.peek().kind != tokRBrace {
+		return nil, xerrors.Errorf("line %d: missing } for %s", n.lbrace.line, n.kind())
+	}
+	n.rbrace = p.advance()
+	n.end = p.parseEnd()
+	return n, nil
+}
+
+func (p *parser) parseCompound(closeWord string) (node, error) {
+	n := &compoundNode{open: p.advance()}
+	body, err := p.parseList(closeWord)
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if p.peek().text != closeWord || p.peek().kind != tokWord {
+		return nil, xerrors.Errorf("line %d: missing %s for %s", n.open.line, closeWord, n.open.text)
+	}
+	n.close = p.advance()
+	n.end = p.parseEnd()
+	return n, nil
+}
+
+// 块或复合语句后面的分隔符
+func (p *parser) parseEnd() *token {
+	if p.peek().isSeparator() {
+		return p.advance()
+	}
+	return nil
+}
+
+func parse(src string) ([]node, *token, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &parser{tokens: tokens}
+	nodes, err := p.parseList("")
+	if err != nil {
+		return nil, nil, err
+	}
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		return nil, nil, xerrors.Errorf("line %d: unexpected }", tok.line)
+	}
+	return nodes, tok, nil
+}
@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubenv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"../../atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// 环境块的文件头
+const header = "# GRUB Environment Block\n"
+
+// 新建的环境块的大小，grub 的 save_env 直接写入文件所在的扇区，所以文件大小不能改变
+const DefaultSize = 1024
+
+// 环境块中未使用的部分用 # 填充
+const padding = '#'
+
+// Env 是 grub 的环境块，即 /boot/grub/grubenv 文件，格式与 grub-editenv 相同，保持变量原来的顺序。
+type Env struct {
+	size   int
+	names  []string
+	values map[string]string
+}
+
+// New 返回大小为 DefaultSize 的空的环境块
+func New() *Env {
+	return &Env{
+		size:   DefaultSize,
+		values: make(map[string]string),
+	}
+}
+
+// Parse 解析环境块，以 # 开始的行和没有 = 的行被忽略。值中的 \ 和换行符以 \ 转义。
+func Parse(data []byte) (*Env, error) {
+	if !bytes.HasPrefix(data, []byte(header)) {
+		return nil, xerrors.New("invalid grub environment block header")
+	}
+	env := New()
+	env.size = len(data)
+	if env.size < DefaultSize {
+		env.size = DefaultSize
+	}
+
+	data = data[len(header):]
+	for len(data) > 0 {
+		// 读取一行，转义的换行符不是行尾
+		i := 0
+		for ; i < len(data) && data[i] != '\n'; i++ {
+			if data[i] == '\\' && i+1 < len(data) {
+				i++
+			}
+		}
+		line := data[:i]
+		if i < len(data) {
+			i++
+		}
+		data = data[i:]
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		eq := bytes.IndexByte(line, '=')
+		if eq <= 0 {
+			continue
+		}
+		env.Set(string(line[:eq]), unescape(line[eq+1:]))
+	}
+	return env, nil
+}
+
+// ReadFile 读取并解析环境块文件，文件不存在时返回的错误满足 os.IsNotExist。
+func ReadFile(filename string) (*Env, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	env, err := Parse(data)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse %q: %w", filename, err)
+	}
+	return env, nil
+}
+
+func unescape(value []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+func escape(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' || value[i] == '\n' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+// Names 按顺序返回全部变量名
+func (env *Env) Names() []string {
+	return append([]string(nil), env.names...)
+}
+
+func (env *Env) Get(name string) (value string, ok bool) {
+	value, ok = env.values[name]
+	return
+}
+
+// Set 设置变量，新的变量加到最后。
+func (env *Env) Set(name, value string) {
+	if _, ok := env.values[name]; !ok {
+		env.names = append(env.names, name)
+	}
+	env.values[name] = value
+}
+
+// Unset 删除变量，返回变量是否存在。
+func (env *Env) Unset(name string) bool {
+	if _, ok := env.values[name]; !ok {
+		return false
+	}
+	delete(env.values, name)
+	for i, n := range env.names {
+		if n == name {
+			env.names = append(env.names[:i], env.names[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Bytes 返回填充到原来的大小的环境块，变量太多放不下时返回错误。
+func (env *Env) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	for _, name := range env.names {
+		if name == "" || strings.ContainsAny(name, "=\n") {
+			return nil, xerrors.Errorf("invalid variable name %q", name)
+		}
+		buf.WriteString(name + "=" + escape(env.values[name]) + "\n")
+	}
+	if buf.Len() > env.size {
+		return nil, xerrors.Errorf("grub environment block is too small: %d > %d", buf.Len(), env.size)
+	}
+	buf.Write(bytes.Repeat([]byte{padding}, env.size-buf.Len()))
+	return buf.Bytes(), nil
+}
+
+// Save 原子地写入 filename，写入中断时不会留下不完整的环境块。
+func (env *Env) Save(filename string) error {
+	data, err := env.Bytes()
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filename, data, 0644)
+}
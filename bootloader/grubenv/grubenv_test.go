@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubenv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// grub-editenv 生成的文件
+func makeTestBlock(vars string, size int) []byte {
+	data := []byte(header + vars)
+	return append(data, bytes.Repeat([]byte("#"), size-len(data))...)
+}
+
+func TestParse(t *testing.T) {
+	env, err := Parse(makeTestBlock("saved_entry=gnulinux-simple-abc\n"+
+		"deepin_ab_recovery_boot_count=2\n"+
+		"multi=a\\\nb\\\\c\n", DefaultSize))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"saved_entry", "deepin_ab_recovery_boot_count", "multi"}, env.Names())
+	value, ok := env.Get("saved_entry")
+	assert.True(t, ok)
+	assert.Equal(t, "gnulinux-simple-abc", value)
+	value, ok = env.Get("multi")
+	assert.True(t, ok)
+	assert.Equal(t, "a\nb\\c", value)
+	_, ok = env.Get("next_entry")
+	assert.False(t, ok)
+
+	_, err = Parse([]byte("saved_entry=0\n"))
+	assert.Error(t, err)
+}
+
+func TestEnvBytes(t *testing.T) {
+	vars := "saved_entry=0\nmulti=a\\\nb\\\\c\n"
+	block := makeTestBlock(vars, DefaultSize)
+	env, err := Parse(block)
+	require.NoError(t, err)
+	data, err := env.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, block, data)
+
+	env.Set("next_entry", "gnulinux-simple-abc")
+	env.Set("saved_entry", "1")
+	assert.True(t, env.Unset("multi"))
+	assert.False(t, env.Unset("multi"))
+	data, err = env.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, makeTestBlock("saved_entry=1\nnext_entry=gnulinux-simple-abc\n", DefaultSize), data)
+
+	// 保持原来的大小
+	env, err = Parse(makeTestBlock(vars, 2048))
+	require.NoError(t, err)
+	data, err = env.Bytes()
+	require.NoError(t, err)
+	assert.Len(t, data, 2048)
+
+	env = New()
+	env.Set("long", strings.Repeat("x", DefaultSize))
+	_, err = env.Bytes()
+	assert.Error(t, err)
+
+	env = New()
+	env.Set("a=b", "c")
+	_, err = env.Bytes()
+	assert.Error(t, err)
+}
+
+func TestEnvSave(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "grubenv")
+	_, err := ReadFile(filename)
+	assert.True(t, os.IsNotExist(err))
+
+	env := New()
+	env.Set("next_entry", "gnulinux-simple-abc")
+	err = env.Save(filename)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, makeTestBlock("next_entry=gnulinux-simple-abc\n", DefaultSize), data)
+	env, err = ReadFile(filename)
+	require.NoError(t, err)
+	value, _ := env.Get("next_entry")
+	assert.Equal(t, "gnulinux-simple-abc", value)
+
+	// 没有留下临时文件
+	fileInfos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, fileInfos, 1)
+}
@@ -0,0 +1,248 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubmkconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	bootloader ".."
+	"../../atomicfile"
+	"../grubenv"
+	"golang.org/x/xerrors"
+)
+
+// 由 /etc/grub.d/11_deepin_ab_recovery 读取的配置文件
+const CfgFile = "/etc/default/grub.d/11_deepin_ab_recovery.cfg"
+
+// grub-mkconfig 生成的 grub.cfg 的文件头中有这个字符串
+const generatedMark = "It is automatically generated by grub-mkconfig"
+
+const backendPriority = 20
+
+// grub.cfg 中的 00_header 在启动时把 default 设为 grubenv 中的 next_entry，并清除 next_entry
+const grubEnvNextEntryVar = "next_entry"
+
+func init() {
+	bootloader.Register(backendPriority, NewBackend)
+}
+
+// Backend 把回滚菜单项的信息写入 CfgFile，然后运行 grub-mkconfig 生成 grub.cfg
+type Backend struct {
+	opts       *bootloader.Options
+	cfgFile    string
+	content    []byte
+	updateGrub func(grubCfgFile string, envVars []string) error
+}
+
+func NewBackend(opts *bootloader.Options) bootloader.Backend {
+	return &Backend{
+		opts:       opts,
+		cfgFile:    CfgFile,
+		updateGrub: runUpdateGrub,
+	}
+}
+
+func (b *Backend) Describe() string {
+	return "grub-mkconfig"
+}
+
+// Detect 在有 grub-mkconfig 命令，并且 grub.cfg 不存在或者由 grub-mkconfig 生成时返回 true。
+func (b *Backend) Detect() bool {
+	if b.opts.NoGrubMkconfig {
+		return false
+	}
+	_, err := exec.LookPath("grub-mkconfig")
+	if err != nil {
+		return false
+	}
+	return isGeneratedByGrubMkconfig(b.opts.GrubCfgFile)
+}
+
+func isGeneratedByGrubMkconfig(grubCfgFile string) bool {
+	content, err := ioutil.ReadFile(grubCfgFile)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return bytes.Contains(content, []byte(generatedMark))
+}
+
+func formatSkipOs(p bootloader.Partition) string {
+	return fmt.Sprintf("GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST %s@%s\"\n",
+		p.Uuid, p.Device)
+}
+
+func (b *Backend) AddRecoveryEntry(entry *bootloader.RecoveryEntry) error {
+	const varPrefix = "DEEPIN_AB_RECOVERY_"
+	var buf bytes.Buffer
+	buf.WriteString(varPrefix + "BACKUP_DEVICE=" + entry.Root.Device + "\n")
+	buf.WriteString(varPrefix + "BACKUP_UUID=" + entry.Root.Uuid + "\n")
+	if entry.Root.Subvol != "" {
+		buf.WriteString(varPrefix + "BACKUP_SUBVOL=\"" + entry.Root.Subvol + "\"\n")
+	}
+	if id := entry.Root.MenuEntryId(); id != entry.Root.Uuid {
+		buf.WriteString(varPrefix + "BACKUP_ID=\"" + id + "\"\n")
+	}
+	if entry.Root.Lv {
+		// LVM 快照与原卷的文件系统 uuid 相同，回滚菜单项使用 BACKUP_DEVICE 作为 root，不影响 10_linux
+		buf.WriteString(varPrefix + "DISABLE_UUID=true\n")
+	}
+	if args := entry.Root.LuksArgs(); len(args) > 0 {
+		buf.WriteString(varPrefix + "LUKS_ARGS=\"" + strings.Join(args, " ") + "\"\n")
+	}
+	buf.WriteString(formatSkipOs(entry.Root))
+	buf.WriteString(varPrefix + "LINUX=\"" + entry.Linux + "\"\n")
+	if entry.Initrd != "" {
+		buf.WriteString(varPrefix + "INITRD=\"" + filepath.Base(entry.Initrd) + "\"\n")
+	}
+	buf.WriteString(varPrefix + "OS_DESC=\"" + entry.OsDesc + "\"\n")
+	buf.WriteString(varPrefix + "BACKUP_TIME=" + strconv.FormatInt(entry.BackupTime.Unix(), 10) + "\n")
+	if entry.BootFailureLimit > 0 {
+		buf.WriteString(varPrefix + "BOOT_FAILURE_LIMIT=" + strconv.Itoa(entry.BootFailureLimit) + "\n")
+	}
+	b.content = buf.Bytes()
+	return nil
+}
+
+func (b *Backend) RemoveRecoveryEntries(backup bootloader.Partition) error {
+	b.content = []byte(formatSkipOs(backup))
+	return nil
+}
+
+// SwitchRoot 不需要修改 root，grub-mkconfig 使用正在运行的系统的根分区。
+func (b *Backend) SwitchRoot(root, previous bootloader.Partition) error {
+	b.content = []byte(formatSkipOs(previous))
+	return nil
+}
+
+func (b *Backend) Commit() error {
+	if b.content == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(b.cfgFile), 0755)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(b.cfgFile, b.content, 0644)
+	if err != nil {
+		return xerrors.Errorf("failed to write file %q: %w", b.cfgFile, err)
+	}
+	err = b.updateGrub(b.opts.GrubCfgFile, b.opts.EnvVars)
+	if err != nil {
+		return xerrors.Errorf("run update-grub err: %w", err)
+	}
+	return nil
+}
+
+func runUpdateGrub(grubCfgFile string, envVars []string) error {
+	var cmd *exec.Cmd
+	updateGrubBin, err := exec.LookPath("update-grub")
+	if err == nil {
+		cmd = exec.Command(updateGrubBin)
+	} else {
+		// 没有 update-grub 命令
+		cmd = exec.Command("grub-mkconfig", "-o", grubCfgFile)
+	}
+
+	cmd.Env = append(os.Environ(), envVars...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (b *Backend) getGrubEnvFile() string {
+	return filepath.Join(b.opts.BootDir, "grub/grubenv")
+}
+
+// grub.cfg 中由 /etc/grub.d/11_deepin_ab_recovery 生成的部分中的菜单项 id
+var regRecoveryMenuEntryId = regexp.MustCompile(`(?s)### BEGIN /etc/grub.d/11_deepin_ab_recovery ###.*?` +
+	`\$menuentry_id_option '([^']+)'.*?### END /etc/grub.d/11_deepin_ab_recovery ###`)
+
+// 返回 misc/11_deepin_ab_recovery 生成的回滚菜单项的 id，没有回滚菜单项时返回空字符串。
+func (b *Backend) getRecoveryMenuEntryId() (string, error) {
+	content, err := ioutil.ReadFile(b.opts.GrubCfgFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	match := regRecoveryMenuEntryId.FindSubmatch(content)
+	if match == nil {
+		return "", nil
+	}
+	return string(match[1]), nil
+}
+
+// 读取 grubenv，文件不存在时返回空的环境块
+func (b *Backend) readGrubEnv() (*grubenv.Env, error) {
+	env, err := grubenv.ReadFile(b.getGrubEnvFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return grubenv.New(), nil
+		}
+		return nil, err
+	}
+	return env, nil
+}
+
+// BootRecoveryOnce 与 grub-reboot 相同，把 grubenv 中的 next_entry 设为回滚菜单项。
+func (b *Backend) BootRecoveryOnce(backup bootloader.Partition) error {
+	id, err := b.getRecoveryMenuEntryId()
+	if err != nil {
+		return err
+	}
+	// 菜单项 id 以备份分区的 UUID 结尾，子卷和逻辑卷还要加上子卷或设备名
+	if id == "" || !strings.HasSuffix(id, "-"+backup.MenuEntryId()) {
+		return xerrors.Errorf("not found recovery menu entry for %q in %q", backup.Uuid, b.opts.GrubCfgFile)
+	}
+	env, err := b.readGrubEnv()
+	if err != nil {
+		return err
+	}
+	env.Set(grubEnvNextEntryVar, id)
+	return env.Save(b.getGrubEnvFile())
+}
+
+func (b *Backend) getNextEntry() (string, error) {
+	env, err := b.readGrubEnv()
+	if err != nil {
+		return "", err
+	}
+	value, _ := env.Get(grubEnvNextEntryVar)
+	return value, nil
+}
+
+func (b *Backend) CancelBootRecoveryOnce() error {
+	ok, err := b.IsBootRecoveryOnce()
+	if err != nil || !ok {
+		return err
+	}
+	env, err := b.readGrubEnv()
+	if err != nil {
+		return err
+	}
+	env.Unset(grubEnvNextEntryVar)
+	return env.Save(b.getGrubEnvFile())
+}
+
+func (b *Backend) IsBootRecoveryOnce() (bool, error) {
+	nextEntry, err := b.getNextEntry()
+	if err != nil || nextEntry == "" {
+		return false, err
+	}
+	id, err := b.getRecoveryMenuEntryId()
+	if err != nil {
+		return false, err
+	}
+	return nextEntry == id, nil
+}
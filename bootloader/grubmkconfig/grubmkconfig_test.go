@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package grubmkconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bootloader ".."
+	"../grubenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGeneratedByGrubMkconfig(t *testing.T) {
+	dir := t.TempDir()
+	assert.True(t, isGeneratedByGrubMkconfig(filepath.Join(dir, "not-exist.cfg")))
+
+	filename := filepath.Join(dir, "grub.cfg")
+	err := ioutil.WriteFile(filename, []byte("#\n# DO NOT EDIT THIS FILE\n#\n"+
+		"# It is automatically generated by grub-mkconfig using templates\n"), 0644)
+	require.NoError(t, err)
+	assert.True(t, isGeneratedByGrubMkconfig(filename))
+
+	err = ioutil.WriteFile(filename, []byte("set default=0\n"), 0644)
+	require.NoError(t, err)
+	assert.False(t, isGeneratedByGrubMkconfig(filename))
+}
+
+func newTestBackend(t *testing.T) (*Backend, *[]string) {
+	dir := t.TempDir()
+	var calls []string
+	b := &Backend{
+		opts: &bootloader.Options{
+			BootDir:     dir,
+			GrubCfgFile: filepath.Join(dir, "grub.cfg"),
+			EnvVars:     []string{"LANG=en_US.UTF-8"},
+		},
+		cfgFile: filepath.Join(dir, "grub.d/11_deepin_ab_recovery.cfg"),
+	}
+	b.updateGrub = func(grubCfgFile string, envVars []string) error {
+		assert.Equal(t, b.opts.GrubCfgFile, grubCfgFile)
+		assert.Equal(t, b.opts.EnvVars, envVars)
+		calls = append(calls, grubCfgFile)
+		return nil
+	}
+	return b, &calls
+}
+
+func TestBackend(t *testing.T) {
+	b, calls := newTestBackend(t)
+	// 没有修改时不运行 grub-mkconfig
+	require.NoError(t, b.Commit())
+	assert.Empty(t, *calls)
+
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:             bootloader.Partition{Uuid: "abc", Device: "/dev/sda3"},
+		Linux:            "/boot/deepin-ab-recovery/vmlinuz-5.10",
+		Initrd:           "/boot/deepin-ab-recovery/initrd.img-5.10",
+		OsDesc:           "UOS 20",
+		BackupTime:       time.Unix(1654050030, 0),
+		BootFailureLimit: 3,
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	assert.Len(t, *calls, 1)
+	content, err := ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, `DEEPIN_AB_RECOVERY_BACKUP_DEVICE=/dev/sda3
+DEEPIN_AB_RECOVERY_BACKUP_UUID=abc
+GRUB_OS_PROBER_SKIP_LIST="$GRUB_OS_PROBER_SKIP_LIST abc@/dev/sda3"
+DEEPIN_AB_RECOVERY_LINUX="/boot/deepin-ab-recovery/vmlinuz-5.10"
+DEEPIN_AB_RECOVERY_INITRD="initrd.img-5.10"
+DEEPIN_AB_RECOVERY_OS_DESC="UOS 20"
+DEEPIN_AB_RECOVERY_BACKUP_TIME=1654050030
+DEEPIN_AB_RECOVERY_BOOT_FAILURE_LIMIT=3
+`, string(content))
+
+	err = b.RemoveRecoveryEntries(bootloader.Partition{Uuid: "abc", Device: "/dev/sda3"})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err = ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, "GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST abc@/dev/sda3\"\n", string(content))
+
+	// 还原后隐藏原来的系统
+	err = b.SwitchRoot(bootloader.Partition{Uuid: "abc"}, bootloader.Partition{Uuid: "def", Device: "/dev/sda2"})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err = ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, "GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST def@/dev/sda2\"\n", string(content))
+	assert.Len(t, *calls, 3)
+}
+
+func TestBackendSubvol(t *testing.T) {
+	b, _ := newTestBackend(t)
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:       bootloader.Partition{Uuid: "abc", Device: "/dev/sda2", Subvol: "@ab-backup"},
+		Linux:      "/boot/deepin-ab-recovery/vmlinuz-5.10",
+		OsDesc:     "UOS 20",
+		BackupTime: time.Unix(1654050030, 0),
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err := ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "DEEPIN_AB_RECOVERY_BACKUP_SUBVOL=\"@ab-backup\"\n")
+	assert.Contains(t, string(content), "DEEPIN_AB_RECOVERY_BACKUP_ID=\"abc-@ab-backup\"\n")
+}
+
+func TestBackendLv(t *testing.T) {
+	b, _ := newTestBackend(t)
+	backup := bootloader.Partition{Uuid: "abc", Device: "/dev/mapper/vg-backup", Lv: true}
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:       backup,
+		Linux:      "/boot/deepin-ab-recovery/vmlinuz-5.10",
+		OsDesc:     "UOS 20",
+		BackupTime: time.Unix(1654050030, 0),
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err := ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "DEEPIN_AB_RECOVERY_DISABLE_UUID=true\n")
+	assert.Contains(t, string(content), "DEEPIN_AB_RECOVERY_BACKUP_ID=\"abc-vg-backup\"\n")
+	// 不修改 10_linux 使用的全局配置
+	assert.NotContains(t, string(content), "GRUB_DISABLE_LINUX_UUID")
+
+	// 还原后只隐藏原来的系统
+	err = b.SwitchRoot(backup, bootloader.Partition{Uuid: "abc", Device: "/dev/mapper/vg-root", Lv: true})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err = ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, "GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST abc@/dev/mapper/vg-root\"\n", string(content))
+}
+
+func TestBackendLuks(t *testing.T) {
+	b, _ := newTestBackend(t)
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:       bootloader.Partition{Uuid: "abc", Device: "/dev/mapper/backup", Luks: "def"},
+		Linux:      "/boot/deepin-ab-recovery/vmlinuz-5.10",
+		OsDesc:     "UOS 20",
+		BackupTime: time.Unix(1654050030, 0),
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	content, err := ioutil.ReadFile(b.cfgFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "DEEPIN_AB_RECOVERY_LUKS_ARGS=\"rd.luks.uuid=def "+
+		"cryptdevice=UUID=def:luks-def cryptopts=target=luks-def,source=UUID=def,luks\"\n")
+	assert.NotContains(t, string(content), "BACKUP_ID")
+}
+
+func TestBackendDetect(t *testing.T) {
+	b := NewBackend(&bootloader.Options{NoGrubMkconfig: true})
+	assert.False(t, b.Detect())
+}
+
+const testGrubCfg = `### BEGIN /etc/grub.d/10_linux ###
+menuentry 'UOS 20' --class gnu-linux $menuentry_id_option 'gnulinux-simple-def' {
+}
+### END /etc/grub.d/10_linux ###
+
+### BEGIN /etc/grub.d/11_deepin_ab_recovery ###
+menuentry 'Roll back to UOS 20 (2022/6/1 10:20:30)' --class gnu-linux $menuentry_id_option 'gnulinux-simple-abc' {
+}
+### END /etc/grub.d/11_deepin_ab_recovery ###
+`
+
+func TestBackendBootRecoveryOnce(t *testing.T) {
+	b, _ := newTestBackend(t)
+	backup := bootloader.Partition{Uuid: "abc", Device: "/dev/sda3"}
+	// 没有 grub.cfg
+	assert.Error(t, b.BootRecoveryOnce(backup))
+	ok, err := b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, b.CancelBootRecoveryOnce())
+
+	err = ioutil.WriteFile(b.opts.GrubCfgFile, []byte(testGrubCfg), 0644)
+	require.NoError(t, err)
+	err = os.Mkdir(filepath.Join(b.opts.BootDir, "grub"), 0755)
+	require.NoError(t, err)
+	assert.Error(t, b.BootRecoveryOnce(bootloader.Partition{Uuid: "def"}))
+
+	err = b.BootRecoveryOnce(backup)
+	require.NoError(t, err)
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	env, err := grubenv.ReadFile(filepath.Join(b.opts.BootDir, "grub/grubenv"))
+	require.NoError(t, err)
+	nextEntry, _ := env.Get("next_entry")
+	assert.Equal(t, "gnulinux-simple-abc", nextEntry)
+
+	err = b.CancelBootRecoveryOnce()
+	require.NoError(t, err)
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// 指向其他菜单项的 next_entry 不是回滚
+	env.Set("next_entry", "gnulinux-simple-def")
+	require.NoError(t, env.Save(b.getGrubEnvFile()))
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pmoncfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bootloader ".."
+	"../../atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// PMON 固件不使用 grub，需要先于 grub 检测
+const backendPriority = 10
+
+// PMON 没有只启动一次的设置，BootRecoveryOnce 把回滚启动项设为默认启动项，并把原来的默认启动项的标题
+// 保存在 boot.cfg 所在文件夹中的这个文件里，下次启动成功后由 CancelBootRecoveryOnce 恢复。
+// 保存标题而不是序号，启动项的位置改变后仍然能找到它。
+const savedDefaultFile = "deepin-ab-recovery-default"
+
+func init() {
+	bootloader.Register(backendPriority, NewBackend)
+}
+
+// Backend 修改龙芯 PMON 固件的 boot.cfg
+type Backend struct {
+	opts *bootloader.Options
+	cfg  *PmonCfg
+}
+
+func NewBackend(opts *bootloader.Options) bootloader.Backend {
+	return &Backend{opts: opts}
+}
+
+func (b *Backend) Describe() string {
+	return "pmon " + b.opts.PmonCfgFile
+}
+
+func (b *Backend) Detect() bool {
+	if !strings.Contains(b.opts.BiosVersion, "PMON") {
+		return false
+	}
+	_, err := os.Stat(b.opts.PmonCfgFile)
+	return err == nil
+}
+
+func (b *Backend) load() (*PmonCfg, error) {
+	if b.cfg != nil {
+		return b.cfg, nil
+	}
+	cfg, err := ParsePmonCfgFile(b.opts.PmonCfgFile)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse pmon cfg file: %w", err)
+	}
+	b.cfg = cfg
+	return cfg, nil
+}
+
+func (b *Backend) AddRecoveryEntry(entry *bootloader.RecoveryEntry) error {
+	err := bootloader.CheckPlainPartition(entry.Root)
+	if err != nil {
+		return err
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+
+	// boot.cfg 中的内核路径是相对于 /boot 分区的根的
+	dir := strings.TrimPrefix(filepath.Dir(entry.Linux), b.opts.BootDir)
+	linux := filepath.Join(dir, filepath.Base(entry.Linux))
+	initrd := filepath.Join(dir, filepath.Base(entry.Initrd))
+	cfg.AddRecoveryMenuEntry(entry.TitleEn, entry.Root.Uuid, linux, initrd)
+	return nil
+}
+
+func (b *Backend) RemoveRecoveryEntries(backup bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+	return nil
+}
+
+func (b *Backend) SwitchRoot(root, previous bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	cfg.RemoveRecoveryMenuEntries()
+	err = cfg.ReplaceRootUuid(root.Uuid)
+	if err != nil {
+		return xerrors.Errorf("failed to replace root uuid: %w", err)
+	}
+	return nil
+}
+
+func (b *Backend) Commit() error {
+	if b.cfg == nil {
+		return nil
+	}
+	err := b.cfg.Save(b.opts.PmonCfgFile)
+	if err != nil {
+		return xerrors.Errorf("failed to save pmon cfg file: %w", err)
+	}
+	return nil
+}
+
+func (b *Backend) getSavedDefaultFile() string {
+	return filepath.Join(filepath.Dir(b.opts.PmonCfgFile), savedDefaultFile)
+}
+
+// 返回保存的默认启动项的标题，没有保存时 ok 为 false。
+func (b *Backend) getSavedDefault() (title string, ok bool, err error) {
+	content, err := ioutil.ReadFile(b.getSavedDefaultFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return strings.TrimSuffix(string(content), "\n"), true, nil
+}
+
+func (b *Backend) BootRecoveryOnce(backup bootloader.Partition) error {
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	if cfg.RecoveryMenuEntryIndex() < 0 {
+		return xerrors.New("not found recovery menu entry")
+	}
+	_, ok, err := b.getSavedDefault()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		err = atomicfile.WriteFile(b.getSavedDefaultFile(), []byte(cfg.DefaultTitle()+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	err = cfg.SetDefaultToRecovery()
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+func (b *Backend) CancelBootRecoveryOnce() error {
+	title, ok, err := b.getSavedDefault()
+	if err != nil || !ok {
+		return err
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return err
+	}
+	// 原来的默认启动项不存在了，或者它就是回滚启动项时，默认启动主启动项
+	if !cfg.SetDefaultTitle(title) || cfg.defaultEntry().isRecovery() {
+		if cfg.SetDefaultToPrimary() != nil {
+			cfg.SetDefault(0)
+		}
+	}
+	err = b.Commit()
+	if err != nil {
+		return err
+	}
+	return os.Remove(b.getSavedDefaultFile())
+}
+
+func (b *Backend) IsBootRecoveryOnce() (bool, error) {
+	_, ok, err := b.getSavedDefault()
+	if err != nil || !ok {
+		return false, err
+	}
+	cfg, err := b.load()
+	if err != nil {
+		return false, err
+	}
+	entry := cfg.defaultEntry()
+	return entry != nil && entry.isRecovery(), nil
+}
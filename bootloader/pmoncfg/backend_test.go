@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package pmoncfg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	bootloader ".."
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackend(t *testing.T, biosVersion string) *Backend {
+	content, err := ioutil.ReadFile("testdata/boot.cfg")
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "boot.cfg")
+	err = ioutil.WriteFile(filename, content, 0644)
+	require.NoError(t, err)
+	b := NewBackend(&bootloader.Options{
+		BootDir:     "/boot",
+		PmonCfgFile: filename,
+		BiosVersion: biosVersion,
+	})
+	return b.(*Backend)
+}
+
+func TestBackendDetect(t *testing.T) {
+	assert.True(t, newTestBackend(t, "Loongson-PMON-V3.3.0").Detect())
+	assert.False(t, newTestBackend(t, "Kunlun-A1901-V4.1.9").Detect())
+	assert.False(t, newTestBackend(t, "").Detect())
+
+	b := NewBackend(&bootloader.Options{
+		PmonCfgFile: "testdata/not-exist.cfg",
+		BiosVersion: "Loongson-PMON-V3.3.0",
+	})
+	assert.False(t, b.Detect())
+}
+
+func TestBackendAddRecoveryEntry(t *testing.T) {
+	b := newTestBackend(t, "PMON")
+	err := b.AddRecoveryEntry(&bootloader.RecoveryEntry{
+		Root:    bootloader.Partition{Uuid: "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75"},
+		Linux:   "/boot/deepin-ab-recovery/vmlinuz-4.19.0-loongson-3-desktop",
+		Initrd:  "/boot/deepin-ab-recovery/initrd.img-4.19.0-loongson-3-desktop",
+		Title:   "回滚",
+		TitleEn: "Roll back",
+	})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+
+	cfg, err := ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	require.Len(t, cfg.items, 2)
+	assert.Equal(t, testMenuEntry{
+		title:  "Roll back # ab-recovery",
+		kernel: "/dev/fs/ext2@wd0/deepin-ab-recovery/vmlinuz-4.19.0-loongson-3-desktop",
+		initrd: "/dev/fs/ext2@wd0/deepin-ab-recovery/initrd.img-4.19.0-loongson-3-desktop",
+		args:   "root=UUID=9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75 console=tty loglevel=0 quiet splash",
+	}, getTestMenuEntries(cfg)[1])
+}
+
+func TestBackendSwitchRoot(t *testing.T) {
+	const uuid = "0d7e4c2b-5a19-4f36-8e0b-9c2a1f6d3b48"
+	b := newTestBackend(t, "PMON")
+	err := b.SwitchRoot(bootloader.Partition{Uuid: uuid}, bootloader.Partition{})
+	require.NoError(t, err)
+	err = b.Commit()
+	require.NoError(t, err)
+
+	cfg, err := ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	require.Len(t, cfg.items, 1)
+	assert.Contains(t, cfg.items[0].args(), "root=UUID="+uuid)
+}
+
+func TestBackendBootRecoveryOnce(t *testing.T) {
+	b := newTestBackend(t, "PMON")
+	ok, err := b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, b.CancelBootRecoveryOnce())
+
+	err = b.BootRecoveryOnce(bootloader.Partition{})
+	require.NoError(t, err)
+	// 重复设置时保存的仍然是原来的默认启动项
+	err = b.BootRecoveryOnce(bootloader.Partition{})
+	require.NoError(t, err)
+	cfg, err := ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Default())
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	b = NewBackend(b.opts).(*Backend)
+	err = b.CancelBootRecoveryOnce()
+	require.NoError(t, err)
+	cfg, err = ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cfg.Default())
+	assert.NoFileExists(t, b.getSavedDefaultFile())
+	ok, err = b.IsBootRecoveryOnce()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// 回滚启动项被移到默认启动项之前后，仍然恢复原来的默认启动项
+	require.NoError(t, b.BootRecoveryOnce(bootloader.Partition{}))
+	cfg, err = ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	title := cfg.items[0].title()
+	cfg.items[0], cfg.items[1] = cfg.items[1], cfg.items[0]
+	cfg.SetDefault(0)
+	require.NoError(t, cfg.Save(b.opts.PmonCfgFile))
+	b = NewBackend(b.opts).(*Backend)
+	require.NoError(t, b.CancelBootRecoveryOnce())
+	cfg, err = ParsePmonCfgFile(b.opts.PmonCfgFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Default())
+	assert.Equal(t, title, cfg.DefaultTitle())
+
+	// 没有回滚启动项
+	require.NoError(t, b.RemoveRecoveryEntries(bootloader.Partition{}))
+	assert.Error(t, b.BootRecoveryOnce(bootloader.Partition{}))
+}
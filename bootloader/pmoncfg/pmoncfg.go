@@ -5,145 +5,351 @@
 package pmoncfg
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
 	"strconv"
 	"strings"
 
 	bootloader ".."
+	"../../atomicfile"
+	"golang.org/x/xerrors"
 )
 
+// menuEntry 是以 title 行开始的启动项，包括它后面的空行、注释和其他指令，直到下一个 title 之前。
 type menuEntry struct {
-	title  string
-	kernel string
-	initrd string
-	args   string
+	lines []string // 每行都带有原来的换行符，最后一行可能没有
 }
 
+// PmonCfg 是 PMON 固件的 boot.cfg，保留原来的每一行，没有修改时 Bytes 返回与原文件完全相同的内容。
 type PmonCfg struct {
-	defaultItem int
-	timeout     int
-	showMenu    int
-	items       []*menuEntry
+	global []string // 第一个 title 之前的 default、timeout、showmenu 等指令
+	items  []*menuEntry
 }
 
 const recoveryTitleSuffix = " # ab-recovery"
 const kernelPathPrefix = "/dev/fs/ext2@wd0"
 
-func ParsePmonCfgFile(filename string) (*PmonCfg, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
+// 新添加的指令使用的缩进
+const defaultIndent = "        "
 
-	cfg := &PmonCfg{}
+// 只能出现在启动项中的指令
+var menuEntryKeywords = []string{"kernel", "initrd", "args"}
 
-	var currentMenuEntry *menuEntry
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		if len(line) == 0 {
-			continue
-		}
+// 解析一行指令，返回关键字和值，空行和注释返回空的关键字。
+// 值中的 # 不是注释的开始，比如回滚启动项的 title。
+func splitDirective(line string) (keyword, value string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", ""
+	}
+	keyword = fields[0]
+	value = strings.TrimSpace(strings.TrimSpace(line)[len(keyword):])
+	return keyword, value
+}
 
-		if strings.HasPrefix(line, "default") {
-			cfg.defaultItem, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "default")))
-			if err != nil {
-				return nil, err
-			}
-			continue
+func getDirective(lines []string, keyword string) string {
+	for _, line := range lines {
+		if k, v := splitDirective(line); k == keyword {
+			return v
 		}
+	}
+	return ""
+}
 
-		if strings.HasPrefix(line, "timeout") {
-			cfg.timeout, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "timeout")))
-			if err != nil {
-				return nil, err
-			}
+// 把第一个 keyword 指令的值改为 value，保留原来的缩进，没有这个指令时返回 false。
+func setDirective(lines []string, keyword, value string) bool {
+	for i, line := range lines {
+		if k, _ := splitDirective(line); k != keyword {
 			continue
 		}
-
-		if strings.HasPrefix(line, "showmenu") {
-			cfg.showMenu, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "showmenu")))
-			if err != nil {
-				return nil, err
-			}
-			continue
+		trimmed := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(trimmed)]
+		rest := trimmed[len(keyword):]
+		sep := rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+		if sep == "" {
+			sep = " "
 		}
+		eol := line[len(strings.TrimRight(line, "\r\n")):]
+		lines[i] = indent + keyword + sep + value + eol
+		return true
+	}
+	return false
+}
 
-		if strings.HasPrefix(line, "title") {
-			if currentMenuEntry != nil {
-				cfg.items = append(cfg.items, currentMenuEntry)
-			}
+func (e *menuEntry) title() string {
+	_, title := splitDirective(e.lines[0])
+	return title
+}
 
-			currentMenuEntry = &menuEntry{
-				title: strings.TrimSpace(strings.TrimPrefix(line, "title")),
-			}
+func (e *menuEntry) kernel() string {
+	return getDirective(e.lines[1:], "kernel")
+}
 
-			continue
-		}
+func (e *menuEntry) initrd() string {
+	return getDirective(e.lines[1:], "initrd")
+}
 
-		if currentMenuEntry == nil {
-			return nil, errors.New("failed to parse pmon cfg: menu entries must start with title")
-		}
+func (e *menuEntry) args() string {
+	return getDirective(e.lines[1:], "args")
+}
 
-		if strings.HasPrefix(line, "kernel") {
-			currentMenuEntry.kernel = strings.TrimSpace(strings.TrimPrefix(line, "kernel"))
-			continue
-		}
+func (e *menuEntry) isRecovery() bool {
+	return strings.HasSuffix(e.title(), recoveryTitleSuffix)
+}
 
-		if strings.HasPrefix(line, "initrd") {
-			currentMenuEntry.initrd = strings.TrimSpace(strings.TrimPrefix(line, "initrd"))
-			continue
+// 返回 title 之后第一条指令的缩进
+func (e *menuEntry) indent() string {
+	for _, line := range e.lines[1:] {
+		if k, _ := splitDirective(line); k != "" {
+			return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
 		}
+	}
+	return defaultIndent
+}
 
-		if strings.HasPrefix(line, "args") {
-			currentMenuEntry.args = strings.TrimSpace(strings.TrimPrefix(line, "args"))
+func Parse(content []byte) (*PmonCfg, error) {
+	cfg := &PmonCfg{}
+	var current *menuEntry
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			// content 以换行符结束时 SplitAfter 返回的最后一个元素
 			continue
 		}
+		keyword, value := splitDirective(line)
+		switch keyword {
+		case "title":
+			current = &menuEntry{}
+			cfg.items = append(cfg.items, current)
+		case "default", "timeout", "showmenu":
+			_, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to parse pmon cfg: invalid %s: %w", keyword, err)
+			}
+		}
+		if current == nil {
+			for _, k := range menuEntryKeywords {
+				if keyword == k {
+					return nil, errors.New("failed to parse pmon cfg: menu entries must start with title")
+				}
+			}
+			cfg.global = append(cfg.global, line)
+		} else {
+			current.lines = append(current.lines, line)
+		}
 	}
+	return cfg, nil
+}
 
-	if currentMenuEntry != nil {
-		cfg.items = append(cfg.items, currentMenuEntry)
+func ParsePmonCfgFile(filename string) (*PmonCfg, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
+	return Parse(content)
+}
 
-	return cfg, nil
+func (cfg *PmonCfg) getInt(keyword string) int {
+	// Parse 已经检查过了
+	value, _ := strconv.Atoi(getDirective(cfg.global, keyword))
+	return value
 }
 
+// RemoveRecoveryMenuEntries 移除回滚启动项，default 仍然指向原来的启动项，它被移除时指向主启动项。
 func (cfg *PmonCfg) RemoveRecoveryMenuEntries() {
+	def := cfg.defaultEntry()
 	newEntries := make([]*menuEntry, 0, len(cfg.items))
+	removedLast := false
 	for _, item := range cfg.items {
-		if !strings.HasSuffix(item.title, recoveryTitleSuffix) {
+		removedLast = item.isRecovery()
+		if !removedLast {
 			newEntries = append(newEntries, item)
 		}
 	}
 
 	cfg.items = newEntries
+	if removedLast {
+		// 去掉 AddRecoveryMenuEntry 添加的分隔空行
+		cfg.trimTrailingBlankLines()
+	}
+	cfg.restoreDefault(def)
+}
+
+// 返回最后一个启动项或者全局指令的行
+func (cfg *PmonCfg) lastLines() *[]string {
+	if len(cfg.items) > 0 {
+		return &cfg.items[len(cfg.items)-1].lines
+	}
+	return &cfg.global
 }
 
+func (cfg *PmonCfg) trimTrailingBlankLines() {
+	lines := cfg.lastLines()
+	min := 0
+	if len(cfg.items) > 0 {
+		// 保留 title 行
+		min = 1
+	}
+	for len(*lines) > min && strings.TrimSpace((*lines)[len(*lines)-1]) == "" {
+		*lines = (*lines)[:len(*lines)-1]
+	}
+}
+
+// AddRecoveryMenuEntry 在末尾添加回滚启动项，与前面的内容之间用空行分隔，使用第一个启动项的缩进。
 func (cfg *PmonCfg) AddRecoveryMenuEntry(menuText, rootUuid, linux, initrd string) {
+	indent := defaultIndent
+	if len(cfg.items) > 0 {
+		indent = cfg.items[0].indent()
+	}
+
+	lines := cfg.lastLines()
+	if n := len(*lines); n > 0 {
+		last := (*lines)[n-1]
+		if !strings.HasSuffix(last, "\n") {
+			(*lines)[n-1] += "\n"
+		}
+		if strings.TrimSpace(last) != "" {
+			*lines = append(*lines, "\n")
+		}
+	}
+
 	cfg.items = append(cfg.items, &menuEntry{
-		title:  menuText + recoveryTitleSuffix,
-		kernel: path.Join(kernelPathPrefix, linux),
-		initrd: path.Join(kernelPathPrefix, initrd),
-		args:   fmt.Sprintf("root=UUID=%s console=tty loglevel=0 quiet splash", rootUuid),
+		lines: []string{
+			"title " + menuText + recoveryTitleSuffix + "\n",
+			indent + "kernel " + path.Join(kernelPathPrefix, linux) + "\n",
+			indent + "initrd " + path.Join(kernelPathPrefix, initrd) + "\n",
+			indent + fmt.Sprintf("args root=UUID=%s console=tty loglevel=0 quiet splash", rootUuid) + "\n",
+		},
 	})
 }
 
+// RecoveryMenuEntryIndex 返回回滚启动项的序号，没有时返回 -1。
+func (cfg *PmonCfg) RecoveryMenuEntryIndex() int {
+	for i, item := range cfg.items {
+		if item.isRecovery() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Default 返回默认启动项的序号
+func (cfg *PmonCfg) Default() int {
+	return cfg.getInt("default")
+}
+
+// 返回 default 指向的启动项，序号超出范围时返回 nil。
+func (cfg *PmonCfg) defaultEntry() *menuEntry {
+	index := cfg.Default()
+	if index < 0 || index >= len(cfg.items) {
+		return nil
+	}
+	return cfg.items[index]
+}
+
+func (cfg *PmonCfg) indexOf(entry *menuEntry) int {
+	for i, item := range cfg.items {
+		if item == entry {
+			return i
+		}
+	}
+	return -1
+}
+
+// 让 default 指向 entry，entry 不存在时指向主启动项，只在序号改变时修改。
+func (cfg *PmonCfg) restoreDefault(entry *menuEntry) {
+	if entry == nil {
+		return
+	}
+	index := cfg.indexOf(entry)
+	if index < 0 {
+		index = cfg.PrimaryMenuEntryIndex()
+	}
+	if index >= 0 && index != cfg.Default() {
+		cfg.SetDefault(index)
+	}
+}
+
+// PrimaryMenuEntryIndex 返回第一个不是回滚启动项的启动项的序号，没有时返回 -1。
+func (cfg *PmonCfg) PrimaryMenuEntryIndex() int {
+	for i, item := range cfg.items {
+		if !item.isRecovery() {
+			return i
+		}
+	}
+	return -1
+}
+
+// DefaultTitle 返回默认启动项的标题，序号超出范围时返回空字符串。
+func (cfg *PmonCfg) DefaultTitle() string {
+	entry := cfg.defaultEntry()
+	if entry == nil {
+		return ""
+	}
+	return entry.title()
+}
+
+// SetDefaultTitle 让 default 指向第一个标题为 title 的启动项，找不到时返回 false。
+func (cfg *PmonCfg) SetDefaultTitle(title string) bool {
+	for i, item := range cfg.items {
+		if item.title() == title {
+			cfg.SetDefault(i)
+			return true
+		}
+	}
+	return false
+}
+
+// SetDefaultToRecovery 让默认启动回滚启动项
+func (cfg *PmonCfg) SetDefaultToRecovery() error {
+	index := cfg.RecoveryMenuEntryIndex()
+	if index < 0 {
+		return errors.New("not found recovery menu entry")
+	}
+	cfg.SetDefault(index)
+	return nil
+}
+
+// SetDefaultToPrimary 让默认启动主启动项，见 PrimaryMenuEntryIndex
+func (cfg *PmonCfg) SetDefaultToPrimary() error {
+	index := cfg.PrimaryMenuEntryIndex()
+	if index < 0 {
+		return errors.New("not found primary menu entry")
+	}
+	cfg.SetDefault(index)
+	return nil
+}
+
+// SetDefault 修改 default 指令，没有时添加到文件开头。
+func (cfg *PmonCfg) SetDefault(index int) {
+	value := strconv.Itoa(index)
+	if !setDirective(cfg.global, "default", value) {
+		cfg.global = append([]string{"default " + value + "\n"}, cfg.global...)
+	}
+}
+
+func (cfg *PmonCfg) Timeout() int {
+	return cfg.getInt("timeout")
+}
+
+func (cfg *PmonCfg) ShowMenu() int {
+	return cfg.getInt("showmenu")
+}
+
 func (cfg *PmonCfg) ReplaceRootUuid(uuid string) error {
 	var result bool
 	for _, item := range cfg.items {
-		if strings.HasSuffix(item.title, recoveryTitleSuffix) {
+		if item.isRecovery() {
 			continue
 		}
 
 		result = true
-		item.args = bootloader.RegRootUUID.ReplaceAllString(item.args, "root=UUID="+uuid)
+		args := bootloader.RegRootUUID.ReplaceAllString(item.args(), "root=UUID="+uuid)
+		if args != item.args() {
+			setDirective(item.lines[1:], "args", args)
+		}
 	}
 
 	if result {
@@ -153,21 +359,19 @@ func (cfg *PmonCfg) ReplaceRootUuid(uuid string) error {
 	return errors.New("not found replace target")
 }
 
-func (cfg *PmonCfg) Save(filename string) error {
-	template := `
-title %s
-        kernel %s
-        initrd %s
-        args %s
-`
-
-	var content string
-	content += "default " + strconv.Itoa(cfg.defaultItem) + "\n"
-	content += "timeout " + strconv.Itoa(cfg.timeout) + "\n"
-	content += "showmenu " + strconv.Itoa(cfg.showMenu) + "\n"
+func (cfg *PmonCfg) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range cfg.global {
+		buf.WriteString(line)
+	}
 	for _, item := range cfg.items {
-		content += fmt.Sprintf(template, item.title, item.kernel, item.initrd, item.args)
+		for _, line := range item.lines {
+			buf.WriteString(line)
+		}
 	}
+	return buf.Bytes()
+}
 
-	return ioutil.WriteFile(filename, []byte(content), 0644)
+func (cfg *PmonCfg) Save(filename string) error {
+	return atomicfile.WriteFile(filename, cfg.Bytes(), 0644)
 }
@@ -5,185 +5,181 @@
 package pmoncfg
 
 import (
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestParsePmonCfgFile(t *testing.T) {
-	type args struct {
-		filename string
+const testArgs = "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19"
+
+type testMenuEntry struct {
+	title  string
+	kernel string
+	initrd string
+	args   string
+}
+
+func getTestMenuEntries(cfg *PmonCfg) []testMenuEntry {
+	var result []testMenuEntry
+	for _, item := range cfg.items {
+		result = append(result, testMenuEntry{
+			title:  item.title(),
+			kernel: item.kernel(),
+			initrd: item.initrd(),
+			args:   item.args(),
+		})
 	}
-	tests := []struct {
-		name    string
-		args    args
-		want    *PmonCfg
-		wantErr bool
-	}{
+	return result
+}
+
+func TestParsePmonCfgFile(t *testing.T) {
+	cfg, err := ParsePmonCfgFile("testdata/boot.cfg")
+	require.NoError(t, err)
+	assert.Equal(t, 0, cfg.Default())
+	assert.Equal(t, 3, cfg.Timeout())
+	assert.Equal(t, 0, cfg.ShowMenu())
+	assert.Equal(t, []testMenuEntry{
 		{
-			name: "ParsePmonCfgFile",
-			args: args{
-				filename: "testdata/boot.cfg",
-			},
-			want: &PmonCfg{
-				defaultItem: 0,
-				timeout:     3,
-				showMenu:    0,
-				items: []*menuEntry{
-					{
-						title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-					{
-						title:  "Roll back to xxxxx # ab-recovery",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-				},
-			},
-			wantErr: false,
+			title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
+			kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
+			initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
+			args:   testArgs,
 		},
 		{
-			name: "ParsePmonCfgFile_Bad",
-			args: args{
-				filename: "testdata/boot_bad.cfg",
-			},
-			wantErr: true,
+			title:  "Roll back to xxxxx # ab-recovery",
+			kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
+			initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
+			args:   testArgs,
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := ParsePmonCfgFile(tt.args.filename)
-			if tt.wantErr {
-				assert.NotNil(t, err)
-				return
-			}
-
-			assert.Equal(t, tt.want, got)
-		})
+	}, getTestMenuEntries(cfg))
+
+	_, err = ParsePmonCfgFile("testdata/boot_bad.cfg")
+	assert.Error(t, err)
+
+	_, err = Parse([]byte("default a\n"))
+	assert.Error(t, err)
+}
+
+func TestPmonCfg_Bytes(t *testing.T) {
+	for _, filename := range []string{"testdata/boot.cfg", "testdata/boot_custom.cfg"} {
+		content, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		cfg, err := Parse(content)
+		require.NoError(t, err)
+		assert.Equal(t, string(content), string(cfg.Bytes()), filename)
 	}
 }
 
 func TestPmonCfg_RemoveRecoveryMenuEntries(t *testing.T) {
-	type fields struct {
-		defaultItem int
-		timeout     int
-		showMenu    int
-		items       []*menuEntry
-	}
-	tests := []struct {
-		name  string
-		cfg   *PmonCfg
-		after *PmonCfg
-	}{
-		{
-			name: "RemoveRecoveryMenuEntries",
-			cfg: &PmonCfg{
-				defaultItem: 0,
-				timeout:     3,
-				showMenu:    0,
-				items: []*menuEntry{
-					{
-						title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-					{
-						title:  "Roll back to xxxxx # ab-recovery",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-				},
-			},
-			after: &PmonCfg{
-				defaultItem: 0,
-				timeout:     3,
-				showMenu:    0,
-				items: []*menuEntry{
-					{
-						title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-				},
-			},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.cfg.RemoveRecoveryMenuEntries()
-			assert.Equal(t, tt.after, tt.cfg)
-		})
-	}
+	cfg, err := ParsePmonCfgFile("testdata/boot.cfg")
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, -1, cfg.RecoveryMenuEntryIndex())
+	assert.Equal(t, `default 0
+timeout 3
+showmenu 0
+
+title UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop
+        kernel /dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop
+        initrd /dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop
+        args `+testArgs+"\n", string(cfg.Bytes()))
+}
+
+func TestPmonCfg_Default(t *testing.T) {
+	const content = `default 2
+title Roll back # ab-recovery
+title a
+title b
+`
+	// 回滚启动项在默认启动项之前，移除后 default 仍然指向 b
+	cfg, err := Parse([]byte(content))
+	require.NoError(t, err)
+	assert.Equal(t, "b", cfg.DefaultTitle())
+	assert.Equal(t, 1, cfg.PrimaryMenuEntryIndex())
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, "default 1\ntitle a\ntitle b\n", string(cfg.Bytes()))
+
+	// 默认启动项被移除时指向主启动项
+	cfg, err = Parse([]byte(strings.Replace(content, "default 2", "default 0", 1)))
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Equal(t, "a", cfg.DefaultTitle())
+
+	cfg, err = Parse([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, cfg.SetDefaultToRecovery())
+	assert.Equal(t, 0, cfg.Default())
+	require.NoError(t, cfg.SetDefaultToPrimary())
+	assert.Equal(t, 1, cfg.Default())
+	assert.True(t, cfg.SetDefaultTitle("b"))
+	assert.Equal(t, 2, cfg.Default())
+	assert.False(t, cfg.SetDefaultTitle("c"))
+
+	cfg.RemoveRecoveryMenuEntries()
+	assert.Error(t, cfg.SetDefaultToRecovery())
 }
 
 func TestPmonCfg_AddRecoveryMenuEntry(t *testing.T) {
-	type args struct {
-		menuText string
-		rootUUID string
-		linux    string
-		initrd   string
-	}
-	tests := []struct {
-		name  string
-		cfg   *PmonCfg
-		args  args
-		after *PmonCfg
-	}{
-		{
-			name: "AddRecoveryMenuEntry",
-			cfg: &PmonCfg{
-				defaultItem: 0,
-				timeout:     3,
-				showMenu:    0,
-				items: []*menuEntry{
-					{
-						title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-				},
-			},
-			args: args{
-				menuText: "testtitle",
-				rootUUID: "a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea",
-				linux:    "/vmlinuz",
-				initrd:   "/initrd.img",
-			},
-			after: &PmonCfg{
-				defaultItem: 0,
-				timeout:     3,
-				showMenu:    0,
-				items: []*menuEntry{
-					{
-						title:  "UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop",
-						kernel: "/dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop",
-						initrd: "/dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop",
-						args:   "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19",
-					},
-					{
-						title:  "testtitle" + recoveryTitleSuffix,
-						kernel: "/dev/fs/ext2@wd0/vmlinuz",
-						initrd: "/dev/fs/ext2@wd0/initrd.img",
-						args:   "root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea console=tty loglevel=0 quiet splash",
-					},
-				},
-			},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tt.cfg.AddRecoveryMenuEntry(tt.args.menuText, tt.args.rootUUID, tt.args.linux, tt.args.initrd)
-			assert.Equal(t, tt.after, tt.cfg)
-		})
-	}
+	cfg, err := ParsePmonCfgFile("testdata/boot.cfg")
+	require.NoError(t, err)
+	cfg.RemoveRecoveryMenuEntries()
+	cfg.AddRecoveryMenuEntry("testtitle", "a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea", "/vmlinuz", "/initrd.img")
+	assert.Equal(t, 1, cfg.RecoveryMenuEntryIndex())
+	assert.Equal(t, testMenuEntry{
+		title:  "testtitle" + recoveryTitleSuffix,
+		kernel: "/dev/fs/ext2@wd0/vmlinuz",
+		initrd: "/dev/fs/ext2@wd0/initrd.img",
+		args:   "root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea console=tty loglevel=0 quiet splash",
+	}, getTestMenuEntries(cfg)[1])
+
+	// 与旧版本的 Save 生成的内容相同
+	assert.Equal(t, `default 0
+timeout 3
+showmenu 0
+
+title UnionTech OS Desktop 20 Pro GNU/Linux 4.19.0-loongson-3-desktop
+        kernel /dev/fs/ext2@wd0/vmlinuz-4.19.0-loongson-3-desktop
+        initrd /dev/fs/ext2@wd0/initrd.img-4.19.0-loongson-3-desktop
+        args `+testArgs+`
+
+title testtitle # ab-recovery
+        kernel /dev/fs/ext2@wd0/vmlinuz
+        initrd /dev/fs/ext2@wd0/initrd.img
+        args root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea console=tty loglevel=0 quiet splash
+`, string(cfg.Bytes()))
+
+	// 空文件
+	cfg, err = Parse(nil)
+	require.NoError(t, err)
+	cfg.AddRecoveryMenuEntry("testtitle", "a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea", "/vmlinuz", "/initrd.img")
+	assert.Equal(t, 0, cfg.RecoveryMenuEntryIndex())
+}
+
+// 厂商添加的注释、缩进和其他指令在重新添加回滚启动项后保持不变
+func TestPmonCfg_RoundTrip(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/boot_custom.cfg")
+	require.NoError(t, err)
+	cfg, err := Parse(content)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.ShowMenu())
+
+	cfg.RemoveRecoveryMenuEntries()
+	cfg.AddRecoveryMenuEntry("Roll back to xxxxx", "9b2d6e41-0c8f-4a57-b3e2-6f1d4a8c0e75",
+		"/deepin-ab-recovery/vmlinuz-4.19.0-loongson-3-desktop",
+		"/deepin-ab-recovery/initrd.img-4.19.0-loongson-3-desktop")
+	assert.Equal(t, string(content), string(cfg.Bytes()))
+
+	// 只修改 default 的值
+	cfg.SetDefault(1)
+	assert.Equal(t, 1, cfg.Default())
+	assert.Contains(t, string(cfg.Bytes()), "# boot.cfg generated by vendor tool\ndefault 1\ntimeout 3\n")
+	cfg, err = Parse([]byte("timeout 3\n"))
+	require.NoError(t, err)
+	cfg.SetDefault(1)
+	assert.Equal(t, "default 1\ntimeout 3\n", string(cfg.Bytes()))
 }
 
 func TestPmonCfg_ReplaceRootUuid(t *testing.T) {
@@ -192,8 +188,24 @@ func TestPmonCfg_ReplaceRootUuid(t *testing.T) {
 	cfg, err := ParsePmonCfgFile(filename)
 	assert.NoError(t, err)
 
-	cfg.ReplaceRootUuid("a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea")
+	err = cfg.ReplaceRootUuid("a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea")
+	assert.NoError(t, err)
+
+	entries := getTestMenuEntries(cfg)
+	assert.Equal(t, "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea", entries[0].args)
+	assert.Equal(t, "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19", entries[1].args)
+
+	// 保留指令和值之间的空白
+	content, err := ioutil.ReadFile("testdata/boot_custom.cfg")
+	require.NoError(t, err)
+	cfg, err = Parse(content)
+	require.NoError(t, err)
+	err = cfg.ReplaceRootUuid("a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea")
+	assert.NoError(t, err)
+	assert.Contains(t, string(cfg.Bytes()),
+		"\targs  console=tty loglevel=0 root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea\n\tconsole ttyS0,115200\n")
 
-	assert.Equal(t, "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea", cfg.items[0].args)
-	assert.Equal(t, "console=tty loglevel=0 locales=zh_CN.UTF-8  splash quiet console=tty loglevel=0 root=UUID=14cbf2c4-9982-4f9e-be1e-71a2b3d35e19", cfg.items[1].args)
+	cfg, err = Parse([]byte("default 0\n"))
+	require.NoError(t, err)
+	assert.Error(t, cfg.ReplaceRootUuid("a13e2b9d-572f-4a25-ab8f-b2eda8c3f8ea"))
 }
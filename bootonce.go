@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"./bootloader"
+	"golang.org/x/xerrors"
+)
+
+// NextBootTarget 属性的值
+const (
+	nextBootTargetDefault = "default" // 下次启动默认启动项
+	nextBootTargetBackup  = "backup"  // 下次启动备份分区中的系统，之后恢复默认
+)
+
+// 检查能否在下次启动时启动一次备份分区中的系统，不能时返回带错误码的错误。
+func checkBootBackupOnce(cfg *Config) error {
+	rootId, err := getRootId(cfg.storageMode())
+	if err != nil {
+		return err
+	}
+	if rootId != cfg.currentId() {
+		return newJobErrorf(errCodeNotOnCurrentRoot, "root %q is not the current system %q",
+			rootId, cfg.currentId())
+	}
+	if cfg.Time == nil {
+		return newJobErrorf(errCodeBackupInvalid, "no valid backup")
+	}
+	return nil
+}
+
+func getOneShotBackend(b bootloader.Backend) (bootloader.OneShotBackend, error) {
+	ob, ok := b.(bootloader.OneShotBackend)
+	if !ok {
+		return nil, newJobErrorf(errCodeBootloaderUnsupported,
+			"bootloader %s does not support booting once", b.Describe())
+	}
+	return ob, nil
+}
+
+// 让下次启动时启动一次回滚启动项，即备份分区中的系统，不修改当前系统和备份。
+func bootBackupOnce(cfg *Config) error {
+	err := checkBootBackupOnce(cfg)
+	if err != nil {
+		return err
+	}
+	b, err := probeBootloader(nil)
+	if err != nil {
+		return err
+	}
+	ob, err := getOneShotBackend(b)
+	if err != nil {
+		return err
+	}
+	backup, err := getBackupPartition(cfg)
+	if err != nil {
+		return newJobErrorf(errCodeConfigInvalid, "failed to get backup partition: %w", err)
+	}
+	err = ob.BootRecoveryOnce(backup)
+	if err != nil {
+		return newJobErrorf(errCodeBootloaderUpdateFailed, "failed to boot backup once: %w", err)
+	}
+	return nil
+}
+
+// 用于命令行参数 -boot-backup-once，读取配置文件后调用 bootBackupOnce。
+func bootBackupOnceWithConfigFile() error {
+	var cfg Config
+	err := loadConfig(configFile, &cfg)
+	if err != nil {
+		return xerrors.Errorf("failed to load config: %w", err)
+	}
+	err = loadConfigDropIns(configDropInDir, &cfg)
+	if err != nil {
+		return err
+	}
+	err = cfg.check()
+	if err != nil {
+		return newJobErrorf(errCodeConfigInvalid, "config %q is invalid: %w", configFile, err)
+	}
+	return bootBackupOnce(&cfg)
+}
+
+// 取消 bootBackupOnce 的设置，引导程序不支持时什么也不做。
+func cancelBootBackupOnce() error {
+	b, err := probeBootloader(nil)
+	if err != nil {
+		return err
+	}
+	ob, ok := b.(bootloader.OneShotBackend)
+	if !ok {
+		return nil
+	}
+	return ob.CancelBootRecoveryOnce()
+}
+
+// 返回 NextBootTarget 属性的值，出错时返回 nextBootTargetDefault。
+func getNextBootTarget() string {
+	b, err := probeBootloader(nil)
+	if err != nil {
+		return nextBootTargetDefault
+	}
+	ob, ok := b.(bootloader.OneShotBackend)
+	if !ok {
+		return nextBootTargetDefault
+	}
+	once, err := ob.IsBootRecoveryOnce()
+	if err != nil {
+		logger.Warning("failed to check boot once:", err)
+		return nextBootTargetDefault
+	}
+	if once {
+		return nextBootTargetBackup
+	}
+	return nextBootTargetDefault
+}
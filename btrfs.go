@@ -0,0 +1,325 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"./atomicfile"
+	"./bootloader"
+	"./fstab"
+	"golang.org/x/xerrors"
+)
+
+// 挂载 btrfs 顶层子卷的选项，顶层子卷的 id 固定为 5
+const btrfsTopLevelMountOptions = "subvolid=5"
+
+// btrfs 子卷根文件夹的 inode 号固定为 256
+const btrfsSubvolRootIno = 256
+
+// 获取根文件系统挂载的子卷，相对于顶层子卷，根文件系统不是 btrfs 时返回空字符串。
+func getRootSubvol() (string, error) {
+	info, err := findMount("/")
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		return "", xerrors.New("not found mount info of /")
+	}
+	if info.FsType != "btrfs" {
+		return "", nil
+	}
+	return strings.Trim(info.Root, "/"), nil
+}
+
+func runBtrfs(args ...string) error {
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to run btrfs %s: %s: %w", strings.Join(args, " "),
+			strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func setSubvolReadOnly(path string, readOnly bool) error {
+	return runBtrfs("property", "set", "-ts", path, "ro", strconv.FormatBool(readOnly))
+}
+
+// 删除 path 处的子卷，不存在时不算错误。path 不是子卷时返回错误，避免删除普通的文件夹。
+func deleteSubvol(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() || info.Sys().(*syscall.Stat_t).Ino != btrfsSubvolRootIno {
+		return xerrors.Errorf("%q is not a btrfs subvolume", path)
+	}
+	return runBtrfs("subvolume", "delete", path)
+}
+
+// 返回 name 在快照 snapDir 中的路径。路径中的软链接可能指向快照以外，
+// 父文件夹解析软链接后不在快照中或者不存在时 ok 为 false。
+func getSnapshotPath(snapDir, name string) (path string, ok bool, err error) {
+	path = filepath.Join(snapDir, name)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if parent != snapDir && !strings.HasPrefix(parent, snapDir+"/") {
+		return "", false, nil
+	}
+	return filepath.Join(parent, filepath.Base(path)), true, nil
+}
+
+// 清除快照中备份时跳过的文件夹的内容和跳过的文件，结果与 rsync 备份时相同：跳过的文件夹为空文件夹。
+func clearSnapshotExcludes(snapDir string, dirs, files []string) error {
+	snapDir, err := filepath.EvalSymlinks(snapDir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		path, ok, err := getSnapshotPath(snapDir, dir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		fileInfoList, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, fileInfo := range fileInfoList {
+			err = os.RemoveAll(filepath.Join(path, fileInfo.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range files {
+		path, ok, err := getSnapshotPath(snapDir, file)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把 fstab 中挂载 / 的行的 subvol 选项改为 subvol，没有时添加，并删除 subvol、subvolid 选项。
+func modifyFsTabSubvol(filename, subvol string) error {
+	f, err := fstab.Load(filename)
+	if err != nil {
+		return err
+	}
+	root := f.Find("/")
+	if root == nil {
+		// 没有找到描述了挂载 / 的行
+		return xerrors.New("not found target line")
+	}
+	var options []string
+	for _, option := range root.Options() {
+		if strings.HasPrefix(option, "subvol=") || strings.HasPrefix(option, "subvolid=") {
+			continue
+		}
+		options = append(options, option)
+	}
+	err = root.SetOptions(append(options, "subvol="+subvol))
+	if err != nil {
+		return err
+	}
+	return f.Save(filename)
+}
+
+// 在快照 snapDir 中写入清单，再写入备份时间为 backupTime 的配置文件和标记文件。
+func writeSnapshotFiles(ctx context.Context, snapDir string, cfg *Config, backupTime time.Time,
+	osVersion string) error {
+	// 快照中的配置文件在最后才写入，不记录在清单中
+	err := writeManifest(ctx, snapDir, []string{configFile})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("failed to write manifest: %w", err)
+	}
+
+	snapCfg := *cfg
+	snapCfg.Time = &backupTime
+	snapCfg.Version = osVersion
+	filename := filepath.Join(snapDir, configFile)
+	err = snapCfg.save(filename)
+	if err != nil {
+		return xerrors.Errorf("failed to save config file %q: %w", filename, err)
+	}
+	err = atomicfile.WriteFile(filepath.Join(snapDir, backupPartitionMarkFile), nil, 0644)
+	if err != nil {
+		return xerrors.Errorf("failed to write backup partition mark file: %w", err)
+	}
+	return nil
+}
+
+// 子卷模式的备份，topDir 为顶层子卷的挂载点。删除原有的备份子卷，创建当前系统子卷的快照，
+// 清除快照中跳过的文件，修改 fstab，写入清单、配置和标记文件后把快照设为只读，最后添加回滚启动项。
+// 快照与当前系统共享数据，不需要 rsync。
+func backupSnapshot(ctx context.Context, cfg *Config, envVars []string, reporter progressReporter,
+	backupDevice, topDir string) (retErr error) {
+	backup := bootloader.Partition{Uuid: cfg.Backup, Device: backupDevice, Subvol: cfg.BackupSubvol}
+	currentDir := filepath.Join(topDir, cfg.CurrentSubvol)
+	snapDir := filepath.Join(topDir, cfg.BackupSubvol)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	estimate, err := estimateBackup(ctx, cfg, topDir)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("failed to estimate backup: %w", err)
+	}
+	err = estimate.check()
+	if err != nil {
+		return err
+	}
+
+	osVersion, osDesc := getOsVersionDesc()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = deleteSubvol(snapDir)
+	if err != nil {
+		return newJobErrorf(errCodeSnapshotFailed, "failed to delete old backup subvolume: %w", err)
+	}
+	err = invalidateBackup(cfg, snapDir)
+	if err != nil {
+		return xerrors.Errorf("failed to invalidate backup: %w", err)
+	}
+	// 原有的备份已失效，下次启动时不再启动它
+	err = cancelBootBackupOnce()
+	if err != nil {
+		logger.Warning("failed to cancel boot backup once:", err)
+	}
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		err := removeBootloaderRecoveryEntry(backup, envVars)
+		if err != nil {
+			logger.Warning("failed to remove recovery entry from bootloader:", err)
+		}
+	}()
+
+	_extraDirs = cfg.getExtraDirs()
+	initBackUpRecord(backupRecordPath, defaultHospiceDir)
+	recoverDeprecatedFilesOrDirs(backupRecordPath, false)
+	err = updateBackUpRecordFile(backupRecordPath)
+	if err != nil {
+		logger.Warning(err)
+		return err
+	}
+	backupExtra()
+	reporter.setPhase(jobPhaseSnapshot)
+	err = os.MkdirAll(filepath.Dir(snapDir), 0755)
+	if err != nil {
+		return newJobError(errCodeSnapshotFailed, err)
+	}
+	err = runBtrfs("subvolume", "snapshot", currentDir, snapDir)
+	if err != nil {
+		return newJobError(errCodeSnapshotFailed, err)
+	}
+	err = clearSnapshotExcludes(snapDir, cfg.getExcludeDirs(), cfg.getExcludeFiles())
+	if err != nil {
+		return xerrors.Errorf("failed to clear excludes in snapshot: %w", err)
+	}
+
+	err = modifyFsTabSubvol(filepath.Join(snapDir, "etc/fstab"), cfg.BackupSubvol)
+	if err != nil {
+		return newJobErrorf(errCodeFstabNotPatched, "failed to modify fs tab: %w", err)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reporter.setPhase(jobPhaseManifest)
+	// 快照设为只读后不能再写入，所以先写入清单、配置文件和标记文件。
+	// 启动项添加失败时快照中虽然有标记文件，但是没有启动项，不能启动它，下次备份时会被删除。
+	now := time.Now()
+	err = writeSnapshotFiles(ctx, snapDir, cfg, now, osVersion)
+	if err != nil {
+		return err
+	}
+	err = setSubvolReadOnly(snapDir, true)
+	if err != nil {
+		return newJobError(errCodeSnapshotFailed, err)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reporter.setPhase(jobPhaseKernel)
+	kFiles, err := backupKernel()
+	if err != nil {
+		return xerrors.Errorf("failed to backup kernel: %w", err)
+	}
+
+	// 进入 bootloader 阶段后不能再取消，所以要先设置阶段再检查
+	reporter.setPhase(jobPhaseBootloader)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = writeBootloaderBackupEntries(cfg, backup, osDesc, kFiles, now, envVars)
+	if err != nil {
+		return err
+	}
+
+	cfg.Time = &now
+	cfg.Version = osVersion
+	err = cfg.save(configFile)
+	if err != nil {
+		return xerrors.Errorf("failed to save config file %q: %w", configFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatRootId(t *testing.T) {
+	cfg := &Config{Current: "abc", Backup: "abc", CurrentSubvol: "@", BackupSubvol: "@ab-backup"}
+	assert.Equal(t, "abc:@", cfg.currentId())
+	assert.Equal(t, "abc:@ab-backup", cfg.backupId())
+
+	cfg = &Config{Current: "abc", Backup: "def"}
+	assert.Equal(t, "abc", cfg.currentId())
+	assert.Equal(t, "def", cfg.backupId())
+}
+
+func TestModifyFsTabSubvol(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fstab")
+	content := `# /dev/sda2
+UUID=abc	/	btrfs	rw,relatime,subvolid=256,subvol=@	0 0
+UUID=abc	/home	btrfs	rw,relatime,subvol=@home	0 0
+`
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyFsTabSubvol(filename, "@ab-backup"))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, `# /dev/sda2
+UUID=abc	/	btrfs	rw,relatime,subvol=@ab-backup	0 0
+UUID=abc	/home	btrfs	rw,relatime,subvol=@home	0 0
+`, string(data))
+
+	// 没有 subvol 选项时添加
+	require.NoError(t, ioutil.WriteFile(filename, []byte("UUID=abc / btrfs defaults 0 1\n"), 0644))
+	require.NoError(t, modifyFsTabSubvol(filename, "@ab-backup"))
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "UUID=abc / btrfs defaults,subvol=@ab-backup 0 1\n", string(data))
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("UUID=abc /home btrfs defaults 0 1\n"), 0644))
+	assert.Error(t, modifyFsTabSubvol(filename, "@ab-backup"))
+}
+
+func TestClearSnapshotExcludes(t *testing.T) {
+	snapDir := t.TempDir()
+	outside := t.TempDir()
+	for _, file := range []string{"tmp/a", "tmp/b/c", "usr/share/a.db", "usr/share/b", "data/keep"} {
+		path := filepath.Join(snapDir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "keep"), nil, 0644))
+	// 指向快照以外的软链接
+	require.NoError(t, os.Symlink(outside, filepath.Join(snapDir, "opt")))
+
+	err := clearSnapshotExcludes(snapDir, []string{"/tmp", "/opt", "/mnt"},
+		[]string{"/usr/share/a.db", "/opt/keep", "/data"})
+	require.NoError(t, err)
+
+	fileInfoList, err := ioutil.ReadDir(filepath.Join(snapDir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, fileInfoList)
+	assert.NoFileExists(t, filepath.Join(snapDir, "usr/share/a.db"))
+	assert.FileExists(t, filepath.Join(snapDir, "usr/share/b"))
+	assert.FileExists(t, filepath.Join(snapDir, "data/keep"))
+	assert.FileExists(t, filepath.Join(outside, "keep"))
+}
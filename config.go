@@ -8,14 +8,66 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
+
+	"./atomicfile"
+	"golang.org/x/xerrors"
 )
 
+// 配置片段所在的文件夹，其中的 *.json 文件按文件名顺序读取，
+// 只使用 Exclude、ExcludeFiles 和 ExtraDirs 字段。
+const configDropInDir = "/etc/deepin/ab-recovery.d"
+
+// Exclude 和 ExcludeFiles 中以此开头的项表示不再跳过之前合并的同名项，比如 "!/opt"。
+const excludeNegatePrefix = "!"
+
 type Config struct {
 	Current string
 	Backup  string
 	Version string     `json:",omitempty"`
 	Time    *time.Time `json:",omitempty"`
+
+	// btrfs 子卷模式：Current 和 Backup 是同一个 btrfs 文件系统的 uuid，当前系统和备份分别在这两个子卷中，
+	// 路径相对于顶层子卷，比如 "@" 和 "@ab-backup"。备份时创建快照，还原时交换两个子卷的角色。
+	CurrentSubvol string `json:",omitempty"`
+	BackupSubvol  string `json:",omitempty"`
+
+	// LVM 模式：当前系统和备份分别在卷组 VolumeGroup 的逻辑卷 CurrentLv 和 BackupLv 中，不使用 Current 和 Backup。
+	// CurrentLv 需要是精简卷，备份时重新创建它的精简快照作为 BackupLv，还原时交换两个逻辑卷的角色。
+	VolumeGroup string `json:",omitempty"`
+	CurrentLv   string `json:",omitempty"`
+	BackupLv    string `json:",omitempty"`
+
+	// 分区模式下分区是 LUKS 加密分区时，CurrentLuks 和 BackupLuks 为加密分区的 uuid，Current 和 Backup 仍然为其中的文件系统的 uuid。
+	// 备份时用 LuksKeyFile 中的密钥或者 TPM2 芯片中密封的密钥解锁备份分区，两个加密分区都要能用这个密钥解锁，因为还原后会交换角色。
+	CurrentLuks string `json:",omitempty"`
+	BackupLuks  string `json:",omitempty"`
+	LuksKeyFile string `json:",omitempty"`
+	LuksTpm2    bool   `json:",omitempty"`
+
+	// 以下字段与内置的默认值合并
+	Exclude      []string   `json:",omitempty"` // 备份时跳过的文件夹
+	ExcludeFiles []string   `json:",omitempty"` // 备份时跳过的文件
+	ExtraDirs    []ExtraDir `json:",omitempty"` // 不在根分区的额外备份文件夹
+
+	// 连续启动失败这么多次后，grub 默认启动回滚菜单项，为 0 时不计数
+	BootFailureLimit int `json:",omitempty"`
+
+	// 备份时在 UEFI 固件中添加直接启动备份的内核的 "Deepin Rollback" 启动项，grub 损坏时也能回滚
+	UefiBootEntry bool `json:",omitempty"`
+
+	// 从 configDropInDir 读取的配置片段，不会被保存
+	dropIns []*Config
+}
+
+// ExtraDir 对应 extraDir，字段含义相同。
+type ExtraDir struct {
+	OriginDir       string
+	HospiceChildDir string   `json:",omitempty"`
+	SpecifiedFiles  []string `json:",omitempty"`
 }
 
 func loadConfig(filename string, c *Config) error {
@@ -30,22 +82,365 @@ func loadConfig(filename string, c *Config) error {
 	return nil
 }
 
+// 读取 dir 中的配置片段，dir 不存在时不算错误。
+func loadConfigDropIns(dir string, c *Config) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	c.dropIns = nil
+	for _, file := range files {
+		var dropIn Config
+		err = loadConfig(file, &dropIn)
+		if err != nil {
+			return xerrors.Errorf("failed to load config drop-in %q: %w", file, err)
+		}
+		c.dropIns = append(c.dropIns, &dropIn)
+	}
+	return nil
+}
+
 func (c *Config) save(filename string) error {
 	content, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, content, 0644)
+	return atomicfile.WriteFile(filename, content, 0644)
+}
+
+// 获取按合并顺序排列的配置片段和配置文件自身
+func (c *Config) getLayers() []*Config {
+	layers := make([]*Config, 0, len(c.dropIns)+1)
+	layers = append(layers, c.dropIns...)
+	return append(layers, c)
 }
 
 func (c *Config) check() error {
-	if !hasDiskDevice(c.Current) {
-		return fmt.Errorf("not found current disk %q", c.Current)
+	if c.isLvm() {
+		err := c.checkLvs()
+		if err != nil {
+			return err
+		}
+	} else {
+		// 加密分区没有解锁时看不到其中的文件系统
+		current := c.Current
+		if c.CurrentLuks != "" {
+			current = c.CurrentLuks
+		}
+		if !hasDiskDevice(current) {
+			return fmt.Errorf("not found current disk %q", current)
+		}
+
+		backup := c.Backup
+		if c.BackupLuks != "" {
+			backup = c.BackupLuks
+		}
+		if !hasDiskDevice(backup) {
+			return fmt.Errorf("not found backup disk %q", backup)
+		}
+	}
+
+	if c.isLuks() {
+		err := c.checkLuks()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.isBtrfs() {
+		err := c.checkSubvols()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.checkBootFailureLimit()
+	if err != nil {
+		return err
+	}
+
+	for _, cfg := range c.getLayers() {
+		err := cfg.checkExcludes()
+		if err != nil {
+			return err
+		}
+	}
+	return checkExtraDirs(c.getExtraDirs())
+}
+
+// 当前系统和备份的存储方式
+const (
+	storageModePartition = ""      // 两个分区
+	storageModeBtrfs     = "btrfs" // 同一个 btrfs 文件系统中的两个子卷
+	storageModeLvm       = "lvm"   // 同一个卷组中的两个逻辑卷
+)
+
+func (c *Config) storageMode() string {
+	if c.isLvm() {
+		return storageModeLvm
+	}
+	if c.isBtrfs() {
+		return storageModeBtrfs
+	}
+	return storageModePartition
+}
+
+// 是否为 btrfs 子卷模式
+func (c *Config) isBtrfs() bool {
+	return c.CurrentSubvol != "" || c.BackupSubvol != ""
+}
+
+// 是否为 LVM 模式
+func (c *Config) isLvm() bool {
+	return c.VolumeGroup != "" || c.CurrentLv != "" || c.BackupLv != ""
+}
+
+// 是否有 LUKS 加密分区
+func (c *Config) isLuks() bool {
+	return c.CurrentLuks != "" || c.BackupLuks != ""
+}
+
+func (c *Config) checkLuks() error {
+	if c.storageMode() != storageModePartition {
+		return fmt.Errorf("LUKS partitions can only be used in partition mode")
+	}
+	if c.CurrentLuks == c.BackupLuks {
+		return fmt.Errorf("current and backup LUKS partitions are the same %q", c.CurrentLuks)
+	}
+	if (c.LuksKeyFile == "") == !c.LuksTpm2 {
+		return fmt.Errorf("exactly one of LuksKeyFile and LuksTpm2 must be set")
+	}
+	if c.LuksKeyFile != "" && !filepath.IsAbs(c.LuksKeyFile) {
+		return fmt.Errorf("LUKS key file %q is not an absolute path", c.LuksKeyFile)
+	}
+	return nil
+}
+
+// 启动计数由 grub 的 save_env 写入 grubenv，grub 不能在 btrfs、LVM 和 LUKS 上写入文件，
+// 这些模式下计数不会递增，所以不能设置 BootFailureLimit。
+func (c *Config) checkBootFailureLimit() error {
+	if c.BootFailureLimit < 0 || c.BootFailureLimit > maxBootFailureLimit {
+		return fmt.Errorf("invalid boot failure limit %d", c.BootFailureLimit)
 	}
+	if c.BootFailureLimit > 0 && (c.storageMode() != storageModePartition || c.isLuks()) {
+		return fmt.Errorf("boot failure limit can only be used in partition mode without LUKS")
+	}
+	return nil
+}
+
+// 备份逻辑卷在第一次备份时才创建，所以只检查当前系统的逻辑卷。
+func (c *Config) checkLvs() error {
+	if c.isBtrfs() {
+		return fmt.Errorf("btrfs subvolume and LVM mode can not be used together")
+	}
+	for _, name := range []string{c.VolumeGroup, c.CurrentLv, c.BackupLv} {
+		if !isValidLvmName(name) {
+			return fmt.Errorf("invalid LVM name %q", name)
+		}
+	}
+	if c.CurrentLv == c.BackupLv {
+		return fmt.Errorf("current and backup logical volume are the same %q", c.CurrentLv)
+	}
+	device := lvDevicePath(c.VolumeGroup, c.CurrentLv)
+	if !hasDiskDevice(device) {
+		return fmt.Errorf("not found current logical volume %q", device)
+	}
+	return nil
+}
+
+// 系统的标识，子卷模式下为 "uuid:subvol"，用于判断正在运行的是当前系统还是备份。
+func formatRootId(uuid, subvol string) string {
+	if subvol == "" {
+		return uuid
+	}
+	return uuid + ":" + subvol
+}
+
+// 当前系统的标识，与 getRootId 的结果比较，LVM 模式下为逻辑卷的设备路径。
+func (c *Config) currentId() string {
+	if c.isLvm() {
+		return lvDevicePath(c.VolumeGroup, c.CurrentLv)
+	}
+	return formatRootId(c.Current, c.CurrentSubvol)
+}
+
+// 备份的标识，与 getRootId 的结果比较，LVM 模式下为逻辑卷的设备路径。
+func (c *Config) backupId() string {
+	if c.isLvm() {
+		return lvDevicePath(c.VolumeGroup, c.BackupLv)
+	}
+	return formatRootId(c.Backup, c.BackupSubvol)
+}
+
+// 获取当前系统所在的设备，LVM 模式下为逻辑卷的设备路径，加密时为加密分区，因为还原时它可能没有解锁。
+func (c *Config) getCurrentDevice() (string, error) {
+	if c.isLvm() {
+		return lvDevicePath(c.VolumeGroup, c.CurrentLv), nil
+	}
+	if c.CurrentLuks != "" {
+		return getDeviceByUuid(c.CurrentLuks)
+	}
+	return getDeviceByUuid(c.Current)
+}
 
-	if !hasDiskDevice(c.Backup) {
-		return fmt.Errorf("not found backup disk %q", c.Backup)
+// 获取备份所在的设备，LVM 模式下为逻辑卷的设备路径，加密时为解锁后的设备，需要先用 withBackupLuks 解锁。
+func (c *Config) getBackupDevice() (string, error) {
+	if c.isLvm() {
+		return lvDevicePath(c.VolumeGroup, c.BackupLv), nil
 	}
+	if c.BackupLuks != "" {
+		return luksBackupDevice, nil
+	}
+	return getDeviceByUuid(c.Backup)
+}
 
+func (c *Config) checkSubvols() error {
+	if c.Current != c.Backup {
+		return fmt.Errorf("current %q and backup %q must be the same btrfs filesystem in subvolume mode",
+			c.Current, c.Backup)
+	}
+	for _, subvol := range []string{c.CurrentSubvol, c.BackupSubvol} {
+		if !isValidSubvol(subvol) {
+			return fmt.Errorf("invalid subvolume %q", subvol)
+		}
+	}
+	if c.CurrentSubvol == c.BackupSubvol {
+		return fmt.Errorf("current and backup subvolume are the same %q", c.CurrentSubvol)
+	}
 	return nil
 }
+
+// 子卷路径相对于顶层子卷，不能包含 ".." 和逗号，逗号会被当作挂载选项的分隔符。
+func isValidSubvol(subvol string) bool {
+	if subvol == "" || filepath.IsAbs(subvol) || filepath.Clean(subvol) != subvol ||
+		strings.Contains(subvol, ",") {
+		return false
+	}
+	for _, name := range strings.Split(subvol, "/") {
+		if !isValidFileName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) checkExcludes() error {
+	for _, list := range [][]string{c.Exclude, c.ExcludeFiles} {
+		for _, item := range list {
+			path := strings.TrimPrefix(item, excludeNegatePrefix)
+			if !filepath.IsAbs(path) || filepath.Clean(path) != path || path == "/" {
+				return fmt.Errorf("invalid exclude item %q", item)
+			}
+		}
+	}
+	return nil
+}
+
+func checkExtraDirs(dirs []extraDir) error {
+	hospiceChildDirs := make(map[string]string)
+	for _, dir := range dirs {
+		origin := dir.originDir
+		if !filepath.IsAbs(origin) || filepath.Clean(origin) != origin || origin == "/" {
+			return fmt.Errorf("invalid extra dir %q", origin)
+		}
+		hospiceChildDir := dir.hospiceChildDir
+		if hospiceChildDir == "" {
+			hospiceChildDir = filepath.Base(origin)
+		}
+		if !isValidFileName(hospiceChildDir) {
+			return fmt.Errorf("invalid hospice child dir %q of extra dir %q", hospiceChildDir, origin)
+		}
+		if other, ok := hospiceChildDirs[hospiceChildDir]; ok {
+			return fmt.Errorf("extra dirs %q and %q have the same hospice child dir %q",
+				other, origin, hospiceChildDir)
+		}
+		hospiceChildDirs[hospiceChildDir] = origin
+
+		for _, file := range dir.specifiedFiles {
+			if !isValidFileName(file) {
+				return fmt.Errorf("invalid specified file %q of extra dir %q", file, origin)
+			}
+		}
+	}
+	return nil
+}
+
+func isValidFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// 依次合并内置的默认值、配置片段和配置文件中的项，以 excludeNegatePrefix 开头的项移除之前合并的同名项。
+func mergeExcludes(defaults []string, lists ...[]string) []string {
+	result := append([]string(nil), defaults...)
+	for _, list := range lists {
+		for _, item := range list {
+			if strings.HasPrefix(item, excludeNegatePrefix) {
+				path := strings.TrimPrefix(item, excludeNegatePrefix)
+				for i, v := range result {
+					if v == path {
+						result = append(result[:i], result[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+			found := false
+			for _, v := range result {
+				if v == item {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// 获取合并后的备份时跳过的文件夹
+func (c *Config) getExcludeDirs() []string {
+	var lists [][]string
+	for _, cfg := range c.getLayers() {
+		lists = append(lists, cfg.Exclude)
+	}
+	return mergeExcludes(_skipDirs, lists...)
+}
+
+// 获取合并后的备份时跳过的文件
+func (c *Config) getExcludeFiles() []string {
+	var lists [][]string
+	for _, cfg := range c.getLayers() {
+		lists = append(lists, cfg.ExcludeFiles)
+	}
+	return mergeExcludes(_skipFiles, lists...)
+}
+
+// 获取合并后的额外备份文件夹，originDir 相同时后合并的项替换之前的项。
+func (c *Config) getExtraDirs() []extraDir {
+	result := append([]extraDir(nil), _defaultExtraDirs...)
+	for _, cfg := range c.getLayers() {
+		for _, item := range cfg.ExtraDirs {
+			dir := extraDir{
+				originDir:       item.OriginDir,
+				hospiceChildDir: item.HospiceChildDir,
+				specifiedFiles:  item.SpecifiedFiles,
+			}
+			replaced := false
+			for i, v := range result {
+				if v.originDir == dir.originDir {
+					result[i] = dir
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				result = append(result, dir)
+			}
+		}
+	}
+	return result
+}
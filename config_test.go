@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -52,3 +53,126 @@ func TestConfigCheck(t *testing.T) {
 	err = cfg.check()
 	require.NoError(t, err)
 }
+
+func TestLoadConfigDropIns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ab-recovery.d-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var cfg Config
+	err = loadConfigDropIns(filepath.Join(dir, "not-exist"), &cfg)
+	require.NoError(t, err)
+	assert.Empty(t, cfg.dropIns)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "20-b.json"),
+		[]byte(`{"Exclude":["!/opt","/srv"],"ExtraDirs":[{"OriginDir":"/var/lib/dkms","HospiceChildDir":"dkms2"}]}`), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "10-a.json"),
+		[]byte(`{"Exclude":["/srv","/home/cache"],"ExcludeFiles":["/etc/machine-id"]}`), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a drop-in"), 0644)
+	require.NoError(t, err)
+
+	cfg.Exclude = []string{"!/home/cache"}
+	cfg.ExtraDirs = []ExtraDir{{OriginDir: "/var/oem", SpecifiedFiles: []string{"license"}}}
+	err = loadConfigDropIns(dir, &cfg)
+	require.NoError(t, err)
+	require.Len(t, cfg.dropIns, 2)
+
+	excludeDirs := cfg.getExcludeDirs()
+	assert.NotContains(t, excludeDirs, "/opt")
+	assert.NotContains(t, excludeDirs, "/home/cache")
+	assert.Contains(t, excludeDirs, "/srv")
+	assert.Contains(t, excludeDirs, "/proc")
+	assert.Equal(t, append(_skipFiles[:len(_skipFiles):len(_skipFiles)], "/etc/machine-id"),
+		cfg.getExcludeFiles())
+
+	extraDirs := cfg.getExtraDirs()
+	assert.Len(t, extraDirs, len(_defaultExtraDirs)+1)
+	assert.Contains(t, extraDirs, extraDir{originDir: "/var/lib/dkms", hospiceChildDir: "dkms2"})
+	assert.Contains(t, extraDirs, extraDir{originDir: "/var/oem", specifiedFiles: []string{"license"}})
+	assert.NoError(t, checkExtraDirs(extraDirs))
+
+	// 配置片段不会被保存
+	content, err := json.Marshal(&cfg)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "/srv")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "30-c.json"), []byte(`{"Exclude":`), 0644)
+	require.NoError(t, err)
+	err = loadConfigDropIns(dir, &cfg)
+	assert.Error(t, err)
+}
+
+func TestMergeExcludes(t *testing.T) {
+	assert.Equal(t, []string{"/a", "/c", "/d"},
+		mergeExcludes([]string{"/a", "/b"}, []string{"/c", "!/b"}, nil, []string{"/d", "/a", "!/e"}))
+	assert.Empty(t, mergeExcludes(nil, []string{"!/a"}))
+}
+
+func TestConfigCheckExcludes(t *testing.T) {
+	for _, item := range []string{"/opt", "!/opt", "/usr/share/a.db"} {
+		cfg := Config{Exclude: []string{item}}
+		assert.NoError(t, cfg.checkExcludes(), item)
+	}
+	for _, item := range []string{"", "/", "!/", "opt", "/opt/", "/opt/../usr", "!opt"} {
+		cfg := Config{ExcludeFiles: []string{item}}
+		assert.Error(t, cfg.checkExcludes(), item)
+	}
+}
+
+func TestConfigCheckSubvols(t *testing.T) {
+	cfg := Config{Current: "abc", Backup: "abc", CurrentSubvol: "@", BackupSubvol: "@ab-backup"}
+	assert.True(t, cfg.isBtrfs())
+	assert.NoError(t, cfg.checkSubvols())
+
+	cfg.Backup = "def"
+	assert.Error(t, cfg.checkSubvols())
+	cfg.Backup = "abc"
+	for _, subvol := range []string{"", "/@", "@/", "@/../a", "..", "@,ro", "@"} {
+		cfg.BackupSubvol = subvol
+		assert.Error(t, cfg.checkSubvols(), subvol)
+	}
+	cfg.BackupSubvol = "snapshots/@ab-backup"
+	assert.NoError(t, cfg.checkSubvols())
+
+	assert.False(t, (&Config{Current: "abc", Backup: "def"}).isBtrfs())
+}
+
+func TestConfigCheckBootFailureLimit(t *testing.T) {
+	cfg := Config{Current: "abc", Backup: "def", BootFailureLimit: 3}
+	assert.NoError(t, cfg.checkBootFailureLimit())
+	cfg.BootFailureLimit = maxBootFailureLimit + 1
+	assert.Error(t, cfg.checkBootFailureLimit())
+	cfg.BootFailureLimit = -1
+	assert.Error(t, cfg.checkBootFailureLimit())
+
+	// grub 不能在 btrfs、LVM 和 LUKS 上写入 grubenv
+	for _, cfg := range []Config{
+		{Current: "abc", Backup: "abc", CurrentSubvol: "@", BackupSubvol: "@ab-backup"},
+		{VolumeGroup: "vg0", CurrentLv: "root", BackupLv: "root-backup"},
+		{Current: "abc", Backup: "def", CurrentLuks: "luks-a", BackupLuks: "luks-b"},
+	} {
+		cfg.BootFailureLimit = 3
+		assert.Error(t, cfg.checkBootFailureLimit(), cfg)
+		cfg.BootFailureLimit = 0
+		assert.NoError(t, cfg.checkBootFailureLimit(), cfg)
+	}
+}
+
+func TestCheckExtraDirs(t *testing.T) {
+	assert.NoError(t, checkExtraDirs(_defaultExtraDirs))
+
+	for _, dirs := range [][]extraDir{
+		{{originDir: "var/oem"}},
+		{{originDir: "/"}},
+		{{originDir: "/var/oem/"}},
+		{{originDir: "/var/oem", hospiceChildDir: "a/b"}},
+		{{originDir: "/var/oem", hospiceChildDir: ".."}},
+		{{originDir: "/var/oem", specifiedFiles: []string{"../etc"}}},
+		{{originDir: "/var/oem", specifiedFiles: []string{""}}},
+		{{originDir: "/var/a/oem"}, {originDir: "/var/b", hospiceChildDir: "oem"}},
+	} {
+		assert.Error(t, checkExtraDirs(dirs), dirs)
+	}
+}
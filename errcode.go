@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+	"golang.org/x/xerrors"
+)
+
+// 错误码，用于 JobEnd 信号、任务对象的 ErrorCode 属性，
+// 以及 D-Bus 错误名 com.deepin.ABRecovery.Error.<错误码>。
+const (
+	errCodeFailed                 = "Failed" // 未分类的错误
+	errCodeCancelled              = "Cancelled"
+	errCodeNotCancellable         = "NotCancellable"
+	errCodeNotAuthorized          = "NotAuthorized"
+	errCodeNoSpace                = "NoSpace"
+	errCodeMountFailed            = "MountFailed"
+	errCodeLuksUnlockFailed       = "LuksUnlockFailed"
+	errCodeRsyncFailed            = "RsyncFailed"
+	errCodeSnapshotFailed         = "SnapshotFailed"
+	errCodeKernelNotFound         = "KernelNotFound"
+	errCodeBootloaderUnsupported  = "BootloaderUnsupported"
+	errCodeBootloaderUpdateFailed = "BootloaderUpdateFailed"
+	errCodeFstabNotPatched        = "FstabNotPatched"
+	errCodeConfigInvalid          = "ConfigInvalid"
+	errCodeNotOnCurrentRoot       = "NotOnCurrentRoot"
+	errCodeNotOnBackupRoot        = "NotOnBackupRoot"
+	errCodeBackupInvalid          = "BackupInvalid"
+	errCodeBackupCorrupted        = "BackupCorrupted"
+	errCodeRecoveryPending        = "RecoveryPending"
+)
+
+const dbusErrorPrefix = dbusInterface + ".Error."
+
+// jobError 给错误附加错误码，可以被 xerrors.Errorf 的 %w 包装。
+type jobError struct {
+	code string
+	err  error
+}
+
+func (e *jobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *jobError) Unwrap() error {
+	return e.err
+}
+
+func newJobError(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &jobError{code: code, err: err}
+}
+
+func newJobErrorf(code string, format string, args ...interface{}) error {
+	return &jobError{code: code, err: xerrors.Errorf(format, args...)}
+}
+
+func isNoSpaceErr(err error) bool {
+	return xerrors.Is(err, syscall.ENOSPC)
+}
+
+// 获取错误链中最外层的错误码，err 为 nil 时返回空字符串。
+func getErrCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var je *jobError
+	if xerrors.As(err, &je) {
+		return je.code
+	}
+	if isNoSpaceErr(err) {
+		return errCodeNoSpace
+	}
+	if xerrors.Is(err, context.Canceled) {
+		return errCodeCancelled
+	}
+	return errCodeFailed
+}
+
+// 带错误码的错误转换为同名的 D-Bus 错误，其他错误交给 dbusutil.ToError 处理。
+func toDBusError(err error) *dbus.Error {
+	if err == nil {
+		return nil
+	}
+	var je *jobError
+	if xerrors.As(err, &je) {
+		return dbus.NewError(dbusErrorPrefix+je.code, []interface{}{err.Error()})
+	}
+	return dbusutil.ToError(err)
+}
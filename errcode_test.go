@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestGetErrCode(t *testing.T) {
+	assert.Equal(t, "", getErrCode(nil))
+	assert.Equal(t, errCodeFailed, getErrCode(errors.New("abc")))
+	assert.Equal(t, errCodeCancelled, getErrCode(context.Canceled))
+
+	err := newJobErrorf(errCodeMountFailed, "failed to mount: %w", errors.New("abc"))
+	assert.Equal(t, errCodeMountFailed, getErrCode(err))
+	assert.Equal(t, "failed to mount: abc", err.Error())
+
+	// 外层的错误码优先
+	err = newJobErrorf(errCodeBootloaderUpdateFailed, "write cfg: %w",
+		newJobError(errCodeNoSpace, errors.New("abc")))
+	assert.Equal(t, errCodeBootloaderUpdateFailed, getErrCode(err))
+
+	err = xerrors.Errorf("copy file: %w", &os.PathError{Op: "write", Path: "/boot/x", Err: syscall.ENOSPC})
+	assert.Equal(t, errCodeNoSpace, getErrCode(err))
+
+	assert.Nil(t, newJobError(errCodeFailed, nil))
+}
+
+func TestToDBusError(t *testing.T) {
+	assert.Nil(t, toDBusError(nil))
+
+	busErr := toDBusError(newJobErrorf(errCodeNoSpace, "no space"))
+	assert.Equal(t, "com.deepin.ABRecovery.Error.NoSpace", busErr.Name)
+	assert.Equal(t, []interface{}{"no space"}, busErr.Body)
+
+	busErr = toDBusError(errNotAuthorized)
+	assert.Equal(t, "com.deepin.ABRecovery.Error.NotAuthorized", busErr.Name)
+}
+
+func TestCanDo(t *testing.T) {
+	can, err := canDo(nil)
+	assert.True(t, can)
+	assert.NoError(t, err)
+
+	can, err = canDo(newJobErrorf(errCodeNotOnCurrentRoot, "abc"))
+	assert.False(t, can)
+	assert.NoError(t, err)
+
+	can, err = canDo(errors.New("abc"))
+	assert.False(t, can)
+	assert.Error(t, err)
+}
@@ -0,0 +1,319 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/godbus/dbus"
+	"golang.org/x/xerrors"
+)
+
+// 精简快照与当前系统共享数据，之后两边写入的数据都占用精简池的空间，精简池满了以后写入会失败。
+// LVM 模式下备份时精简池至少要有这么多空闲空间，用于写入清单和修改快照中的文件。
+const lvSnapshotMinFree = 256 * 1024 * 1024
+
+// backupEstimate 是备份前对空间的估算结果，单位都是字节。
+type backupEstimate struct {
+	required      uint64 // 备份根分区需要的空间
+	available     uint64 // 备份分区的可用空间，包括会被当前系统的文件替换的原有备份所占空间，LVM 模式下为精简池的空闲空间
+	bootRequired  uint64 // 备份内核和 initrd 需要的空间
+	bootAvailable uint64 // /boot 的可用空间，包括可以回收的原有内核备份所占空间
+}
+
+func (e *backupEstimate) check() error {
+	if e.required > e.available {
+		return newJobErrorf(errCodeNoSpace,
+			"not enough space on backup partition: required %d bytes, available %d bytes",
+			e.required, e.available)
+	}
+	if e.bootRequired > e.bootAvailable {
+		return newJobErrorf(errCodeNoSpace,
+			"not enough space on %s: required %d bytes, available %d bytes",
+			globalBootDir, e.bootRequired, e.bootAvailable)
+	}
+	return nil
+}
+
+// 估算备份需要的空间，backupDir 为备份分区的挂载点，子卷模式下为 btrfs 文件系统中的任意文件夹，LVM 模式下不使用。
+func estimateBackup(ctx context.Context, cfg *Config, backupDir string) (*backupEstimate, error) {
+	if cfg.isLvm() {
+		return estimateLvSnapshot(ctx, cfg)
+	}
+	var e backupEstimate
+	var err error
+	if cfg.isBtrfs() {
+		// 快照与当前系统共享数据，创建时几乎不占用空间
+		e.available, _, err = getFsSpace(backupDir)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		e.required, err = getTreeSize(ctx, "/", append(getBackupExcludes(cfg), backupDir))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get size of root: %w", err)
+		}
+
+		// rsync 会用当前系统的文件替换备份分区中同一路径的原有文件，这些文件占用的空间也算作可用空间。
+		// 当前系统中已经没有的文件由 --delete-after 在传输完成后才删除，不算作可用空间。
+		free, _, err := getFsSpace(backupDir)
+		if err != nil {
+			return nil, err
+		}
+		overwritten, err := getOverwrittenSize(ctx, backupDir, "/", getBackupExcludes(cfg))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get size of old backup: %w", err)
+		}
+		e.available = free + overwritten
+	}
+
+	err = estimateBootSpace(ctx, &e)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("backup estimate: %+v", e)
+	return &e, nil
+}
+
+// 估算 LVM 模式的备份需要的空间。精简快照创建时不复制数据，只检查精简池的空闲空间，不遍历根文件系统。
+func estimateLvSnapshot(ctx context.Context, cfg *Config) (*backupEstimate, error) {
+	free, err := getThinPoolFree(cfg.VolumeGroup, cfg.CurrentLv)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get free space of thin pool: %w", err)
+	}
+	e := backupEstimate{required: lvSnapshotMinFree, available: free}
+	err = estimateBootSpace(ctx, &e)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("backup estimate: %+v", e)
+	return &e, nil
+}
+
+// 估算复制当前内核和 initrd 需要的 /boot 空间，结果写入 e 的 bootRequired 和 bootAvailable。
+func estimateBootSpace(ctx context.Context, e *backupEstimate) error {
+	kFiles, err := findCurrentKernelFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{kFiles.linux, kFiles.initrd} {
+		if file == "" {
+			continue
+		}
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		e.bootRequired += uint64(fileInfo.Size())
+	}
+
+	bootFree, _, err := getFsSpace(globalBootDir)
+	if err != nil {
+		return err
+	}
+	e.bootAvailable = bootFree
+	// 原有的内核备份会在复制前被删除
+	for _, dir := range []string{globalKernelBackupDir, globalKernelBackupDir + ".old"} {
+		size, err := getTreeSize(ctx, dir, nil)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		e.bootAvailable += size
+	}
+	return nil
+}
+
+// 获取 dir 所在文件系统的空闲空间和已使用空间，空闲空间不包括为 root 保留的部分。
+func getFsSpace(dir string) (free, used uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("failed to statfs %s: %w", dir, err)
+	}
+	bSize := uint64(st.Bsize)
+	free = st.Bavail * bSize
+	used = (st.Blocks - st.Bfree) * bSize
+	return
+}
+
+// 统计 root 下的文件实际占用的磁盘空间，与 rsync -x 一样不跨越文件系统，
+// excludes 为要跳过的绝对路径，统计过程中消失的文件被忽略。
+// rsync 没有使用 -H 选项，硬链接会被复制为多个文件，所以硬链接按文件分别统计。
+func getTreeSize(ctx context.Context, root string, excludes []string) (uint64, error) {
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return 0, err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+
+	excludeMap := make(map[string]struct{}, len(excludes))
+	for _, exclude := range excludes {
+		excludeMap[filepath.Clean(exclude)] = struct{}{}
+	}
+
+	var size uint64
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != root {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if _, ok := excludeMap[path]; ok && path != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		st := info.Sys().(*syscall.Stat_t)
+		if uint64(st.Dev) != uint64(rootDev) {
+			// 其他文件系统的挂载点，rsync 会创建空文件夹
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		size += uint64(st.Blocks) * 512
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// 统计备份 backupDir 中会被 srcRoot 中同一路径的文件替换的文件实际占用的磁盘空间，
+// 文件夹只在 srcRoot 中的对应路径也是文件夹时继续统计。excludes 为 srcRoot 中要跳过的绝对路径，
+// rsync 不会替换或删除备份中对应的文件。
+func getOverwrittenSize(ctx context.Context, backupDir, srcRoot string, excludes []string) (uint64, error) {
+	excludeMap := make(map[string]struct{}, len(excludes))
+	for _, exclude := range excludes {
+		excludeMap[filepath.Clean(exclude)] = struct{}{}
+	}
+
+	var size uint64
+	err := filepath.Walk(backupDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != backupDir {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+		srcPath := filepath.Join(srcRoot, rel)
+		if _, ok := excludeMap[srcPath]; ok && path != backupDir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil || srcInfo.IsDir() != info.IsDir() {
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		size += uint64(info.Sys().(*syscall.Stat_t).Blocks) * 512
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (m *Manager) startEstimate() (dbus.ObjectPath, error) {
+	err := m.checkBackup()
+	if err != nil {
+		return "", err
+	}
+
+	m.PropsMu.Lock()
+	if m.BackingUp || m.estimating {
+		m.PropsMu.Unlock()
+		return "", xerrors.New("backup or estimating is in progress")
+	}
+	job, err := m.addJob(jobKindEstimate)
+	if err != nil {
+		m.PropsMu.Unlock()
+		return "", xerrors.Errorf("failed to add job: %w", err)
+	}
+	m.estimating = true
+	m.PropsMu.Unlock()
+
+	go func() {
+		e, err := m.estimateBackup()
+		if err != nil {
+			logger.Warning("failed to estimate backup:", err)
+		} else {
+			job.appendLog(fmt.Sprintf("required %d bytes, available %d bytes, boot required %d bytes, "+
+				"boot available %d bytes", e.required, e.available, e.bootRequired, e.bootAvailable))
+			m.emitSignalBackupEstimated(job, e)
+		}
+		job.finish(err)
+		m.emitSignalJobEnd(jobKindEstimate, err)
+
+		m.PropsMu.Lock()
+		m.estimating = false
+		m.PropsMu.Unlock()
+	}()
+	return job.getPath(), nil
+}
+
+func (m *Manager) estimateBackup() (*backupEstimate, error) {
+	if m.cfg.storageMode() != storageModePartition {
+		// 备份和当前系统在同一个文件系统或者精简池中，不需要挂载，备份逻辑卷也可能还不存在
+		return estimateBackup(context.Background(), &m.cfg, "/")
+	}
+	var e *backupEstimate
+	err := withBackupMount(&m.cfg, "estimate", func(dir string) error {
+		var err error
+		e, err = estimateBackup(context.Background(), &m.cfg, dir)
+		return err
+	})
+	return e, err
+}
+
+func (m *Manager) emitSignalBackupEstimated(job *Job, e *backupEstimate) {
+	err := m.service.Emit(m, "BackupEstimated", job.getPath(), e.required, e.available,
+		e.bootRequired, e.bootAvailable)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+// EstimateBackup 在后台估算备份需要的空间，遍历根文件系统可能超过 D-Bus 调用的超时时间。
+// 结果由 BackupEstimated 信号报告。
+func (m *Manager) EstimateBackup(sender dbus.Sender) (job dbus.ObjectPath, busErr *dbus.Error) {
+	err := m.checkAuthWithSender(sender, polkitActionBackup)
+	if err != nil {
+		return "", toDBusError(err)
+	}
+	job, err = m.startEstimate()
+	return job, toDBusError(err)
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getDiskUsage(t *testing.T, path string) uint64 {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	require.NoError(t, err)
+	return uint64(st.Blocks) * 512
+}
+
+func TestGetTreeSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "ab-recovery-estimate-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 64*1024)
+	for _, dir := range []string{"usr/bin", "tmp", "var/lib"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0755)
+		require.NoError(t, err)
+	}
+	for _, file := range []string{"usr/bin/a", "tmp/b", "var/lib/c", "var/lib/d"} {
+		err = ioutil.WriteFile(filepath.Join(root, file), data, 0644)
+		require.NoError(t, err)
+	}
+	err = os.Link(filepath.Join(root, "usr/bin/a"), filepath.Join(root, "usr/bin/a-link"))
+	require.NoError(t, err)
+
+	var want uint64
+	for _, path := range []string{"", "usr", "usr/bin", "usr/bin/a", "usr/bin/a", "var", "var/lib", "var/lib/c"} {
+		want += getDiskUsage(t, filepath.Join(root, path))
+	}
+
+	size, err := getTreeSize(context.Background(), root, []string{
+		filepath.Join(root, "tmp"),
+		filepath.Join(root, "var/lib/d"),
+		filepath.Join(root, "not-exist"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, want, size)
+
+	_, err = getTreeSize(context.Background(), filepath.Join(root, "not-exist"), nil)
+	assert.True(t, os.IsNotExist(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getTreeSize(ctx, root, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGetOverwrittenSize(t *testing.T) {
+	src := t.TempDir()
+	backup := t.TempDir()
+	data := make([]byte, 64*1024)
+	for _, dir := range []string{"usr/bin", "tmp", "var/lib", "opt"} {
+		for _, root := range []string{src, backup} {
+			err := os.MkdirAll(filepath.Join(root, dir), 0755)
+			require.NoError(t, err)
+		}
+	}
+	for _, file := range []string{"usr/bin/a", "tmp/b", "var/lib/c", "var/lib/d", "opt/e", "old"} {
+		err := ioutil.WriteFile(filepath.Join(backup, file), data, 0644)
+		require.NoError(t, err)
+	}
+	// 当前系统中没有 var/lib/d 和 old，opt 不是文件夹
+	for _, file := range []string{"usr/bin/a", "tmp/b", "var/lib/c"} {
+		err := ioutil.WriteFile(filepath.Join(src, file), nil, 0644)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.RemoveAll(filepath.Join(src, "opt")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "opt"), nil, 0644))
+
+	var want uint64
+	for _, path := range []string{"", "usr", "usr/bin", "usr/bin/a", "var", "var/lib", "var/lib/c"} {
+		want += getDiskUsage(t, filepath.Join(backup, path))
+	}
+	size, err := getOverwrittenSize(context.Background(), backup, src, []string{filepath.Join(src, "tmp")})
+	assert.NoError(t, err)
+	assert.Equal(t, want, size)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getOverwrittenSize(ctx, backup, src, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestBackupEstimateCheck(t *testing.T) {
+	e := &backupEstimate{
+		required:      100,
+		available:     100,
+		bootRequired:  10,
+		bootAvailable: 10,
+	}
+	assert.NoError(t, e.check())
+
+	e.required = 101
+	err := e.check()
+	assert.Equal(t, errCodeNoSpace, getErrCode(err))
+	assert.Contains(t, err.Error(), "required 101 bytes, available 100 bytes")
+
+	e.required = 100
+	e.bootRequired = 11
+	err = e.check()
+	assert.Equal(t, errCodeNoSpace, getErrCode(err))
+	assert.Contains(t, err.Error(), "required 11 bytes, available 10 bytes")
+}
@@ -8,6 +8,14 @@ import (
 
 func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 	return dbusutil.ExportedMethods{
+		{
+			Name: "BootBackupOnce",
+			Fn:   v.BootBackupOnce,
+		},
+		{
+			Name: "CancelJob",
+			Fn:   v.CancelJob,
+		},
 		{
 			Name:    "CanBackup",
 			Fn:      v.CanBackup,
@@ -18,6 +26,15 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			Fn:      v.CanRestore,
 			OutArgs: []string{"can"},
 		},
+		{
+			Name: "DiscardRecovery",
+			Fn:   v.DiscardRecovery,
+		},
+		{
+			Name:    "EstimateBackup",
+			Fn:      v.EstimateBackup,
+			OutArgs: []string{"job"},
+		},
 		{
 			Name: "StartBackup",
 			Fn:   v.StartBackup,
@@ -26,5 +43,10 @@ func (v *Manager) GetExportedMethods() dbusutil.ExportedMethods {
 			Name: "StartRestore",
 			Fn:   v.StartRestore,
 		},
+		{
+			Name:    "VerifyBackup",
+			Fn:      v.VerifyBackup,
+			OutArgs: []string{"job"},
+		},
 	}
 }
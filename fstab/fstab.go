@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fstab
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"../atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// 一条挂载记录中各字段的下标，见 fstab(5)
+const (
+	FieldSource = iota
+	FieldMountPoint
+	FieldFsType
+	FieldOptions
+	FieldFreq
+	FieldPassNo
+	numFields
+)
+
+// Line 是 fstab 中的一行，注释和空行没有字段。修改字段时只替换这个字段的文本，其他部分的格式保持不变。
+type Line struct {
+	text  string
+	spans [][2]int // 每个字段在 text 中的起止位置
+}
+
+func parseLine(text string) *Line {
+	l := &Line{text: text}
+	if strings.HasPrefix(strings.TrimSpace(text), "#") {
+		return l
+	}
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		blank := i == len(text) || text[i] == ' ' || text[i] == '\t'
+		if blank && start >= 0 {
+			l.spans = append(l.spans, [2]int{start, i})
+			start = -1
+		} else if !blank && start < 0 {
+			start = i
+		}
+	}
+	return l
+}
+
+// IsEntry 返回这一行是不是挂载记录，不是注释或空行。
+func (l *Line) IsEntry() bool {
+	return len(l.spans) > 0
+}
+
+// Field 返回第 i 个字段的原始文本，没有时返回空字符串。
+func (l *Line) Field(i int) string {
+	if i >= len(l.spans) {
+		return ""
+	}
+	return l.text[l.spans[i][0]:l.spans[i][1]]
+}
+
+// SetField 把第 i 个字段改为 value，缺少前面的字段时返回错误。
+func (l *Line) SetField(i int, value string) error {
+	if i < 0 || i >= numFields || i > len(l.spans) {
+		return xerrors.Errorf("can not set field %d of line %q", i, l.text)
+	}
+	if i == len(l.spans) {
+		// 添加到末尾，与前面的字段之间用制表符分隔
+		text := strings.TrimRight(l.text, " \t")
+		l.text = text + "\t" + value
+		l.spans = append(l.spans, [2]int{len(text) + 1, len(l.text)})
+		return nil
+	}
+	span := l.spans[i]
+	delta := len(value) - (span[1] - span[0])
+	l.text = l.text[:span[0]] + value + l.text[span[1]:]
+	l.spans[i][1] += delta
+	for j := i + 1; j < len(l.spans); j++ {
+		l.spans[j][0] += delta
+		l.spans[j][1] += delta
+	}
+	return nil
+}
+
+func (l *Line) Source() string {
+	return l.Field(FieldSource)
+}
+
+func (l *Line) SetSource(source string) error {
+	return l.SetField(FieldSource, source)
+}
+
+// MountPoint 返回反转义后的挂载点。
+func (l *Line) MountPoint() string {
+	return Unescape(l.Field(FieldMountPoint))
+}
+
+func (l *Line) FsType() string {
+	return l.Field(FieldFsType)
+}
+
+// Options 返回挂载选项，没有这个字段时返回 nil。
+func (l *Line) Options() []string {
+	options := l.Field(FieldOptions)
+	if options == "" {
+		return nil
+	}
+	return strings.Split(options, ",")
+}
+
+// SetOptions 修改挂载选项，没有这个字段时添加。
+func (l *Line) SetOptions(options []string) error {
+	return l.SetField(FieldOptions, strings.Join(options, ","))
+}
+
+func (l *Line) String() string {
+	return l.text
+}
+
+// 检查字段的数量和 freq、passno 字段的格式。
+func (l *Line) check() error {
+	if len(l.spans) < FieldOptions || len(l.spans) > numFields {
+		return xerrors.Errorf("invalid number of fields in line %q", l.text)
+	}
+	for _, i := range []int{FieldFreq, FieldPassNo} {
+		field := l.Field(i)
+		if field == "" {
+			continue
+		}
+		_, err := strconv.Atoi(field)
+		if err != nil {
+			return xerrors.Errorf("invalid field %d in line %q: %w", i, l.text, err)
+		}
+	}
+	return nil
+}
+
+// 挂载点中的空格、制表符、换行符和 \ 被转义为 \ 加三位八进制数，比如空格为 \040。
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// 第 1 个字段中用标签指定设备的方式，以及对应的 /dev/disk 中的文件夹
+var sourceTags = map[string]string{
+	"UUID":      "/dev/disk/by-uuid/",
+	"LABEL":     "/dev/disk/by-label/",
+	"PARTUUID":  "/dev/disk/by-partuuid/",
+	"PARTLABEL": "/dev/disk/by-partlabel/",
+}
+
+// ParseSource 解析第 1 个字段，返回标签和值，比如 UUID=xxx 返回 "UUID" 和 "xxx"。
+// /dev/disk 中对应的路径也返回标签，其他的返回空的标签和原来的字段。
+func ParseSource(source string) (tag, value string) {
+	if i := strings.Index(source, "="); i > 0 {
+		if _, ok := sourceTags[source[:i]]; ok {
+			return source[:i], strings.Trim(source[i+1:], `"`)
+		}
+	}
+	for tag, dir := range sourceTags {
+		if strings.HasPrefix(source, dir) {
+			return tag, source[len(dir):]
+		}
+	}
+	return "", source
+}
+
+// SourcePath 返回第 1 个字段指定的设备在 /dev 中的路径，用标签指定时为 /dev/disk 中的路径。
+func SourcePath(source string) string {
+	tag, value := ParseSource(source)
+	if tag == "" {
+		return source
+	}
+	return sourceTags[tag] + value
+}
+
+// SameSource 返回 a 和 b 是不是同一种写法指定的同一个设备，UUID=xxx 与 /dev/disk/by-uuid/xxx 相同。
+func SameSource(a, b string) bool {
+	aTag, aValue := ParseSource(a)
+	bTag, bValue := ParseSource(b)
+	return aTag == bTag && aValue == bValue
+}
+
+// File 是 fstab 文件的全部内容。
+type File struct {
+	lines []*Line
+}
+
+func Parse(content []byte) *File {
+	text := strings.TrimSuffix(string(content), "\n")
+	f := &File{}
+	if text == "" {
+		return f
+	}
+	for _, line := range strings.Split(text, "\n") {
+		f.lines = append(f.lines, parseLine(line))
+	}
+	return f
+}
+
+func Load(filename string) (*File, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content), nil
+}
+
+// Entries 返回全部挂载记录。
+func (f *File) Entries() []*Line {
+	var result []*Line
+	for _, l := range f.lines {
+		if l.IsEntry() {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+// Find 返回挂载点为 mountPoint 的第一条记录，没有时返回 nil。
+func (f *File) Find(mountPoint string) *Line {
+	for _, l := range f.Entries() {
+		if l.MountPoint() == mountPoint {
+			return l
+		}
+	}
+	return nil
+}
+
+// SetSource 把挂载点为 mountPoint 的记录的第 1 个字段改为 source。
+func (f *File) SetSource(mountPoint, source string) error {
+	l := f.Find(mountPoint)
+	if l == nil {
+		return xerrors.Errorf("not found mount point %q", mountPoint)
+	}
+	return l.SetSource(source)
+}
+
+// ReplaceSource 把第 1 个字段与 old 指向同一个设备的记录都改为 new，返回修改的数量。
+// 比如 / 所在的分区同时挂载在其他位置时，这些记录也一起修改。
+func (f *File) ReplaceSource(old, new string) int {
+	n := 0
+	for _, l := range f.Entries() {
+		if SameSource(l.Source(), old) {
+			// 记录的第 1 个字段一定存在
+			_ = l.SetSource(new)
+			n++
+		}
+	}
+	return n
+}
+
+// Check 检查每条记录的格式，并且有且只有一条挂载 / 的记录。
+func (f *File) Check() error {
+	rootCount := 0
+	for _, l := range f.Entries() {
+		err := l.check()
+		if err != nil {
+			return err
+		}
+		if l.MountPoint() == "/" {
+			rootCount++
+		}
+	}
+	if rootCount != 1 {
+		return xerrors.Errorf("found %d entries of /", rootCount)
+	}
+	return nil
+}
+
+func (f *File) Bytes() []byte {
+	var sb strings.Builder
+	for _, l := range f.lines {
+		sb.WriteString(l.text)
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String())
+}
+
+func (f *File) Save(filename string) error {
+	return atomicfile.WriteFile(filename, f.Bytes(), 0644)
+}
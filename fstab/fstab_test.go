@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fstab
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFsTab = `# /etc/fstab: static file system information.
+#
+# <file system>	<mount point>	<type>	<options>	<dump>	<pass>
+# /dev/sda2
+UUID=aaa	/	ext4	rw,relatime	0	1
+
+# /dev/sda1
+UUID=bbb	/boot	ext4	rw,relatime	0 2
+/dev/disk/by-uuid/aaa /media/root\040a ext4 ro 0 0
+LABEL=data  /data  ext4  defaults
+/swapfile none swap sw 0 0
+/data/home /home none bind
+`
+
+func TestParse(t *testing.T) {
+	f := Parse([]byte(testFsTab))
+	assert.Equal(t, testFsTab, string(f.Bytes()))
+
+	entries := f.Entries()
+	require.Len(t, entries, 6)
+	assert.Equal(t, "UUID=aaa", entries[0].Source())
+	assert.Equal(t, "/", entries[0].MountPoint())
+	assert.Equal(t, "ext4", entries[0].FsType())
+	assert.Equal(t, []string{"rw", "relatime"}, entries[0].Options())
+	assert.Equal(t, "1", entries[0].Field(FieldPassNo))
+	assert.Equal(t, "/media/root a", entries[2].MountPoint())
+	assert.Equal(t, "", entries[3].Field(FieldFreq))
+
+	assert.Equal(t, entries[3], f.Find("/data"))
+	assert.Nil(t, f.Find("/var"))
+	assert.NoError(t, f.Check())
+
+	assert.Empty(t, Parse(nil).Entries())
+	assert.Equal(t, "", string(Parse(nil).Bytes()))
+}
+
+func TestSetField(t *testing.T) {
+	f := Parse([]byte(testFsTab))
+	require.NoError(t, f.SetSource("/", "PARTUUID=ccc-02"))
+	root := f.Find("/")
+	require.NoError(t, root.SetOptions(append(root.Options(), "errors=remount-ro")))
+	assert.Equal(t, "PARTUUID=ccc-02\t/\text4\trw,relatime,errors=remount-ro\t0\t1", root.String())
+	assert.Equal(t, "1", root.Field(FieldPassNo))
+
+	// 没有的字段添加到末尾
+	l := parseLine("UUID=aaa / ext4  ")
+	require.NoError(t, l.SetOptions([]string{"defaults"}))
+	assert.Equal(t, "UUID=aaa / ext4\tdefaults", l.String())
+	assert.Equal(t, []string{"defaults"}, l.Options())
+	assert.Error(t, l.SetField(FieldPassNo, "1"))
+	assert.Error(t, l.SetField(numFields, "1"))
+
+	assert.Error(t, f.SetSource("/var", "UUID=ddd"))
+}
+
+func TestReplaceSource(t *testing.T) {
+	f := Parse([]byte(testFsTab))
+	assert.Equal(t, 2, f.ReplaceSource("UUID=aaa", "UUID=ccc"))
+	assert.Equal(t, "UUID=ccc", f.Find("/").Source())
+	assert.Equal(t, "UUID=ccc", f.Find("/media/root a").Source())
+	// 用路径指定的记录不变
+	assert.Equal(t, "/swapfile", f.Find("none").Source())
+	assert.Equal(t, "/data/home", f.Find("/home").Source())
+	assert.Equal(t, 0, f.ReplaceSource("/dev/sda2", "UUID=ddd"))
+}
+
+func TestParseSource(t *testing.T) {
+	for _, c := range []struct {
+		source, tag, value string
+	}{
+		{"UUID=aaa", "UUID", "aaa"},
+		{`LABEL="my data"`, "LABEL", "my data"},
+		{"PARTUUID=ccc-02", "PARTUUID", "ccc-02"},
+		{"/dev/disk/by-partlabel/rootb", "PARTLABEL", "rootb"},
+		{"/dev/sda2", "", "/dev/sda2"},
+		{"tmpfs", "", "tmpfs"},
+	} {
+		tag, value := ParseSource(c.source)
+		assert.Equal(t, c.tag, tag, c.source)
+		assert.Equal(t, c.value, value, c.source)
+	}
+	assert.True(t, SameSource("UUID=aaa", "/dev/disk/by-uuid/aaa"))
+	assert.False(t, SameSource("UUID=aaa", "PARTUUID=aaa"))
+	assert.Equal(t, "/dev/disk/by-label/data", SourcePath("LABEL=data"))
+	assert.Equal(t, "/dev/sda2", SourcePath("/dev/sda2"))
+}
+
+func TestCheck(t *testing.T) {
+	for _, content := range []string{
+		"UUID=bbb /boot ext4 defaults 0 2\n",
+		"UUID=aaa / ext4 defaults 0 1\nUUID=ccc / ext4 defaults 0 1\n",
+		"UUID=aaa /\n",
+		"UUID=aaa / ext4 defaults 0 1 x\n",
+		"UUID=aaa / ext4 defaults x 1\n",
+	} {
+		assert.Error(t, Parse([]byte(content)).Check(), content)
+	}
+	assert.NoError(t, Parse([]byte("UUID=aaa / ext4\n")).Check())
+}
+
+func TestUnescape(t *testing.T) {
+	assert.Equal(t, "/media/a b", Unescape(`/media/a\040b`))
+	assert.Equal(t, "/a\tb\\c\nd", Unescape(`/a\011b\134c\012d`))
+	assert.Equal(t, `/a\b`, Unescape(`/a\b`))
+	assert.Equal(t, `/a\04`, Unescape(`/a\04`))
+}
+
+func TestSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fstab")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testFsTab), 0644))
+	f, err := Load(filename)
+	require.NoError(t, err)
+	require.NoError(t, f.SetSource("/", "UUID=ccc"))
+	require.NoError(t, f.Save(filename))
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "# /dev/sda2\nUUID=ccc\t/\text4\trw,relatime\t0\t1\n")
+
+	_, err = Load(filepath.Join(t.TempDir(), "not-exist"))
+	assert.Error(t, err)
+}
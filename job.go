@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/linuxdeepin/go-lib/dbusutil"
+)
+
+const (
+	dbusJobPathPrefix = dbusPath + "/Job/"
+	dbusJobInterface  = dbusInterface + ".Job"
+
+	jobStateRunning   = "running"
+	jobStateSucceeded = "succeeded"
+	jobStateFailed    = "failed"
+	jobStateCancelled = "cancelled"
+
+	// 每个任务最多保留的日志行数
+	jobLogMaxLines = 200
+	// 最多保留的任务数，超出时移除最早结束的任务
+	jobsMaxCount = 10
+)
+
+// Job 表示一次备份或恢复任务，导出在 /com/deepin/ABRecovery/Job/N 上。
+type Job struct {
+	service      *dbusutil.Service
+	id           uint32
+	PropsMu      sync.RWMutex
+	Kind         string
+	State        string
+	StartTime    int64
+	EndTime      int64
+	Progress     float64
+	ErrorCode    string
+	ErrorMessage string
+	Log          []string
+}
+
+func newJob(service *dbusutil.Service, id uint32, kind string) *Job {
+	j := &Job{
+		service:   service,
+		id:        id,
+		Kind:      kind,
+		State:     jobStateRunning,
+		StartTime: time.Now().Unix(),
+	}
+	j.Log = []string{formatJobLog("job started")}
+	return j
+}
+
+func (j *Job) GetInterfaceName() string {
+	return dbusJobInterface
+}
+
+func (j *Job) getPath() dbus.ObjectPath {
+	return dbus.ObjectPath(dbusJobPathPrefix + strconv.FormatUint(uint64(j.id), 10))
+}
+
+func formatJobLog(msg string) string {
+	return time.Now().Format("2006-01-02 15:04:05") + " " + msg
+}
+
+func (j *Job) appendLog(msg string) {
+	j.PropsMu.Lock()
+	log := append(j.Log, formatJobLog(msg))
+	if len(log) > jobLogMaxLines {
+		log = log[len(log)-jobLogMaxLines:]
+	}
+	j.setPropLog(log)
+	j.PropsMu.Unlock()
+}
+
+func (j *Job) setProgress(progress float64) {
+	j.PropsMu.Lock()
+	j.setPropProgress(progress)
+	j.PropsMu.Unlock()
+}
+
+func (j *Job) isRunning() bool {
+	j.PropsMu.RLock()
+	running := j.State == jobStateRunning
+	j.PropsMu.RUnlock()
+	return running
+}
+
+func (j *Job) finish(err error) {
+	var state, errMsg string
+	errCode := getErrCode(err)
+	switch errCode {
+	case "":
+		state = jobStateSucceeded
+	case errCodeCancelled:
+		state = jobStateCancelled
+		errMsg = err.Error()
+	default:
+		state = jobStateFailed
+		errMsg = err.Error()
+	}
+
+	if err == nil {
+		j.appendLog("job succeeded")
+	} else {
+		j.appendLog(fmt.Sprintf("job %s: %v", state, err))
+	}
+
+	j.PropsMu.Lock()
+	if err == nil {
+		j.setPropProgress(100)
+	}
+	j.setPropErrorCode(errCode)
+	j.setPropErrorMessage(errMsg)
+	j.setPropEndTime(time.Now().Unix())
+	j.setPropState(state)
+	j.PropsMu.Unlock()
+}
+
+// 创建并导出新的任务，需要在 PropsMu 加锁后调用。
+func (m *Manager) addJob(kind string) (*Job, error) {
+	m.jobIdCounter++
+	job := newJob(m.service, m.jobIdCounter, kind)
+	err := m.service.Export(job.getPath(), job)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := append(m.jobs, job)
+	for len(jobs) > jobsMaxCount && !jobs[0].isRunning() {
+		err = m.service.StopExport(jobs[0])
+		if err != nil {
+			logger.Warning(err)
+		}
+		jobs = jobs[1:]
+	}
+	m.jobs = jobs
+
+	paths := make([]dbus.ObjectPath, 0, len(jobs))
+	for _, j := range jobs {
+		paths = append(paths, j.getPath())
+	}
+	m.setPropJobs(paths)
+	return job, nil
+}
@@ -0,0 +1,572 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"./atomicfile"
+	"./bootloader"
+	"./fstab"
+	"github.com/linuxdeepin/go-lib/strv"
+	"golang.org/x/xerrors"
+)
+
+// 还原日志，还原开始时创建，每完成一步就更新，全部步骤完成或回退后删除。
+// 服务启动时发现这个文件说明上次还原被中断了，比如断电。
+// 放在两个系统共用的 /boot 中，中断后启动的是原来的系统时也能读到并回退。
+var restoreJournalFile = "/boot/deepin-ab-recovery-journal.json"
+
+// 还原的步骤，按执行顺序排列。每一步重复执行的结果与执行一次相同，中断后从未完成的那一步重新开始。
+const (
+	restoreStepSubvol       = "subvol"        // 子卷模式下把正在运行的备份子卷设为可写
+	restoreStepFstab        = "fstab"         // 检查 fstab 中的 / 是正在运行的系统，LVM 模式下先改为正在运行的逻辑卷
+	restoreStepDDEWelcome   = "dde-welcome"   // 恢复备份时替换的 dde-welcome
+	restoreStepKernels      = "kernels"       // 把备份的内核文件复制到 /boot
+	restoreStepBootloader   = "bootloader"    // 修改引导程序配置，完成这一步后中断时只能继续完成还原
+	restoreStepKernelBackup = "kernel-backup" // 删除已经复制到 /boot 的备份内核文件，回滚启动项已经不再使用
+	restoreStepInitramfs    = "initramfs"     // 有加密分区时重新生成 initramfs，使其中的 crypttab 解锁正在运行的系统
+	restoreStepUefi         = "uefi"          // 移除固件启动菜单中的回滚启动项
+	restoreStepExtra        = "extra"         // 恢复 hospice 中的文件和额外的文件夹
+	restoreStepConfig       = "config"        // 交换配置文件中的 Current 和 Backup，以及两个子卷或逻辑卷
+	restoreStepUdevRules    = "udev-rules"    // 隐藏新的备份分区，子卷和 LVM 模式下不需要
+	restoreStepMarkFile     = "mark-file"     // 删除备份分区的标记文件和清单
+	restoreStepHooks        = "hooks"         // 适配系统激活，执行还原钩子
+)
+
+type restoreStep struct {
+	name string
+	fn   func(cfg *Config, j *restoreJournal) error
+}
+
+var restoreSteps = []restoreStep{
+	{restoreStepSubvol, restoreSubvol},
+	{restoreStepFstab, restoreFstab},
+	{restoreStepDDEWelcome, restoreDDEWelcome},
+	{restoreStepKernels, restoreKernels},
+	{restoreStepBootloader, restoreBootloader},
+	{restoreStepKernelBackup, restoreKernelBackup},
+	{restoreStepInitramfs, restoreInitramfs},
+	{restoreStepUefi, restoreUefi},
+	{restoreStepExtra, restoreExtraStep},
+	{restoreStepConfig, restoreConfig},
+	{restoreStepUdevRules, restoreUdevRules},
+	{restoreStepMarkFile, restoreMarkFile},
+	{restoreStepHooks, restoreHooks},
+}
+
+// restoreJournal 记录还原开始时的状态和已完成的步骤，继续还原时只使用这里的值，不受配置文件已被修改的影响。
+type restoreJournal struct {
+	Current       string   // 还原前的 Current 分区的 uuid，即被替换的系统
+	CurrentDevice string   // 还原前的 Current 分区的设备
+	Backup        string   // 还原前的 Backup 分区的 uuid，即正在运行的系统
+	CurrentSubvol string   `json:",omitempty"` // 子卷模式下还原前的 CurrentSubvol
+	BackupSubvol  string   `json:",omitempty"` // 子卷模式下还原前的 BackupSubvol
+	VolumeGroup   string   `json:",omitempty"` // LVM 模式下的卷组
+	CurrentLv     string   `json:",omitempty"` // LVM 模式下还原前的 CurrentLv
+	BackupLv      string   `json:",omitempty"` // LVM 模式下还原前的 BackupLv
+	CurrentLuks   string   `json:",omitempty"` // 还原前的 CurrentLuks
+	BackupLuks    string   `json:",omitempty"` // 还原前的 BackupLuks
+	EnvVars       []string // 生成启动菜单标题使用的环境变量
+	Kernels       []string // 从 globalKernelBackupDir 复制到 /boot 的文件名
+	Hooks         []string `json:",omitempty"` // 已经执行完的激活适配程序和还原钩子
+	Done          []string // 已完成的步骤
+
+	filename string
+}
+
+func newRestoreJournal(filename string, cfg *Config, currentDevice string, envVars []string) *restoreJournal {
+	return &restoreJournal{
+		Current:       cfg.Current,
+		CurrentDevice: currentDevice,
+		Backup:        cfg.Backup,
+		CurrentSubvol: cfg.CurrentSubvol,
+		BackupSubvol:  cfg.BackupSubvol,
+		VolumeGroup:   cfg.VolumeGroup,
+		CurrentLv:     cfg.CurrentLv,
+		BackupLv:      cfg.BackupLv,
+		CurrentLuks:   cfg.CurrentLuks,
+		BackupLuks:    cfg.BackupLuks,
+		EnvVars:       envVars,
+		filename:      filename,
+	}
+}
+
+// 读取还原日志，文件不存在时返回 nil。
+// 不能解析的还原日志无法继续或回退，改名为 .corrupt 后当作不存在，以免一直不能备份和还原。
+func loadRestoreJournal(filename string) (*restoreJournal, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var j restoreJournal
+	err = json.Unmarshal(content, &j)
+	if err != nil {
+		logger.Warningf("failed to parse restore journal %q: %v", filename, err)
+		renameErr := os.Rename(filename, filename+".corrupt")
+		if renameErr != nil {
+			return nil, xerrors.Errorf("failed to move corrupt restore journal %q aside: %w", filename, renameErr)
+		}
+		return nil, nil
+	}
+	j.filename = filename
+	return &j, nil
+}
+
+func (j *restoreJournal) save() error {
+	content, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(j.filename), 0755)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(j.filename, content, 0644)
+}
+
+func (j *restoreJournal) remove() error {
+	err := os.Remove(j.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 还原开始时配置中描述当前系统和备份的部分
+func (j *restoreJournal) config() *Config {
+	return &Config{
+		Current:       j.Current,
+		Backup:        j.Backup,
+		CurrentSubvol: j.CurrentSubvol,
+		BackupSubvol:  j.BackupSubvol,
+		VolumeGroup:   j.VolumeGroup,
+		CurrentLv:     j.CurrentLv,
+		BackupLv:      j.BackupLv,
+		CurrentLuks:   j.CurrentLuks,
+		BackupLuks:    j.BackupLuks,
+	}
+}
+
+// 还原后启动的系统，即正在运行的备份，和被替换的系统。
+func (j *restoreJournal) getPartitions() (root, previous bootloader.Partition, err error) {
+	root = bootloader.Partition{Uuid: j.Backup, Subvol: j.BackupSubvol, Luks: j.BackupLuks}
+	previous = bootloader.Partition{Uuid: j.Current, Device: j.CurrentDevice, Subvol: j.CurrentSubvol,
+		Luks: j.CurrentLuks}
+	if j.VolumeGroup != "" {
+		root.Device = lvDevicePath(j.VolumeGroup, j.BackupLv)
+		root.Uuid, err = getDeviceUuid(root.Device)
+		if err != nil {
+			return root, previous, xerrors.Errorf("failed to get uuid of %q: %w", root.Device, err)
+		}
+		// 精简快照与原卷的文件系统 uuid 相同
+		previous.Uuid = root.Uuid
+		root.Lv, previous.Lv = true, true
+	}
+	return root, previous, nil
+}
+
+func (j *restoreJournal) isDone(step string) bool {
+	for _, s := range j.Done {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *restoreJournal) markDone(step string) error {
+	j.Done = append(j.Done, step)
+	err := j.save()
+	if err != nil {
+		return xerrors.Errorf("failed to save restore journal: %w", err)
+	}
+	return nil
+}
+
+// 引导程序配置已经修改，下次启动的是还原后的系统，中断后只能继续完成。
+func (j *restoreJournal) canRollback() bool {
+	return !j.isDone(restoreStepBootloader)
+}
+
+// 从第一个未完成的步骤开始执行还原，全部完成后删除还原日志。
+func runRestoreJournal(cfg *Config, j *restoreJournal) error {
+	for _, step := range restoreSteps {
+		if j.isDone(step.name) {
+			continue
+		}
+		logger.Debug("restore step:", step.name)
+		err := step.fn(cfg, j)
+		if err != nil {
+			return err
+		}
+		err = j.markDone(step.name)
+		if err != nil {
+			return err
+		}
+	}
+	return j.remove()
+}
+
+// 回退还没有修改引导程序配置的还原。备份的内核文件在修改引导程序配置之后才删除，回滚启动项仍然可用，
+// 子卷模式下把备份子卷重新设为只读，最后删除还原日志。
+func rollbackRestoreJournal(j *restoreJournal) error {
+	if !j.canRollback() {
+		return xerrors.New("bootloader has been switched, can not roll back")
+	}
+	if j.isDone(restoreStepSubvol) {
+		err := rollbackSubvol(j)
+		if err != nil {
+			return err
+		}
+	}
+	return j.remove()
+}
+
+// 继续完成或者回退被中断的还原。只有在还原所用的系统上才继续完成；
+// 回退只需要还原日志和 /boot 中的文件，在两个系统上都可以。
+func resumeRestoreJournal(cfg *Config, j *restoreJournal) error {
+	if j.canRollback() {
+		logger.Info("roll back interrupted restore")
+		return rollbackRestoreJournal(j)
+	}
+	jCfg := j.config()
+	backupId := jCfg.backupId()
+	rootId, err := getRootId(jCfg.storageMode())
+	if err != nil {
+		return err
+	}
+	if rootId != backupId {
+		return newJobErrorf(errCodeNotOnBackupRoot, "root %q is not the restored system %q",
+			rootId, backupId)
+	}
+	logger.Info("complete interrupted restore, done steps:", j.Done)
+	return runRestoreJournal(cfg, j)
+}
+
+// 备份子卷是只读快照，还原后作为当前系统使用，要先设为可写。
+// 撤销 restoreSubvol，把备份子卷设为只读。在备份子卷上运行时直接修改 /，
+// 否则是重启后在原来的系统上回退，挂载顶层子卷后修改。
+func rollbackSubvol(j *restoreJournal) error {
+	if j.BackupSubvol == "" {
+		return nil
+	}
+	rootSubvol, err := getRootSubvol()
+	if err != nil {
+		return err
+	}
+	if rootSubvol == j.BackupSubvol {
+		return setSubvolReadOnly("/", true)
+	}
+	device, err := getDeviceByUuid(j.Backup)
+	if err != nil {
+		return err
+	}
+	return withPrivateMountOptions(device, btrfsTopLevelMountOptions, "rollback", func(dir string) error {
+		return setSubvolReadOnly(filepath.Join(dir, j.BackupSubvol), true)
+	})
+}
+
+func restoreSubvol(cfg *Config, j *restoreJournal) error {
+	if j.BackupSubvol == "" {
+		return nil
+	}
+	err := setSubvolReadOnly("/", false)
+	if err != nil {
+		return newJobError(errCodeSnapshotFailed, err)
+	}
+	return nil
+}
+
+// LVM 模式下备份时已经修改过逻辑卷中的 fstab，这里再改一次，保证还原后挂载的是正在运行的逻辑卷。
+// 还原后默认启动正在运行的系统，所以在修改引导程序配置之前检查它的 fstab，这时失败还能回退。
+func restoreFstab(cfg *Config, j *restoreJournal) error {
+	if j.VolumeGroup != "" {
+		err := modifyFsTab("/etc/fstab", lvDevicePath(j.VolumeGroup, j.BackupLv))
+		if err != nil {
+			return newJobErrorf(errCodeFstabNotPatched, "failed to modify fs tab: %w", err)
+		}
+	}
+	err := checkFsTabRoot("/etc/fstab", j)
+	if err != nil {
+		return newJobErrorf(errCodeFstabNotPatched, "invalid fs tab: %w", err)
+	}
+	return nil
+}
+
+// 检查 fstab 的格式，以及其中挂载的 / 是不是正在运行的系统，即还原前的备份。
+func checkFsTabRoot(filename string, j *restoreJournal) error {
+	f, err := fstab.Load(filename)
+	if err != nil {
+		return err
+	}
+	err = f.Check()
+	if err != nil {
+		return err
+	}
+	root := f.Find("/")
+	device, err := filepath.EvalSymlinks(fstab.SourcePath(root.Source()))
+	if err != nil {
+		return xerrors.Errorf("failed to find device of %q: %w", root.Source(), err)
+	}
+
+	if j.VolumeGroup != "" {
+		// 精简快照与原卷的文件系统 uuid 相同，只能比较设备
+		want, err := filepath.EvalSymlinks(lvDevicePath(j.VolumeGroup, j.BackupLv))
+		if err != nil {
+			return err
+		}
+		if device != want {
+			return xerrors.Errorf("root %q is not the running logical volume %q", root.Source(), want)
+		}
+		return nil
+	}
+
+	uuid, err := getDeviceUuid(device)
+	if err != nil {
+		return err
+	}
+	if uuid != j.Backup {
+		return xerrors.Errorf("root %q is not the running system %q", root.Source(), j.Backup)
+	}
+	if j.BackupSubvol != "" {
+		var subvol string
+		for _, option := range root.Options() {
+			if strings.HasPrefix(option, "subvol=") {
+				subvol = strings.Trim(strings.TrimPrefix(option, "subvol="), "/")
+			}
+		}
+		if subvol != j.BackupSubvol {
+			return xerrors.Errorf("root subvolume %q is not the running subvolume %q", subvol, j.BackupSubvol)
+		}
+	}
+	return nil
+}
+
+func restoreDDEWelcome(cfg *Config, j *restoreJournal) error {
+	_, err := os.Stat(ddeWelcomeFile + ".save")
+	if err == nil {
+		err = os.Rename(ddeWelcomeFile+".save", ddeWelcomeFile)
+		if err != nil {
+			logger.Warning("failed to restore dde-welcome:", err)
+		}
+	}
+	return nil
+}
+
+// 将 /boot/deepin-ab-recovery 文件夹中的内核文件复制到 /boot，先记录文件名，修改引导程序配置之后再删除。
+func restoreKernels(cfg *Config, j *restoreJournal) error {
+	fileInfoList, err := ioutil.ReadDir(globalKernelBackupDir)
+	if err != nil {
+		return newJobErrorf(errCodeKernelNotFound, "failed to read dir %s: %w", globalKernelBackupDir, err)
+	}
+
+	for _, info := range fileInfoList {
+		if !strv.Strv(j.Kernels).Contains(info.Name()) {
+			j.Kernels = append(j.Kernels, info.Name())
+		}
+	}
+	err = j.save()
+	if err != nil {
+		return xerrors.Errorf("failed to save restore journal: %w", err)
+	}
+	for _, info := range fileInfoList {
+		err = copyKernelFile(filepath.Join(globalKernelBackupDir, info.Name()), filepath.Join(globalBootDir, info.Name()))
+		if err != nil {
+			logger.Warning("copy recovery file failed:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// 先复制到临时文件再重命名，中断时 /boot 中同名的文件不会只写了一半，当前系统可能正在使用它。
+func copyKernelFile(src, dst string) error {
+	tmp := dst + ".ab-recovery-tmp"
+	out, err := exec.Command("cp", "-a", src, tmp).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to copy kernel file %q: %s: %w", src, strings.TrimSpace(string(out)), err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+func restoreKernelBackup(cfg *Config, j *restoreJournal) error {
+	for _, name := range j.Kernels {
+		err := os.Remove(filepath.Join(globalKernelBackupDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warning("failed to remove kernel backup:", err)
+		}
+	}
+	return nil
+}
+
+func restoreBootloader(cfg *Config, j *restoreJournal) error {
+	err := cancelBootBackupOnce()
+	if err != nil {
+		logger.Warning("failed to cancel boot backup once:", err)
+	}
+	root, previous, err := j.getPartitions()
+	if err != nil {
+		return newJobError(errCodeBootloaderUpdateFailed, err)
+	}
+	err = writeBootloaderCfgRestore(root, previous, j.EnvVars)
+	if err != nil {
+		return newJobErrorf(errCodeBootloaderUpdateFailed, "failed to write grub cfg: %w", err)
+	}
+	return nil
+}
+
+// 还原后启动的内核是备份时复制的，它的 initramfs 中的 crypttab 解锁的是原来的系统所在的加密分区。
+func restoreInitramfs(cfg *Config, j *restoreJournal) error {
+	if j.CurrentLuks == "" && j.BackupLuks == "" {
+		return nil
+	}
+	err := updateInitramfs()
+	if err != nil {
+		return xerrors.Errorf("failed to update initramfs: %w", err)
+	}
+	return nil
+}
+
+func restoreUefi(cfg *Config, j *restoreJournal) error {
+	// 回滚启动项指向的是现在正在运行的系统
+	err := removeUefiBootEntry()
+	if err != nil {
+		logger.Warning(err)
+	}
+	return nil
+}
+
+// 恢复 hospice 中的文件时先复制再替换软链接，恢复额外的文件夹时跳过已经是软链接的，重复执行不会丢失内容。
+func restoreExtraStep(cfg *Config, j *restoreJournal) error {
+	_extraDirs = cfg.getExtraDirs()
+	initBackUpRecord(backupRecordPath, defaultHospiceDir)
+	recoverDeprecatedFilesOrDirs(backupRecordPath, true)
+	restoreExtra()
+	return nil
+}
+
+// 交换 Current 和 Backup，使用日志中的值，重复执行不会换回去。
+func restoreConfig(cfg *Config, j *restoreJournal) error {
+	cfg.Current, cfg.Backup = j.Backup, j.Current
+	cfg.CurrentSubvol, cfg.BackupSubvol = j.BackupSubvol, j.CurrentSubvol
+	cfg.CurrentLv, cfg.BackupLv = j.BackupLv, j.CurrentLv
+	cfg.CurrentLuks, cfg.BackupLuks = j.BackupLuks, j.CurrentLuks
+	cfg.Time = nil
+	cfg.Version = ""
+	err := cfg.save(configFile)
+	if err != nil {
+		return xerrors.Errorf("failed to save config file %q: %w", configFile, err)
+	}
+	return nil
+}
+
+// 还原时，对需要隐藏的分区进行处理: 将备份分区进行隐藏，并解除挂载
+func restoreUdevRules(cfg *Config, j *restoreJournal) error {
+	if j.BackupSubvol != "" || j.VolumeGroup != "" {
+		// 备份子卷与当前系统在同一个分区，不能隐藏；逻辑卷没有分区标签，不在 udev 规则中
+		return nil
+	}
+	var rulesPaths = []string{
+		"/etc/udev/rules.d/80-udisks2.rules",
+		"/etc/udev/rules.d/80-udisks-installer.rules",
+	}
+	foundRules := false
+	// 还原后的备份分区是还原前的 Current 分区，加密时隐藏的是加密分区
+	newBackup, newCurrent := j.Current, j.Backup
+	if j.CurrentLuks != "" {
+		newBackup = j.CurrentLuks
+	}
+	if j.BackupLuks != "" {
+		newCurrent = j.BackupLuks
+	}
+
+	rootDisk, err := getPathDisk("/")
+	if err != nil {
+		return xerrors.Errorf("failed to get root disk: %w", err)
+	}
+
+	labelUuidMap, err := getLabelUuidMap(rootDisk)
+	if err != nil {
+		return xerrors.Errorf("failed to get label uuid map: %w", err)
+	}
+	backupDevice, err := getDeviceByUuid(newBackup)
+	if err != nil {
+		logger.Warning(err)
+		return err
+	}
+	backupLabel, err := getDeviceLabel(backupDevice)
+	if err != nil {
+		logger.Warning(err)
+		return err
+	}
+	for _, rulesPath := range rulesPaths {
+		_, err = os.Stat(rulesPath)
+		if err == nil {
+			err = modifyRules(rulesPath, labelUuidMap, newBackup, newCurrent, backupLabel)
+			if err != nil {
+				return xerrors.Errorf("failed to modify rules: %w", err)
+			}
+			foundRules = true
+		}
+	}
+	if !foundRules {
+		logger.Warning("not found 80-udisks-installer.rules or 80-udisks2.rules")
+	} else {
+		err = reloadUdev() // 重载udev的rules,让rules的修改生效
+		if err != nil {
+			logger.Warning(err)
+			return err
+		}
+		mountDir, err := getMountPointByLabel(strings.ToLower(strings.TrimSpace(backupLabel)))
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			umountDeleteDir(mountDir)
+		}
+	}
+	return nil
+}
+
+func restoreMarkFile(cfg *Config, j *restoreJournal) error {
+	err := os.Remove(filepath.Join("/", backupPartitionMarkFile))
+	if err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("failed to delete backup partition mark file: %w", err)
+	}
+	err = os.Remove(filepath.Join("/", backupManifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warning("failed to delete backup manifest file:", err)
+	}
+	return nil
+}
+
+// 激活适配程序和钩子脚本由其他模块提供，每执行完一个就记录在还原日志中，中断后只有正在执行的那个会被再次执行。
+func restoreHooks(cfg *Config, j *restoreJournal) error {
+	hooks := append([]string{licenseAdapterFile}, getRestoreHooks()...)
+	for _, hook := range hooks {
+		if strv.Strv(j.Hooks).Contains(hook) {
+			continue
+		}
+		if hook == licenseAdapterFile {
+			adapterActivator()
+		} else {
+			runRestoreHook(hook)
+		}
+		j.Hooks = append(j.Hooks, hook)
+		err := j.save()
+		if err != nil {
+			return xerrors.Errorf("failed to save restore journal: %w", err)
+		}
+	}
+	return nil
+}
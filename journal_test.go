@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"./blockdev"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreJournal(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "deepin-ab-recovery", "restore-journal.json")
+	j, err := loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Nil(t, j)
+
+	cfg := &Config{Current: "uuid-a", Backup: "uuid-b"}
+	j = newRestoreJournal(filename, cfg, "/dev/sda2", []string{"LANG=zh_CN.UTF-8"})
+	require.NoError(t, j.save())
+	require.NoError(t, j.markDone(restoreStepKernels))
+
+	j, err = loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "uuid-a", j.Current)
+	assert.Equal(t, "/dev/sda2", j.CurrentDevice)
+	assert.Equal(t, "uuid-b", j.Backup)
+	assert.Equal(t, []string{"LANG=zh_CN.UTF-8"}, j.EnvVars)
+	assert.True(t, j.isDone(restoreStepKernels))
+	assert.False(t, j.isDone(restoreStepBootloader))
+	assert.True(t, j.canRollback())
+
+	assert.Empty(t, j.BackupSubvol)
+
+	cfg = &Config{Current: "uuid-a", Backup: "uuid-a", CurrentSubvol: "@", BackupSubvol: "@ab-backup"}
+	require.NoError(t, newRestoreJournal(filename, cfg, "/dev/sda2", nil).save())
+	j, err = loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "@", j.CurrentSubvol)
+	assert.Equal(t, "@ab-backup", j.BackupSubvol)
+
+	cfg = &Config{VolumeGroup: "vg0", CurrentLv: "root", BackupLv: "root-backup"}
+	require.NoError(t, newRestoreJournal(filename, cfg, "/dev/mapper/vg0-root", nil).save())
+	j, err = loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "vg0", j.VolumeGroup)
+	assert.Equal(t, "root", j.CurrentLv)
+	assert.Equal(t, "root-backup", j.BackupLv)
+	assert.Equal(t, "/dev/mapper/vg0-root--backup", j.config().backupId())
+
+	cfg = &Config{Current: "uuid-a", Backup: "uuid-b", CurrentLuks: "luks-a", BackupLuks: "luks-b"}
+	require.NoError(t, newRestoreJournal(filename, cfg, "/dev/sda2", nil).save())
+	j, err = loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "luks-a", j.CurrentLuks)
+	assert.Equal(t, "luks-b", j.BackupLuks)
+
+	// 不能解析时移到一边
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0644))
+	j, err = loadRestoreJournal(filename)
+	assert.NoError(t, err)
+	assert.Nil(t, j)
+	assert.NoFileExists(t, filename)
+	assert.FileExists(t, filename+".corrupt")
+}
+
+func TestRunRestoreJournal(t *testing.T) {
+	oldSteps := restoreSteps
+	defer func() {
+		restoreSteps = oldSteps
+	}()
+
+	var ran []string
+	fail := true
+	step := func(name string) restoreStep {
+		return restoreStep{name, func(cfg *Config, j *restoreJournal) error {
+			if name == "b" && fail {
+				return errors.New("power loss")
+			}
+			ran = append(ran, name)
+			return nil
+		}}
+	}
+	restoreSteps = []restoreStep{step("a"), step("b"), step("c")}
+
+	filename := filepath.Join(t.TempDir(), "restore-journal.json")
+	j := newRestoreJournal(filename, &Config{}, "", nil)
+	require.NoError(t, j.save())
+	assert.Error(t, runRestoreJournal(&Config{}, j))
+	assert.Equal(t, []string{"a"}, ran)
+
+	// 从未完成的步骤继续，完成后删除日志
+	fail = false
+	j, err := loadRestoreJournal(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, j.Done)
+	require.NoError(t, runRestoreJournal(&Config{}, j))
+	assert.Equal(t, []string{"a", "b", "c"}, ran)
+	assert.NoFileExists(t, filename)
+}
+
+func TestRollbackRestoreJournal(t *testing.T) {
+	oldBootDir, oldKernelBackupDir := globalBootDir, globalKernelBackupDir
+	defer func() {
+		globalBootDir, globalKernelBackupDir = oldBootDir, oldKernelBackupDir
+	}()
+	globalBootDir = t.TempDir()
+	globalKernelBackupDir = filepath.Join(globalBootDir, "deepin-ab-recovery")
+	require.NoError(t, os.Mkdir(globalKernelBackupDir, 0755))
+	for _, name := range []string{"vmlinuz-5.10", "initrd.img-5.10"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(globalKernelBackupDir, name), []byte(name), 0644))
+	}
+
+	filename := filepath.Join(t.TempDir(), "restore-journal.json")
+	j := newRestoreJournal(filename, &Config{}, "", nil)
+	require.NoError(t, restoreKernels(&Config{}, j))
+	assert.ElementsMatch(t, []string{"vmlinuz-5.10", "initrd.img-5.10"}, j.Kernels)
+	assert.FileExists(t, filepath.Join(globalBootDir, "vmlinuz-5.10"))
+	assert.FileExists(t, filepath.Join(globalKernelBackupDir, "vmlinuz-5.10"))
+	// 重复执行不改变结果
+	require.NoError(t, restoreKernels(&Config{}, j))
+	assert.Len(t, j.Kernels, 2)
+	assert.NoFileExists(t, filepath.Join(globalBootDir, "vmlinuz-5.10.ab-recovery-tmp"))
+
+	// 回退时备份的内核文件还在，回滚启动项仍然可用
+	require.NoError(t, j.markDone(restoreStepKernels))
+	require.NoError(t, rollbackRestoreJournal(j))
+	assert.FileExists(t, filepath.Join(globalKernelBackupDir, "vmlinuz-5.10"))
+	assert.FileExists(t, filepath.Join(globalKernelBackupDir, "initrd.img-5.10"))
+	assert.NoFileExists(t, filename)
+
+	// 修改引导程序配置后不能回退，备份的内核文件随后删除
+	j.Done = append(j.Done, restoreStepBootloader)
+	assert.Error(t, rollbackRestoreJournal(j))
+	require.NoError(t, restoreKernelBackup(&Config{}, j))
+	require.NoError(t, restoreKernelBackup(&Config{}, j))
+	assert.NoFileExists(t, filepath.Join(globalKernelBackupDir, "vmlinuz-5.10"))
+	assert.FileExists(t, filepath.Join(globalBootDir, "vmlinuz-5.10"))
+}
+
+func TestRollbackRestoreJournalSubvol(t *testing.T) {
+	// 用记录参数的脚本代替 btrfs 命令
+	binDir := t.TempDir()
+	argsFile := filepath.Join(binDir, "args")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(binDir, "btrfs"),
+		[]byte("#!/bin/sh\necho \"$@\" >> "+argsFile+"\n"), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	defer useFakeBlockDevs(&blockdev.Fake{
+		Mounts: []*blockdev.MountInfo{
+			{MountPoint: "/", Root: "/@ab-backup", FsType: "btrfs", Source: "/dev/sda2"},
+		},
+	})()
+
+	cfg := &Config{Current: "uuid-a", Backup: "uuid-a", CurrentSubvol: "@", BackupSubvol: "@ab-backup"}
+	filename := filepath.Join(t.TempDir(), "restore-journal.json")
+
+	// 没有把备份子卷设为可写时不修改
+	j := newRestoreJournal(filename, cfg, "/dev/sda2", nil)
+	require.NoError(t, j.save())
+	require.NoError(t, rollbackRestoreJournal(j))
+	assert.NoFileExists(t, argsFile)
+
+	// 在备份子卷上回退时把 / 设为只读，然后删除还原日志
+	j = newRestoreJournal(filename, cfg, "/dev/sda2", nil)
+	require.NoError(t, j.save())
+	require.NoError(t, restoreSubvol(cfg, j))
+	require.NoError(t, j.markDone(restoreStepSubvol))
+	require.NoError(t, rollbackRestoreJournal(j))
+	assert.NoFileExists(t, filename)
+	args, err := ioutil.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "property set -ts / ro false\nproperty set -ts / ro true\n", string(args))
+}
+
+func TestRestoreHooks(t *testing.T) {
+	oldHookDir := restoreHookDir
+	defer func() {
+		restoreHookDir = oldHookDir
+	}()
+	restoreHookDir = t.TempDir()
+	outFile := filepath.Join(t.TempDir(), "out")
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(restoreHookDir, name),
+			[]byte("#!/bin/sh\necho "+name+" >> "+outFile+"\n"), 0755))
+	}
+
+	// 中断前已经执行完 a，继续时只执行 b
+	j := newRestoreJournal(filepath.Join(t.TempDir(), "restore-journal.json"), &Config{}, "", nil)
+	j.Hooks = []string{licenseAdapterFile, filepath.Join(restoreHookDir, "a")}
+	require.NoError(t, restoreHooks(&Config{}, j))
+	require.NoError(t, restoreHooks(&Config{}, j))
+	out, err := ioutil.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, "b\n", string(out))
+	assert.Len(t, j.Hooks, 3)
+}
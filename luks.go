@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"./atomicfile"
+	"golang.org/x/xerrors"
+)
+
+// 备份时解锁备份分区使用的 device mapper 名字
+const luksBackupName = "deepin-ab-recovery-backup"
+
+const luksBackupDevice = "/dev/mapper/" + luksBackupName
+
+// 用 TPM2 芯片中密封的密钥解锁，cryptsetup 不支持
+const systemdCryptsetupBin = "/lib/systemd/systemd-cryptsetup"
+
+// 执行命令，失败时错误中包含命令的输出。
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("failed to run %s %s: %s: %w", name, strings.Join(args, " "),
+			strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// 解锁加密分区 device，解锁后的设备为 /dev/mapper/name。
+func openLuks(cfg *Config, device, name string) error {
+	if cfg.LuksTpm2 {
+		return runCommand(systemdCryptsetupBin, "attach", name, device, "-", "tpm2-device=auto")
+	}
+	return runCommand("cryptsetup", "open", "--type", "luks", "--key-file", cfg.LuksKeyFile, device, name)
+}
+
+// 关闭解锁后的设备。挂载在私有挂载命名空间中，命名空间销毁时才一定被卸载，所以延迟到不再使用时关闭。
+func closeLuks(name string) error {
+	return runCommand("cryptsetup", "close", "--deferred", name)
+}
+
+// 备份分区是加密分区时先解锁，fn 返回后关闭，fn 中用 cfg.getBackupDevice 获取解锁后的设备。
+func withBackupLuks(cfg *Config, fn func() error) error {
+	if cfg.BackupLuks == "" {
+		return fn()
+	}
+	device, err := getDeviceByUuid(cfg.BackupLuks)
+	if err != nil {
+		return newJobErrorf(errCodeConfigInvalid, "failed to get backup LUKS device: %w", err)
+	}
+	if isExist(luksBackupDevice) {
+		// 上次没有关闭，比如服务崩溃
+		err = runCommand("cryptsetup", "close", luksBackupName)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
+	err = openLuks(cfg, device, luksBackupName)
+	if err != nil {
+		return newJobErrorf(errCodeLuksUnlockFailed, "failed to unlock %q: %w", device, err)
+	}
+	defer func() {
+		err := closeLuks(luksBackupName)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}()
+	return fn()
+}
+
+// crypttab 中指定加密分区的字段，UUID= 或者 /dev/disk/by-uuid/ 中的路径
+func isCryptTabSource(source, uuid string) bool {
+	return source == "UUID="+uuid || source == "/dev/disk/by-uuid/"+uuid
+}
+
+// 把 crypttab 中解锁加密分区 currentLuks 的行改为解锁 backupLuks，没有这一行时添加。
+// currentLuks 为空时只添加，backupLuks 为空时注释掉原来的行。
+func modifyCryptTab(filename, currentLuks, backupLuks string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(content) == 0 {
+		lines = nil
+	}
+	modifyDone := false
+	for idx, line := range lines {
+		l := strings.TrimSpace(line)
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if currentLuks == "" || len(fields) < 2 || !isCryptTabSource(fields[1], currentLuks) {
+			continue
+		}
+
+		if backupLuks == "" {
+			lines[idx] = "#" + line
+		} else {
+			target := fields[0]
+			if target == "luks-"+currentLuks {
+				target = "luks-" + backupLuks
+			}
+			fields[0], fields[1] = target, "UUID="+backupLuks
+			lines[idx] = strings.Join(fields, " ")
+		}
+		modifyDone = true
+		break
+	}
+	if !modifyDone && backupLuks != "" {
+		lines = append(lines, "luks-"+backupLuks+" UUID="+backupLuks+" none luks")
+	}
+	return atomicfile.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// 重新生成 initramfs，其中的 crypttab 来自正在运行的系统。
+func updateInitramfs() error {
+	_, err := exec.LookPath("update-initramfs")
+	if err == nil {
+		return runCommand("update-initramfs", "-u", "-k", "all")
+	}
+	return runCommand("dracut", "--regenerate-all", "--force")
+}
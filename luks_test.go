@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModifyCryptTab(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "crypttab")
+	content := `# <target name> <source device> <key file> <options>
+luks-aaa UUID=aaa none luks,discard
+home /dev/disk/by-uuid/ccc /etc/home.key luks
+`
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyCryptTab(filename, "aaa", "bbb"))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, `# <target name> <source device> <key file> <options>
+luks-bbb UUID=bbb none luks,discard
+home /dev/disk/by-uuid/ccc /etc/home.key luks
+`, string(data))
+
+	// 当前系统没有加密
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyCryptTab(filename, "", "bbb"))
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, content+"luks-bbb UUID=bbb none luks\n", string(data))
+
+	// 备份分区没有加密
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyCryptTab(filename, "aaa", ""))
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "\n#luks-aaa UUID=aaa none luks,discard\n")
+
+	// 没有 crypttab
+	filename = filepath.Join(t.TempDir(), "crypttab")
+	require.NoError(t, modifyCryptTab(filename, "aaa", "bbb"))
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "luks-bbb UUID=bbb none luks\n", string(data))
+}
+
+func TestConfigCheckLuks(t *testing.T) {
+	cfg := Config{Current: "abc", Backup: "def", CurrentLuks: "aaa", BackupLuks: "bbb", LuksKeyFile: "/etc/ab.key"}
+	assert.True(t, cfg.isLuks())
+	assert.NoError(t, cfg.checkLuks())
+
+	cfg.LuksTpm2 = true
+	assert.Error(t, cfg.checkLuks())
+	cfg.LuksKeyFile = ""
+	assert.NoError(t, cfg.checkLuks())
+	cfg.LuksTpm2 = false
+	assert.Error(t, cfg.checkLuks())
+
+	cfg.LuksKeyFile = "ab.key"
+	assert.Error(t, cfg.checkLuks())
+	cfg.LuksKeyFile = "/etc/ab.key"
+	cfg.BackupSubvol = "@ab-backup"
+	assert.Error(t, cfg.checkLuks())
+
+	assert.False(t, (&Config{Current: "abc", Backup: "def"}).isLuks())
+}
@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"./blockdev"
+	"./bootloader"
+	"golang.org/x/xerrors"
+)
+
+// 卷组和逻辑卷的名字允许的字符，见 lvm(8)
+var regLvmName = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+func isValidLvmName(name string) bool {
+	if len(name) > 127 || name == "." || name == ".." {
+		return false
+	}
+	return regLvmName.MatchString(name)
+}
+
+// 逻辑卷在 /dev/mapper 中的设备路径，卷组名和逻辑卷名中的 - 被转义为 --。
+func lvDevicePath(vg, lv string) string {
+	return "/dev/mapper/" + strings.Replace(vg, "-", "--", -1) + "-" + strings.Replace(lv, "-", "--", -1)
+}
+
+func runLvm(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		var stderr []byte
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = exitErr.Stderr
+		}
+		return "", xerrors.Errorf("failed to run %s %s: %s: %w", name, strings.Join(args, " "),
+			strings.TrimSpace(string(stderr)), err)
+	}
+	return string(out), nil
+}
+
+func lvExists(vg, lv string) (bool, error) {
+	out, err := runLvm("lvs", "--noheadings", "-o", "lv_name", vg)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range strings.Fields(out) {
+		if name == lv {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 删除逻辑卷，不存在时不算错误。
+func removeLv(vg, lv string) error {
+	exist, err := lvExists(vg, lv)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return nil
+	}
+	_, err = runLvm("lvremove", "-y", vg+"/"+lv)
+	return err
+}
+
+// 激活逻辑卷，精简快照默认设置了激活跳过标志，需要 -K 才能激活。
+func activateLv(vg, lv string) error {
+	_, err := runLvm("lvchange", "-ay", "-K", vg+"/"+lv)
+	return err
+}
+
+// 创建精简卷 origin 的精简快照 snapshot，去掉激活跳过标志，这样启动时可以自动激活。
+func createThinSnapshot(vg, origin, snapshot string) error {
+	_, err := runLvm("lvcreate", "-s", "-kn", "-n", snapshot, vg+"/"+origin)
+	if err != nil {
+		return err
+	}
+	return activateLv(vg, snapshot)
+}
+
+// 解析 lvs -o lv_size,data_percent 的输出，返回精简池的空闲空间。
+func parseThinPoolSpace(out string) (uint64, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return 0, xerrors.Errorf("invalid lvs output %q", out)
+	}
+	size, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid lvs output %q: %w", out, err)
+	}
+	percent, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid lvs output %q: %w", out, err)
+	}
+	used := uint64(float64(size) * percent / 100)
+	if used > size {
+		return 0, nil
+	}
+	return size - used, nil
+}
+
+// 获取精简卷 lv 所在的精简池的空闲空间，lv 不是精简卷时返回错误。
+func getThinPoolFree(vg, lv string) (uint64, error) {
+	out, err := runLvm("lvs", "--noheadings", "-o", "pool_lv", vg+"/"+lv)
+	if err != nil {
+		return 0, err
+	}
+	pool := strings.TrimSpace(out)
+	if pool == "" {
+		return 0, xerrors.Errorf("logical volume %s/%s is not a thin volume", vg, lv)
+	}
+	out, err = runLvm("lvs", "--noheadings", "--nosuffix", "--units", "b",
+		"-o", "lv_size,data_percent", vg+"/"+pool)
+	if err != nil {
+		return 0, err
+	}
+	return parseThinPoolSpace(out)
+}
+
+// 获取根文件系统所在的设备，是 device mapper 设备时返回 /dev/mapper 中的路径，与 lvDevicePath 的结果一致。
+func getRootLvDevice() (string, error) {
+	d, err := blockdev.FindByPathMount(_blockDevs, "/")
+	if err != nil {
+		return "", err
+	}
+	return d.Path, nil
+}
+
+// 挂载逻辑卷的选项。快照与原卷的 xfs 文件系统 uuid 相同，不指定 nouuid 时不能同时挂载。
+func getLvMountOptions(device string) (string, error) {
+	d, err := blockdev.FindByPath(_blockDevs, device)
+	if err != nil {
+		return "", xerrors.Errorf("failed to get fs type of %q: %w", device, err)
+	}
+	if d.FsType == "xfs" {
+		return "nouuid", nil
+	}
+	return "", nil
+}
+
+// LVM 模式的备份。删除原有的备份逻辑卷，创建当前系统逻辑卷的精简快照，挂载后清除快照中跳过的文件，
+// 修改 fstab，写入清单、配置和标记文件，最后添加回滚启动项。快照与当前系统共享数据，不需要 rsync。
+func backupLvSnapshot(ctx context.Context, cfg *Config, envVars []string, reporter progressReporter) (retErr error) {
+	vg := cfg.VolumeGroup
+	currentDevice := lvDevicePath(vg, cfg.CurrentLv)
+	// 精简快照与原卷的文件系统 uuid 相同
+	fsUuid, err := getDeviceUuid(currentDevice)
+	if err != nil {
+		return newJobErrorf(errCodeConfigInvalid, "failed to get uuid of %q: %w", currentDevice, err)
+	}
+	backup := bootloader.Partition{Uuid: fsUuid, Device: lvDevicePath(vg, cfg.BackupLv), Lv: true}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	estimate, err := estimateLvSnapshot(ctx, cfg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("failed to estimate backup: %w", err)
+	}
+	err = estimate.check()
+	if err != nil {
+		return err
+	}
+
+	osVersion, osDesc := getOsVersionDesc()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = removeLv(vg, cfg.BackupLv)
+	if err != nil {
+		return newJobErrorf(errCodeSnapshotFailed, "failed to remove old backup logical volume: %w", err)
+	}
+	// 标记文件随原有的逻辑卷一起删除了，只需要清除配置
+	cfg.Time = nil
+	cfg.Version = ""
+	err = cfg.save(configFile)
+	if err != nil {
+		return xerrors.Errorf("failed to invalidate backup: %w", err)
+	}
+	// 原有的备份已失效，下次启动时不再启动它
+	err = cancelBootBackupOnce()
+	if err != nil {
+		logger.Warning("failed to cancel boot backup once:", err)
+	}
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		err := removeBootloaderRecoveryEntry(backup, envVars)
+		if err != nil {
+			logger.Warning("failed to remove recovery entry from bootloader:", err)
+		}
+	}()
+
+	_extraDirs = cfg.getExtraDirs()
+	initBackUpRecord(backupRecordPath, defaultHospiceDir)
+	recoverDeprecatedFilesOrDirs(backupRecordPath, false)
+	err = updateBackUpRecordFile(backupRecordPath)
+	if err != nil {
+		logger.Warning(err)
+		return err
+	}
+	backupExtra()
+	reporter.setPhase(jobPhaseSnapshot)
+	err = createThinSnapshot(vg, cfg.CurrentLv, cfg.BackupLv)
+	if err != nil {
+		return newJobError(errCodeSnapshotFailed, err)
+	}
+
+	now := time.Now()
+	err = withBackupMount(cfg, "backup", func(snapDir string) error {
+		err := clearSnapshotExcludes(snapDir, cfg.getExcludeDirs(), cfg.getExcludeFiles())
+		if err != nil {
+			return xerrors.Errorf("failed to clear excludes in snapshot: %w", err)
+		}
+
+		err = modifyFsTab(filepath.Join(snapDir, "etc/fstab"), backup.Device)
+		if err != nil {
+			return newJobErrorf(errCodeFstabNotPatched, "failed to modify fs tab: %w", err)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reporter.setPhase(jobPhaseManifest)
+		return writeSnapshotFiles(ctx, snapDir, cfg, now, osVersion)
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reporter.setPhase(jobPhaseKernel)
+	kFiles, err := backupKernel()
+	if err != nil {
+		return xerrors.Errorf("failed to backup kernel: %w", err)
+	}
+
+	// 进入 bootloader 阶段后不能再取消，所以要先设置阶段再检查
+	reporter.setPhase(jobPhaseBootloader)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = writeBootloaderBackupEntries(cfg, backup, osDesc, kFiles, now, envVars)
+	if err != nil {
+		return err
+	}
+
+	cfg.Time = &now
+	cfg.Version = osVersion
+	err = cfg.save(configFile)
+	if err != nil {
+		return xerrors.Errorf("failed to save config file %q: %w", configFile, err)
+	}
+	return nil
+}
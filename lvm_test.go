@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLvDevicePath(t *testing.T) {
+	assert.Equal(t, "/dev/mapper/vg0-root", lvDevicePath("vg0", "root"))
+	assert.Equal(t, "/dev/mapper/deepin--vg-root--backup", lvDevicePath("deepin-vg", "root-backup"))
+
+	cfg := &Config{VolumeGroup: "vg0", CurrentLv: "root", BackupLv: "root-backup"}
+	assert.True(t, cfg.isLvm())
+	assert.Equal(t, storageModeLvm, cfg.storageMode())
+	assert.Equal(t, "/dev/mapper/vg0-root", cfg.currentId())
+	assert.Equal(t, "/dev/mapper/vg0-root--backup", cfg.backupId())
+}
+
+func TestIsValidLvmName(t *testing.T) {
+	for _, name := range []string{"vg0", "root-backup", "a.b_c+d"} {
+		assert.True(t, isValidLvmName(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "-root", "a/b", "a b"} {
+		assert.False(t, isValidLvmName(name), name)
+	}
+}
+
+func TestConfigCheckLvs(t *testing.T) {
+	cfg := Config{VolumeGroup: "vg0", CurrentLv: "root", BackupLv: "root"}
+	assert.Error(t, cfg.checkLvs())
+	cfg.BackupLv = ""
+	assert.Error(t, cfg.checkLvs())
+	cfg.BackupLv = "root/../x"
+	assert.Error(t, cfg.checkLvs())
+	cfg.BackupLv = "root-backup"
+	cfg.CurrentSubvol = "@"
+	assert.Error(t, cfg.checkLvs())
+}
+
+func TestParseThinPoolSpace(t *testing.T) {
+	free, err := parseThinPoolSpace("  1000 12.50\n")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(875), free)
+
+	_, err = parseThinPoolSpace("  1000\n")
+	assert.Error(t, err)
+	_, err = parseThinPoolSpace("  abc 1.00\n")
+	assert.Error(t, err)
+}
+
+func TestModifyFsTab(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fstab")
+	content := `# /dev/mapper/vg0-root
+/dev/mapper/vg0-root	/	ext4	rw,relatime	0 1
+UUID=abc	/boot	ext4	rw,relatime	0 2
+`
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyFsTab(filename, "/dev/mapper/vg0-root--backup"))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, `# /dev/mapper/vg0-root
+/dev/mapper/vg0-root--backup	/	ext4	rw,relatime	0 1
+UUID=abc	/boot	ext4	rw,relatime	0 2
+`, string(data))
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("UUID=abc /boot ext4 defaults 0 2\n"), 0644))
+	assert.Error(t, modifyFsTab(filename, "/dev/mapper/vg0-root--backup"))
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -20,8 +21,15 @@ import (
 	"strings"
 	"time"
 
-	"./bootloader/grubcfg"
-	"./bootloader/pmoncfg"
+	"./atomicfile"
+	"./blockdev"
+	"./bootloader"
+	_ "./bootloader/blscfg"
+	_ "./bootloader/extlinuxcfg"
+	_ "./bootloader/grubcfg"
+	_ "./bootloader/grubmkconfig"
+	_ "./bootloader/pmoncfg"
+	"./fstab"
 	"github.com/godbus/dbus"
 	"github.com/linuxdeepin/dde-api/inhibit_hint"
 	login1 "github.com/linuxdeepin/go-dbus-factory/org.freedesktop.login1"
@@ -37,8 +45,6 @@ var logger = log.NewLogger("ab-recovery")
 
 const (
 	configFile              = "/etc/deepin/ab-recovery.json"
-	backupMountPoint        = "/deepin-ab-recovery-backup"
-	abRecoveryGrubCfgFile   = "/etc/default/grub.d/11_deepin_ab_recovery.cfg"
 	abRecoveryGrubCfg12File = "/etc/default/grub.d/12_deepin_ab_recovery.cfg"
 	abRecoveryFile          = "/usr/lib/deepin-daemon/ab-recovery"
 	ddeWelcomeFile          = "/usr/lib/deepin-daemon/dde-welcome"
@@ -47,9 +53,6 @@ const (
 	defaultHospiceDir       = "/usr/share/deepin-ab-recovery/hospice/"
 )
 
-var globalNoGrubMkconfig bool
-var globalUsePmonBios bool
-
 var globalArch string
 var globalGrubCfgFile = "/boot/grub/grub.cfg"
 var globalPmonCfgFile = "/boot/boot/boot.cfg"
@@ -66,6 +69,9 @@ var options struct {
 	grubMenuEn     bool
 	fixBackup      bool
 	printShHideOs  bool
+
+	markBootSuccessful bool
+	bootBackupOnce     bool
 }
 
 type extraDir struct {
@@ -74,7 +80,8 @@ type extraDir struct {
 	specifiedFiles  []string // 该切片内只能存放originDir中的文件或文件夹名
 }
 
-var _extraDirs = []extraDir{
+// 内置的额外备份文件夹，会与配置文件中的 ExtraDirs 合并
+var _defaultExtraDirs = []extraDir{
 	{
 		originDir: "/var/lib/systemd",
 	},
@@ -89,6 +96,28 @@ var _extraDirs = []extraDir{
 	},
 }
 
+// 由 initBackUpRecord 使用的额外备份文件夹，备份和恢复前根据配置设置
+var _extraDirs []extraDir
+
+// 内置的备份时跳过的文件夹，会与配置文件中的 Exclude 合并，
+// 备份后会在备份分区中创建同名的空文件夹
+var _skipDirs = []string{
+	"/media", "/tmp", "/proc", "/sys", "/dev", "/run", "/mnt", "/boot", "/data", "/lost+found", "/recovery", "/opt",
+}
+
+// 内置的备份时跳过的文件，会与配置文件中的 ExcludeFiles 合并
+var _skipFiles = []string{
+	"/usr/share/deepin-home-appstore-daemon/appstore.db",
+}
+
+func getBackupExcludes(cfg *Config) []string {
+	var result []string
+	result = append(result, cfg.getExcludeDirs()...)
+	result = append(result, mountRuntimeDir)
+	result = append(result, cfg.getExcludeFiles()...)
+	return result
+}
+
 const backupRecordPath = "/var/lib/deepin-ab-recovery/record.json"
 
 var _lastBackUpRecord map[string]string
@@ -104,6 +133,10 @@ func init() {
 	flag.BoolVar(&options.fixBackup, "fix-backup", false, "Fix bugs in backup partition")
 	flag.BoolVar(&options.printShHideOs, "print-sh-hide-os", false,
 		"print the shell script to hide the backup OS")
+	flag.BoolVar(&options.markBootSuccessful, "mark-boot-successful", false,
+		"clear the boot failure count in grubenv and restore the default entry after booting the backup once")
+	flag.BoolVar(&options.bootBackupOnce, "boot-backup-once", false,
+		"boot the backup system on next reboot only")
 	flag.StringVar(&options.arch, "arch", "", "")
 	flag.StringVar(&options.grubCfgFile, "grub-cfg", "", "")
 	flag.StringVar(&options.bootDir, "boot", "", "")
@@ -166,46 +199,13 @@ func printShHideOs() (exitCode int) {
 }
 
 func isBackupDevice(device string) (bool, error) {
-	dir := "/deepin-ab-recovery-isBackupDevice"
-	umount, err := mountDevice(device, dir)
-	if umount != nil {
-		defer umount()
-	}
-	if err != nil {
-		return false, err
-	}
-
-	_, err = os.Stat(filepath.Join(dir, backupPartitionMarkFile))
-	return err == nil, nil
-}
-
-func mountDevice(device, dir string) (fn func(), err error) {
-	fn = func() {
-		umountDeleteDir(dir)
-	}
-	mounted, err := isMounted(dir)
-	if err != nil {
-		return
-	}
-	if mounted {
-		err = exec.Command("umount", dir).Run()
-		if err != nil {
-			err = xerrors.Errorf("failed to unmount %s: %w", dir, err)
-			return
-		}
-	}
-
-	err = os.Mkdir(dir, 0755)
-	if err != nil && !os.IsExist(err) {
-		return
-	}
-
-	err = exec.Command("mount", device, dir).Run()
-	if err != nil {
-		err = xerrors.Errorf("failed to mount device %q to dir %q: %w",
-			device, dir, err)
-	}
-	return
+	var result bool
+	err := withPrivateMount(device, "probe", func(dir string) error {
+		_, err := os.Stat(filepath.Join(dir, backupPartitionMarkFile))
+		result = err == nil
+		return nil
+	})
+	return result, err
 }
 
 func umountDeleteDir(dir string) {
@@ -237,24 +237,6 @@ func main() {
 		globalArch = options.arch
 	}
 
-	if isArchMips() {
-		// mips64
-
-		bi, err := readBoardInfo()
-		if err != nil {
-			logger.Warning("failed to read board info:", err)
-		} else {
-			if strings.Contains(bi.biosVersion, "PMON") {
-				globalUsePmonBios = true
-			}
-		}
-	} else if isArchSw() {
-		globalNoGrubMkconfig = true
-	}
-
-	if options.noGrubMkconfig {
-		globalNoGrubMkconfig = true
-	}
 	if options.grubCfgFile != "" {
 		globalGrubCfgFile = options.grubCfgFile
 	}
@@ -267,6 +249,7 @@ func main() {
 		globalBootDir = filepath.Clean(options.bootDir)
 	}
 	globalKernelBackupDir = filepath.Join(globalBootDir, "deepin-ab-recovery")
+	restoreJournalFile = filepath.Join(globalBootDir, "deepin-ab-recovery-journal.json")
 
 	if options.fixBackup {
 		err := fixBackup()
@@ -276,9 +259,24 @@ func main() {
 		return
 	}
 
+	if options.markBootSuccessful {
+		err := markBootSuccessful()
+		if err != nil {
+			logger.Fatal("failed to mark boot successful:", err)
+		}
+		return
+	}
+
+	if options.bootBackupOnce {
+		err := bootBackupOnceWithConfigFile()
+		if err != nil {
+			logger.Fatal("failed to boot backup once:", err)
+		}
+		return
+	}
+
 	logger.Debug("arch:", globalArch)
-	logger.Debug("noGrubMkConfig:", globalNoGrubMkconfig)
-	logger.Debug("usePmonBios:", globalUsePmonBios)
+	logger.Debug("noGrubMkConfig:", options.noGrubMkconfig)
 	logger.Debug("bootDir:", globalBootDir)
 	logger.Debug("grubCfgFile:", globalGrubCfgFile)
 	logger.Debug("pmonCfgFile:", globalPmonCfgFile)
@@ -308,56 +306,60 @@ func main() {
 		logger.Fatal("failed to request service name:", err)
 	}
 
+	m.resumeRestore()
 	service.SetAutoQuitHandler(3*time.Minute, m.canQuit)
 	service.Wait()
 }
 
-func backup(cfg *Config, envVars []string) error {
-	backupUuid := cfg.Backup
-	backupDevice, err := getDeviceByUuid(backupUuid)
-	logger.Debug("backup device:", backupDevice)
-
-	mounted, err := isMounted(backupMountPoint)
-	if err != nil {
-		return err
+// ctx 被取消时停止备份。一旦开始同步，原有的备份就不再完整，此后备份失败或被取消，
+// 都会移除引导菜单中的回滚项，备份分区中的系统只有在全部步骤成功后才会被重新标记为有效。
+func backup(ctx context.Context, cfg *Config, envVars []string, reporter progressReporter) error {
+	reporter.setPhase(jobPhaseMount)
+	if cfg.isLvm() {
+		// 备份逻辑卷在创建快照后才挂载
+		return backupLvSnapshot(ctx, cfg, envVars, reporter)
 	}
-	if mounted {
-		err = exec.Command("umount", backupMountPoint).Run()
+	return withBackupLuks(cfg, func() error {
+		backupDevice, err := cfg.getBackupDevice()
 		if err != nil {
-			return xerrors.Errorf("failed to unmount %s: %w", backupMountPoint, err)
+			return newJobErrorf(errCodeConfigInvalid, "failed to get backup device: %w", err)
 		}
-	}
-
-	err = os.Mkdir(backupMountPoint, 0755)
-	if err != nil && !os.IsExist(err) {
-		return err
-	}
-	defer func() {
-		err = os.Remove(backupMountPoint)
-		if err != nil {
-			logger.Warning("failed to remove backup mount point:", err)
+		logger.Debug("backup device:", backupDevice)
+
+		if cfg.isBtrfs() {
+			// 挂载顶层子卷，当前系统和备份子卷都在其中
+			return withPrivateMountOptions(backupDevice, btrfsTopLevelMountOptions, "backup",
+				func(topDir string) error {
+					return backupSnapshot(ctx, cfg, envVars, reporter, backupDevice, topDir)
+				})
 		}
-	}()
+		return withPrivateMount(backupDevice, "backup", func(mountPoint string) error {
+			return backupToDir(ctx, cfg, envVars, reporter, backupDevice, mountPoint)
+		})
+	})
+}
 
-	err = exec.Command("mount", backupDevice, backupMountPoint).Run()
-	if err != nil {
-		return xerrors.Errorf("failed to mount device %q to dir %q: %w",
-			backupDevice, backupMountPoint, err)
+// 备份到已经挂载在 mountPoint 的备份分区。
+func backupToDir(ctx context.Context, cfg *Config, envVars []string, reporter progressReporter,
+	backupDevice, mountPoint string) (retErr error) {
+	backup := bootloader.Partition{Uuid: cfg.Backup, Device: backupDevice, Luks: cfg.BackupLuks}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	defer func() {
-		err := exec.Command("umount", backupMountPoint).Run()
-		if err != nil {
-			logger.Warning("failed to unmount backup directory:", err)
+	// 在使原有的备份失效之前检查空间是否足够
+	estimate, err := estimateBackup(ctx, cfg, mountPoint)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-	}()
-
-	skipDirs := []string{
-		"/media", "/tmp", "/proc", "/sys", "/dev", "/run", "/mnt", "/boot", "/data", "/lost+found", "/recovery", "/opt",
+		return xerrors.Errorf("failed to estimate backup: %w", err)
 	}
-	skipFiles := []string{
-		"/usr/share/deepin-home-appstore-daemon/appstore.db",
+	err = estimate.check()
+	if err != nil {
+		return err
 	}
-	tmpExcludeFile, err := writeExcludeFile(append(append(skipDirs, backupMountPoint), skipFiles...))
+
+	tmpExcludeFile, err := writeExcludeFile(getBackupExcludes(cfg))
 	if err != nil {
 		return xerrors.Errorf("failed to write exclude file: %w", err)
 	}
@@ -368,33 +370,31 @@ func backup(cfg *Config, envVars []string) error {
 		}
 	}()
 
-	osVersion := "unknown"
-	osDesc := "Uos unknown"
-	osReleaseInfo, oserr := runOsRelease()
-	lsbReleaseInfo, err := runLsbRelease()
+	osVersion, osDesc := getOsVersionDesc()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = invalidateBackup(cfg, mountPoint)
 	if err != nil {
-		logger.Warning("failed to run lsb-release:", err)
-	} else {
-		if oserr != nil {
-			osVersion = lsbReleaseInfo[lsbReleaseKeyRelease]
-			osDesc = lsbReleaseInfo[lsbReleaseKeyDesc]
-		} else {
-			systemName := osReleaseInfo[osSystemName]
-			majorVersion := osReleaseInfo[osMajorVersion]
-			EditName := osReleaseInfo[osEditionName]
-			osDesc = systemName + " " + majorVersion + " " + EditName
-			osVersion = majorVersion
-		}
+		return xerrors.Errorf("failed to invalidate backup: %w", err)
 	}
-
-	now := time.Now()
-	cfg.Time = &now
-	cfg.Version = osVersion
-	err = cfg.save(configFile)
+	// 原有的备份已失效，下次启动时不再启动它
+	err = cancelBootBackupOnce()
 	if err != nil {
-		return xerrors.Errorf("failed to save config file %q: %w", configFile, err)
+		logger.Warning("failed to cancel boot backup once:", err)
 	}
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		err := removeBootloaderRecoveryEntry(backup, envVars)
+		if err != nil {
+			logger.Warning("failed to remove recovery entry from bootloader:", err)
+		}
+	}()
 
+	_extraDirs = cfg.getExtraDirs()
 	initBackUpRecord(backupRecordPath, defaultHospiceDir)
 	recoverDeprecatedFilesOrDirs(backupRecordPath, false)
 	err = updateBackUpRecordFile(backupRecordPath)
@@ -403,8 +403,13 @@ func backup(cfg *Config, envVars []string) error {
 		return err
 	}
 	backupExtra()
-	errMsg, err := runRsync(tmpExcludeFile)
+	reporter.setPhase(jobPhaseRsync)
+	rsyncStart := time.Now()
+	errMsg, err := runRsync(ctx, tmpExcludeFile, mountPoint, reporter)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		logger.Warning(errMsg)
 		allMatchedString := _renameFailedMsgRegexp.FindAllStringSubmatch(errMsg, -1)
 		for _, matchString := range allMatchedString {
@@ -412,7 +417,7 @@ func backup(cfg *Config, envVars []string) error {
 				tempFilePath := matchString[1]
 				destFilePath := matchString[2]
 				if strings.Contains(filepath.Base(tempFilePath), filepath.Base(destFilePath)) {
-					err := exec.Command("chattr", "-i", filepath.Join(backupMountPoint, destFilePath)).Run()
+					err := exec.Command("chattr", "-i", filepath.Join(mountPoint, destFilePath)).Run()
 					if err != nil {
 						logger.Warning(err)
 						continue
@@ -423,18 +428,31 @@ func backup(cfg *Config, envVars []string) error {
 		allMatchedString = _delFailedMsgRegexp.FindAllStringSubmatch(errMsg, -1)
 		for _, matchString := range allMatchedString {
 			if len(matchString) == 2 {
-				err := exec.Command("chattr", "-i", filepath.Join(backupMountPoint, matchString[1])).Run()
+				err := exec.Command("chattr", "-i", filepath.Join(mountPoint, matchString[1])).Run()
 				if err != nil {
 					logger.Warning(err)
 					continue
 				}
 			}
 		}
-		return xerrors.Errorf("run rsync err: %w", errMsg)
+		if strings.Contains(errMsg, "No space left on device") {
+			return newJobErrorf(errCodeNoSpace, "run rsync err: %s: %w", strings.TrimSpace(errMsg), err)
+		}
+		return newJobErrorf(errCodeRsyncFailed, "run rsync err: %s: %w", strings.TrimSpace(errMsg), err)
 	}
 
-	for _, dir := range skipDirs {
-		dir := filepath.Join(backupMountPoint, dir)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reporter.setPhase(jobPhaseManifest)
+	// 清单由备份分区中的文件生成，生成前先与当前系统比较，确认复制的结果是正确的
+	err = checkBackupCopy(ctx, cfg, mountPoint, rsyncStart)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range cfg.getExcludeDirs() {
+		dir := filepath.Join(mountPoint, dir)
 		err = os.Mkdir(dir, 0755)
 		if err != nil {
 			if os.IsExist(err) {
@@ -445,30 +463,161 @@ func backup(cfg *Config, envVars []string) error {
 	}
 
 	// modify fs tab
-	err = modifyFsTab(filepath.Join(backupMountPoint, "etc/fstab"), backupUuid, backupDevice)
+	err = modifyFsTab(filepath.Join(mountPoint, "etc/fstab"), "UUID="+backup.Uuid)
+	if err != nil {
+		return newJobErrorf(errCodeFstabNotPatched, "failed to modify fs tab: %w", err)
+	}
+	if cfg.isLuks() {
+		err = modifyCryptTab(filepath.Join(mountPoint, "etc/crypttab"), cfg.CurrentLuks, cfg.BackupLuks)
+		if err != nil {
+			return newJobErrorf(errCodeFstabNotPatched, "failed to modify crypttab: %w", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// 备份分区中的配置文件在最后才写入，不记录在清单中
+	err = writeManifest(ctx, mountPoint, []string{configFile})
 	if err != nil {
-		return xerrors.Errorf("failed to modify fs tab: %w", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("failed to write manifest: %w", err)
 	}
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reporter.setPhase(jobPhaseKernel)
 	kFiles, err := backupKernel()
 	if err != nil {
 		return xerrors.Errorf("failed to backup kernel: %w", err)
 	}
 
-	err = ioutil.WriteFile(filepath.Join(backupMountPoint, backupPartitionMarkFile), nil, 0644)
-	if err != nil {
-		return xerrors.Errorf("failed to write backup partition mark file: %w", err)
+	// 进入 bootloader 阶段后不能再取消，所以要先设置阶段再检查
+	reporter.setPhase(jobPhaseBootloader)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
 	// generate bootloader config
-	err = writeBootloaderCfgBackup(backupUuid, backupDevice, osDesc, kFiles, now, envVars)
+	now := time.Now()
+	err = writeBootloaderBackupEntries(cfg, backup, osDesc, kFiles, now, envVars)
 	if err != nil {
-		return xerrors.Errorf("failed to write bootloader cfg: %w", err)
+		return err
+	}
+
+	cfg.Time = &now
+	cfg.Version = osVersion
+	// 备份分区中的配置文件也要更新，它是 rsync 在备份失效后复制过去的
+	for _, filename := range []string{configFile, filepath.Join(mountPoint, configFile)} {
+		err = cfg.save(filename)
+		if err != nil {
+			return xerrors.Errorf("failed to save config file %q: %w", filename, err)
+		}
 	}
 
+	err = atomicfile.WriteFile(filepath.Join(mountPoint, backupPartitionMarkFile), nil, 0644)
+	if err != nil {
+		return xerrors.Errorf("failed to write backup partition mark file: %w", err)
+	}
+
+	return nil
+}
+
+// 添加回滚到 backup 的引导菜单项，配置了 UefiBootEntry 时还添加 UEFI 启动项。
+func writeBootloaderBackupEntries(cfg *Config, backup bootloader.Partition, osDesc string,
+	kFiles *kernelFiles, backupTime time.Time, envVars []string) error {
+	err := writeBootloaderCfgBackup(backup, osDesc, kFiles, backupTime, cfg.BootFailureLimit, envVars)
+	if err != nil {
+		return newJobErrorf(errCodeBootloaderUpdateFailed, "failed to write bootloader cfg: %w", err)
+	}
+	if cfg.UefiBootEntry {
+		err = writeUefiBootEntry(backup, kFiles)
+		if err != nil {
+			return newJobErrorf(errCodeBootloaderUpdateFailed, "failed to write uefi boot entry: %w", err)
+		}
+	} else {
+		// 配置改变后移除之前添加的启动项
+		err = removeUefiBootEntry()
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
 	return nil
 }
 
+// 获取当前系统的版本和描述，用于配置文件中的 Version 和回滚菜单项的标题。
+func getOsVersionDesc() (osVersion, osDesc string) {
+	osVersion = "unknown"
+	osDesc = "Uos unknown"
+	osReleaseInfo, oserr := runOsRelease()
+	lsbReleaseInfo, err := runLsbRelease()
+	if err != nil {
+		logger.Warning("failed to run lsb-release:", err)
+	} else {
+		if oserr != nil {
+			osVersion = lsbReleaseInfo[lsbReleaseKeyRelease]
+			osDesc = lsbReleaseInfo[lsbReleaseKeyDesc]
+		} else {
+			systemName := osReleaseInfo[osSystemName]
+			majorVersion := osReleaseInfo[osMajorVersion]
+			EditName := osReleaseInfo[osEditionName]
+			osDesc = systemName + " " + majorVersion + " " + EditName
+			osVersion = majorVersion
+		}
+	}
+	return
+}
+
+// 使备份分区中原有的备份失效：删除标记文件，并清除配置中的备份时间和版本。
+func invalidateBackup(cfg *Config, mountPoint string) error {
+	err := os.Remove(filepath.Join(mountPoint, backupPartitionMarkFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cfg.Time = nil
+	cfg.Version = ""
+	return cfg.save(configFile)
+}
+
+// 获取备份所在的分区，用于引导程序的回滚菜单项。
+func getBackupPartition(cfg *Config) (bootloader.Partition, error) {
+	device, err := cfg.getBackupDevice()
+	if err != nil {
+		return bootloader.Partition{}, err
+	}
+	if !cfg.isLvm() {
+		return bootloader.Partition{Uuid: cfg.Backup, Device: device, Subvol: cfg.BackupSubvol,
+			Luks: cfg.BackupLuks}, nil
+	}
+	uuid, err := getDeviceUuid(device)
+	if err != nil {
+		return bootloader.Partition{}, xerrors.Errorf("failed to get uuid of %q: %w", device, err)
+	}
+	return bootloader.Partition{Uuid: uuid, Device: device, Lv: true}, nil
+}
+
+// 从引导菜单中移除回滚到备份分区的菜单项，备份分区仍然对 os-prober 隐藏。
+func removeBootloaderRecoveryEntry(backup bootloader.Partition, envVars []string) error {
+	err := removeUefiBootEntry()
+	if err != nil {
+		logger.Warning(err)
+	}
+
+	b, err := probeBootloader(envVars)
+	if err != nil {
+		return err
+	}
+	err = b.RemoveRecoveryEntries(backup)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
 // 备份不在根分区的额外文件夹，比如实际上在 /data 分区的 /var/lib/systemd 文件夹。
 func backupExtra() {
 	for origin, backupPath := range _currentBackUpRecord {
@@ -498,7 +647,29 @@ func backupExtra() {
 	}
 }
 
-func runRsync(excludeFile string) (string, error) {
+// 比较 rsync 复制到 mountPoint 的关键文件夹与当前系统中的对应文件夹，since 为 rsync 开始的时间。
+// 日志、缓存和数据库等文件在备份过程中会被修改，不比较。
+func checkBackupCopy(ctx context.Context, cfg *Config, mountPoint string, since time.Time) error {
+	if options.noRsync {
+		return nil
+	}
+	mismatches, err := compareWithSource(ctx, "/", mountPoint, _manifestHashDirs, getBackupExcludes(cfg), since)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return xerrors.Errorf("failed to compare backup with current system: %w", err)
+	}
+	for _, mismatch := range mismatches {
+		logger.Warning("backup copy mismatch:", mismatch)
+	}
+	if len(mismatches) > 0 {
+		return newJobErrorf(errCodeBackupCorrupted, "backup does not match current system: %s", mismatches[0])
+	}
+	return nil
+}
+
+func runRsync(ctx context.Context, excludeFile, dest string, reporter progressReporter) (string, error) {
 	var errBuffer bytes.Buffer
 	if options.noRsync {
 		logger.Debug("skip run rsync")
@@ -510,16 +681,29 @@ func runRsync(excludeFile string) (string, error) {
 	if logger.GetLogLevel() == log.LevelDebug {
 		rsyncArgs = append(rsyncArgs, "-v")
 	}
+	// --no-inc-recursive 让 rsync 在传输前统计出全部文件，总进度才准确
 	rsyncArgs = append(rsyncArgs, "-X", "-x", "-a", "--delete-after",
+		"--info=progress2", "--no-inc-recursive",
 		"--exclude-from="+excludeFile,
-		"/", backupMountPoint+"/")
+		"/", dest+"/")
 
-	cmd := exec.Command("rsync", rsyncArgs...)
-	cmd.Stdout = os.Stdout
+	cmd := exec.CommandContext(ctx, "rsync", rsyncArgs...)
 	cmd.Stderr = &errBuffer
 	cmd.Env = append(cmd.Env, "LC_ALL=C")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
 	logger.Info("run rsync...cmd: ", cmd.String())
-	err := cmd.Run()
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	err = readRsyncOutput(stdout, reporter)
+	if err != nil {
+		logger.Warning("failed to read rsync output:", err)
+	}
+	err = cmd.Wait()
 	return errBuffer.String(), err
 }
 
@@ -549,23 +733,7 @@ func backupKernel() (kFiles *kernelFiles, err error) {
 		return
 	}
 
-	// find current kernel
-	utsName, err := uname()
-	if err != nil {
-		return
-	}
-	release := utsName.release
-	bootOpts, err := getBootOptions()
-	if err == nil {
-		releaseBo := getKernelReleaseWithBootOption(bootOpts)
-		if releaseBo != "" {
-			release = releaseBo
-		}
-	} else {
-		logger.Warning(err)
-	}
-
-	kFiles, err = findKernelFiles(release, utsName.machine)
+	kFiles, err = findCurrentKernelFiles()
 	if err != nil {
 		return
 	}
@@ -597,6 +765,30 @@ type kernelFiles struct {
 	initrd string
 }
 
+// 查找当前正在运行的内核的文件
+func findCurrentKernelFiles() (*kernelFiles, error) {
+	utsName, err := uname()
+	if err != nil {
+		return nil, err
+	}
+	release := utsName.release
+	bootOpts, err := getBootOptions()
+	if err == nil {
+		releaseBo := getKernelReleaseWithBootOption(bootOpts)
+		if releaseBo != "" {
+			release = releaseBo
+		}
+	} else {
+		logger.Warning(err)
+	}
+
+	kFiles, err := findKernelFiles(release, utsName.machine)
+	if err != nil {
+		return nil, newJobError(errCodeKernelNotFound, err)
+	}
+	return kFiles, nil
+}
+
 func getGenKernelArch(machine string) string {
 	switch machine {
 	case "i386", "i686":
@@ -710,48 +902,28 @@ func fixBackup() error {
 		}
 		return xerrors.Errorf("load config: %w", err)
 	}
-	backupUuid := cfg.Backup
-	backupDevice, err := getDeviceByUuid(backupUuid)
-	if err != nil {
-		return xerrors.Errorf("get backup device by backup uuid: %w", err)
-	}
-
-	mounted, err := isMounted(backupMountPoint)
-	if err != nil {
-		return err
+	if cfg.isBtrfs() {
+		// 备份子卷是只读快照，不修正
+		return nil
 	}
-	if mounted {
-		err = exec.Command("umount", backupMountPoint).Run()
+	if cfg.isLvm() {
+		exist, err := lvExists(cfg.VolumeGroup, cfg.BackupLv)
 		if err != nil {
-			return xerrors.Errorf("failed to unmount %s: %w", backupMountPoint, err)
+			return err
 		}
-	}
-	err = os.Mkdir(backupMountPoint, 0755)
-	if err != nil && !os.IsExist(err) {
-		return err
-	}
-	defer func() {
-		err = os.Remove(backupMountPoint)
-		if err != nil {
-			logger.Warning("failed to remove backup mount point:", err)
+		if !exist {
+			// 还没有备份，不修正
+			return nil
 		}
-	}()
-
-	err = exec.Command("mount", backupDevice, backupMountPoint).Run()
-	if err != nil {
-		return xerrors.Errorf("failed to mount device %q to dir %q: %w",
-			backupDevice, backupMountPoint, err)
 	}
-	defer func() {
-		err := exec.Command("umount", backupMountPoint).Run()
-		if err != nil {
-			logger.Warning("failed to umount backup directory:", err)
-		}
-	}()
+	return withBackupMount(&cfg, "fix", fixBackupInDir)
+}
 
+// 修正已经挂载在 mountPoint 的备份分区中的系统
+func fixBackupInDir(mountPoint string) error {
 	// 替换备份盘中的恢复程序
-	backupPartitionAbRecoveryFile := filepath.Join(backupMountPoint, abRecoveryFile)
-	_, err = os.Stat(filepath.Dir(backupPartitionAbRecoveryFile))
+	backupPartitionAbRecoveryFile := filepath.Join(mountPoint, abRecoveryFile)
+	_, err := os.Stat(filepath.Dir(backupPartitionAbRecoveryFile))
 	if err != nil {
 		if os.IsNotExist(err) {
 			// 目前备份分区为空，不修正
@@ -764,12 +936,12 @@ func fixBackup() error {
 	if err != nil {
 		return err
 	}
-	err = utils.CopyFile(abRecoveryGrubCfg12File, filepath.Join(backupMountPoint, abRecoveryGrubCfg12File))
+	err = utils.CopyFile(abRecoveryGrubCfg12File, filepath.Join(mountPoint, abRecoveryGrubCfg12File))
 	if err != nil {
 		return err
 	}
 	// 暂时屏蔽真dde-welcome运行
-	backupDDEWelcomeFile := filepath.Join(backupMountPoint, ddeWelcomeFile)
+	backupDDEWelcomeFile := filepath.Join(mountPoint, ddeWelcomeFile)
 	backupDDEWelcomeFileInfo, err := os.Stat(backupDDEWelcomeFile)
 	if err == nil && backupDDEWelcomeFileInfo != nil &&
 		backupDDEWelcomeFileInfo.Size() > 100 {
@@ -779,7 +951,7 @@ func fixBackup() error {
 			return err
 		}
 		var content = []byte("#!/bin/sh\nexec /usr/bin/true")
-		err = ioutil.WriteFile(backupDDEWelcomeFile, content, 0755)
+		err = atomicfile.WriteFile(backupDDEWelcomeFile, content, 0755)
 		if err != nil {
 			return err
 		}
@@ -788,119 +960,27 @@ func fixBackup() error {
 	return nil
 }
 
+// 还原的每一步记录在还原日志中，中断后在服务启动时继续完成或回退，见 journal.go。
 func restore(cfg *Config, envVars []string) error {
-	currentDevice, err := getDeviceByUuid(cfg.Current)
+	currentDevice, err := cfg.getCurrentDevice()
 	if err != nil {
-		return xerrors.Errorf("failed to get device by uuid %q: %w", cfg.Current, err)
+		return newJobErrorf(errCodeConfigInvalid, "failed to get current device: %w", err)
 	}
 
-	_, err = os.Stat(ddeWelcomeFile + ".save")
-	if err == nil {
-		err = os.Rename(ddeWelcomeFile+".save", ddeWelcomeFile)
-		if err != nil {
-			logger.Warning("failed to restore dde-welcome:", err)
-		}
-	}
-
-	// 将/boot/deepin-ab-recovery文件内核文件移动到 /boot
-	fileInfoList, err := ioutil.ReadDir(globalKernelBackupDir)
+	j := newRestoreJournal(restoreJournalFile, cfg, currentDevice, envVars)
+	err = j.save()
 	if err != nil {
-		return xerrors.Errorf("failed to read dir %s: %w", globalKernelBackupDir, err)
+		return xerrors.Errorf("failed to save restore journal: %w", err)
 	}
-
-	for _, info := range fileInfoList {
-		err = os.Rename(filepath.Join(globalKernelBackupDir, info.Name()), filepath.Join(globalBootDir, info.Name()))
-		if err != nil {
-			logger.Warning("copy recovery file failed:", err)
-			return err
-		}
-	}
-
-	err = writeBootloaderCfgRestore(cfg.Current, currentDevice, cfg.Backup, envVars)
-	if err != nil {
-		return xerrors.Errorf("failed to write grub cfg: %w", err)
-	}
-	initBackUpRecord(backupRecordPath, defaultHospiceDir)
-	recoverDeprecatedFilesOrDirs(backupRecordPath, true)
-	restoreExtra()
-	// swap current and backup
-	cfg.Current, cfg.Backup = cfg.Backup, cfg.Current
-	cfg.Time = nil
-	cfg.Version = ""
-	err = cfg.save(configFile)
-	if err != nil {
-		return xerrors.Errorf("failed to save config file %q: %w", configFile, err)
-	}
-
-	// 还原时，对需要隐藏的分区进行处理: 将备份分区进行隐藏，并解除挂载
-	var rulesPaths = []string{
-		"/etc/udev/rules.d/80-udisks2.rules",
-		"/etc/udev/rules.d/80-udisks-installer.rules",
-	}
-	foundRules := false
-
-	rootDisk, err := getPathDisk("/")
-	if err != nil {
-		return xerrors.Errorf("failed to get root disk: %w", err)
-	}
-
-	labelUuidMap, err := getLabelUuidMap(rootDisk)
-	if err != nil {
-		return xerrors.Errorf("failed to get label uuid map: %w", err)
-	}
-	backupDevice, err := getDeviceByUuid(cfg.Backup)
-	if err != nil {
-		logger.Warning(err)
-		return err
-	}
-	backupLabel, err := getDeviceLabel(backupDevice)
-	if err != nil {
-		logger.Warning(err)
-		return err
-	}
-	for _, rulesPath := range rulesPaths {
-		_, err = os.Stat(rulesPath)
-		if err == nil {
-			err = modifyRules(rulesPath, labelUuidMap, cfg.Backup, cfg.Current, backupLabel)
-			if err != nil {
-				return xerrors.Errorf("failed to modify rules: %w", err)
-			}
-			foundRules = true
-		}
-	}
-	if !foundRules {
-		logger.Warning("not found 80-udisks-installer.rules or 80-udisks2.rules")
-	} else {
-		err = reloadUdev() // 重载udev的rules,让rules的修改生效
-		if err != nil {
-			logger.Warning(err)
-			return err
-		}
-		mountDir, err := getMountPointByLabel(strings.ToLower(strings.TrimSpace(backupLabel)))
-		if err != nil {
-			logger.Warning(err)
-		} else {
-			umountDeleteDir(mountDir)
-		}
-	}
-	// end
-
-	err = os.Remove(filepath.Join("/", backupPartitionMarkFile))
-	if err != nil && !os.IsNotExist(err) {
-		return xerrors.Errorf("failed to delete backup partition mark file: %w", err)
-	}
-
-	adapterActivator()
-	doRestoreHooks()
-	return nil
+	return runRestoreJournal(cfg, j)
 }
 
 // 回退不在根分区的额外文件夹，实际上是通过创建软链接完成的。
-// 如果已经是软链接了，则不需要处理。
+// 如果已经是软链接了，则不需要处理；不存在时是上次删除后还没有创建软链接就被中断了。
 func restoreExtra() {
 	for origin, backupPath := range _lastBackUpRecord {
 		isSym, err := isSymlink(origin)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			logger.Warningf("isSymlink %q failed: %v", origin, err)
 			continue
 		}
@@ -925,246 +1005,117 @@ func restoreExtra() {
 	}
 }
 
-func writeBootloaderCfgRestore(currentUuid, currentDevice, backupUuid string, envVars []string) error {
-	if globalUsePmonBios {
-		return writePmonCfgRestore(backupUuid)
+// 检测使用的引导程序，没有检测到支持的引导程序时返回 BootloaderUnsupported 错误。
+func probeBootloader(envVars []string) (bootloader.Backend, error) {
+	opts := &bootloader.Options{
+		BootDir:        globalBootDir,
+		GrubCfgFile:    globalGrubCfgFile,
+		PmonCfgFile:    globalPmonCfgFile,
+		NoGrubMkconfig: options.noGrubMkconfig || isArchSw(), // sw_64 上一直直接修改 grub.cfg
+		EnvVars:        envVars,
 	}
-
-	if globalNoGrubMkconfig {
-		if isArchMips() {
-			return writeGrubCfgRestoreMips(backupUuid)
-		} else if isArchSw() {
-			return writeGrubCfgRestoreSw(backupUuid)
-		} else {
-			return nil
-		}
-	}
-
-	filename := abRecoveryGrubCfgFile
-	dir := filepath.Dir(filename)
-	err := os.MkdirAll(dir, 0755)
-	if err != nil {
-		return err
-	}
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST %s@%s\"\n",
-		currentUuid, currentDevice))
-
-	err = ioutil.WriteFile(filename, buf.Bytes(), 0644)
-	if err != nil {
-		return err
-	}
-
-	err = runUpdateGrub(envVars)
-	return err
-}
-
-func writeGrubCfgRestoreSw(uuid string) error {
-	return writeGrubCfgRestoreMips(uuid)
-}
-
-func writeGrubCfgRestoreMips(uuid string) error {
-	cfg, err := grubcfg.ParseGrubCfgFile(globalGrubCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to parse grub cfg file: %w", err)
-	}
-
-	cfg.RemoveRecoveryMenuEntries()
-	err = cfg.ReplaceRootUuid(uuid)
-	if err != nil {
-		return xerrors.Errorf("failed to replace root uuid: %w", err)
+	bi, err := readBoardInfo()
+	if err == nil {
+		opts.BiosVersion = bi.biosVersion
+	} else if !os.IsNotExist(err) {
+		logger.Warning("failed to read board info:", err)
 	}
 
-	err = cfg.Save(globalGrubCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to save grub cfg file: %w", err)
+	b := bootloader.Probe(opts)
+	if b == nil {
+		return nil, newJobErrorf(errCodeBootloaderUnsupported, "unsupported bootloader")
 	}
-	return nil
+	logger.Debug("bootloader:", b.Describe())
+	return b, nil
 }
 
-func writePmonCfgRestore(uuid string) error {
-	cfg, err := pmoncfg.ParsePmonCfgFile(globalPmonCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to parse grub cfg file: %w", err)
-	}
-
-	cfg.RemoveRecoveryMenuEntries()
-	err = cfg.ReplaceRootUuid(uuid)
+// 还原后启动 root，即正在运行的备份，previous 为被替换的系统。
+func writeBootloaderCfgRestore(root, previous bootloader.Partition, envVars []string) error {
+	b, err := probeBootloader(envVars)
 	if err != nil {
-		return xerrors.Errorf("failed to replace root uuid: %w", err)
+		return err
 	}
-
-	err = cfg.Save(globalPmonCfgFile)
+	err = b.SwitchRoot(root, previous)
 	if err != nil {
-		return xerrors.Errorf("failed to save grub cfg file: %w", err)
+		return err
 	}
-	return nil
+	return b.Commit()
 }
 
-func writeBootloaderCfgBackup(backupUuid, backupDevice, osDesc string,
-	kFiles *kernelFiles, backupTime time.Time, envVars []string) error {
+func writeBootloaderCfgBackup(backup bootloader.Partition, osDesc string,
+	kFiles *kernelFiles, backupTime time.Time, bootFailureLimit int, envVars []string) error {
 	if globalGrubMenuEn {
 		envVars = []string{"LANG=en_US.UTF-8", "LANGUAGE=en_US"}
 	}
 
-	if globalUsePmonBios {
-		return writePmonCfgBackup(backupUuid, osDesc, kFiles, backupTime)
-	}
-
-	if globalNoGrubMkconfig {
-		if isArchSw() {
-			return writeGrubCfgBackupSw(backupUuid, osDesc, kFiles, backupTime, envVars)
-		} else if isArchMips() {
-			return writeGrubCfgBackupMips(backupUuid, osDesc, kFiles, backupTime)
-		} else {
-			return nil
-		}
-	}
-
-	filename := abRecoveryGrubCfgFile
-	dir := filepath.Dir(filename)
-	err := os.MkdirAll(dir, 0755)
+	b, err := probeBootloader(envVars)
 	if err != nil {
 		return err
 	}
-	const varPrefix = "DEEPIN_AB_RECOVERY_"
-	var buf bytes.Buffer
-	buf.WriteString(varPrefix + "BACKUP_DEVICE=" + backupDevice + "\n")
-	buf.WriteString(varPrefix + "BACKUP_UUID=" + backupUuid + "\n")
-	buf.WriteString(fmt.Sprintf("GRUB_OS_PROBER_SKIP_LIST=\"$GRUB_OS_PROBER_SKIP_LIST %s@%s\"\n",
-		backupUuid, backupDevice))
-	buf.WriteString(varPrefix + "LINUX=\"" + filepath.Join(globalKernelBackupDir,
-		filepath.Base(kFiles.linux)) + "\"\n")
-	if kFiles.initrd != "" {
-		buf.WriteString(varPrefix + "INITRD=\"" + filepath.Base(kFiles.initrd) + "\"\n")
+	entry := &bootloader.RecoveryEntry{
+		Root:             backup,
+		Linux:            filepath.Join(globalKernelBackupDir, filepath.Base(kFiles.linux)),
+		OsDesc:           osDesc,
+		BackupTime:       backupTime,
+		Title:            getRollBackMenuTextSafe(osDesc, backupTime, envVars),
+		TitleEn:          getRollbackMenuTextForceEn(osDesc, backupTime),
+		BootFailureLimit: bootFailureLimit,
 	}
-	buf.WriteString(varPrefix + "OS_DESC=\"" + osDesc + "\"\n")
-	buf.WriteString(varPrefix + "BACKUP_TIME=" + strconv.FormatInt(backupTime.Unix(), 10) + "\n")
-
-	err = ioutil.WriteFile(filename, buf.Bytes(), 0644)
-	if err != nil {
-		return xerrors.Errorf("failed to write file %q: %w", filename, err)
+	if kFiles.initrd != "" {
+		entry.Initrd = filepath.Join(globalKernelBackupDir, filepath.Base(kFiles.initrd))
 	}
-	err = runUpdateGrub(envVars)
+	err = b.AddRecoveryEntry(entry)
 	if err != nil {
-		return xerrors.Errorf("run update-grub err: %w", err)
+		return err
 	}
-
-	return nil
+	return b.Commit()
 }
 
-func writeGrubCfgBackupSw(backupUuid string, osDesc string, kFiles *kernelFiles,
-	backupTime time.Time, envVars []string) error {
-	cfg, err := grubcfg.ParseGrubCfgFile(globalGrubCfgFile)
+// 把 fstab 中挂载 / 的设备改为 source，比如 UUID=xxx 或者设备路径，同一个设备挂载在其他位置的记录也一起修改，
+// 注释和格式保持不变。交换文件和绑定挂载等用路径指定的记录在备份中指向的是备份里的文件，不需要修改。
+func modifyFsTab(filename, source string) error {
+	f, err := fstab.Load(filename)
 	if err != nil {
-		return xerrors.Errorf("failed to parse grub cfg file: %w", err)
+		return err
 	}
-
-	cfg.RemoveRecoveryMenuEntries()
-
-	menuText := getRollBackMenuTextSafe(osDesc, backupTime, envVars)
-	dir := strings.TrimPrefix(globalKernelBackupDir, globalBootDir+"/")
-	linux := filepath.Join(dir, filepath.Base(kFiles.linux))
-	initrd := filepath.Join(dir, filepath.Base(kFiles.initrd))
-	cfg.AddRecoveryMenuEntrySw(menuText, backupUuid, linux, initrd)
-
-	err = cfg.Save(globalGrubCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to save grub cfg file: %w", err)
+	root := f.Find("/")
+	if root == nil {
+		// 没有找到描述了挂载 / 的行
+		return errors.New("not found target line")
 	}
-	return nil
+	f.ReplaceSource(root.Source(), source)
+	return f.Save(filename)
 }
 
-func writeGrubCfgBackupMips(backupUuid string, osDesc string, kFiles *kernelFiles, backupTime time.Time) error {
-	cfg, err := grubcfg.ParseGrubCfgFile(globalGrubCfgFile)
+func getRootUuid() (string, error) {
+	d, err := blockdev.FindByPathMount(_blockDevs, "/")
 	if err != nil {
-		return xerrors.Errorf("failed to parse grub cfg file: %w", err)
+		return "", err
 	}
-
-	cfg.RemoveRecoveryMenuEntries()
-
-	menuText := getRollbackMenuTextForceEn(osDesc, backupTime)
-	dir := strings.TrimPrefix(globalKernelBackupDir, globalBootDir+"/")
-	linux := filepath.Join(dir, filepath.Base(kFiles.linux))
-	initrd := filepath.Join(dir, filepath.Base(kFiles.initrd))
-	cfg.AddRecoveryMenuEntryMips(menuText, backupUuid, linux, initrd)
-
-	err = cfg.Save(globalGrubCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to save grub cfg file: %w", err)
+	if d.Uuid == "" {
+		return "", xerrors.Errorf("root device %s has no uuid", d.Path)
 	}
-	return nil
+	return d.Uuid, nil
 }
 
-func writePmonCfgBackup(backupUuid string, osDesc string, kFiles *kernelFiles, backupTime time.Time) error {
-	cfg, err := pmoncfg.ParsePmonCfgFile(globalPmonCfgFile)
-	if err != nil {
-		return err
-	}
-
-	cfg.RemoveRecoveryMenuEntries()
-
-	menuText := getRollbackMenuTextForceEn(osDesc, backupTime)
-	dir := strings.TrimPrefix(globalKernelBackupDir, globalBootDir)
-	linux := filepath.Join(dir, filepath.Base(kFiles.linux))
-	initrd := filepath.Join(dir, filepath.Base(kFiles.initrd))
-	cfg.AddRecoveryMenuEntry(menuText, backupUuid, linux, initrd)
-
-	err = cfg.Save(globalPmonCfgFile)
-	if err != nil {
-		return xerrors.Errorf("failed to save pmon cfg file: %w", err)
+// 获取正在运行的系统的标识，用于与 Config.currentId 和 backupId 比较，mode 为 Config.storageMode 的结果：
+// 分区模式下为根分区的 uuid，子卷模式下加上根文件系统挂载的子卷，LVM 模式下为根逻辑卷的设备路径。
+func getRootId(mode string) (string, error) {
+	if mode == storageModeLvm {
+		return getRootLvDevice()
 	}
-
-	return nil
-}
-
-func modifyFsTab(filename, uuid, device string) error {
-	content, err := ioutil.ReadFile(filename)
+	rootUuid, err := getRootUuid()
 	if err != nil {
-		return err
-	}
-
-	lines := bytes.Split(content, []byte("\n"))
-	modifyDone := false
-	for idx, line := range lines {
-		l := bytes.TrimSpace(line)
-		if bytes.HasPrefix(l, []byte("#")) {
-			continue
-		}
-
-		fields := bytes.Fields(l)
-		if len(fields) >= 2 {
-			if bytes.Equal(fields[1], []byte("/")) &&
-				bytes.HasPrefix(fields[0], []byte("UUID")) {
-
-				lines[idx] = bytes.Replace(line, fields[0], []byte("UUID="+uuid), 1)
-
-				// set comment line
-				if idx-1 >= 0 &&
-					bytes.HasPrefix(bytes.TrimSpace(lines[idx-1]), []byte("#")) {
-					lines[idx-1] = []byte("# " + device)
-				}
-
-				modifyDone = true
-				break
-			}
-		}
+		return "", err
 	}
-	if !modifyDone {
-		// 没有找到描述了挂载 / 的行
-		return errors.New("not found target line")
+	if mode != storageModeBtrfs {
+		return rootUuid, nil
 	}
-	content = bytes.Join(lines, []byte("\n"))
-	err = ioutil.WriteFile(filename, content, 0644)
-	return err
-}
-
-func getRootUuid() (string, error) {
-	out, err := exec.Command("grub-probe", "-t", "fs_uuid", "/").Output()
+	subvol, err := getRootSubvol()
 	if err != nil {
 		return "", err
 	}
-	return string(bytes.TrimSpace(out)), nil
+	return formatRootId(rootUuid, subvol), nil
 }
 
 func inhibit(what, who, why string) (dbus.UnixFD, error) {
@@ -1241,11 +1192,13 @@ func recoverDeprecatedFilesOrDirs(recordPath string, isRestore bool) {
 		// 兼容 /var/uos文件夹备份改为 /var/uos/os-license文件备份
 		// 处理软链接和非软链接两种情况
 		isSym, err := isSymlink("/var/uos")
-		if err != nil {
+		// /var/uos 不存在时是上次删除软链接后还没有移回就被中断了
+		missing := os.IsNotExist(err) && isExist(oldBackupPath)
+		if err != nil && !missing {
 			logger.Warningf("isSymlink %q failed: %v", "/var/uos", err)
 			return
 		}
-		if isSym {
+		if isSym || missing {
 			err := os.RemoveAll("/var/uos")
 			if err != nil {
 				logger.Warningf("remove origin dir failed: %v", err)
@@ -1257,7 +1210,7 @@ func recoverDeprecatedFilesOrDirs(recordPath string, isRestore bool) {
 				return
 			}
 		} else {
-			if isRestore {
+			if isRestore && isExist(filepath.Join(oldBackupPath, "os-license")) {
 				err := exec.Command("mv", filepath.Join(oldBackupPath, "os-license"), "/var/uos", "-f").Run() // 将os-license文件还原至备份时候的状态
 				if err != nil {
 					logger.Warningf("only restore os-license failed: %v", err)
@@ -1277,21 +1230,16 @@ func recoverDeprecatedFilesOrDirs(recordPath string, isRestore bool) {
 		if currentBackupPath, ok := _currentBackUpRecord[originPath]; ok && backupPath == currentBackupPath {
 			continue
 		}
-		// 恢复之前的备份
+		// 恢复之前的备份，originPath 不存在时是上次删除软链接后还没有复制完成就被中断了
 		isSym, err := isSymlink(originPath)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			logger.Warningf("isSymlink %q failed: %v", originPath, err)
 			continue
 		}
-		if isSym {
-			err = os.RemoveAll(originPath)
+		if isSym || err != nil {
+			err = copyBackDeprecated(backupPath, originPath)
 			if err != nil {
-				logger.Warningf("remove origin dir failed: %v", err)
-				continue
-			}
-			err = exec.Command("cp", "-a", backupPath, originPath).Run()
-			if err != nil {
-				logger.Warningf("run cp command failed: %v", err)
+				logger.Warning(err)
 				continue
 			}
 		}
@@ -1304,6 +1252,24 @@ func recoverDeprecatedFilesOrDirs(recordPath string, isRestore bool) {
 	return
 }
 
+// 先复制到临时位置再替换软链接，中断时 originPath 要么是软链接要么是完整的副本，不会在删除 backupPath 时丢失内容。
+func copyBackDeprecated(backupPath, originPath string) error {
+	tmpPath := originPath + ".ab-recovery-tmp"
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		return xerrors.Errorf("remove tmp dir failed: %w", err)
+	}
+	err = exec.Command("cp", "-a", backupPath, tmpPath).Run()
+	if err != nil {
+		return xerrors.Errorf("run cp command failed: %w", err)
+	}
+	err = os.RemoveAll(originPath)
+	if err != nil {
+		return xerrors.Errorf("remove origin dir failed: %w", err)
+	}
+	return os.Rename(tmpPath, originPath)
+}
+
 // 更新记录备份项的文件
 func updateBackUpRecordFile(path string) error {
 	err := os.MkdirAll(filepath.Dir(path), 0755)
@@ -1314,7 +1280,7 @@ func updateBackUpRecordFile(path string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, data, 0644)
+	return atomicfile.WriteFile(path, data, 0644)
 }
 
 // 初始化_lastBackUpRecord和_currentBackUpRecord
@@ -1360,12 +1326,14 @@ func initBackUpRecord(recordPath, hospice string) {
 	}
 }
 
+const licenseAdapterFile = "/var/uos/.licenseadapter"
+
 // 在还原过程中适配系统激活
 func adapterActivator() {
-	_, err := os.Stat("/var/uos/.licenseadapter")
+	_, err := os.Stat(licenseAdapterFile)
 	if err == nil {
 		// 系统进行还原操作时，通过root权限运行程序 /var/uos/.licenseadapter
-		err = exec.Command("/var/uos/.licenseadapter").Run()
+		err = exec.Command(licenseAdapterFile).Run()
 		if err != nil {
 			logger.Warning("run /var/uos/.licenseadapter failed", err)
 		}
@@ -1375,20 +1343,26 @@ func adapterActivator() {
 }
 
 // /var/lib/deepin-ab-recovery/hooks用于其他模块存放脚本(类似bug 114537的问题)，在进行回滚的时候，执行对应脚本
-func doRestoreHooks() {
-	const restoreHookDir = "/var/lib/deepin-ab-recovery/hooks"
+var restoreHookDir = "/var/lib/deepin-ab-recovery/hooks"
+
+func getRestoreHooks() []string {
 	infos, err := ioutil.ReadDir(restoreHookDir)
 	if err != nil {
 		logger.Warning(err)
-		return
+		return nil
 	}
+	var hooks []string
 	for _, info := range infos {
 		if !info.IsDir() {
-			path := filepath.Join(restoreHookDir, info.Name())
-			err = exec.Command(path).Run()
-			if err != nil {
-				logger.Warning("run this hook failed: ", err)
-			}
+			hooks = append(hooks, filepath.Join(restoreHookDir, info.Name()))
 		}
 	}
+	return hooks
+}
+
+func runRestoreHook(path string) {
+	err := exec.Command(path).Run()
+	if err != nil {
+		logger.Warning("run this hook failed: ", err)
+	}
 }
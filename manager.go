@@ -5,15 +5,17 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/godbus/dbus"
-	"golang.org/x/xerrors"
 	"github.com/linuxdeepin/go-lib/dbusutil"
+	"golang.org/x/xerrors"
 )
 
 const (
@@ -23,14 +25,19 @@ const (
 
 	jobKindBackup        = "backup"
 	jobKindRestore       = "restore"
+	jobKindVerify        = "verify"
+	jobKindEstimate      = "estimate"
 	abBackupFinishedFile = "/tmp/ab-backup-finished"
+
+	// JobProgress 信号的最短发送间隔
+	progressEmitInterval = 500 * time.Millisecond
 )
 
 var msgRollBack = Tr("Roll back to %s (%s)")
 
 // ^ 相同的源字符串也定义在文件 misc/11_deepin_ab_recovery 中
 
-//go:generate dbusutil-gen -type Manager manager.go
+//go:generate dbusutil-gen -type Manager,Job manager.go job.go
 //go:generate dbusutil-gen em -type Manager
 
 type Manager struct {
@@ -42,6 +49,32 @@ type Manager struct {
 	BackupVersion string
 	BackupTime    int64
 	HasBackedUp   bool
+	// 下次启动的系统，"default" 或 "backup"
+	NextBootTarget string
+	// 有被中断的还原，服务启动后会继续完成或回退
+	PendingRecovery bool
+
+	// 以下属性描述正在进行的备份任务的进度
+	Progress         float64 // 总进度 0 ~ 100
+	BytesTransferred uint64
+	FilesTransferred uint64
+	Phase            string
+	ETA              int64 // rsync 阶段预计剩余秒数
+
+	// 已导出的任务对象路径
+	Jobs []dbus.ObjectPath
+
+	jobs         []*Job
+	jobIdCounter uint32
+	backupJob    *Job
+
+	progressEmitTime time.Time
+	// 取消当前备份任务，没有可取消的任务时为 nil
+	cancelJob context.CancelFunc
+	// 是否正在估算备份需要的空间
+	estimating bool
+	// 是否正在校验备份
+	verifying bool
 
 	cfg Config
 
@@ -51,6 +84,24 @@ type Manager struct {
 			kind    string
 			success bool
 			errMsg  string
+			errCode string
+		}
+
+		JobProgress struct {
+			kind             string
+			phase            string
+			progress         float64
+			bytesTransferred uint64
+			filesTransferred uint64
+			eta              int64
+		}
+
+		BackupEstimated struct {
+			job           dbus.ObjectPath
+			required      uint64
+			available     uint64
+			bootRequired  uint64
+			bootAvailable uint64
 		}
 	}
 }
@@ -65,6 +116,10 @@ func newManager(service *dbusutil.Service) *Manager {
 	if err != nil {
 		logger.Warning("failed to load config:", err)
 	}
+	dropInErr := loadConfigDropIns(configDropInDir, &m.cfg)
+	if dropInErr != nil {
+		logger.Warning(dropInErr)
+	}
 	logger.Debug("current:", m.cfg.Current)
 	logger.Debug("backup:", m.cfg.Backup)
 
@@ -72,7 +127,7 @@ func newManager(service *dbusutil.Service) *Manager {
 	if err != nil {
 		logger.Warning(err)
 	}
-	m.ConfigValid = err == nil
+	m.ConfigValid = err == nil && dropInErr == nil
 
 	if m.ConfigValid {
 		if m.cfg.Time != nil {
@@ -80,34 +135,72 @@ func newManager(service *dbusutil.Service) *Manager {
 		}
 		m.BackupVersion = m.cfg.Version
 	}
+	m.NextBootTarget = getNextBootTarget()
+
+	j, err := loadRestoreJournal(restoreJournalFile)
+	if err != nil {
+		logger.Warning(err)
+	}
+	m.PendingRecovery = j != nil || err != nil
 
 	return m
 }
 
+// 检查是否有被中断的还原，有时不能备份或还原。
+func (m *Manager) checkPendingRecovery() error {
+	m.PropsMu.RLock()
+	pending := m.PendingRecovery
+	m.PropsMu.RUnlock()
+	if pending {
+		return newJobErrorf(errCodeRecoveryPending, "an interrupted restore is pending")
+	}
+	return nil
+}
+
 func (m *Manager) GetInterfaceName() string {
 	return dbusInterface
 }
 
-func (m *Manager) canBackup() (bool, error) {
-	if globalNoGrubMkconfig {
-		if isArchMips() {
-			// pass
-		} else if isArchSw() {
-			// pass
-		} else {
-			return false, nil
-		}
+// 检查能否备份，不能备份时返回带错误码的错误，其他错误表示检查本身失败。
+func (m *Manager) checkBackup() error {
+	err := m.checkPendingRecovery()
+	if err != nil {
+		return err
+	}
+	_, err = probeBootloader(nil)
+	if err != nil {
+		return err
 	}
 
 	if !m.ConfigValid {
-		return false, nil
+		return newJobErrorf(errCodeConfigInvalid, "config %q is invalid", configFile)
 	}
 
-	rootUuid, err := getRootUuid()
+	rootId, err := getRootId(m.cfg.storageMode())
 	if err != nil {
-		return false, err
+		return err
 	}
-	return rootUuid == m.cfg.Current, nil
+	if rootId != m.cfg.currentId() {
+		return newJobErrorf(errCodeNotOnCurrentRoot, "root %q is not the current system %q",
+			rootId, m.cfg.currentId())
+	}
+	return nil
+}
+
+func (m *Manager) canBackup() (bool, error) {
+	return canDo(m.checkBackup())
+}
+
+// 把 checkBackup 和 checkRestore 的结果转换为 canBackup 和 canRestore 的结果
+func canDo(checkErr error) (bool, error) {
+	if checkErr == nil {
+		return true, nil
+	}
+	var je *jobError
+	if xerrors.As(checkErr, &je) {
+		return false, nil
+	}
+	return false, checkErr
 }
 
 func (m *Manager) CanBackup() (can bool, busErr *dbus.Error) {
@@ -115,25 +208,36 @@ func (m *Manager) CanBackup() (can bool, busErr *dbus.Error) {
 	return can, dbusutil.ToError(err)
 }
 
-func (m *Manager) canRestore() (bool, error) {
-	if globalNoGrubMkconfig {
-		if isArchMips() {
-			// pass
-		} else if isArchSw() {
-			// pass
-		} else {
-			return false, nil
-		}
+func (m *Manager) checkRestore() error {
+	err := m.checkPendingRecovery()
+	if err != nil {
+		return err
+	}
+	_, err = probeBootloader(nil)
+	if err != nil {
+		return err
 	}
 
 	if !m.ConfigValid {
-		return false, nil
+		return newJobErrorf(errCodeConfigInvalid, "config %q is invalid", configFile)
 	}
-	rootUuid, err := getRootUuid()
+	rootId, err := getRootId(m.cfg.storageMode())
 	if err != nil {
-		return false, err
+		return err
+	}
+	if rootId != m.cfg.backupId() {
+		return newJobErrorf(errCodeNotOnBackupRoot, "root %q is not the backup system %q",
+			rootId, m.cfg.backupId())
+	}
+	// 没有标记文件说明备份没有完成，比如备份被取消了
+	if !isExist(filepath.Join("/", backupPartitionMarkFile)) {
+		return newJobErrorf(errCodeBackupInvalid, "backup is incomplete")
 	}
-	return rootUuid == m.cfg.Backup, nil
+	return nil
+}
+
+func (m *Manager) canRestore() (bool, error) {
+	return canDo(m.checkRestore())
 }
 
 func (m *Manager) CanRestore() (can bool, busErr *dbus.Error) {
@@ -142,22 +246,35 @@ func (m *Manager) CanRestore() (can bool, busErr *dbus.Error) {
 }
 
 func (m *Manager) startBackup(envVars []string) error {
-	can, err := m.canBackup()
+	err := m.checkBackup()
 	if err != nil {
 		return err
 	}
 
-	if !can {
-		return errors.New("backup cannot be performed")
-	}
-
 	m.PropsMu.Lock()
 	if m.BackingUp {
 		m.PropsMu.Unlock()
 		return nil
 	}
+	if m.verifying {
+		m.PropsMu.Unlock()
+		return xerrors.New("verification is in progress")
+	}
+	if m.estimating {
+		m.PropsMu.Unlock()
+		return xerrors.New("estimating is in progress")
+	}
 
+	job, err := m.addJob(jobKindBackup)
+	if err != nil {
+		m.PropsMu.Unlock()
+		return xerrors.Errorf("failed to add job: %w", err)
+	}
+	m.backupJob = job
 	m.BackingUp = true
+	m.resetProgress()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelJob = cancel
 	m.PropsMu.Unlock()
 	err = m.emitPropChangedBackingUp(true)
 	if err != nil {
@@ -165,20 +282,38 @@ func (m *Manager) startBackup(envVars []string) error {
 	}
 
 	go func() {
-		err := m.backup(envVars)
+		err := m.backup(ctx, envVars)
 		if err != nil {
 			logger.Warning("failed to backup:", err)
 		}
+		job.finish(err)
 		m.emitSignalJobEnd(jobKindBackup, err)
 
+		nextBootTarget := getNextBootTarget()
 		m.PropsMu.Lock()
+		m.setPropNextBootTarget(nextBootTarget)
+		m.backupJob = nil
+		m.cancelJob = nil
+		cancel()
 		m.setPropBackingUp(false)
+		m.setPropPhase("")
+		m.setPropETA(0)
 		if err == nil {
+			m.setPropProgress(100)
 			backupTime := m.cfg.Time.Unix()
 			m.setPropBackupTime(backupTime)
 			m.setPropBackupVersion(m.cfg.Version)
 			creatFile(abBackupFinishedFile)
 			m.setPropHasBackedUp(true)
+		} else if m.cfg.Time == nil {
+			// 原有的备份已失效
+			m.setPropBackupTime(0)
+			m.setPropBackupVersion("")
+			err = os.Remove(abBackupFinishedFile)
+			if err != nil && !os.IsNotExist(err) {
+				logger.Warning(err)
+			}
+			m.setPropHasBackedUp(false)
 		}
 		m.PropsMu.Unlock()
 
@@ -188,22 +323,46 @@ func (m *Manager) startBackup(envVars []string) error {
 }
 
 func (m *Manager) StartBackup(sender dbus.Sender) *dbus.Error {
+	err := m.checkAuthWithSender(sender, polkitActionBackup)
+	if err != nil {
+		return toDBusError(err)
+	}
 	envVars, err := getLocaleEnvVarsWithSender(m.service, sender)
 	if err != nil {
 		return dbusutil.ToError(err)
 	}
 	err = m.startBackup(envVars)
-	return dbusutil.ToError(err)
+	return toDBusError(err)
 }
 
-func (m *Manager) startRestore(envVars []string) error {
-	can, err := m.canRestore()
+func (m *Manager) cancelBackup() error {
+	m.PropsMu.Lock()
+	defer m.PropsMu.Unlock()
+
+	if !m.BackingUp || m.cancelJob == nil {
+		return newJobErrorf(errCodeNotCancellable, "no backup job can be cancelled")
+	}
+	if m.Phase == jobPhaseBootloader {
+		return newJobErrorf(errCodeNotCancellable,
+			"backup job can not be cancelled while writing bootloader config")
+	}
+	m.cancelJob()
+	return nil
+}
+
+func (m *Manager) CancelJob(sender dbus.Sender) *dbus.Error {
+	err := m.checkAuthWithSender(sender, polkitActionBackup)
 	if err != nil {
-		return err
+		return toDBusError(err)
 	}
+	err = m.cancelBackup()
+	return toDBusError(err)
+}
 
-	if !can {
-		return errors.New("restore cannot be performed")
+func (m *Manager) startRestore(envVars []string) error {
+	err := m.checkRestore()
+	if err != nil {
+		return err
 	}
 
 	m.PropsMu.Lock()
@@ -212,6 +371,11 @@ func (m *Manager) startRestore(envVars []string) error {
 		return nil
 	}
 
+	job, err := m.addJob(jobKindRestore)
+	if err != nil {
+		m.PropsMu.Unlock()
+		return xerrors.Errorf("failed to add job: %w", err)
+	}
 	m.Restoring = true
 	m.PropsMu.Unlock()
 	err = m.emitPropChangedRestoring(true)
@@ -224,9 +388,12 @@ func (m *Manager) startRestore(envVars []string) error {
 		if err != nil {
 			logger.Warning("failed to restore:", err)
 		}
+		job.finish(err)
 		m.emitSignalJobEnd(jobKindRestore, err)
 
+		nextBootTarget := getNextBootTarget()
 		m.PropsMu.Lock()
+		m.setPropNextBootTarget(nextBootTarget)
 		m.Restoring = false
 		m.PropsMu.Unlock()
 
@@ -239,13 +406,132 @@ func (m *Manager) startRestore(envVars []string) error {
 	return nil
 }
 
+// 在服务启动时继续完成或回退被中断的还原，作为一个还原任务执行，成功后 PendingRecovery 变为 false。
+func (m *Manager) resumeRestore() {
+	j, err := loadRestoreJournal(restoreJournalFile)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	if j == nil {
+		return
+	}
+
+	m.PropsMu.Lock()
+	job, err := m.addJob(jobKindRestore)
+	if err != nil {
+		m.PropsMu.Unlock()
+		logger.Warning("failed to add job:", err)
+		return
+	}
+	m.Restoring = true
+	m.PropsMu.Unlock()
+	err = m.emitPropChangedRestoring(true)
+	if err != nil {
+		logger.Warning(err)
+	}
+
+	go func() {
+		err := inhibitShutdownDo(Tr("Restoring the system"), func() error {
+			return resumeRestoreJournal(&m.cfg, j)
+		})
+		if err != nil {
+			logger.Warning("failed to resume restore:", err)
+		}
+		job.finish(err)
+		m.emitSignalJobEnd(jobKindRestore, err)
+
+		nextBootTarget := getNextBootTarget()
+		m.PropsMu.Lock()
+		m.setPropNextBootTarget(nextBootTarget)
+		if err == nil {
+			m.setPropPendingRecovery(false)
+		}
+		m.setPropRestoring(false)
+		m.PropsMu.Unlock()
+	}()
+}
+
+// 放弃不能继续完成也不能回退的还原，删除还原日志，剩下的步骤需要手动处理。
+func (m *Manager) discardRecovery() error {
+	m.PropsMu.Lock()
+	defer m.PropsMu.Unlock()
+	if m.Restoring {
+		return xerrors.New("restore is in progress")
+	}
+	if !m.PendingRecovery {
+		return nil
+	}
+	// 读取失败时也删除
+	j, err := loadRestoreJournal(restoreJournalFile)
+	if err != nil {
+		logger.Warning(err)
+	} else if j != nil {
+		logger.Warning("discard interrupted restore, done steps:", j.Done)
+	}
+	j = &restoreJournal{filename: restoreJournalFile}
+	err = inhibitShutdownDo(Tr("Restoring the system"), j.remove)
+	if err != nil {
+		return xerrors.Errorf("failed to remove restore journal: %w", err)
+	}
+	m.setPropPendingRecovery(false)
+	return nil
+}
+
+func (m *Manager) DiscardRecovery(sender dbus.Sender) *dbus.Error {
+	err := m.checkAuthWithSender(sender, polkitActionRestore)
+	if err != nil {
+		return toDBusError(err)
+	}
+	err = m.discardRecovery()
+	return toDBusError(err)
+}
+
 func (m *Manager) StartRestore(sender dbus.Sender) *dbus.Error {
+	err := m.checkAuthWithSender(sender, polkitActionRestore)
+	if err != nil {
+		return toDBusError(err)
+	}
 	envVars, err := getLocaleEnvVarsWithSender(m.service, sender)
 	if err != nil {
 		return dbusutil.ToError(err)
 	}
 	err = m.startRestore(envVars)
-	return dbusutil.ToError(err)
+	return toDBusError(err)
+}
+
+func (m *Manager) bootBackupOnce() error {
+	if !m.ConfigValid {
+		return newJobErrorf(errCodeConfigInvalid, "config %q is invalid", configFile)
+	}
+	m.PropsMu.RLock()
+	busy := m.BackingUp || m.Restoring
+	m.PropsMu.RUnlock()
+	if busy {
+		return xerrors.New("backup or restore is in progress")
+	}
+
+	err := bootBackupOnce(&m.cfg)
+	if err != nil {
+		return err
+	}
+	m.PropsMu.Lock()
+	m.setPropNextBootTarget(nextBootTargetBackup)
+	m.PropsMu.Unlock()
+	return nil
+}
+
+func (m *Manager) BootBackupOnce(sender dbus.Sender) *dbus.Error {
+	err := m.checkAuthWithSender(sender, polkitActionRestore)
+	if err != nil {
+		return toDBusError(err)
+	}
+	err = m.bootBackupOnce()
+	return toDBusError(err)
+}
+
+func (m *Manager) checkAuthWithSender(sender dbus.Sender, actionId string) error {
+	return checkAuthorization(m.service.Conn(), actionId, string(sender))
 }
 
 func inhibitShutdownDo(why string, fn func() error) error {
@@ -282,9 +568,9 @@ func inhibitShutdownDo(why string, fn func() error) error {
 	return err
 }
 
-func (m *Manager) backup(envVars []string) error {
+func (m *Manager) backup(ctx context.Context, envVars []string) error {
 	return inhibitShutdownDo(Tr("Backing up the system"), func() error {
-		return backup(&m.cfg, envVars)
+		return backup(ctx, &m.cfg, envVars, m)
 	})
 }
 
@@ -300,7 +586,7 @@ func Tr(text string) string {
 
 func (m *Manager) emitSignalJobEnd(kind string, err error) {
 	switch kind {
-	case jobKindBackup, jobKindRestore:
+	case jobKindBackup, jobKindRestore, jobKindVerify, jobKindEstimate:
 		// pass
 	default:
 		panic("invalid kind " + kind)
@@ -310,15 +596,80 @@ func (m *Manager) emitSignalJobEnd(kind string, err error) {
 		errMsg = err.Error()
 	}
 	success := err == nil
-	emitErr := m.service.Emit(m, "JobEnd", kind, success, errMsg)
+	emitErr := m.service.Emit(m, "JobEnd", kind, success, errMsg, getErrCode(err))
 	if emitErr != nil {
+		logger.Warning(emitErr)
+	}
+}
+
+// 需要在 PropsMu 加锁后调用
+func (m *Manager) resetProgress() {
+	m.setPropProgress(0)
+	m.setPropBytesTransferred(0)
+	m.setPropFilesTransferred(0)
+	m.setPropPhase("")
+	m.setPropETA(0)
+	m.progressEmitTime = time.Time{}
+}
+
+func (m *Manager) setPhase(phase string) {
+	m.PropsMu.Lock()
+	m.setPropPhase(phase)
+	m.setPropProgress(getTotalProgress(phase, 0))
+	if phase != jobPhaseRsync {
+		m.setPropETA(0)
+	}
+	m.progressEmitTime = time.Now()
+	if m.backupJob != nil {
+		m.backupJob.setProgress(m.Progress)
+		m.backupJob.appendLog("enter phase " + phase)
+	}
+	m.PropsMu.Unlock()
+
+	m.emitSignalJobProgress(jobKindBackup)
+}
+
+func (m *Manager) setRsyncProgress(p *rsyncProgress) {
+	m.PropsMu.Lock()
+	now := time.Now()
+	if p.percent < 100 && now.Sub(m.progressEmitTime) < progressEmitInterval {
+		m.PropsMu.Unlock()
+		return
+	}
+	m.progressEmitTime = now
+	m.setPropProgress(getTotalProgress(m.Phase, p.percent))
+	m.setPropBytesTransferred(p.bytes)
+	m.setPropFilesTransferred(p.files)
+	if p.eta >= 0 {
+		m.setPropETA(p.eta)
+	}
+	if m.backupJob != nil {
+		m.backupJob.setProgress(m.Progress)
+	}
+	m.PropsMu.Unlock()
+
+	m.emitSignalJobProgress(jobKindBackup)
+}
+
+func (m *Manager) emitSignalJobProgress(kind string) {
+	m.PropsMu.RLock()
+	phase := m.Phase
+	progress := m.Progress
+	bytesTransferred := m.BytesTransferred
+	filesTransferred := m.FilesTransferred
+	eta := m.ETA
+	m.PropsMu.RUnlock()
+
+	err := m.service.Emit(m, "JobProgress", kind, phase, progress,
+		bytesTransferred, filesTransferred, eta)
+	if err != nil {
 		logger.Warning(err)
 	}
 }
 
 func (m *Manager) canQuit() bool {
 	m.PropsMu.Lock()
-	can := !m.BackingUp && !m.Restoring
+	can := !m.BackingUp && !m.Restoring && !m.verifying && !m.estimating
 	m.PropsMu.Unlock()
 	return can
 }
@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagerCancelBackup(t *testing.T) {
+	m := &Manager{}
+	assert.Error(t, m.cancelBackup())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.BackingUp = true
+	m.cancelJob = cancel
+	m.Phase = jobPhaseBootloader
+	assert.Error(t, m.cancelBackup())
+	assert.NoError(t, ctx.Err())
+
+	m.Phase = jobPhaseRsync
+	assert.NoError(t, m.cancelBackup())
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestManagerDiscardRecovery(t *testing.T) {
+	m := &Manager{}
+	assert.NoError(t, m.discardRecovery())
+
+	m.PendingRecovery = true
+	m.Restoring = true
+	assert.Error(t, m.discardRecovery())
+	assert.True(t, m.PendingRecovery)
+}
@@ -0,0 +1,587 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus"
+	"golang.org/x/xerrors"
+)
+
+// 清单文件，与备份分区标记文件放在一起，记录 rsync 写入备份分区的全部文件。
+const backupManifestFile = ".deepin-ab-recovery-manifest"
+
+const manifestHeader = "# deepin-ab-recovery manifest v1"
+
+// 清单中表示没有值的字段
+const manifestNone = "-"
+
+// VerifyBackup 最多报告的不一致项数
+const manifestMaxMismatches = 100
+
+// 这些文件夹中的普通文件会计算内容的哈希值，其他文件只比较元数据。
+var _manifestHashDirs = []string{"/usr", "/etc", "/var/lib/dpkg"}
+
+type manifestEntry struct {
+	path        string // 以 / 开头，相对于备份分区的根
+	mode        uint32 // st_mode
+	uid         uint32
+	gid         uint32
+	size        int64 // 文件夹的大小与文件系统有关，记为 0
+	xattrHash   string
+	contentHash string // 普通文件内容或符号链接目标的哈希值
+}
+
+func (e *manifestEntry) String() string {
+	return fmt.Sprintf("%o %d %d %d %s %s %s", e.mode, e.uid, e.gid, e.size,
+		orManifestNone(e.xattrHash), orManifestNone(e.contentHash), strconv.Quote(e.path))
+}
+
+func orManifestNone(s string) string {
+	if s == "" {
+		return manifestNone
+	}
+	return s
+}
+
+func parseManifestLine(line string) (*manifestEntry, error) {
+	fields := strings.SplitN(line, " ", 7)
+	if len(fields) != 7 {
+		return nil, xerrors.Errorf("invalid manifest line %q", line)
+	}
+	var e manifestEntry
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid mode in manifest line %q: %w", line, err)
+	}
+	e.mode = uint32(mode)
+	uid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid uid in manifest line %q: %w", line, err)
+	}
+	e.uid = uint32(uid)
+	gid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid gid in manifest line %q: %w", line, err)
+	}
+	e.gid = uint32(gid)
+	e.size, err = strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid size in manifest line %q: %w", line, err)
+	}
+	if fields[4] != manifestNone {
+		e.xattrHash = fields[4]
+	}
+	if fields[5] != manifestNone {
+		e.contentHash = fields[5]
+	}
+	e.path, err = strconv.Unquote(fields[6])
+	if err != nil {
+		return nil, xerrors.Errorf("invalid path in manifest line %q: %w", line, err)
+	}
+	return &e, nil
+}
+
+func needHashContent(path string) bool {
+	for _, dir := range _manifestHashDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 按名称排序后计算全部扩展属性的哈希值，没有扩展属性时返回空字符串。
+func hashXattrs(filename string) (string, error) {
+	size, err := syscall.Listxattr(filename, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return "", nil
+		}
+		return "", err
+	}
+	if size == 0 {
+		return "", nil
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(filename, buf)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		valueSize, err := syscall.Getxattr(filename, name, nil)
+		if err != nil {
+			return "", err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(filename, name, value)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(value[:valueSize])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newManifestEntry(root, path string, info os.FileInfo) (*manifestEntry, error) {
+	filename := filepath.Join(root, path)
+	st := info.Sys().(*syscall.Stat_t)
+	e := &manifestEntry{
+		path: path,
+		mode: st.Mode,
+		uid:  st.Uid,
+		gid:  st.Gid,
+	}
+	var err error
+	switch {
+	case info.Mode().IsRegular():
+		e.size = info.Size()
+		if needHashContent(path) {
+			e.contentHash, err = hashFile(filename)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filename)
+		if err != nil {
+			return nil, err
+		}
+		e.size = int64(len(target))
+		sum := sha256.Sum256([]byte(target))
+		e.contentHash = hex.EncodeToString(sum[:])
+	}
+
+	// syscall 中的函数会跟随符号链接，所以不读取符号链接的扩展属性
+	if info.Mode()&os.ModeSymlink == 0 {
+		e.xattrHash, err = hashXattrs(filename)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get xattrs of %q: %w", filename, err)
+		}
+	}
+	return e, nil
+}
+
+// 遍历 root 下的文件，excludes 为要跳过的以 / 开头、相对于 root 的路径。
+func walkManifest(ctx context.Context, root string, excludes []string,
+	fn func(e *manifestEntry) error) error {
+	excludeMap := make(map[string]struct{}, len(excludes))
+	for _, exclude := range excludes {
+		excludeMap[exclude] = struct{}{}
+	}
+	return filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join("/", rel)
+		if _, ok := excludeMap[path]; ok {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e, err := newManifestEntry(root, path, info)
+		if err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// 生成 root 的清单，写入 root 中的清单文件。
+func writeManifest(ctx context.Context, root string, excludes []string) error {
+	filename := filepath.Join(root, backupManifestFile)
+	tmpFile, err := ioutil.TempFile(root, backupManifestFile+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer func() {
+		if tmpFile != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpName)
+		}
+	}()
+
+	excludes = append([]string{
+		"/" + backupManifestFile,
+		"/" + filepath.Base(tmpName),
+		"/" + backupPartitionMarkFile,
+	}, excludes...)
+	bw := bufio.NewWriter(tmpFile)
+	_, err = fmt.Fprintln(bw, manifestHeader)
+	if err != nil {
+		return err
+	}
+	err = walkManifest(ctx, root, excludes, func(e *manifestEntry) error {
+		_, err := fmt.Fprintln(bw, e)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFile.Close()
+	tmpFile = nil
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	err = os.Rename(tmpName, filename)
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// 比较备份完成后 dest 中的文件与 src 中的对应文件，返回不一致项的描述，最多 manifestMaxMismatches 项。
+// 只比较 dirs 中的关键文件夹（以 / 开头、相对于 src 的路径），与 rsync -x 一样不进入其他文件系统的挂载点，
+// excludes 为要跳过的路径。当前系统仍在运行，src 中 ctime 或 mtime 不早于 since 的文件是备份过程中被修改的，
+// 不比较；比较时发现不一致后再检查一次，比较过程中被修改的文件也不算。
+func compareWithSource(ctx context.Context, src, dest string, dirs, excludes []string,
+	since time.Time) ([]string, error) {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+	srcDev := srcInfo.Sys().(*syscall.Stat_t).Dev
+
+	excludeMap := make(map[string]struct{}, len(excludes))
+	for _, exclude := range excludes {
+		excludeMap[exclude] = struct{}{}
+	}
+
+	var mismatches []string
+	var count int
+	addMismatch := func(filename, msg string) {
+		if changedSince(filename, since) {
+			return
+		}
+		count++
+		if len(mismatches) < manifestMaxMismatches {
+			mismatches = append(mismatches, msg)
+		}
+	}
+
+	walkFn := func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// 备份过程中被删除
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(src, filename)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join("/", rel)
+		if _, ok := excludeMap[path]; ok {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Dev != srcDev {
+			// 其他文件系统的挂载点，rsync 只创建空文件夹
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isChangedSince(st, since) {
+			return nil
+		}
+
+		want, err := newManifestEntry(src, path, info)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		destInfo, err := os.Lstat(filepath.Join(dest, path))
+		if err != nil {
+			if os.IsNotExist(err) {
+				addMismatch(filename, "missing: "+path)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return err
+		}
+		got, err := newManifestEntry(dest, path, destInfo)
+		if err != nil {
+			return err
+		}
+		if msg := compareManifestEntry(want, got); msg != "" {
+			addMismatch(filename, msg)
+		}
+		return nil
+	}
+
+	for _, dir := range dirs {
+		err = filepath.Walk(filepath.Join(src, dir), walkFn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if count > len(mismatches) {
+		mismatches = append(mismatches, fmt.Sprintf("... and %d more", count-len(mismatches)))
+	}
+	return mismatches, nil
+}
+
+// 文件的 ctime 或 mtime 不早于 since，即在 since 之后被修改过
+func isChangedSince(st *syscall.Stat_t, since time.Time) bool {
+	return !time.Unix(st.Ctim.Unix()).Before(since) || !time.Unix(st.Mtim.Unix()).Before(since)
+}
+
+// 重新读取 filename 的状态，判断它是否在 since 之后被修改或者删除了
+func changedSince(filename string, since time.Time) bool {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return isChangedSince(info.Sys().(*syscall.Stat_t), since)
+}
+
+func loadManifest(filename string) (map[string]*manifestEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]*manifestEntry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+		return nil, xerrors.Errorf("invalid manifest header in %q", filename)
+	}
+	for scanner.Scan() {
+		e, err := parseManifestLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		entries[e.path] = e
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return entries, nil
+}
+
+// 比较同一路径在清单中和实际的记录，返回不一致的描述，一致时返回空字符串。
+func compareManifestEntry(want, got *manifestEntry) string {
+	var diffs []string
+	if want.mode != got.mode {
+		diffs = append(diffs, fmt.Sprintf("mode %o != %o", got.mode, want.mode))
+	}
+	if want.uid != got.uid || want.gid != got.gid {
+		diffs = append(diffs, fmt.Sprintf("owner %d:%d != %d:%d", got.uid, got.gid, want.uid, want.gid))
+	}
+	if want.size != got.size {
+		diffs = append(diffs, fmt.Sprintf("size %d != %d", got.size, want.size))
+	}
+	if want.xattrHash != got.xattrHash {
+		diffs = append(diffs, "xattrs differ")
+	}
+	if want.contentHash != got.contentHash {
+		diffs = append(diffs, "content differs")
+	}
+	if len(diffs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("changed: %s (%s)", want.path, strings.Join(diffs, ", "))
+}
+
+// 根据 root 中的清单文件检查 root 中的文件，返回不一致项的描述，最多 manifestMaxMismatches 项。
+func verifyManifest(ctx context.Context, root string, excludes []string) ([]string, error) {
+	entries, err := loadManifest(filepath.Join(root, backupManifestFile))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load manifest: %w", err)
+	}
+
+	var mismatches []string
+	var count int
+	addMismatch := func(msg string) {
+		count++
+		if len(mismatches) < manifestMaxMismatches {
+			mismatches = append(mismatches, msg)
+		}
+	}
+
+	excludes = append([]string{
+		"/" + backupManifestFile,
+		"/" + backupPartitionMarkFile,
+	}, excludes...)
+	err = walkManifest(ctx, root, excludes, func(got *manifestEntry) error {
+		want, ok := entries[got.path]
+		if !ok {
+			addMismatch("extra: " + got.path)
+			return nil
+		}
+		delete(entries, got.path)
+		if msg := compareManifestEntry(want, got); msg != "" {
+			addMismatch(msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for path := range entries {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+	for _, path := range missing {
+		addMismatch("missing: " + path)
+	}
+
+	if count > len(mismatches) {
+		mismatches = append(mismatches, fmt.Sprintf("... and %d more", count-len(mismatches)))
+	}
+	return mismatches, nil
+}
+
+func (m *Manager) startVerify() (dbus.ObjectPath, error) {
+	err := m.checkBackup()
+	if err != nil {
+		return "", err
+	}
+
+	m.PropsMu.Lock()
+	if m.BackingUp || m.verifying {
+		m.PropsMu.Unlock()
+		return "", xerrors.New("backup or verification is in progress")
+	}
+	job, err := m.addJob(jobKindVerify)
+	if err != nil {
+		m.PropsMu.Unlock()
+		return "", xerrors.Errorf("failed to add job: %w", err)
+	}
+	m.verifying = true
+	m.PropsMu.Unlock()
+
+	go func() {
+		err := m.verifyBackup(job)
+		if err != nil {
+			logger.Warning("failed to verify backup:", err)
+		}
+		job.finish(err)
+		m.emitSignalJobEnd(jobKindVerify, err)
+
+		m.PropsMu.Lock()
+		m.verifying = false
+		m.PropsMu.Unlock()
+	}()
+	return job.getPath(), nil
+}
+
+func (m *Manager) verifyBackup(job *Job) error {
+	return withBackupMount(&m.cfg, "verify", func(mountPoint string) error {
+		return verifyBackupInDir(job, mountPoint)
+	})
+}
+
+func verifyBackupInDir(job *Job, mountPoint string) error {
+	if !isExist(filepath.Join(mountPoint, backupPartitionMarkFile)) {
+		return newJobErrorf(errCodeBackupInvalid, "backup is incomplete")
+	}
+	if !isExist(filepath.Join(mountPoint, backupManifestFile)) {
+		return newJobErrorf(errCodeBackupInvalid, "backup has no manifest")
+	}
+
+	// 备份分区中的配置文件在生成清单后才写入
+	mismatches, err := verifyManifest(context.Background(), mountPoint, []string{configFile})
+	if err != nil {
+		return err
+	}
+	for _, mismatch := range mismatches {
+		job.appendLog(mismatch)
+	}
+	if len(mismatches) > 0 {
+		return newJobErrorf(errCodeBackupCorrupted, "backup does not match manifest: %s", mismatches[0])
+	}
+	return nil
+}
+
+func (m *Manager) VerifyBackup(sender dbus.Sender) (job dbus.ObjectPath, busErr *dbus.Error) {
+	err := m.checkAuthWithSender(sender, polkitActionBackup)
+	if err != nil {
+		return "", toDBusError(err)
+	}
+	job, err = m.startVerify()
+	return job, toDBusError(err)
+}
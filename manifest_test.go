@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestEntryString(t *testing.T) {
+	e := &manifestEntry{
+		path:        "/usr/bin/a b\nc",
+		mode:        0100755,
+		uid:         0,
+		gid:         50,
+		size:        12,
+		contentHash: "abcd",
+	}
+	line := e.String()
+	assert.Equal(t, `100755 0 50 12 - abcd "/usr/bin/a b\nc"`, line)
+
+	e1, err := parseManifestLine(line)
+	require.NoError(t, err)
+	assert.Equal(t, e, e1)
+
+	for _, line := range []string{
+		"",
+		`100755 0 50 12 - abcd`,
+		`900 0 50 12 - abcd "/a"`,
+		`100755 0 50 12 - abcd /a`,
+	} {
+		_, err = parseManifestLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestNeedHashContent(t *testing.T) {
+	assert.True(t, needHashContent("/usr/bin/ls"))
+	assert.True(t, needHashContent("/etc"))
+	assert.True(t, needHashContent("/var/lib/dpkg/status"))
+	assert.False(t, needHashContent("/usr2/a"))
+	assert.False(t, needHashContent("/var/lib/apt/lists"))
+}
+
+func TestWriteVerifyManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "ab-recovery-manifest-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"usr/bin", "etc/deepin", "var/log"} {
+		err = os.MkdirAll(filepath.Join(root, dir), 0755)
+		require.NoError(t, err)
+	}
+	files := map[string]string{
+		"usr/bin/a":                   "aaaa",
+		"etc/hostname":                "deepin",
+		"etc/deepin/ab-recovery.json": "{}",
+		"var/log/syslog":              "log",
+		backupPartitionMarkFile:       "",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+		require.NoError(t, err)
+	}
+	err = os.Symlink("a", filepath.Join(root, "usr/bin/b"))
+	require.NoError(t, err)
+
+	excludes := []string{configFile}
+	err = writeManifest(context.Background(), root, excludes)
+	require.NoError(t, err)
+
+	entries, err := loadManifest(filepath.Join(root, backupManifestFile))
+	require.NoError(t, err)
+	assert.Contains(t, entries, "/")
+	assert.Contains(t, entries, "/usr/bin/b")
+	assert.NotContains(t, entries, configFile)
+	assert.NotContains(t, entries, "/"+backupPartitionMarkFile)
+	assert.NotContains(t, entries, "/"+backupManifestFile)
+	assert.NotEmpty(t, entries["/etc/hostname"].contentHash)
+	assert.Empty(t, entries["/var/log/syslog"].contentHash)
+
+	// 临时文件已被移除
+	fileInfos, err := ioutil.ReadDir(root)
+	require.NoError(t, err)
+	for _, info := range fileInfos {
+		assert.NotContains(t, info.Name(), ".tmp")
+	}
+
+	mismatches, err := verifyManifest(context.Background(), root, excludes)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// 被排除的文件不检查
+	err = ioutil.WriteFile(filepath.Join(root, configFile), []byte(`{"Current":"a"}`), 0644)
+	require.NoError(t, err)
+	// 大小不变，但内容不同
+	err = ioutil.WriteFile(filepath.Join(root, "etc/hostname"), []byte("DEEPIN"), 0644)
+	require.NoError(t, err)
+	err = os.Chmod(filepath.Join(root, "usr/bin/a"), 0755)
+	require.NoError(t, err)
+	err = os.Remove(filepath.Join(root, "var/log/syslog"))
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(root, "usr/bin/c"), nil, 0644)
+	require.NoError(t, err)
+
+	mismatches, err = verifyManifest(context.Background(), root, excludes)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"changed: /etc/hostname (content differs)",
+		"changed: /usr/bin/a (mode 100755 != 100644)",
+		"extra: /usr/bin/c",
+		"missing: /var/log/syslog",
+	}, mismatches)
+
+	err = os.Remove(filepath.Join(root, backupManifestFile))
+	require.NoError(t, err)
+	_, err = verifyManifest(context.Background(), root, excludes)
+	assert.Error(t, err)
+}
+
+func TestVerifyManifestMaxMismatches(t *testing.T) {
+	root, err := ioutil.TempDir("", "ab-recovery-manifest-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	err = writeManifest(context.Background(), root, nil)
+	require.NoError(t, err)
+	for i := 0; i < manifestMaxMismatches+5; i++ {
+		f, err := ioutil.TempFile(root, "extra-")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	mismatches, err := verifyManifest(context.Background(), root, nil)
+	require.NoError(t, err)
+	require.Len(t, mismatches, manifestMaxMismatches+1)
+	assert.Equal(t, "... and 5 more", mismatches[manifestMaxMismatches])
+}
+
+func TestCompareWithSource(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	for _, root := range []string{src, dest} {
+		for _, dir := range []string{"usr/bin", "etc", "tmp"} {
+			err := os.MkdirAll(filepath.Join(root, dir), 0755)
+			require.NoError(t, err)
+		}
+		files := map[string]string{
+			"usr/bin/a":    "aaaa",
+			"etc/hostname": "deepin",
+		}
+		for name, content := range files {
+			err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+			require.NoError(t, err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(src, "tmp/x"), nil, 0644)
+	require.NoError(t, err)
+	// 不在关键文件夹中的文件不比较
+	err = ioutil.WriteFile(filepath.Join(src, "var.log"), []byte("log"), 0644)
+	require.NoError(t, err)
+	testCompareDirs := []string{"/usr", "/etc", "/tmp", "/var/lib/dpkg"}
+
+	future := time.Now().Add(time.Hour)
+	mismatches, err := compareWithSource(context.Background(), src, dest, testCompareDirs, []string{"/tmp"}, future)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// 内容相同长度的损坏和缺少的文件
+	err = ioutil.WriteFile(filepath.Join(dest, "usr/bin/a"), []byte("aaab"), 0644)
+	require.NoError(t, err)
+	err = os.Remove(filepath.Join(dest, "etc/hostname"))
+	require.NoError(t, err)
+	mismatches, err = compareWithSource(context.Background(), src, dest, testCompareDirs, []string{"/tmp"}, future)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"changed: /usr/bin/a (content differs)",
+		"missing: /etc/hostname",
+	}, mismatches)
+
+	// 备份开始后修改的文件不比较
+	mismatches, err = compareWithSource(context.Background(), src, dest, testCompareDirs, []string{"/tmp"},
+		time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = compareWithSource(ctx, src, dest, testCompareDirs, nil, future)
+	assert.Equal(t, context.Canceled, err)
+}
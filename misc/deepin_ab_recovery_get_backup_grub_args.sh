@@ -1,9 +1,23 @@
 #!/bin/sh
 if test -e "/etc/deepin/ab-recovery.json"; then
   backup_uuid=$(jq -r '.Backup' /etc/deepin/ab-recovery.json)
-  backup_dev=$(blkid -U ${backup_uuid})
+  backup_subvol=$(jq -r '.BackupSubvol // empty' /etc/deepin/ab-recovery.json)
+  backup_vg=$(jq -r '.VolumeGroup // empty' /etc/deepin/ab-recovery.json)
+  backup_lv=$(jq -r '.BackupLv // empty' /etc/deepin/ab-recovery.json)
+  if test -n "${backup_vg}" ; then
+    backup_dev=/dev/${backup_vg}/${backup_lv}
+  else
+    backup_dev=$(blkid -U ${backup_uuid})
+  fi
   mount_dir=$(mktemp -d)
-  mount ${backup_dev} ${mount_dir}
+  if test -n "${backup_subvol}" ; then
+    mount -o subvol=${backup_subvol} ${backup_dev} ${mount_dir}
+  elif test -n "${backup_vg}" && test "$(blkid -o value -s TYPE ${backup_dev})" = xfs ; then
+    # 快照与原卷的 xfs uuid 相同
+    mount -o ro,nouuid ${backup_dev} ${mount_dir}
+  else
+    mount ${backup_dev} ${mount_dir}
+  fi
 
   sys_dir="${mount_dir}/etc"
   if test -f ${sys_dir}/default/grub ; then
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// 挂载备份分区使用的临时挂载点都在这个文件夹中，挂载只在私有的挂载命名空间中可见，
+// 其他进程看到的是空文件夹，文件管理器不会显示备份分区。
+const mountRuntimeDir = "/run/deepin-ab-recovery"
+
+// 在新的私有挂载命名空间中执行 fn。
+//
+// 挂载命名空间属于线程，所以 fn 在新的 goroutine 中执行，goroutine 锁定在一个线程上并 unshare，
+// fn 返回后不调用 runtime.UnlockOSThread，goroutine 结束时线程随之退出，命名空间被销毁，
+// 其中的挂载由内核卸载，即使 umount 失败或者 fn 崩溃也不会留下挂载。
+// fn 必须在同一个 goroutine 中访问挂载点，它启动的子进程继承这个命名空间。
+func runInPrivateMountNs(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- xerrors.Errorf("panic in private mount namespace: %v", r)
+			}
+		}()
+
+		err := syscall.Unshare(syscall.CLONE_NEWNS)
+		if err != nil {
+			errCh <- xerrors.Errorf("failed to unshare mount namespace: %w", err)
+			return
+		}
+		// 新的命名空间中的挂载不传播到原来的命名空间
+		err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+		if err != nil {
+			errCh <- xerrors.Errorf("failed to make mounts private: %w", err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// 在私有的挂载命名空间中把 device 挂载到 mountRuntimeDir 中新建的名字唯一的文件夹，再执行 fn(dir)。
+// fn 返回后卸载并删除文件夹，挂载失败时返回 MountFailed 错误。
+func withPrivateMount(device, name string, fn func(dir string) error) error {
+	return withPrivateMountOptions(device, "", name, fn)
+}
+
+// 与 withPrivateMount 相同，options 为 mount -o 的挂载选项，比如 "subvol=@"，为空时不指定。
+func withPrivateMountOptions(device, options, name string, fn func(dir string) error) error {
+	err := os.MkdirAll(mountRuntimeDir, 0700)
+	if err != nil {
+		return newJobError(errCodeMountFailed, err)
+	}
+	dir, err := ioutil.TempDir(mountRuntimeDir, name+"-")
+	if err != nil {
+		return newJobError(errCodeMountFailed, err)
+	}
+	defer func() {
+		err := os.Remove(dir)
+		if err != nil {
+			logger.Warning("failed to remove mount point:", err)
+		}
+	}()
+
+	return runInPrivateMountNs(func() error {
+		args := []string{device, dir}
+		if options != "" {
+			args = append([]string{"-o", options}, args...)
+		}
+		out, err := exec.Command("mount", args...).CombinedOutput()
+		if err != nil {
+			return newJobErrorf(errCodeMountFailed, "failed to mount device %q to dir %q with options %q: %s: %w",
+				device, dir, options, strings.TrimSpace(string(out)), err)
+		}
+		defer func() {
+			// 失败时命名空间销毁时也会卸载
+			err := exec.Command("umount", dir).Run()
+			if err != nil {
+				logger.Warningf("failed to unmount %q: %v", dir, err)
+			}
+		}()
+		return fn(dir)
+	})
+}
+
+// 与 withPrivateMount 相同，挂载的是 cfg 中的备份：子卷模式下挂载备份子卷，LVM 模式下先激活备份逻辑卷，
+// 备份分区加密时先解锁。
+func withBackupMount(cfg *Config, name string, fn func(dir string) error) error {
+	return withBackupLuks(cfg, func() error {
+		return withBackupMountUnlocked(cfg, name, fn)
+	})
+}
+
+func withBackupMountUnlocked(cfg *Config, name string, fn func(dir string) error) error {
+	device, err := cfg.getBackupDevice()
+	if err != nil {
+		return newJobErrorf(errCodeConfigInvalid, "failed to get backup device: %w", err)
+	}
+	var options string
+	switch cfg.storageMode() {
+	case storageModeBtrfs:
+		options = "subvol=" + cfg.BackupSubvol
+	case storageModeLvm:
+		err = activateLv(cfg.VolumeGroup, cfg.BackupLv)
+		if err != nil {
+			return newJobError(errCodeMountFailed, err)
+		}
+		options, err = getLvMountOptions(device)
+		if err != nil {
+			return newJobError(errCodeMountFailed, err)
+		}
+	}
+	return withPrivateMountOptions(device, options, name, fn)
+}
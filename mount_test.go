@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 私有命名空间中的挂载在外面看不到，fn 返回后随命名空间一起消失。
+func TestRunInPrivateMountNs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root")
+	}
+	dir := t.TempDir()
+	err := runInPrivateMountNs(func() error {
+		err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "")
+		if err != nil {
+			return err
+		}
+		mounted, err := isMounted(dir)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			return errors.New("not mounted in private namespace")
+		}
+		// 子进程也在私有命名空间中
+		return exec.Command("mountpoint", "-q", dir).Run()
+	})
+	if err != nil && errors.Is(err, syscall.EPERM) {
+		t.Skip("can not unshare mount namespace:", err)
+	}
+	require.NoError(t, err)
+
+	mounted, err := isMounted(dir)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+
+	errTest := errors.New("test")
+	assert.Equal(t, errTest, runInPrivateMountNs(func() error {
+		return errTest
+	}))
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"./blockdev"
+)
+
+// 查找当前线程所在的挂载命名空间中挂载在 mountPoint 上的最上层的挂载，没有时返回 nil。
+func findMount(mountPoint string) (*blockdev.MountInfo, error) {
+	infos, err := _blockDevs.MountInfos()
+	if err != nil {
+		return nil, err
+	}
+	return blockdev.FindMountInfo(infos, mountPoint), nil
+}
+
+func isMounted(mountPoint string) (bool, error) {
+	info, err := findMount(mountPoint)
+	if err != nil {
+		return false, err
+	}
+	return info != nil, nil
+}
+
+func isMountedRo(mountPoint string) (bool, error) {
+	info, err := findMount(mountPoint)
+	if err != nil {
+		return false, err
+	}
+	return info != nil && info.Options.Contains("ro"), nil
+}
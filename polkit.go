@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+
+	"github.com/godbus/dbus"
+	"golang.org/x/xerrors"
+)
+
+// 与 misc/com.deepin.ABRecovery.policy 中定义的 action id 一致
+const (
+	polkitActionBackup  = "com.deepin.ABRecovery.backup"
+	polkitActionRestore = "com.deepin.ABRecovery.restore"
+)
+
+const (
+	polkitServiceName        = "org.freedesktop.PolicyKit1"
+	polkitAuthorityPath      = "/org/freedesktop/PolicyKit1/Authority"
+	polkitAuthorityInterface = "org.freedesktop.PolicyKit1.Authority"
+
+	polkitCheckFlagAllowUserInteraction uint32 = 1
+)
+
+var errNotAuthorized = newJobError(errCodeNotAuthorized, errors.New("not authorized"))
+
+type polkitSubject struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+type polkitAuthResult struct {
+	IsAuthorized bool
+	IsChallenge  bool
+	Details      map[string]string
+}
+
+// 用 system-bus-name 主体检查总线连接 sender 是否有权限执行 actionId。
+// polkit 根据总线连接查询进程，不会因为进程号被重用或者调用者已经退出而检查错误的进程。
+func checkAuthorization(conn *dbus.Conn, actionId, sender string) error {
+	subject := polkitSubject{
+		Kind: "system-bus-name",
+		Details: map[string]dbus.Variant{
+			"name": dbus.MakeVariant(sender),
+		},
+	}
+
+	var result polkitAuthResult
+	obj := conn.Object(polkitServiceName, polkitAuthorityPath)
+	err := obj.Call(polkitAuthorityInterface+".CheckAuthorization", 0,
+		subject, actionId, map[string]string{},
+		polkitCheckFlagAllowUserInteraction, "").Store(&result)
+	if err != nil {
+		return xerrors.Errorf("failed to check authorization: %w", err)
+	}
+	if !result.IsAuthorized {
+		return errNotAuthorized
+	}
+	return nil
+}
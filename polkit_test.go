@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubAuthority struct {
+	allowed   map[string]bool
+	lastKind  string
+	lastName  string
+	lastFlags uint32
+}
+
+func (a *stubAuthority) CheckAuthorization(subject polkitSubject, actionId string,
+	details map[string]string, flags uint32, cancellationId string) (polkitAuthResult, *dbus.Error) {
+	a.lastKind = subject.Kind
+	a.lastName, _ = subject.Details["name"].Value().(string)
+	a.lastFlags = flags
+	return polkitAuthResult{IsAuthorized: a.allowed[actionId]}, nil
+}
+
+// 启动私有总线，返回总线地址和结束函数
+func startPrivateBus(t *testing.T) (string, func()) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("not found command dbus-daemon")
+	}
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	err = cmd.Start()
+	if err != nil {
+		t.Skip("failed to start dbus-daemon:", err)
+	}
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		_ = cmd.Process.Kill()
+		t.Skip("failed to read dbus-daemon address:", err)
+	}
+	return strings.TrimSpace(address), func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+}
+
+func dialPrivateBus(t *testing.T, address string) *dbus.Conn {
+	conn, err := dbus.Dial(address)
+	require.NoError(t, err)
+	err = conn.Auth(nil)
+	require.NoError(t, err)
+	err = conn.Hello()
+	require.NoError(t, err)
+	return conn
+}
+
+func TestCheckAuthorization(t *testing.T) {
+	address, stop := startPrivateBus(t)
+	defer stop()
+
+	authorityConn := dialPrivateBus(t, address)
+	defer authorityConn.Close()
+	authority := &stubAuthority{
+		allowed: map[string]bool{polkitActionBackup: true},
+	}
+	err := authorityConn.Export(authority, polkitAuthorityPath, polkitAuthorityInterface)
+	require.NoError(t, err)
+	reply, err := authorityConn.RequestName(polkitServiceName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+
+	conn := dialPrivateBus(t, address)
+	defer conn.Close()
+
+	sender := conn.Names()[0]
+	err = checkAuthorization(conn, polkitActionBackup, sender)
+	assert.NoError(t, err)
+	assert.Equal(t, "system-bus-name", authority.lastKind)
+	assert.Equal(t, sender, authority.lastName)
+	assert.Equal(t, polkitCheckFlagAllowUserInteraction, authority.lastFlags)
+
+	err = checkAuthorization(conn, polkitActionRestore, sender)
+	assert.Equal(t, errNotAuthorized, err)
+
+	authorityConn.ReleaseName(polkitServiceName)
+	err = checkAuthorization(conn, polkitActionBackup, sender)
+	assert.Error(t, err)
+	assert.NotEqual(t, errNotAuthorized, err)
+}
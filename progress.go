@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	jobPhaseMount      = "mount"
+	jobPhaseRsync      = "rsync"
+	jobPhaseSnapshot   = "snapshot" // 子卷模式下代替 rsync
+	jobPhaseManifest   = "manifest"
+	jobPhaseKernel     = "kernel"
+	jobPhaseBootloader = "bootloader"
+)
+
+// 各阶段在总进度中所占的区间，rsync 耗时最长，子卷模式下没有 rsync 阶段，snapshot 阶段占用同样的区间。
+var jobPhaseRanges = map[string][2]float64{
+	jobPhaseMount:      {0, 2},
+	jobPhaseRsync:      {2, 90},
+	jobPhaseSnapshot:   {2, 90},
+	jobPhaseManifest:   {90, 95},
+	jobPhaseKernel:     {95, 97},
+	jobPhaseBootloader: {97, 100},
+}
+
+// 把阶段内的进度 percent (0 ~ 100) 换算为总进度。
+func getTotalProgress(phase string, percent float64) float64 {
+	r, ok := jobPhaseRanges[phase]
+	if !ok {
+		return 0
+	}
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	return r[0] + (r[1]-r[0])*percent/100
+}
+
+type progressReporter interface {
+	setPhase(phase string)
+	setRsyncProgress(p *rsyncProgress)
+}
+
+type rsyncProgress struct {
+	bytes   uint64
+	percent float64
+	files   uint64
+	eta     int64 // 单位为秒，小于 0 表示未知
+}
+
+// rsync --info=progress2 的输出，比如：
+//
+//	1,238,099,968  45%   31.47MB/s    0:00:41 (xfr#1520, to-chk=2031/5110)
+//
+// 在有 xfr# 部分时，时间字段是已用时间，而非剩余时间。
+var _regRsyncProgress = regexp.MustCompile(`^\s*([0-9,]+)\s+([0-9]+)%\s+\S+\s+([0-9]+):([0-9]{2}):([0-9]{2})(\s+\(xfr#([0-9]+),)?`)
+
+func parseRsyncProgressLine(line string) (*rsyncProgress, bool) {
+	match := _regRsyncProgress.FindStringSubmatch(line)
+	if match == nil {
+		return nil, false
+	}
+	bytesNum, err := strconv.ParseUint(strings.Replace(match[1], ",", "", -1), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	percent, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return nil, false
+	}
+	var p = rsyncProgress{
+		bytes:   bytesNum,
+		percent: percent,
+		eta:     -1,
+	}
+	if match[6] == "" {
+		hours, _ := strconv.ParseInt(match[3], 10, 64)
+		minutes, _ := strconv.ParseInt(match[4], 10, 64)
+		seconds, _ := strconv.ParseInt(match[5], 10, 64)
+		p.eta = hours*3600 + minutes*60 + seconds
+	} else {
+		p.files, _ = strconv.ParseUint(match[7], 10, 64)
+	}
+	return &p, true
+}
+
+// rsync 使用 \r 刷新进度行，使用 \n 结束普通行。
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// rsync 输出的一行的最大长度，路径很长的文件名可能超过 bufio.Scanner 默认的 64 KiB
+const rsyncMaxLineSize = 1024 * 1024
+
+// 读取 rsync 的标准输出，把解析到的进度交给 reporter，其他行写入日志。
+// 出错时也读完剩余的输出，否则 rsync 会因为管道写满而阻塞，等待它退出时永远不会返回。
+func readRsyncOutput(r io.Reader, reporter progressReporter) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, rsyncMaxLineSize)
+	scanner.Split(scanLinesOrCR)
+	var files uint64
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, ok := parseRsyncProgressLine(line)
+		if !ok {
+			logger.Debug("rsync:", line)
+			continue
+		}
+		// 没有 xfr# 部分的行不含文件数，沿用之前的值
+		if p.files < files {
+			p.files = files
+		}
+		files = p.files
+		if reporter != nil {
+			reporter.setRsyncProgress(p)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		_, _ = io.Copy(ioutil.Discard, r)
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRsyncProgressLine(t *testing.T) {
+	p, ok := parseRsyncProgressLine("  1,238,099,968  45%   31.47MB/s    0:01:41")
+	require.True(t, ok)
+	assert.Equal(t, uint64(1238099968), p.bytes)
+	assert.Equal(t, 45.0, p.percent)
+	assert.Equal(t, int64(101), p.eta)
+	assert.Equal(t, uint64(0), p.files)
+
+	p, ok = parseRsyncProgressLine("  1,238,099,968  45%   31.47MB/s    0:00:41 (xfr#1520, to-chk=2031/5110)")
+	require.True(t, ok)
+	assert.Equal(t, uint64(1520), p.files)
+	assert.Equal(t, int64(-1), p.eta)
+
+	_, ok = parseRsyncProgressLine("sending incremental file list")
+	assert.False(t, ok)
+	_, ok = parseRsyncProgressLine("usr/bin/100%")
+	assert.False(t, ok)
+}
+
+type testProgressReporter struct {
+	phases   []string
+	progress []rsyncProgress
+}
+
+func (r *testProgressReporter) setPhase(phase string) {
+	r.phases = append(r.phases, phase)
+}
+
+func (r *testProgressReporter) setRsyncProgress(p *rsyncProgress) {
+	r.progress = append(r.progress, *p)
+}
+
+func TestReadRsyncOutput(t *testing.T) {
+	const out = "etc/\n" +
+		"          0   0%    0.00kB/s    0:00:00\r" +
+		"     32,768   1%   10.00MB/s    0:10:00 (xfr#3, to-chk=90/100)\r" +
+		"     65,536   2%   11.00MB/s    0:09:00\r" +
+		"  3,276,800 100%   12.00MB/s    0:01:00 (xfr#100, to-chk=0/100)\n"
+	var reporter testProgressReporter
+	err := readRsyncOutput(strings.NewReader(out), &reporter)
+	require.NoError(t, err)
+	require.Len(t, reporter.progress, 4)
+	assert.Equal(t, uint64(3), reporter.progress[2].files)
+	assert.Equal(t, int64(540), reporter.progress[2].eta)
+	assert.Equal(t, 100.0, reporter.progress[3].percent)
+	assert.Equal(t, uint64(100), reporter.progress[3].files)
+}
+
+func TestReadRsyncOutputTooLong(t *testing.T) {
+	out := strings.Repeat("a", rsyncMaxLineSize+1) + "\n" +
+		"  3,276,800 100%   12.00MB/s    0:01:00 (xfr#100, to-chk=0/100)\n"
+	r := strings.NewReader(out)
+	var reporter testProgressReporter
+	err := readRsyncOutput(r, &reporter)
+	assert.Error(t, err)
+	// 出错后剩余的输出也被读完
+	assert.Equal(t, 0, r.Len())
+
+	// 超过 64 KiB 的行可以正常读取
+	out = strings.Repeat("a", 100*1024) + "\n" +
+		"  3,276,800 100%   12.00MB/s    0:01:00 (xfr#100, to-chk=0/100)\n"
+	reporter = testProgressReporter{}
+	err = readRsyncOutput(strings.NewReader(out), &reporter)
+	require.NoError(t, err)
+	assert.Len(t, reporter.progress, 1)
+}
+
+func TestGetTotalProgress(t *testing.T) {
+	assert.Equal(t, 0.0, getTotalProgress(jobPhaseMount, 0))
+	assert.Equal(t, 46.0, getTotalProgress(jobPhaseRsync, 50))
+	assert.Equal(t, 90.0, getTotalProgress(jobPhaseRsync, 120))
+	assert.Equal(t, 100.0, getTotalProgress(jobPhaseBootloader, 100))
+	assert.Equal(t, 0.0, getTotalProgress("unknown", 50))
+}
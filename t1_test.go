@@ -15,6 +15,7 @@ import (
 	"strings"
 	"testing"
 
+	"./blockdev"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -51,26 +52,23 @@ func TestParseLsbReleaseOutput(t *testing.T) {
 	assert.Equal(t, "stable", info[lsbReleaseKeyCodename])
 }
 
-const mountsInfo = `mqueue /dev/mqueue mqueue rw,relatime 0 0
-configfs /sys/kernel/config configfs rw,relatime 0 0
-hugetlbfs /dev/hugepages hugetlbfs rw,relatime,pagesize=2M 0 0
-debugfs /sys/kernel/debug debugfs rw,relatime 0 0
-fusectl /sys/fs/fuse/connections fusectl rw,relatime 0 0
-binfmt_misc /proc/sys/fs/binfmt_misc binfmt_misc rw,relatime 0 0
-/dev/loop0 /snap/core/5145 squashfs ro,nodev,relatime 0 0
-/dev/sda2 /home ext4 rw,relatime,data=ordered 0 0
-/dev/sda3 /home/tp1/ext ext4 rw,relatime,data=ordered 0 0
-tmpfs /run/user/1000 tmpfs rw,nosuid,nodev,relatime,size=790424k,mode=700,uid=1000,gid=1000 0 0
-gvfsd-fuse /run/user/1000/gvfs fuse.gvfsd-fuse rw,nosuid,nodev,relatime,user_id=1000,group_id=1000 0 0
-/dev/sda5 /media/tp1/19e980bd-a723-4051-bbd9-361a57967657 ext4 rw,nosuid,nodev,relatime,data=ordered 0 0
-/dev/fuse /run/user/1000/doc fuse rw,nosuid,nodev,relatime,user_id=1000,group_id=1000 0 0
-nvim.appimage /tmp/.mount_vimJNL8U9 fuse.nvim.appimage ro,nosuid,nodev,relatime,user_id=1000,group_id=1000 0 0
-`
-
 func TestIsMounted(t *testing.T) {
-	assert.True(t, isMountedAux([]byte(mountsInfo), "/home"))
-	assert.False(t, isMountedAux([]byte(mountsInfo), "/home/tp1"))
-	assert.False(t, isMountedAux([]byte(mountsInfo), "/dev/sda3"))
+	defer useFakeBlockDevs(&blockdev.Fake{
+		Mounts: []*blockdev.MountInfo{
+			{MountPoint: "/", Major: 8, Minor: 1, Source: "/dev/sda1", FsType: "ext4"},
+			{MountPoint: "/home", Major: 8, Minor: 2, Source: "/dev/sda2", FsType: "ext4"},
+			{MountPoint: "/home/tp1/ext", Major: 8, Minor: 3, Source: "/dev/sda3", FsType: "ext4"},
+		},
+	})()
+	for mountPoint, want := range map[string]bool{
+		"/home":     true,
+		"/home/tp1": false,
+		"/dev/sda3": false,
+	} {
+		mounted, err := isMounted(mountPoint)
+		require.NoError(t, err)
+		assert.Equal(t, want, mounted, mountPoint)
+	}
 }
 
 func TestUname(t *testing.T) {
@@ -156,29 +154,43 @@ func TestGetKernelReleaseWithBootOption(t *testing.T) {
 	assert.Equal(t, "4.19.0-arm64-desktop", result)
 }
 
-const lsblkUuidPath1 = `UUID="" PATH="/dev/sda"
-UUID="309ca993-66a3-469d-bb6e-22a4b2d800da" PATH="/dev/sda1"
-UUID="eb5aaf62-4375-47a4-b518-68e3973b153e" PATH="/dev/sda2"
-UUID="" PATH="/dev/sdb"
-UUID="" PATH="/dev/sdb1"
-UUID="" PATH="/dev/sr0"
-UUID="cWU76A-fvpc-NlSD-Xw3z-G4qQ-4yWg-jDvnsj" PATH="/dev/mapper/luks_crypt0"
-UUID="8b7aec2d-9084-4969-a13a-405d1d5ec82e" PATH="/dev/mapper/vg0-Roota"
-UUID="e4376f24-55e9-4980-8d2e-003dde15ff83" PATH="/dev/mapper/vg0-Rootb"
-UUID="55c8bfaf-89b1-4453-8780-7efa4ead39d5" PATH="/dev/mapper/vg0-_dde_data"
-UUID="0a96531e-e9c0-4e9e-b01f-eb98c5f619bd" PATH="/dev/mapper/vg0-Backup"
-UUID="1c461280-bf0c-451f-8033-3e1041b71e6e" PATH="/dev/mapper/vg0-SWAP"
-`
+// 与 lsblk -P -o UUID,PATH 输出的设备相同
+func newLsblkTestBlockDevs() *blockdev.Fake {
+	return &blockdev.Fake{Devs: []*blockdev.Device{
+		{Path: "/dev/sda"},
+		{Path: "/dev/sda1", Uuid: "309ca993-66a3-469d-bb6e-22a4b2d800da"},
+		{Path: "/dev/sda2", Uuid: "eb5aaf62-4375-47a4-b518-68e3973b153e"},
+		{Path: "/dev/sdb"},
+		{Path: "/dev/sdb1"},
+		{Path: "/dev/sr0"},
+		{Path: "/dev/mapper/luks_crypt0", Uuid: "cWU76A-fvpc-NlSD-Xw3z-G4qQ-4yWg-jDvnsj"},
+		{Path: "/dev/mapper/vg0-Roota", Uuid: "8b7aec2d-9084-4969-a13a-405d1d5ec82e"},
+		{Path: "/dev/mapper/vg0-Rootb", Uuid: "e4376f24-55e9-4980-8d2e-003dde15ff83"},
+		{Path: "/dev/mapper/vg0-_dde_data", Uuid: "55c8bfaf-89b1-4453-8780-7efa4ead39d5"},
+		{Path: "/dev/mapper/vg0-Backup", Uuid: "0a96531e-e9c0-4e9e-b01f-eb98c5f619bd"},
+		{Path: "/dev/mapper/vg0-SWAP", Uuid: "1c461280-bf0c-451f-8033-3e1041b71e6e"},
+	}}
+}
+
+func TestGetDeviceByUuid(t *testing.T) {
+	fake := newLsblkTestBlockDevs()
+	defer useFakeBlockDevs(fake)()
 
-func TestGetPathFromLsblkOutput(t *testing.T) {
-	ret := getPathFromLsblkOutput(lsblkUuidPath1, "e4376f24-55e9-4980-8d2e-003dde15ff83")
+	ret, err := getDeviceByUuid("e4376f24-55e9-4980-8d2e-003dde15ff83")
+	require.NoError(t, err)
 	assert.Equal(t, "/dev/mapper/vg0-Rootb", ret)
 
-	ret = getPathFromLsblkOutput(lsblkUuidPath1, "e4376f24-55e9-4980-8d2e-003dde15ff831")
-	assert.Equal(t, "", ret)
+	_, err = getDeviceByUuid("e4376f24-55e9-4980-8d2e-003dde15ff831")
+	assert.True(t, xerrors.Is(err, blockdev.ErrNotFound))
+
+	_, err = getDeviceByUuid("")
+	assert.Error(t, err)
 
-	ret = getPathFromLsblkOutput(lsblkUuidPath1, "")
-	assert.Equal(t, "", ret)
+	// 精简快照与原卷的文件系统 uuid 相同，不能按 uuid 确定设备
+	fake.Devs = append(fake.Devs, &blockdev.Device{Path: "/dev/mapper/vg0-Rootb--snap",
+		Uuid: "e4376f24-55e9-4980-8d2e-003dde15ff83"})
+	_, err = getDeviceByUuid("e4376f24-55e9-4980-8d2e-003dde15ff83")
+	assert.True(t, xerrors.Is(err, blockdev.ErrAmbiguous))
 }
 
 func TestParseOsProberOutput(t *testing.T) {
@@ -311,6 +323,13 @@ func TestRestoreExtraDir(t *testing.T) {
 	abc, err = getFileContent(filepath.Join(originDir, "abc"))
 	assert.NoError(t, err)
 	assert.Equal(t, "ABC123", abc)
+
+	// 删除后还没有创建软链接就被中断，重新执行时创建
+	require.NoError(t, os.Remove(originDir))
+	restoreExtra()
+	abc, err = getFileContent(filepath.Join(originDir, "abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC123", abc)
 }
 
 func Test_initBackUpRecord(t *testing.T) {
@@ -455,9 +474,18 @@ func Test_recoverDeprecatedFilesOrDirs(t *testing.T) {
 		specifiedFiles:  nil,
 	})
 	initBackUpRecord(filepath.Join(originDir, "record.json"), backupDir)
+	// xyz3/dir/def 的软链接已被删除但还没有复制回来时被中断
+	require.NoError(t, os.Remove(filepath.Join(originDir, "/abc/xyz3/dir/def")))
 	recoverDeprecatedFilesOrDirs(filepath.Join(originDir, "record.json"), false)
 	assert.DirExists(t, filepath.Join(backupDir, "qwe"))
 	assert.DirExists(t, filepath.Join(backupDir, filepath.Base("/abc/xyz1")))
+	def, err := getFileContent(filepath.Join(originDir, "/abc/xyz3/dir/def"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DEF", def)
+	assert.NoFileExists(t, filepath.Join(backupDir, "xyz3/dir/def"))
+	abc, err := getFileContent(filepath.Join(originDir, "/abc/xyz2/abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC", abc)
 }
 
 func Test_isExist(t *testing.T) {
@@ -542,25 +570,23 @@ func TestGetIgnoredUuid(t *testing.T) {
 	}
 }
 
-func TestParseLsblkOutputDevices(t *testing.T) {
-	const jsonText = `
-{
-   "blockdevices": [
-      {"uuid":null, "mountpoint":null, "label":null},
-      {"uuid":"95EF-33CC", "mountpoint":"/boot/efi", "label":"EFI"},
-      {"uuid":"47b1b22f-fe7d-40f6-99ec-5f2e32fbf143", "mountpoint":"/boot", "label":"Boot"},
-      {"uuid":"017415e7-15b1-4812-beaf-8fb75e685f01", "mountpoint":"/", "label":"Roota"},
-      {"uuid":"8bafe9c6-71f5-4b5c-8923-accb280cc12b", "mountpoint":"/media/del1/Rootb", "label":"Rootb"},
-      {"uuid":"150f05ea-629b-4f16-acde-1bf18ac776c9", "mountpoint":"/data", "label":"_dde_data"},
-      {"uuid":"1dee4cfe-7467-4c10-832f-5dfc45c35303", "mountpoint":"/recovery", "label":"Backup"},
-      {"uuid":"791cde56-65a9-463b-a8ad-b5c61d9d993e", "mountpoint":"[SWAP]", "label":"SWAP"}
-   ]
-}
-`
-	devices, err := parseLsblkOutputDevices([]byte(jsonText))
-	assert.NoError(t, err)
-	assert.Equal(t, "95EF-33CC", devices[1].Uuid)
-	assert.Equal(t, "SWAP", devices[7].Label)
+func TestToLabelUuidMap(t *testing.T) {
+	// 与 lsblk -J -o UUID,MOUNTPOINT,LABEL 输出的设备相同
+	devices := []*blockdev.Device{
+		{},
+		{Uuid: "95EF-33CC", MountPoint: "/boot/efi", Label: "EFI"},
+		{Uuid: "47b1b22f-fe7d-40f6-99ec-5f2e32fbf143", MountPoint: "/boot", Label: "Boot"},
+		{Uuid: "017415e7-15b1-4812-beaf-8fb75e685f01", MountPoint: "/", Label: "Roota"},
+		{Uuid: "8bafe9c6-71f5-4b5c-8923-accb280cc12b", MountPoint: "/media/del1/Rootb", Label: "Rootb"},
+		{Uuid: "150f05ea-629b-4f16-acde-1bf18ac776c9", MountPoint: "/data", Label: "_dde_data"},
+		{Uuid: "1dee4cfe-7467-4c10-832f-5dfc45c35303", MountPoint: "/recovery", Label: "Backup"},
+		{Uuid: "791cde56-65a9-463b-a8ad-b5c61d9d993e", Label: "SWAP"},
+	}
+	assert.Equal(t, map[string]string{
+		"efi":      "95EF-33CC",
+		"boot":     "47b1b22f-fe7d-40f6-99ec-5f2e32fbf143",
+		"recovery": "1dee4cfe-7467-4c10-832f-5dfc45c35303",
+	}, toLabelUuidMap(devices))
 }
 
 func splitToLines(str string) []string {
@@ -678,3 +704,24 @@ func Test_backupFinishedFileExist(t *testing.T) {
 	assert.FileExists(t, filepath.Join(tempDir, "file2"))
 	assert.True(t, !backupFinishedFileExist(filepath.Join(tempDir, "file2"))) // 需要root用户创建的文件才会被认为是备份完成的标志文件
 }
+
+func TestModifyFsTabUuid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fstab")
+	content := `# /dev/sda2
+PARTUUID=aaa-02	/	ext4	rw,relatime	0 1
+/dev/disk/by-partuuid/aaa-02	/mnt/root	ext4	ro	0 0
+UUID=bbb	/boot	ext4	rw,relatime	0 2
+/swapfile	none	swap	sw	0 0
+`
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	require.NoError(t, modifyFsTab(filename, "UUID=ccc"))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	// 注释保持不变
+	assert.Equal(t, `# /dev/sda2
+UUID=ccc	/	ext4	rw,relatime	0 1
+UUID=ccc	/mnt/root	ext4	ro	0 0
+UUID=bbb	/boot	ext4	rw,relatime	0 2
+/swapfile	none	swap	sw	0 0
+`, string(data))
+}
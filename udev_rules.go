@@ -8,10 +8,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+
+	"./atomicfile"
 )
 
 func getHideWhat(str string) string {
@@ -118,15 +119,7 @@ func modifyRules(filename string, labelUuidMap map[string]string, uuid, otherUui
 		buf.WriteByte('\n')
 	}
 	data = buf.Bytes()
-	err = ioutil.WriteFile(filename+".new", data, 0644)
-	if err != nil {
-		return err
-	}
-	err = os.Rename(filename+".new", filename)
-	if err != nil {
-		return err
-	}
-	return nil
+	return atomicfile.WriteFile(filename, data, 0644)
 }
 
 func reloadUdev() error {
@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"./blockdev"
+	"./bootloader"
+	"./bootloader/efiboot"
+	"github.com/linuxdeepin/go-lib/utils"
+	"golang.org/x/xerrors"
+)
+
+// UEFI 固件中回滚启动项的描述，也用于查找已有的回滚启动项
+const uefiBootEntryDesc = "Deepin Rollback"
+
+// 回滚启动项使用的内核和 initrd 在 ESP 分区中的文件夹
+const uefiKernelDir = "EFI/deepin-ab-recovery"
+
+// ESP 分区的挂载点
+var globalEspDir = "/boot/efi"
+
+// 获取挂载在 globalEspDir 的 ESP 分区，设备来自 mountinfo，PARTUUID 来自 /dev/disk/by-partuuid，不依赖 grub 的工具。
+func getEspDevice() (*blockdev.Device, error) {
+	mounted, err := isMounted(globalEspDir)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		return nil, xerrors.Errorf("ESP is not mounted on %s", globalEspDir)
+	}
+	d, err := blockdev.FindByPathMount(_blockDevs, globalEspDir)
+	if err != nil {
+		return nil, err
+	}
+	if d.PartUuid == "" {
+		return nil, xerrors.Errorf("device %s has no PARTUUID", d.Path)
+	}
+	return d, nil
+}
+
+// 根据当前的内核参数生成回滚启动项的内核参数，root 改为备份分区，initrd 指向 ESP 分区中的文件。
+// 备份在 btrfs 子卷中时 rootflags 改为挂载备份子卷，在 LVM 逻辑卷中时 root 使用设备路径，
+// 在 LUKS 容器中时加上解锁它的参数。
+func getUefiKernelArgs(bootOptions string, backup bootloader.Partition, initrd string) string {
+	bootOptions = bootloader.ReplaceLuksArgs(bootOptions, backup)
+	args := []string{"root=UUID=" + backup.Uuid}
+	if backup.Lv {
+		args[0] = "root=" + backup.Device
+	}
+	if backup.Subvol != "" {
+		args = append(args, "rootflags=subvol="+backup.Subvol)
+	}
+	for _, field := range strings.Fields(bootOptions) {
+		if strings.HasPrefix(field, "BOOT_IMAGE=") || strings.HasPrefix(field, "initrd=") ||
+			strings.HasPrefix(field, "root=") {
+			continue
+		}
+		if backup.Subvol != "" && strings.HasPrefix(field, "rootflags=") {
+			continue
+		}
+		args = append(args, field)
+	}
+	if initrd != "" {
+		args = append(args, "initrd="+strings.Replace(initrd, "/", `\`, -1))
+	}
+	return strings.Join(args, " ")
+}
+
+// 把内核复制到 ESP 分区，并添加直接启动它的 UEFI 启动项，不依赖 grub。
+func writeUefiBootEntry(backup bootloader.Partition, kFiles *kernelFiles) error {
+	vars := &efiboot.Vars{Dir: efiboot.EfivarsDir}
+	if !vars.Available() {
+		return xerrors.New("efivarfs is not available")
+	}
+
+	esp, err := getEspDevice()
+	if err != nil {
+		return xerrors.Errorf("failed to get ESP device: %w", err)
+	}
+	hd, err := efiboot.ReadHardDrive(efiboot.SysClassBlockDir, esp.Path, esp.PartUuid)
+	if err != nil {
+		return xerrors.Errorf("failed to read ESP partition info: %w", err)
+	}
+
+	dir := filepath.Join(globalEspDir, uefiKernelDir)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	linux := "/" + uefiKernelDir + "/" + filepath.Base(kFiles.linux)
+	err = utils.CopyFile(kFiles.linux, filepath.Join(globalEspDir, linux))
+	if err != nil {
+		return xerrors.Errorf("failed to copy kernel to ESP: %w", err)
+	}
+	var initrd string
+	if kFiles.initrd != "" {
+		initrd = "/" + uefiKernelDir + "/" + filepath.Base(kFiles.initrd)
+		err = utils.CopyFile(kFiles.initrd, filepath.Join(globalEspDir, initrd))
+		if err != nil {
+			return xerrors.Errorf("failed to copy initrd to ESP: %w", err)
+		}
+	}
+
+	bootOptions, err := getBootOptions()
+	if err != nil {
+		return err
+	}
+	filePath, err := efiboot.FileDevicePath(hd, linux)
+	if err != nil {
+		return err
+	}
+	num, err := vars.SetBootEntry(&efiboot.LoadOption{
+		Attributes:   efiboot.LoadOptionActive,
+		Description:  uefiBootEntryDesc,
+		FilePath:     filePath,
+		OptionalData: efiboot.EncodeArgs(getUefiKernelArgs(bootOptions, backup, initrd)),
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to set uefi boot entry: %w", err)
+	}
+	logger.Debugf("uefi boot entry Boot%04X added", num)
+	return nil
+}
+
+// 删除回滚启动项和 ESP 分区中的内核，不是使用 UEFI 启动或者没有回滚启动项时什么也不做。
+func removeUefiBootEntry() error {
+	vars := &efiboot.Vars{Dir: efiboot.EfivarsDir}
+	if !vars.Available() {
+		return nil
+	}
+	removed, err := vars.RemoveBootEntry(uefiBootEntryDesc)
+	if err != nil {
+		return xerrors.Errorf("failed to remove uefi boot entry: %w", err)
+	}
+	if removed {
+		logger.Debug("uefi boot entry removed")
+	}
+	return os.RemoveAll(filepath.Join(globalEspDir, uefiKernelDir))
+}
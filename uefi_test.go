@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2022 UnionTech Software Technology Co., Ltd.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+
+	"./bootloader"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getUefiKernelArgs(t *testing.T) {
+	bootOptions := "BOOT_IMAGE=/vmlinuz-5.10.101-amd64-desktop root=UUID=5d0f1c1e-54a7-4a3e-9f0e-0f3b6f0f9d2e ro splash quiet DEEPIN_GFXMODE=\n"
+	assert.Equal(t, `root=UUID=abc ro splash quiet DEEPIN_GFXMODE= initrd=\EFI\deepin-ab-recovery\initrd.img-5.10.101-amd64-desktop`,
+		getUefiKernelArgs(bootOptions, bootloader.Partition{Uuid: "abc"}, "/EFI/deepin-ab-recovery/initrd.img-5.10.101-amd64-desktop"))
+	assert.Equal(t, "root=UUID=abc ro", getUefiKernelArgs("root=/dev/sda2 initrd=/initrd.img ro", bootloader.Partition{Uuid: "abc"}, ""))
+	assert.Equal(t, "root=UUID=abc rootflags=subvol=@ab-backup ro",
+		getUefiKernelArgs("root=UUID=abc rootflags=subvol=@ ro",
+			bootloader.Partition{Uuid: "abc", Subvol: "@ab-backup"}, ""))
+	assert.Equal(t, "root=/dev/mapper/vg-backup ro",
+		getUefiKernelArgs("root=/dev/mapper/vg-root ro",
+			bootloader.Partition{Uuid: "abc", Device: "/dev/mapper/vg-backup", Lv: true}, ""))
+	assert.Equal(t, "root=UUID=abc ro rd.luks.uuid=def cryptdevice=UUID=def:luks-def "+
+		"cryptopts=target=luks-def,source=UUID=def,luks",
+		getUefiKernelArgs("root=UUID=xyz rd.luks.uuid=123 ro", bootloader.Partition{Uuid: "abc", Luks: "def"}, ""))
+}
+
+func Test_getEspDevice(t *testing.T) {
+	fake := newTestBlockDevs()
+	defer useFakeBlockDevs(fake)()
+
+	_, err := getEspDevice()
+	assert.EqualError(t, err, "device /dev/sda1 has no PARTUUID")
+
+	fake.Devs[1].PartUuid = "9a4c1f0e-01"
+	d, err := getEspDevice()
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda1", d.Path)
+	assert.Equal(t, "9a4c1f0e-01", d.PartUuid)
+
+	// 没有挂载 ESP 时不能使用根分区
+	fake.Mounts = fake.Mounts[:2]
+	_, err = getEspDevice()
+	assert.Error(t, err)
+}
@@ -7,18 +7,16 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/linuxdeepin/go-lib/strv"
+	"./blockdev"
 	"golang.org/x/xerrors"
 )
 
@@ -83,30 +81,6 @@ func charsToString(ca []int8) string {
 	return string(s)
 }
 
-func runUpdateGrub(envVars []string) error {
-	if globalNoGrubMkconfig {
-		return nil
-	}
-
-	var cmd *exec.Cmd
-	updateGrubBin, err := exec.LookPath("update-grub")
-	if err == nil {
-		// found update-grub
-		logger.Debug("$ ", updateGrubBin)
-		cmd = exec.Command(updateGrubBin)
-	} else {
-		// not found update-grub
-		logger.Warning("not found command update-grub")
-		logger.Debug("$ grub-mkconfig -o /boot/grub/grub.cfg")
-		cmd = exec.Command("grub-mkconfig", "-o", "/boot/grub/grub.cfg")
-	}
-
-	cmd.Env = append(os.Environ(), envVars...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func writeExcludeFile(excludeItems []string) (string, error) {
 	fh, err := ioutil.TempFile("", "deepin-recovery-")
 	if err != nil {
@@ -127,135 +101,91 @@ func writeExcludeFile(excludeItems []string) (string, error) {
 	return fh.Name(), nil
 }
 
-func hasDiskDevice(uuid string) bool {
-	if uuid == "" {
+// 判断 uuid 对应的设备是否存在，也可以是以 /dev/ 开头的设备路径，比如 LVM 逻辑卷 /dev/mapper/vg-root。
+func hasDiskDevice(uuidOrDevice string) bool {
+	if uuidOrDevice == "" {
 		return false
 	}
-	_, err := os.Stat(filepath.Join("/dev/disk/by-uuid", uuid))
+	path := uuidOrDevice
+	if !strings.HasPrefix(path, "/dev/") {
+		path = filepath.Join("/dev/disk/by-uuid", uuidOrDevice)
+	}
+	_, err := os.Stat(path)
 	return err == nil
 }
 
+// 块设备的信息，测试时替换为 blockdev.Fake
+var _blockDevs blockdev.Interface = &blockdev.System{}
+
 func getDeviceUuid(device string) (string, error) {
-	out, err := exec.Command("grub-probe", "-t", "fs_uuid", "-d", device).Output()
+	d, err := blockdev.FindByPath(_blockDevs, device)
 	if err != nil {
 		return "", err
 	}
-	return string(bytes.TrimSpace(out)), nil
+	if d.Uuid == "" {
+		return "", xerrors.Errorf("device %s has no uuid", device)
+	}
+	return d.Uuid, nil
 }
 
 // 获取 path 所指路径的硬盘设备路径
 func getPathDisk(path string) (string, error) {
-	out, err := exec.Command("grub-probe", "-t", "disk", path).Output()
+	d, err := blockdev.FindByPathMount(_blockDevs, path)
 	if err != nil {
 		return "", err
 	}
-	disk := string(bytes.TrimSpace(out))
-	_, err = os.Stat(disk)
-	if err != nil {
-		return "", err
-	}
-	return disk, nil
+	return d.Disk, nil
 }
 
 // 获取 device 所指硬盘分区块设备的标签，比如 /dev/sda1 的标签为 Boot。
 func getDeviceLabel(device string) (string, error) {
-	out, err := exec.Command("blkid", "-o", "value", "-s", "LABEL", device).Output()
+	d, err := blockdev.FindByPath(_blockDevs, device)
 	if err != nil {
 		return "", err
 	}
-	return string(bytes.TrimSpace(out)), nil
+	return d.Label, nil
 }
 
 func getDeviceByUuid(uuid string) (string, error) {
 	if uuid == "" {
 		return "", xerrors.New("parameter uuid is empty")
 	}
-	out, err := exec.Command("lsblk", "-P", "-n", "-o", "UUID,PATH").Output()
+	d, err := blockdev.FindByUuid(_blockDevs, uuid)
 	if err != nil {
-		return "", xerrors.Errorf("failed to run lsblk: %w", err)
-	}
-	devPath := getPathFromLsblkOutput(string(out), uuid)
-	if devPath == "" {
-		return "", xerrors.New("failed to get device path from lsblk output")
+		return "", err
 	}
-	return devPath, nil
+	return d.Path, nil
 }
 
-func getUuidByLabel(label string) (uuid string, err error) {
-	out, err := exec.Command("lsblk", "-J", "-o", "UUID,MOUNTPOINT,LABEL").Output()
-	if err != nil {
-		return "", xerrors.Errorf("failed to run lsblk: %w", err)
-	}
-	var blockDevices lsblkDevices
-	err = json.Unmarshal(out, &blockDevices)
+// 按标签查找设备，不区分大小写，没有找到时返回 notFoundErr。
+func findDeviceByLabel(label string, notFoundErr error) (*blockdev.Device, error) {
+	d, err := blockdev.FindByLabel(_blockDevs, label)
 	if err != nil {
-		return "", xerrors.Errorf("failed to unmarshal: %w", err)
-	}
-	for _, d := range blockDevices.BlockDevices {
-		if strings.ToLower(strings.TrimSpace(d.Label)) == label {
-			return d.Uuid, nil
+		if xerrors.Is(err, blockdev.ErrNotFound) {
+			return nil, notFoundErr
 		}
+		return nil, err
 	}
-	return "", xerrors.Errorf("failed to get %q uuid", label)
+	return d, nil
 }
 
-func getMountPointByLabel(label string) (mountPoint string, err error) {
-	out, err := exec.Command("lsblk", "-J", "-o", "UUID,MOUNTPOINT,LABEL").Output()
-	if err != nil {
-		return "", xerrors.Errorf("failed to run lsblk: %w", err)
-	}
-	var blockDevices lsblkDevices
-	err = json.Unmarshal(out, &blockDevices)
+func getUuidByLabel(label string) (uuid string, err error) {
+	d, err := findDeviceByLabel(label, xerrors.Errorf("failed to get %q uuid", label))
 	if err != nil {
-		return "", xerrors.Errorf("failed to unmarshal: %w", err)
-	}
-	for _, d := range blockDevices.BlockDevices {
-		if strings.ToLower(strings.TrimSpace(d.Label)) == label {
-			return d.MountPoint, nil
-		}
-	}
-	return "", xerrors.Errorf("failed to get %q mountPoint", label)
-}
-
-func getPathFromLsblkOutput(out string, uuid string) string {
-	if uuid == "" {
-		return ""
-	}
-	lines := strings.Split(out, "\n")
-	uuidSubstr := fmt.Sprintf("UUID=%q", uuid)
-	for _, line := range lines {
-		if strings.Contains(line, uuidSubstr) {
-			pathReg := regexp.MustCompile(`PATH="(.+)"`)
-			match := pathReg.FindStringSubmatch(line)
-			if match != nil {
-				return match[1]
-			}
-			break
-		}
+		return "", err
 	}
-	return ""
-}
-
-type lsblkDevices struct {
-	BlockDevices []blockDevice `json:"blockdevices"`
+	return d.Uuid, nil
 }
 
-type blockDevice struct {
-	Uuid       string `json:"uuid"`
-	MountPoint string `json:"mountpoint"`
-	Label      string `json:"label"`
-}
-
-func parseLsblkOutputDevices(data []byte) ([]blockDevice, error) {
-	var devices lsblkDevices
-	err := json.Unmarshal(data, &devices)
+func getMountPointByLabel(label string) (mountPoint string, err error) {
+	d, err := findDeviceByLabel(label, xerrors.Errorf("failed to get %q mountPoint", label))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return devices.BlockDevices, nil
+	return d.MountPoint, nil
 }
 
-func toLabelUuidMap(devices []blockDevice) map[string]string {
+func toLabelUuidMap(devices []*blockdev.Device) map[string]string {
 	out := make(map[string]string)
 	for _, device := range devices {
 		if out["boot"] == "" &&
@@ -272,62 +202,19 @@ func toLabelUuidMap(devices []blockDevice) map[string]string {
 	return out
 }
 
+// 获取硬盘 disk 上的 boot、efi、recovery 分区的 uuid
 func getLabelUuidMap(disk string) (map[string]string, error) {
-	out, err := exec.Command("lsblk", "-J", "-o", "UUID,MOUNTPOINT,LABEL", disk).Output()
-	if err != nil {
-		return nil, xerrors.Errorf("failed to run lsblk: %w", err)
-	}
-	devices, err := parseLsblkOutputDevices(out)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to parse lsblk json output: %w", err)
-	}
-	return toLabelUuidMap(devices), nil
-}
-
-func isMounted(mountPoint string) (bool, error) {
-	content, err := ioutil.ReadFile("/proc/self/mounts")
-	if err != nil {
-		return false, err
-	}
-	return isMountedAux(content, mountPoint), nil
-}
-
-func isMountedAux(data []byte, mountPoint string) bool {
-	lines := bytes.Split(data, []byte{'\n'})
-	for _, line := range lines {
-		fields := bytes.SplitN(line, []byte{' '}, 3)
-		if len(fields) >= 2 {
-			if string(fields[1]) == mountPoint {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func isMountedRo(mountPoint string) (bool, error) {
-	content, err := ioutil.ReadFile("/proc/self/mounts")
+	devices, err := _blockDevs.Devices()
 	if err != nil {
-		return false, err
+		return nil, xerrors.Errorf("failed to get block devices: %w", err)
 	}
-	return isMountedRoAux(content, mountPoint), nil
-}
-
-func isMountedRoAux(data []byte, mountPoint string) bool {
-	lines := bytes.Split(data, []byte{'\n'})
-	for _, line := range lines {
-		fields := bytes.Split(line, []byte{' '})
-		if len(fields) >= 4 {
-			if string(fields[1]) == mountPoint {
-				optionsStr := string(fields[3])
-				options := strv.Strv(strings.Split(optionsStr, ","))
-				if options.Contains("ro") {
-					return true
-				}
-			}
+	var diskDevices []*blockdev.Device
+	for _, d := range devices {
+		if d.Disk == disk {
+			diskDevices = append(diskDevices, d)
 		}
 	}
-	return false
+	return toLabelUuidMap(diskDevices), nil
 }
 
 const (
@@ -12,6 +12,7 @@ import (
 	"syscall"
 	"testing"
 
+	"./blockdev"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -81,6 +82,92 @@ func TestUtilDiskDevice(t *testing.T) {
 	}
 }
 
+// 把块设备的信息替换为 fake，返回恢复的函数
+func useFakeBlockDevs(fake *blockdev.Fake) func() {
+	old := _blockDevs
+	_blockDevs = fake
+	return func() {
+		_blockDevs = old
+	}
+}
+
+func newTestBlockDevs() *blockdev.Fake {
+	return &blockdev.Fake{
+		Devs: []*blockdev.Device{
+			{Name: "sda", Path: "/dev/sda", Disk: "/dev/sda", Major: 8, Minor: 0},
+			{Name: "sda1", Path: "/dev/sda1", Disk: "/dev/sda", Major: 8, Minor: 1,
+				Uuid: "95EF-33CC", Label: "EFI", MountPoint: "/boot/efi"},
+			{Name: "sda2", Path: "/dev/sda2", Disk: "/dev/sda", Major: 8, Minor: 2,
+				Uuid: "47b1b22f-fe7d-40f6-99ec-5f2e32fbf143", Label: "Boot", MountPoint: "/boot"},
+			{Name: "sda3", Path: "/dev/sda3", Disk: "/dev/sda", Major: 8, Minor: 3,
+				Uuid: "017415e7-15b1-4812-beaf-8fb75e685f01", Label: "Roota", MountPoint: "/"},
+			{Name: "sda4", Path: "/dev/sda4", Disk: "/dev/sda", Major: 8, Minor: 4,
+				Uuid: "8bafe9c6-71f5-4b5c-8923-accb280cc12b", Label: "Rootb"},
+			{Name: "sda5", Path: "/dev/sda5", Disk: "/dev/sda", Major: 8, Minor: 5,
+				Uuid: "1dee4cfe-7467-4c10-832f-5dfc45c35303", Label: "Backup", MountPoint: "/recovery"},
+			{Name: "sdb1", Path: "/dev/sdb1", Disk: "/dev/sdb", Major: 8, Minor: 17,
+				Uuid: "150f05ea-629b-4f16-acde-1bf18ac776c9", Label: "boot"},
+		},
+		Mounts: []*blockdev.MountInfo{
+			{MountPoint: "/", Major: 8, Minor: 3, Source: "/dev/sda3", FsType: "ext4"},
+			{MountPoint: "/boot", Major: 8, Minor: 2, Source: "/dev/sda2", FsType: "ext4"},
+			{MountPoint: "/boot/efi", Major: 8, Minor: 1, Source: "/dev/sda1", FsType: "vfat"},
+		},
+	}
+}
+
+func TestUtilBlockDevs(t *testing.T) {
+	defer useFakeBlockDevs(newTestBlockDevs())()
+
+	device, err := getDeviceByUuid("8bafe9c6-71f5-4b5c-8923-accb280cc12b")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda4", device)
+	_, err = getDeviceByUuid("not-exist")
+	assert.Error(t, err)
+	_, err = getDeviceByUuid("")
+	assert.Error(t, err)
+
+	uuid, err := getDeviceUuid("/dev/sda5")
+	require.NoError(t, err)
+	assert.Equal(t, "1dee4cfe-7467-4c10-832f-5dfc45c35303", uuid)
+	_, err = getDeviceUuid("/dev/sda")
+	assert.Error(t, err)
+
+	label, err := getDeviceLabel("/dev/sda2")
+	require.NoError(t, err)
+	assert.Equal(t, "Boot", label)
+
+	uuid, err = getUuidByLabel("rootb")
+	require.NoError(t, err)
+	assert.Equal(t, "8bafe9c6-71f5-4b5c-8923-accb280cc12b", uuid)
+	mountPoint, err := getMountPointByLabel("backup")
+	require.NoError(t, err)
+	assert.Equal(t, "/recovery", mountPoint)
+	_, err = getMountPointByLabel("rootc")
+	assert.EqualError(t, err, `failed to get "rootc" mountPoint`)
+
+	disk, err := getPathDisk("/boot/grub")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda", disk)
+
+	rootUuid, err := getRootUuid()
+	require.NoError(t, err)
+	assert.Equal(t, "017415e7-15b1-4812-beaf-8fb75e685f01", rootUuid)
+
+	// sdb 上的 boot 分区不算
+	labelUuidMap, err := getLabelUuidMap("/dev/sda")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"efi":      "95EF-33CC",
+		"boot":     "47b1b22f-fe7d-40f6-99ec-5f2e32fbf143",
+		"recovery": "1dee4cfe-7467-4c10-832f-5dfc45c35303",
+	}, labelUuidMap)
+
+	ro, err := isMountedRo("/boot")
+	require.NoError(t, err)
+	assert.False(t, ro)
+}
+
 func TestUtilOsProber(t *testing.T) {
 	devices, err := runOsProber()
 	if err != nil {
@@ -118,16 +205,16 @@ func TestUtilParseOsReleaseOutput(t *testing.T) {
 func TestUtilPathDisk(t *testing.T) {
 	rootDisk, err := getPathDisk("/")
 	if err != nil {
-		t.Skip("can not find grub-probe")
+		t.Skip("can not find disk of /")
 	}
 	_, err = getLabelUuidMap(rootDisk)
 	require.NoError(t, err)
 }
 
 func TestUtilMount(t *testing.T) {
-	_, err := ioutil.ReadFile("/proc/self/mounts")
+	_, err := ioutil.ReadFile("/proc/self/mountinfo")
 	if err != nil {
-		t.Skip("can not read /proc/self/mounts")
+		t.Skip("can not read /proc/self/mountinfo")
 	}
 	_, err = isMounted("/")
 	require.NoError(t, err)